@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"app/db"
+	"app/models"
+	"app/services"
+	"app/storage"
+)
+
+// cliCommands are the administrative subcommands, run as `app <command> [flags]`
+var cliCommands = map[string]struct {
+	description string
+	run         func(args []string) error
+}{
+	"import":                  {"Import a Slack or Discord export archive", cliImport},
+	"grant-admin":             {"Make a user a site administrator: grant-admin <email>", func(args []string) error { return cliSetAdmin(args, true) }},
+	"migrate-legacy-messages": {"Copy rows left in the legacy messages/attachments tables into the new tables", cliMigrateLegacyMessages},
+	"migrate-storage":         {"Move attachment files and thumbnails between storage backends: migrate-storage -from local -to s3", cliMigrateStorage},
+	"revoke-admin":            {"Remove site administrator rights: revoke-admin <email>", func(args []string) error { return cliSetAdmin(args, false) }},
+	"rotate-signing-key":      {"Create a new access token signing key and retire the current one", cliRotateSigningKey},
+}
+
+// runCLI runs an administrative subcommand and returns the process exit code
+func runCLI(args []string) int {
+	command, ok := cliCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\nCommands:\n", args[0])
+		names := make([]string, 0, len(cliCommands))
+		for name := range cliCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %-24s %s\n", name, cliCommands[name].description)
+		}
+		return 2
+	}
+
+	if err := command.run(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func cliImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "", "export format: slack or discord")
+	file := flags.String("file", "", "path to the export zip (or a Discord .json file)")
+	serverID := flags.String("server-id", "", "import into this existing server")
+	serverName := flags.String("server-name", "", "name of a new server to create (defaults to the source workspace name)")
+	ownerEmail := flags.String("owner-email", "", "email of the owner of a new server")
+	dryRun := flags.Bool("dry-run", false, "report what would be imported without changing anything")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("-file is required")
+	}
+
+	database, err := db.NewDB()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	opts := models.ImportOptions{
+		Format:     *format,
+		ServerId:   *serverID,
+		ServerName: *serverName,
+		DryRun:     *dryRun,
+	}
+	if *serverID == "" {
+		if *ownerEmail == "" {
+			return fmt.Errorf("-owner-email is required when creating a new server")
+		}
+		opts.OwnerId, err = services.NewUserService(database, nil).GetUserIDByEmail(*ownerEmail)
+		if err != nil {
+			return err
+		}
+	}
+
+	files, err := storage.FromEnv()
+	if err != nil {
+		return err
+	}
+	report, err := services.NewImportService(database, files).ImportFile(*file, opts)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+func cliSetAdmin(args []string, isAdmin bool) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected exactly one email address")
+	}
+
+	database, err := db.NewDB()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	userService := services.NewUserService(database, nil)
+	userID, err := userService.GetUserIDByEmail(args[0])
+	if err != nil {
+		return err
+	}
+	if err := userService.SetAdmin(userID, isAdmin); err != nil {
+		return err
+	}
+	fmt.Printf("updated %s\n", args[0])
+	return nil
+}
+
+func cliMigrateLegacyMessages(args []string) error {
+	flags := flag.NewFlagSet("migrate-legacy-messages", flag.ContinueOnError)
+	batchSize := flags.Int("batch-size", 1000, "rows copied per transaction")
+	dropLegacy := flags.Bool("drop-legacy", false, "drop the legacy tables once every row has been copied")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *batchSize <= 0 {
+		return fmt.Errorf("-batch-size must be positive")
+	}
+
+	database, err := db.NewDB()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	report, err := services.NewLegacyMigrationService(database).Run(*batchSize, *dropLegacy)
+	if report != nil {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if encodeErr := encoder.Encode(report); encodeErr != nil {
+			return encodeErr
+		}
+	}
+	return err
+}
+
+func cliMigrateStorage(args []string) error {
+	flags := flag.NewFlagSet("migrate-storage", flag.ContinueOnError)
+	from := flags.String("from", "local", "backend to move files out of: local or s3")
+	to := flags.String("to", "s3", "backend to move files into: local or s3")
+	batchSize := flags.Int("batch-size", 100, "attachment rows read per query")
+	deleteSource := flags.Bool("delete-source", false, "delete each original once its row points at the copy")
+	dryRun := flags.Bool("dry-run", false, "report what would be moved without copying anything")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *batchSize <= 0 {
+		return fmt.Errorf("-batch-size must be positive")
+	}
+
+	files, err := storage.FromEnv()
+	if err != nil {
+		return err
+	}
+	database, err := db.NewDB()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	report, err := services.NewStorageMigrationService(database, files).Run(*from, *to, *batchSize, *deleteSource, *dryRun)
+	if report != nil {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if encodeErr := encoder.Encode(report); encodeErr != nil {
+			return encodeErr
+		}
+	}
+	return err
+}
+
+func cliRotateSigningKey(args []string) error {
+	flags := flag.NewFlagSet("rotate-signing-key", flag.ContinueOnError)
+	algorithm := flags.String("algorithm", "", "EdDSA or RS256 (defaults to JWT_SIGNING_ALGORITHM)")
+	publishAhead := flags.Duration("publish-ahead", 0, "publish the new key in the JWKS this long before it starts signing")
+	grace := flags.Duration("grace", services.DefaultKeyRotationGrace, "how long the old key keeps verifying tokens after the new key starts signing; at least ACCESS_TOKEN_TTL")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *publishAhead < 0 || *grace < 0 {
+		return fmt.Errorf("-publish-ahead and -grace must not be negative")
+	}
+
+	database, err := db.NewDB()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	keys, err := services.KeyManagerFromEnv(database)
+	if err != nil {
+		return err
+	}
+	if err := keys.Load(); err != nil {
+		return err
+	}
+	key, err := keys.Rotate(*algorithm, *publishAhead, *grace)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("created %s key %s, signing from %s\n", key.Algorithm, key.Kid, key.ActivatedAt.Format(time.RFC3339))
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(keys.ListKeys())
+}
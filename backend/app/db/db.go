@@ -4,10 +4,14 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"strconv"
 
 	_ "github.com/lib/pq"
 )
 
+// defaultMaxOpenConns is the connection pool size per replica
+const defaultMaxOpenConns = 25
+
 func NewDB() (*sql.DB, error) {
 	dbHost := os.Getenv("DB_HOST")
 	dbUser := os.Getenv("DB_USER")
@@ -23,6 +27,18 @@ func NewDB() (*sql.DB, error) {
 		return nil, err
 	}
 
+	// 接続数の上限（DB_MAX_OPEN_CONNS）。リクエストが殺到してもPostgresの接続を使い切らないようにする
+	maxOpenConns := defaultMaxOpenConns
+	if value := os.Getenv("DB_MAX_OPEN_CONNS"); value != "" {
+		maxOpenConns, err = strconv.Atoi(value)
+		if err != nil || maxOpenConns <= 0 {
+			db.Close()
+			return nil, fmt.Errorf("DB_MAX_OPEN_CONNS must be a positive integer")
+		}
+	}
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxOpenConns)
+
 	if err = db.Ping(); err != nil {
 		return nil, err
 	}
@@ -0,0 +1,22 @@
+-- +migrate Up
+-- Keep every edit of a channel message as a revision row
+
+CREATE TABLE channel_message_revisions (
+    id UUID PRIMARY KEY,
+    message_id UUID NOT NULL,
+    content TEXT NOT NULL,
+    edited_by UUID NOT NULL,
+    edited_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (message_id) REFERENCES channel_messages(id) ON DELETE CASCADE,
+    FOREIGN KEY (edited_by) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_channel_message_revisions_message_id ON channel_message_revisions(message_id);
+CREATE INDEX idx_channel_message_revisions_edited_at ON channel_message_revisions(edited_at);
+
+-- Retention policy for revisions per server (NULL keeps revisions forever)
+ALTER TABLE servers ADD COLUMN IF NOT EXISTS revision_retention_days INTEGER;
+
+-- +migrate Down
+ALTER TABLE servers DROP COLUMN IF EXISTS revision_retention_days;
+DROP TABLE IF EXISTS channel_message_revisions;
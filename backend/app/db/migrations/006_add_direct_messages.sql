@@ -0,0 +1,41 @@
+-- +migrate Up
+-- Direct messages are channels that do not belong to a server.
+-- Participants are tracked in channel_members, so channel_messages,
+-- channel_attachments and the WebSocket hub work for them unchanged.
+
+ALTER TABLE channels ALTER COLUMN server_id DROP NOT NULL;
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS kind VARCHAR(20) NOT NULL DEFAULT 'server';
+-- Sorted participant IDs for one-to-one conversations so each pair has a single DM
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS dm_key VARCHAR(80) UNIQUE;
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS created_by UUID REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS last_message_at TIMESTAMP;
+
+ALTER TABLE channels ADD CONSTRAINT chk_channels_kind CHECK (
+    (kind = 'server' AND server_id IS NOT NULL) OR
+    (kind IN ('dm', 'group_dm') AND server_id IS NULL)
+);
+
+-- Participants can hide a conversation from their list and reopen it later
+ALTER TABLE channel_members ADD COLUMN IF NOT EXISTS is_closed BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE channels c
+SET last_message_at = (
+    SELECT MAX(timestamp)
+    FROM channel_messages cm
+    WHERE cm.channel_id = c.id
+);
+
+CREATE INDEX idx_channels_kind ON channels(kind);
+CREATE INDEX idx_channel_members_user_id ON channel_members(user_id);
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_channel_members_user_id;
+DROP INDEX IF EXISTS idx_channels_kind;
+ALTER TABLE channel_members DROP COLUMN IF EXISTS is_closed;
+DELETE FROM channels WHERE kind <> 'server';
+ALTER TABLE channels DROP CONSTRAINT IF EXISTS chk_channels_kind;
+ALTER TABLE channels DROP COLUMN IF EXISTS last_message_at;
+ALTER TABLE channels DROP COLUMN IF EXISTS created_by;
+ALTER TABLE channels DROP COLUMN IF EXISTS dm_key;
+ALTER TABLE channels DROP COLUMN IF EXISTS kind;
+ALTER TABLE channels ALTER COLUMN server_id SET NOT NULL;
@@ -0,0 +1,29 @@
+-- +migrate Up
+-- Channel topics that members can change
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS topic VARCHAR(250) NOT NULL DEFAULT '';
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS topic_updated_by UUID REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS topic_updated_at TIMESTAMP;
+
+-- Distinguish user messages from system messages such as pin notices
+ALTER TABLE channel_messages ADD COLUMN IF NOT EXISTS message_type VARCHAR(20) NOT NULL DEFAULT 'user';
+
+-- Pinned messages per channel
+CREATE TABLE channel_pins (
+    channel_id UUID NOT NULL,
+    message_id UUID NOT NULL,
+    pinned_by UUID NOT NULL,
+    pinned_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (channel_id, message_id),
+    FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+    FOREIGN KEY (message_id) REFERENCES channel_messages(id) ON DELETE CASCADE,
+    FOREIGN KEY (pinned_by) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_channel_pins_message_id ON channel_pins(message_id);
+
+-- +migrate Down
+DROP TABLE IF EXISTS channel_pins;
+ALTER TABLE channel_messages DROP COLUMN IF EXISTS message_type;
+ALTER TABLE channels DROP COLUMN IF EXISTS topic_updated_at;
+ALTER TABLE channels DROP COLUMN IF EXISTS topic_updated_by;
+ALTER TABLE channels DROP COLUMN IF EXISTS topic;
@@ -0,0 +1,22 @@
+-- +migrate Up
+-- Slash commands registered by bots for a server
+CREATE TABLE bot_commands (
+    id UUID PRIMARY KEY,
+    server_id UUID NOT NULL,
+    bot_user_id UUID NOT NULL,
+    name VARCHAR(32) NOT NULL,
+    description VARCHAR(100) NOT NULL DEFAULT '',
+    arguments JSONB NOT NULL DEFAULT '[]',
+    callback_url TEXT NOT NULL,
+    signing_secret VARCHAR(64) NOT NULL,
+    created_by UUID NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (server_id) REFERENCES servers(id) ON DELETE CASCADE,
+    FOREIGN KEY (bot_user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE CASCADE,
+    UNIQUE (server_id, name)
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS bot_commands;
@@ -0,0 +1,46 @@
+-- +migrate Up
+-- Polls are attached to a channel message of type 'poll'
+CREATE TABLE polls (
+    id UUID PRIMARY KEY,
+    message_id UUID NOT NULL UNIQUE,
+    channel_id UUID NOT NULL,
+    question VARCHAR(300) NOT NULL,
+    allow_multiple BOOLEAN NOT NULL DEFAULT FALSE,
+    is_anonymous BOOLEAN NOT NULL DEFAULT FALSE,
+    closes_at TIMESTAMP,
+    closed_at TIMESTAMP,
+    created_by UUID NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (message_id) REFERENCES channel_messages(id) ON DELETE CASCADE,
+    FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE poll_options (
+    id UUID PRIMARY KEY,
+    poll_id UUID NOT NULL,
+    text VARCHAR(100) NOT NULL,
+    position INT NOT NULL,
+    FOREIGN KEY (poll_id) REFERENCES polls(id) ON DELETE CASCADE
+);
+
+CREATE TABLE poll_votes (
+    poll_id UUID NOT NULL,
+    option_id UUID NOT NULL,
+    user_id UUID NOT NULL,
+    voted_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (option_id, user_id),
+    FOREIGN KEY (poll_id) REFERENCES polls(id) ON DELETE CASCADE,
+    FOREIGN KEY (option_id) REFERENCES poll_options(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_poll_options_poll_id ON poll_options(poll_id);
+CREATE INDEX idx_poll_votes_poll_user ON poll_votes(poll_id, user_id);
+-- Open polls with a deadline, scanned by the auto-close loop
+CREATE INDEX idx_polls_open_deadline ON polls(closes_at) WHERE closed_at IS NULL;
+
+-- +migrate Down
+DROP TABLE IF EXISTS poll_votes;
+DROP TABLE IF EXISTS poll_options;
+DROP TABLE IF EXISTS polls;
@@ -0,0 +1,32 @@
+-- +migrate Up
+-- Messages and reminders delivered later by the background scheduler.
+-- message_id is generated up front so a job delivered twice (for example after a
+-- replica crashes mid-delivery) collides on channel_messages' primary key instead
+-- of posting a duplicate.
+CREATE TABLE scheduled_messages (
+    id UUID PRIMARY KEY,
+    channel_id UUID NOT NULL,
+    user_id UUID NOT NULL,
+    kind VARCHAR(20) NOT NULL DEFAULT 'message',
+    content TEXT NOT NULL,
+    send_at TIMESTAMP NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    message_id UUID NOT NULL UNIQUE,
+    locked_until TIMESTAMP,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    sent_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    CONSTRAINT chk_scheduled_messages_kind CHECK (kind IN ('message', 'reminder')),
+    CONSTRAINT chk_scheduled_messages_status CHECK (status IN ('pending', 'sending', 'sent', 'cancelled', 'failed')),
+    FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_scheduled_messages_user ON scheduled_messages(user_id, send_at);
+-- Jobs the scheduler still has to look at
+CREATE INDEX idx_scheduled_messages_due ON scheduled_messages(send_at) WHERE status IN ('pending', 'sending');
+
+-- +migrate Down
+DROP TABLE IF EXISTS scheduled_messages;
@@ -0,0 +1,30 @@
+-- +migrate Up
+-- Background exports of channel or server history into a zip archive
+CREATE TABLE export_jobs (
+    id UUID PRIMARY KEY,
+    requested_by UUID NOT NULL,
+    scope VARCHAR(20) NOT NULL,
+    server_id UUID,
+    channel_id UUID,
+    status VARCHAR(20) NOT NULL DEFAULT 'queued',
+    total_channels INT NOT NULL DEFAULT 0,
+    processed_channels INT NOT NULL DEFAULT 0,
+    processed_messages INT NOT NULL DEFAULT 0,
+    file_path TEXT,
+    file_size BIGINT,
+    error TEXT,
+    created_at TIMESTAMP NOT NULL,
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP,
+    expires_at TIMESTAMP,
+    CONSTRAINT chk_export_jobs_scope CHECK (scope IN ('channel', 'server')),
+    CONSTRAINT chk_export_jobs_status CHECK (status IN ('queued', 'running', 'completed', 'failed', 'expired')),
+    FOREIGN KEY (requested_by) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (server_id) REFERENCES servers(id) ON DELETE CASCADE,
+    FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_export_jobs_requested_by ON export_jobs(requested_by, created_at DESC);
+
+-- +migrate Down
+DROP TABLE IF EXISTS export_jobs;
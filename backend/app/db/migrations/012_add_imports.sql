@@ -0,0 +1,41 @@
+-- +migrate Up
+-- Site administrators can run instance-wide operations such as imports
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+-- Placeholder users stand in for imported authors without an account; they cannot log in
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_placeholder BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Thread replies point at the message that started the thread
+ALTER TABLE channel_messages ADD COLUMN IF NOT EXISTS parent_message_id UUID NULL;
+ALTER TABLE channel_messages ADD CONSTRAINT fk_channel_messages_parent
+    FOREIGN KEY (parent_message_id) REFERENCES channel_messages(id) ON DELETE SET NULL;
+CREATE INDEX idx_channel_messages_parent ON channel_messages(parent_message_id) WHERE parent_message_id IS NOT NULL;
+
+CREATE TABLE message_reactions (
+    message_id UUID NOT NULL,
+    user_id UUID NOT NULL,
+    emoji VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (message_id, user_id, emoji),
+    FOREIGN KEY (message_id) REFERENCES channel_messages(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Maps IDs from the source system to local rows so re-running an import skips
+-- what was already imported instead of duplicating it
+CREATE TABLE import_mappings (
+    source VARCHAR(20) NOT NULL,
+    kind VARCHAR(20) NOT NULL,
+    external_id VARCHAR(255) NOT NULL,
+    local_id UUID NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (source, kind, external_id)
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS import_mappings;
+DROP TABLE IF EXISTS message_reactions;
+DROP INDEX IF EXISTS idx_channel_messages_parent;
+ALTER TABLE channel_messages DROP CONSTRAINT IF EXISTS fk_channel_messages_parent;
+ALTER TABLE channel_messages DROP COLUMN IF EXISTS parent_message_id;
+ALTER TABLE users DROP COLUMN IF EXISTS is_placeholder;
+ALTER TABLE users DROP COLUMN IF EXISTS is_admin;
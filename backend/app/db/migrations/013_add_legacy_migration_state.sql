@@ -0,0 +1,17 @@
+-- +migrate Up
+-- Checkpoints for the one-shot copy of the legacy messages/attachments tables
+-- into channel_messages, chatbot_messages and channel_attachments.
+-- The copy is idempotent; the checkpoint only lets an interrupted run resume
+-- where it stopped instead of rescanning the whole table.
+CREATE TABLE legacy_migration_state (
+    name VARCHAR(50) PRIMARY KEY,
+    last_id UUID,
+    copied INT NOT NULL DEFAULT 0,
+    skipped INT NOT NULL DEFAULT 0,
+    started_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    completed_at TIMESTAMP
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS legacy_migration_state;
@@ -0,0 +1,29 @@
+-- +migrate Up
+-- Who uploaded each attachment and its detected MIME type, for quotas and serving
+ALTER TABLE channel_attachments ADD COLUMN IF NOT EXISTS uploaded_by UUID REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE channel_attachments ADD COLUMN IF NOT EXISTS content_type VARCHAR(255);
+
+UPDATE channel_attachments ca
+SET uploaded_by = cm.user_id
+FROM channel_messages cm
+WHERE ca.message_id = cm.id AND ca.uploaded_by IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_channel_attachments_uploaded_by ON channel_attachments(uploaded_by);
+
+-- Per-server upload settings. NULL limits fall back to the site defaults.
+-- Type lists hold MIME patterns such as "image/*" or "application/pdf".
+CREATE TABLE server_upload_policies (
+    server_id UUID PRIMARY KEY REFERENCES servers(id) ON DELETE CASCADE,
+    max_file_size BIGINT,
+    storage_quota BIGINT,
+    allowed_types TEXT[] NOT NULL DEFAULT '{}',
+    denied_types TEXT[] NOT NULL DEFAULT '{}',
+    updated_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS server_upload_policies;
+DROP INDEX IF EXISTS idx_channel_attachments_uploaded_by;
+ALTER TABLE channel_attachments DROP COLUMN IF EXISTS content_type;
+ALTER TABLE channel_attachments DROP COLUMN IF EXISTS uploaded_by;
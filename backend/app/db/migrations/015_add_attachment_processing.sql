@@ -0,0 +1,45 @@
+-- +migrate Up
+-- Image metadata filled in by background processing. processing_status is
+-- NULL for files that are not processed (non-images) and otherwise one of
+-- pending, processing, done or failed.
+ALTER TABLE channel_attachments ADD COLUMN IF NOT EXISTS width INT;
+ALTER TABLE channel_attachments ADD COLUMN IF NOT EXISTS height INT;
+ALTER TABLE channel_attachments ADD COLUMN IF NOT EXISTS blurhash VARCHAR(100);
+ALTER TABLE channel_attachments ADD COLUMN IF NOT EXISTS processing_status VARCHAR(20);
+ALTER TABLE channel_attachments ADD COLUMN IF NOT EXISTS processing_attempts INT NOT NULL DEFAULT 0;
+ALTER TABLE channel_attachments ADD COLUMN IF NOT EXISTS processing_locked_until TIMESTAMP;
+ALTER TABLE channel_attachments ADD COLUMN IF NOT EXISTS processing_error TEXT;
+ALTER TABLE channel_attachments ADD COLUMN IF NOT EXISTS processed_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_channel_attachments_processing
+    ON channel_attachments(uploaded_at) WHERE processing_status IN ('pending', 'processing');
+
+-- Process images uploaded before this migration as well
+UPDATE channel_attachments
+SET processing_status = 'pending'
+WHERE processing_status IS NULL AND lower(file_name) ~ '\.(jpe?g|png|gif)$';
+
+-- Downscaled copies of image attachments; size is the longest edge in pixels
+CREATE TABLE attachment_thumbnails (
+    attachment_id UUID NOT NULL REFERENCES channel_attachments(id) ON DELETE CASCADE,
+    size INT NOT NULL,
+    width INT NOT NULL,
+    height INT NOT NULL,
+    content_type VARCHAR(50) NOT NULL,
+    file_path TEXT NOT NULL,
+    file_size BIGINT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (attachment_id, size)
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS attachment_thumbnails;
+DROP INDEX IF EXISTS idx_channel_attachments_processing;
+ALTER TABLE channel_attachments DROP COLUMN IF EXISTS processed_at;
+ALTER TABLE channel_attachments DROP COLUMN IF EXISTS processing_error;
+ALTER TABLE channel_attachments DROP COLUMN IF EXISTS processing_locked_until;
+ALTER TABLE channel_attachments DROP COLUMN IF EXISTS processing_attempts;
+ALTER TABLE channel_attachments DROP COLUMN IF EXISTS processing_status;
+ALTER TABLE channel_attachments DROP COLUMN IF EXISTS blurhash;
+ALTER TABLE channel_attachments DROP COLUMN IF EXISTS height;
+ALTER TABLE channel_attachments DROP COLUMN IF EXISTS width;
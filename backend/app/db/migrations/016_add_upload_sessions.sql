@@ -0,0 +1,33 @@
+-- +migrate Up
+-- Resumable uploads. Each PATCH stores its bytes as a separate chunk object
+-- so any replica can accept the next chunk; completing the session joins
+-- them into a channel_attachments row. Sessions outlive their user or
+-- message (SET NULL) so the garbage collector can still find their chunks.
+CREATE TABLE upload_sessions (
+    id UUID PRIMARY KEY,
+    user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    message_id UUID REFERENCES channel_messages(id) ON DELETE SET NULL,
+    file_name VARCHAR(255) NOT NULL,
+    file_size BIGINT NOT NULL,
+    received_bytes BIGINT NOT NULL DEFAULT 0,
+    status VARCHAR(20) NOT NULL DEFAULT 'active', -- active, completing, completed
+    attachment_id UUID REFERENCES channel_attachments(id) ON DELETE SET NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_upload_sessions_user ON upload_sessions(user_id);
+CREATE INDEX idx_upload_sessions_expires_at ON upload_sessions(expires_at);
+
+CREATE TABLE upload_session_chunks (
+    session_id UUID NOT NULL REFERENCES upload_sessions(id) ON DELETE CASCADE,
+    chunk_offset BIGINT NOT NULL,
+    chunk_size BIGINT NOT NULL,
+    file_path TEXT NOT NULL,
+    PRIMARY KEY (session_id, chunk_offset)
+);
+
+-- +migrate Down
+DROP TABLE IF EXISTS upload_session_chunks;
+DROP TABLE IF EXISTS upload_sessions;
@@ -0,0 +1,48 @@
+-- +migrate Up
+-- Attachments are uploaded first and claimed by the message that is posted
+-- with them. Until then message_id is NULL and channel_id records where the
+-- file may be posted; claimed_at is set once a message has claimed it.
+ALTER TABLE channel_attachments ADD COLUMN IF NOT EXISTS channel_id UUID REFERENCES channels(id) ON DELETE SET NULL;
+ALTER TABLE channel_attachments ADD COLUMN IF NOT EXISTS claimed_at TIMESTAMP;
+
+UPDATE channel_attachments ca
+SET channel_id = cm.channel_id, claimed_at = ca.uploaded_at
+FROM channel_messages cm
+WHERE ca.message_id = cm.id;
+
+-- A deleted message leaves its attachments behind (message_id NULL,
+-- claimed_at set) for the garbage collector, which also removes the files
+ALTER TABLE channel_attachments ALTER COLUMN message_id DROP NOT NULL;
+ALTER TABLE channel_attachments DROP CONSTRAINT IF EXISTS channel_attachments_message_id_fkey;
+ALTER TABLE channel_attachments ADD CONSTRAINT channel_attachments_message_id_fkey
+    FOREIGN KEY (message_id) REFERENCES channel_messages(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_channel_attachments_channel_id ON channel_attachments(channel_id);
+CREATE INDEX IF NOT EXISTS idx_channel_attachments_unlinked
+    ON channel_attachments(uploaded_at) WHERE message_id IS NULL;
+
+-- Files whose rows are gone. Rows are added in the same transaction that
+-- deletes the attachment, so a file is never forgotten if deleting it fails.
+CREATE TABLE attachment_file_deletions (
+    file_path TEXT PRIMARY KEY,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMP NOT NULL
+);
+
+-- Resumable uploads can target a channel instead of an existing message
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS channel_id UUID REFERENCES channels(id) ON DELETE SET NULL;
+UPDATE upload_sessions us SET channel_id = cm.channel_id FROM channel_messages cm WHERE us.message_id = cm.id;
+
+-- +migrate Down
+ALTER TABLE upload_sessions DROP COLUMN IF EXISTS channel_id;
+DROP TABLE IF EXISTS attachment_file_deletions;
+DROP INDEX IF EXISTS idx_channel_attachments_unlinked;
+DROP INDEX IF EXISTS idx_channel_attachments_channel_id;
+DELETE FROM channel_attachments WHERE message_id IS NULL;
+ALTER TABLE channel_attachments DROP CONSTRAINT IF EXISTS channel_attachments_message_id_fkey;
+ALTER TABLE channel_attachments ADD CONSTRAINT channel_attachments_message_id_fkey
+    FOREIGN KEY (message_id) REFERENCES channel_messages(id) ON DELETE CASCADE;
+ALTER TABLE channel_attachments ALTER COLUMN message_id SET NOT NULL;
+ALTER TABLE channel_attachments DROP COLUMN IF EXISTS claimed_at;
+ALTER TABLE channel_attachments DROP COLUMN IF EXISTS channel_id;
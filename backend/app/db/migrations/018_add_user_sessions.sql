@@ -0,0 +1,34 @@
+-- +migrate Up
+-- Login sessions. Access tokens are short-lived JWTs carrying the session id
+-- (sid claim); a session stays alive by rotating its refresh token. Every
+-- refresh token ever issued is kept until it expires so that presenting one
+-- that was already rotated can be detected as reuse and revoke the session.
+CREATE TABLE user_sessions (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip_address VARCHAR(64) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    revoked_reason VARCHAR(50) -- logout, revoked, refresh_token_reuse
+);
+
+CREATE INDEX idx_user_sessions_user ON user_sessions(user_id);
+CREATE INDEX idx_user_sessions_expires_at ON user_sessions(expires_at);
+
+CREATE TABLE refresh_tokens (
+    token_hash VARCHAR(64) PRIMARY KEY, -- hex SHA-256 of the token
+    session_id UUID NOT NULL REFERENCES user_sessions(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP -- set when the token is rotated
+);
+
+CREATE INDEX idx_refresh_tokens_session ON refresh_tokens(session_id);
+CREATE INDEX idx_refresh_tokens_expires_at ON refresh_tokens(expires_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS user_sessions;
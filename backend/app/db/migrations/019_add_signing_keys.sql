@@ -0,0 +1,20 @@
+-- +migrate Up
+-- Keys that sign access tokens, identified by the kid JWT header. The key
+-- with the latest activated_at in the past signs new tokens; every key that
+-- hasn't expired verifies them and is published at /.well-known/jwks.json.
+-- Rotating sets the previous key's expires_at so tokens it signed stay valid
+-- for a grace period. Private keys are stored encrypted (AES-GCM).
+CREATE TABLE signing_keys (
+    kid VARCHAR(64) PRIMARY KEY,
+    algorithm VARCHAR(10) NOT NULL, -- EdDSA, RS256
+    private_key BYTEA NOT NULL,
+    public_key BYTEA NOT NULL, -- PKIX DER
+    created_at TIMESTAMP NOT NULL,
+    activated_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP
+);
+
+CREATE INDEX idx_signing_keys_activated_at ON signing_keys(activated_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS signing_keys;
@@ -0,0 +1,25 @@
+-- +migrate Up
+-- Users who registered before email verification existed are treated as
+-- verified, so they are not locked out.
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP;
+UPDATE users SET email_verified_at = COALESCE(created_at, NOW());
+
+-- Single-use tokens mailed to users: password reset links and email
+-- verification links. Only the SHA-256 of a token is stored. A verification
+-- token is for the address it was sent to, so it can't verify a changed email.
+CREATE TABLE account_tokens (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(30) NOT NULL, -- password_reset, email_verification
+    email VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX idx_account_tokens_user_purpose ON account_tokens(user_id, purpose);
+CREATE INDEX idx_account_tokens_expires_at ON account_tokens(expires_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS account_tokens;
+ALTER TABLE users DROP COLUMN IF EXISTS email_verified_at;
@@ -0,0 +1,45 @@
+-- +migrate Up
+-- TOTP secrets, encrypted with AES-GCM (the user id is authenticated). A row
+-- with confirmed_at NULL is an enrollment that hasn't been confirmed with a
+-- code yet. last_used_step is the time step of the last accepted code, so a
+-- code can't be replayed.
+CREATE TABLE user_totp (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret BYTEA NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    confirmed_at TIMESTAMP,
+    last_used_step BIGINT NOT NULL DEFAULT 0
+);
+
+-- Single-use recovery codes; only the SHA-256 of a code is stored
+CREATE TABLE user_recovery_codes (
+    code_hash VARCHAR(64) PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX idx_user_recovery_codes_user ON user_recovery_codes(user_id);
+
+-- Second step of a login: the password step returns a challenge token that
+-- is exchanged, together with a code, for a session
+CREATE TABLE login_challenges (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX idx_login_challenges_expires_at ON login_challenges(expires_at);
+
+-- Owners and admins of a server with this set only keep their privileges
+-- while they have two-factor authentication enabled
+ALTER TABLE servers ADD COLUMN require_two_factor BOOLEAN NOT NULL DEFAULT false;
+
+-- +migrate Down
+ALTER TABLE servers DROP COLUMN IF EXISTS require_two_factor;
+DROP TABLE IF EXISTS login_challenges;
+DROP TABLE IF EXISTS user_recovery_codes;
+DROP TABLE IF EXISTS user_totp;
@@ -0,0 +1,22 @@
+-- +migrate Up
+-- Long-lived tokens for scripts and integrations. Only the SHA-256 of a
+-- token is stored; token_hint keeps its first characters so users can tell
+-- their tokens apart.
+CREATE TABLE personal_access_tokens (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    token_hint VARCHAR(16) NOT NULL,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP,
+    last_used_ip VARCHAR(64),
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX idx_personal_access_tokens_user ON personal_access_tokens(user_id);
+
+-- +migrate Down
+DROP TABLE IF EXISTS personal_access_tokens;
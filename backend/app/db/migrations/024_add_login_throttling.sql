@@ -0,0 +1,21 @@
+-- +migrate Up
+-- Failed authentication attempts, per account (the email address used to
+-- log in), per client IP, and per IP for registrations. Keys are stored as
+-- the SHA-256 of the email address or IP. blocked_until is when the next
+-- attempt is allowed; locked marks it as a lockout rather than a backoff
+-- delay. Rows live in Postgres so every replica enforces the same limits.
+CREATE TABLE auth_throttles (
+    scope VARCHAR(16) NOT NULL,
+    key_hash VARCHAR(64) NOT NULL,
+    failures INTEGER NOT NULL DEFAULT 0,
+    lockouts INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL,
+    blocked_until TIMESTAMP,
+    locked BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (scope, key_hash)
+);
+
+CREATE INDEX idx_auth_throttles_last_failure ON auth_throttles(last_failure_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS auth_throttles;
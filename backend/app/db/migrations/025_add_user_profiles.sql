@@ -0,0 +1,28 @@
+-- +migrate Up
+-- Public profile fields. The avatar is an image stored as an attachment, so
+-- it goes through the same processing (metadata stripping, thumbnails); the
+-- attachment garbage collector keeps it while a user references it.
+ALTER TABLE users ADD COLUMN display_name VARCHAR(64);
+ALTER TABLE users ADD COLUMN bio TEXT;
+ALTER TABLE users ADD COLUMN pronouns VARCHAR(40);
+ALTER TABLE users ADD COLUMN timezone VARCHAR(64);
+ALTER TABLE users ADD COLUMN avatar_attachment_id UUID REFERENCES channel_attachments(id) ON DELETE SET NULL;
+-- Custom status; cleared once status_expires_at passes
+ALTER TABLE users ADD COLUMN status_text VARCHAR(128);
+ALTER TABLE users ADD COLUMN status_emoji VARCHAR(64);
+ALTER TABLE users ADD COLUMN status_expires_at TIMESTAMP;
+
+CREATE INDEX idx_users_avatar_attachment ON users(avatar_attachment_id) WHERE avatar_attachment_id IS NOT NULL;
+CREATE INDEX idx_users_status_expires_at ON users(status_expires_at) WHERE status_expires_at IS NOT NULL;
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_users_status_expires_at;
+DROP INDEX IF EXISTS idx_users_avatar_attachment;
+ALTER TABLE users DROP COLUMN IF EXISTS status_expires_at;
+ALTER TABLE users DROP COLUMN IF EXISTS status_emoji;
+ALTER TABLE users DROP COLUMN IF EXISTS status_text;
+ALTER TABLE users DROP COLUMN IF EXISTS avatar_attachment_id;
+ALTER TABLE users DROP COLUMN IF EXISTS timezone;
+ALTER TABLE users DROP COLUMN IF EXISTS pronouns;
+ALTER TABLE users DROP COLUMN IF EXISTS bio;
+ALTER TABLE users DROP COLUMN IF EXISTS display_name;
@@ -0,0 +1,16 @@
+-- +migrate Up
+-- Whether a user shows up in user search at all, and whether others can
+-- find them by their exact email address (and see it in results). Everyone
+-- is discoverable by handle by default; email lookup is opt-in.
+ALTER TABLE users ADD COLUMN discoverable BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE users ADD COLUMN email_discoverable BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Exact, case-insensitive handle and email lookups from search
+CREATE INDEX idx_users_username_lower ON users(LOWER(username));
+CREATE INDEX idx_users_email_lower ON users(LOWER(email)) WHERE email_discoverable;
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_users_email_lower;
+DROP INDEX IF EXISTS idx_users_username_lower;
+ALTER TABLE users DROP COLUMN IF EXISTS email_discoverable;
+ALTER TABLE users DROP COLUMN IF EXISTS discoverable;
@@ -0,0 +1,25 @@
+-- +migrate Up
+-- Account deletion is scheduled and carried out once the grace period
+-- passes, unless the user cancels it first.
+ALTER TABLE users ADD COLUMN deletion_scheduled_at TIMESTAMP;
+CREATE INDEX idx_users_deletion_scheduled_at ON users(deletion_scheduled_at) WHERE deletion_scheduled_at IS NOT NULL;
+
+-- Messages, revisions, pins and polls of deleted accounts are reassigned to
+-- this tombstone. It can't sign in: it has no password, its email is not an
+-- address, and its username is longer than registration allows.
+INSERT INTO users (id, username, email, password, display_name, discoverable, created_at, updated_at)
+VALUES ('00000000-0000-0000-0000-000000000000', '00000000-0000-0000-0000-000000000000', 'deleted-user', '',
+        'Deleted user', FALSE, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+ON CONFLICT (id) DO NOTHING;
+
+-- Personal data exports of a user's own account
+ALTER TABLE export_jobs DROP CONSTRAINT chk_export_jobs_scope;
+ALTER TABLE export_jobs ADD CONSTRAINT chk_export_jobs_scope CHECK (scope IN ('channel', 'server', 'account'));
+
+-- +migrate Down
+DELETE FROM export_jobs WHERE scope = 'account';
+ALTER TABLE export_jobs DROP CONSTRAINT chk_export_jobs_scope;
+ALTER TABLE export_jobs ADD CONSTRAINT chk_export_jobs_scope CHECK (scope IN ('channel', 'server'));
+DELETE FROM users WHERE id = '00000000-0000-0000-0000-000000000000';
+DROP INDEX IF EXISTS idx_users_deletion_scheduled_at;
+ALTER TABLE users DROP COLUMN IF EXISTS deletion_scheduled_at;
@@ -0,0 +1,14 @@
+-- +migrate Up
+-- A replica building an export owns it until locked_until and renews the
+-- lease while it works. locked_by identifies the claim so that a replica
+-- whose lease was taken over cannot record a result.
+ALTER TABLE export_jobs ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP;
+ALTER TABLE export_jobs ADD COLUMN IF NOT EXISTS locked_by UUID;
+
+CREATE INDEX IF NOT EXISTS idx_export_jobs_unfinished
+    ON export_jobs(created_at) WHERE status IN ('queued', 'running');
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_export_jobs_unfinished;
+ALTER TABLE export_jobs DROP COLUMN IF EXISTS locked_by;
+ALTER TABLE export_jobs DROP COLUMN IF EXISTS locked_until;
@@ -0,0 +1,31 @@
+-- +migrate Up
+-- Channel and message mappings belong to the server they were imported into,
+-- so importing the same export into another server creates new rows instead
+-- of pointing at the first server's. User mappings stay instance-wide and use
+-- the all-zero server_id.
+ALTER TABLE import_mappings ADD COLUMN server_id UUID NOT NULL DEFAULT '00000000-0000-0000-0000-000000000000';
+
+UPDATE import_mappings m SET server_id = c.server_id
+FROM channels c
+WHERE m.kind = 'channel' AND c.id = m.local_id;
+
+UPDATE import_mappings m SET server_id = c.server_id
+FROM channel_messages cm
+JOIN channels c ON c.id = cm.channel_id
+WHERE m.kind = 'message' AND cm.id = m.local_id;
+
+-- Mappings whose channel or message no longer exists can't be scoped
+DELETE FROM import_mappings
+WHERE kind <> 'user' AND server_id = '00000000-0000-0000-0000-000000000000';
+
+ALTER TABLE import_mappings DROP CONSTRAINT import_mappings_pkey;
+ALTER TABLE import_mappings ADD PRIMARY KEY (source, server_id, kind, external_id);
+
+-- +migrate Down
+ALTER TABLE import_mappings DROP CONSTRAINT import_mappings_pkey;
+DELETE FROM import_mappings a
+USING import_mappings b
+WHERE a.source = b.source AND a.kind = b.kind AND a.external_id = b.external_id
+  AND a.ctid > b.ctid;
+ALTER TABLE import_mappings ADD PRIMARY KEY (source, kind, external_id);
+ALTER TABLE import_mappings DROP COLUMN IF EXISTS server_id;
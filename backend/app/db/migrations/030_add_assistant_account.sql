@@ -0,0 +1,12 @@
+-- +migrate Up
+-- /ask answers are posted by this account rather than by the user who asked,
+-- so nobody owns them. Like the deleted-user tombstone it can't sign in: it
+-- has no password, its email is not an address, and its username is longer
+-- than registration allows.
+INSERT INTO users (id, username, email, password, display_name, discoverable, created_at, updated_at)
+VALUES ('00000000-0000-0000-0000-000000000001', '00000000-0000-0000-0000-000000000001', 'assistant', '',
+        'Assistant', FALSE, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+ON CONFLICT (id) DO NOTHING;
+
+-- +migrate Down
+DELETE FROM users WHERE id = '00000000-0000-0000-0000-000000000001';
@@ -0,0 +1,19 @@
+-- +migrate Up
+-- Every bot command posts as an account of its own instead of as a member
+-- picked when it was registered. Bot accounts can't sign in: they have no
+-- password, their email is not an address, and their username is longer
+-- than registration allows.
+INSERT INTO users (id, username, email, password, display_name, discoverable, created_at, updated_at)
+SELECT gen_random_uuid(), 'bot-' || id::text, 'bot-' || id::text, '', '/' || name, FALSE, created_at, created_at
+FROM bot_commands
+ON CONFLICT DO NOTHING;
+
+UPDATE bot_commands bc SET bot_user_id = u.id
+FROM users u
+WHERE u.username = 'bot-' || bc.id::text;
+
+-- +migrate Down
+UPDATE bot_commands SET bot_user_id = created_by;
+DELETE FROM users u
+WHERE u.username LIKE 'bot-%' AND u.email = u.username
+  AND NOT EXISTS (SELECT 1 FROM channel_messages m WHERE m.user_id = u.id);
@@ -0,0 +1,14 @@
+-- +migrate Up
+-- HEIC, HEIF, WebP, TIFF and AVIF photos stored before they were refused
+-- still carry their EXIF/GPS metadata, which the processor can't remove.
+-- Marking them failed stops their originals from being served.
+UPDATE channel_attachments
+SET processing_status = 'failed', processing_error = 'metadata can''t be removed from this image format', processed_at = CURRENT_TIMESTAMP
+WHERE processing_status IS NULL
+  AND content_type IN ('image/heic', 'image/heif', 'image/webp', 'image/tiff', 'image/avif');
+
+-- +migrate Down
+UPDATE channel_attachments
+SET processing_status = NULL, processing_error = NULL, processed_at = NULL
+WHERE processing_status = 'failed'
+  AND content_type IN ('image/heic', 'image/heif', 'image/webp', 'image/tiff', 'image/avif');
@@ -0,0 +1,10 @@
+-- +migrate Up
+-- Deleting a message now detaches its attachments so the garbage collector
+-- removes them. Attachments of messages deleted before that are detached here.
+UPDATE channel_attachments ca
+SET message_id = NULL
+FROM channel_messages cm
+WHERE ca.message_id = cm.id AND cm.is_deleted = true;
+
+-- +migrate Down
+-- Detached attachments can't be linked back to their messages
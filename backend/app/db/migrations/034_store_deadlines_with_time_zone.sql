@@ -0,0 +1,25 @@
+-- +migrate Up
+-- Deadlines that are compared with the current time keep their time zone, so
+-- a client's offset is never dropped and values read back compare correctly
+-- whatever zone the API runs in. Existing values were written as the API's
+-- local time, which is taken to be the database session's time zone.
+ALTER TABLE scheduled_messages
+    ALTER COLUMN send_at TYPE TIMESTAMP WITH TIME ZONE,
+    ALTER COLUMN locked_until TYPE TIMESTAMP WITH TIME ZONE,
+    ALTER COLUMN sent_at TYPE TIMESTAMP WITH TIME ZONE;
+ALTER TABLE polls
+    ALTER COLUMN closes_at TYPE TIMESTAMP WITH TIME ZONE,
+    ALTER COLUMN closed_at TYPE TIMESTAMP WITH TIME ZONE;
+ALTER TABLE users
+    ALTER COLUMN status_expires_at TYPE TIMESTAMP WITH TIME ZONE;
+
+-- +migrate Down
+ALTER TABLE users
+    ALTER COLUMN status_expires_at TYPE TIMESTAMP;
+ALTER TABLE polls
+    ALTER COLUMN closed_at TYPE TIMESTAMP,
+    ALTER COLUMN closes_at TYPE TIMESTAMP;
+ALTER TABLE scheduled_messages
+    ALTER COLUMN sent_at TYPE TIMESTAMP,
+    ALTER COLUMN locked_until TYPE TIMESTAMP,
+    ALTER COLUMN send_at TYPE TIMESTAMP;
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"app/models"
+	"app/services"
+)
+
+// AccountDeletionHandler lets users delete their own account
+type AccountDeletionHandler struct {
+	deletionService *services.AccountDeletionService
+}
+
+// NewAccountDeletionHandler creates a new account deletion handler
+func NewAccountDeletionHandler(deletionService *services.AccountDeletionService) *AccountDeletionHandler {
+	return &AccountDeletionHandler{deletionService: deletionService}
+}
+
+// GetDeletion はアカウントの削除予定日時と、削除の前に手放す必要があるサーバーを返す
+func (h *AccountDeletionHandler) GetDeletion(c *gin.Context) {
+	deletion, err := h.deletionService.GetDeletion(c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, deletion)
+}
+
+// ScheduleDeletion はパスワードを確認し、猶予期間の後にアカウントを削除するよう予約する。
+// パスワードのないユーザーは2段階認証のコードか、直前のサインインで本人確認する。
+// 所有しているサーバーがある場合は、先に所有者の変更か削除が必要
+func (h *AccountDeletionHandler) ScheduleDeletion(c *gin.Context) {
+	var req models.AccountDeletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deletion, err := h.deletionService.ScheduleDeletion(c.GetString("userID"), c.GetString("sessionID"), req)
+	if err != nil {
+		var owned *services.OwnedServersError
+		switch {
+		case errors.As(err, &owned):
+			c.JSON(http.StatusConflict, gin.H{
+				"error":   err.Error(),
+				"code":    "owns_servers",
+				"servers": owned.Servers,
+			})
+		case errors.Is(err, services.ErrIncorrectPassword),
+			errors.Is(err, services.ErrInvalidTwoFactorCode),
+			errors.Is(err, services.ErrTwoFactorNotEnabled):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrReauthenticationRequired):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "code": "reauthentication_required"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusAccepted, deletion)
+}
+
+// CancelDeletion は予約されたアカウントの削除を取り消す
+func (h *AccountDeletionHandler) CancelDeletion(c *gin.Context) {
+	if err := h.deletionService.CancelDeletion(c.GetString("userID")); err != nil {
+		if errors.Is(err, services.ErrAccountDeletionNotScheduled) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Account deletion cancelled"})
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"app/models"
+	"app/services"
+	"app/storage"
+)
+
+// AttachmentHandler serves attachment downloads. Every download is checked
+// against the channel the attachment was posted in.
+type AttachmentHandler struct {
+	channelMessageService *services.ChannelMessageService
+	serverService         *services.ServerService
+	userService           *services.UserService
+	signer                *services.AttachmentURLSigner
+}
+
+// NewAttachmentHandler creates a new attachment handler
+func NewAttachmentHandler(channelMessageService *services.ChannelMessageService, serverService *services.ServerService, userService *services.UserService, signer *services.AttachmentURLSigner) *AttachmentHandler {
+	return &AttachmentHandler{
+		channelMessageService: channelMessageService,
+		serverService:         serverService,
+		userService:           userService,
+		signer:                signer,
+	}
+}
+
+// DownloadAttachment は添付ファイルを返す。
+// 署名付きURL（expires, signature）か Authorization ヘッダーのどちらかが必要。
+// size を指定すると画像のサムネイルを返す
+func (h *AttachmentHandler) DownloadAttachment(c *gin.Context) {
+	attachmentID := c.Param("id")
+
+	if signature := c.Query("signature"); signature != "" {
+		if err := h.signer.Verify(attachmentID, c.Query("expires"), signature); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		h.serveAttachment(c, attachmentID)
+		return
+	}
+
+	authHeader := c.GetHeader("Authorization")
+	if authHeader == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header or signed URL is required"})
+		return
+	}
+	userID, err := h.userService.ValidateToken(strings.TrimPrefix(authHeader, "Bearer "))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+	if !checkAttachmentAccess(c, h.channelMessageService, h.serverService, attachmentID, userID) {
+		return
+	}
+	h.serveAttachment(c, attachmentID)
+}
+
+// GetAttachmentURL は添付ファイルの署名付きURLを発行する
+func (h *AttachmentHandler) GetAttachmentURL(c *gin.Context) {
+	attachmentID := c.Param("id")
+	if !checkAttachmentAccess(c, h.channelMessageService, h.serverService, attachmentID, c.GetString("userID")) {
+		return
+	}
+
+	attachment, err := h.channelMessageService.GetChannelAttachment(attachmentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	signedURL, expiresAt := h.signer.SignedURL(attachment.ID, attachment.FileName)
+	c.JSON(http.StatusOK, gin.H{
+		"url":       signedURL,
+		"expiresAt": expiresAt,
+	})
+}
+
+func (h *AttachmentHandler) serveAttachment(c *gin.Context, attachmentID string) {
+	attachment, err := h.channelMessageService.GetChannelAttachment(attachmentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if sizeParam := c.Query("size"); sizeParam != "" {
+		size, err := strconv.Atoi(sizeParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid thumbnail size"})
+			return
+		}
+		attachment, err = h.channelMessageService.GetAttachmentThumbnail(attachment, size)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Thumbnail not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	serveAttachmentFile(c, h.channelMessageService.Files(), attachment)
+}
+
+// attachmentRedirectTTL is how long storage presigned URLs handed out by a redirect stay valid
+const attachmentRedirectTTL = 5 * time.Minute
+
+// serveAttachmentFile sends an attachment that the caller has already been
+// authorized to read. Backends that support presigned URLs are redirected
+// to; other files are streamed from storage.
+func serveAttachmentFile(c *gin.Context, files *storage.Manager, attachment models.ChannelAttachment) {
+	// 画像の原本はEXIFや位置情報が削除されるまで返さない。処理に失敗した画像は
+	// サムネイルもないため、原本は取得できないままになる
+	switch attachment.ProcessingStatus {
+	case models.AttachmentProcessingPending, models.AttachmentProcessingProcessing:
+		c.Header("Retry-After", "5")
+		c.JSON(http.StatusConflict, gin.H{"error": "The image is still being processed", "code": "attachment_processing"})
+		return
+	case models.AttachmentProcessingFailed:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "The image could not be processed, so the original is not available", "code": "attachment_unprocessable"})
+		return
+	}
+
+	disposition := "attachment"
+	if attachment.FileType == "image" || attachment.FileType == "video" {
+		// 画像と動画は<img>/<video>タグで表示できるようインラインで返す
+		disposition = "inline"
+	}
+	contentDisposition := mime.FormatMediaType(disposition, map[string]string{"filename": attachment.FileName})
+	c.Header("Cache-Control", "private, max-age=300")
+
+	ctx := c.Request.Context()
+	presignedURL, err := files.Presign(ctx, attachment.FilePath, attachmentRedirectTTL, storage.PresignOptions{ContentDisposition: contentDisposition})
+	if err == nil {
+		c.Redirect(http.StatusFound, presignedURL)
+		return
+	}
+	if !errors.Is(err, storage.ErrPresignUnsupported) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	reader, err := files.Open(ctx, attachment.FilePath)
+	if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrUnknownLocator) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment file not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer reader.Close()
+
+	c.Header("Content-Disposition", contentDisposition)
+	c.Header("X-Content-Type-Options", "nosniff")
+	// Opened directly, uploaded HTML or SVG must not run scripts on the API origin
+	c.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	contentType := attachment.ContentType
+	if contentType == "" {
+		// Attachments uploaded before content types were recorded
+		contentType = mime.TypeByExtension(filepath.Ext(attachment.FileName))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		// Range requests are supported for seekable (local) files
+		c.Header("Content-Type", contentType)
+		http.ServeContent(c.Writer, c.Request, attachment.FileName, attachment.UploadedAt, seeker)
+		return
+	}
+	c.DataFromReader(http.StatusOK, attachment.FileSize, contentType, reader, nil)
+}
+
+// checkAttachmentAccess resolves attachment → message → channel and checks
+// that the user can access the channel. Unposted uploads are only visible to
+// their uploader. It writes the error response and
+// returns false when access is denied.
+func checkAttachmentAccess(c *gin.Context, channelMessageService *services.ChannelMessageService, serverService *services.ServerService, attachmentID, userID string) bool {
+	if attachmentID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Attachment ID is required"})
+		return false
+	}
+
+	channelID, uploaderID, err := channelMessageService.GetAttachmentOwner(attachmentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if channelID == "" {
+		// メッセージに添付される前のファイルはアップロードした本人だけが見られる
+		if uploaderID != userID {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+			return false
+		}
+		return true
+	}
+
+	hasAccess, err := serverService.HasChannelAccess(channelID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if !hasAccess {
+		// 存在を漏らさないよう、アクセスできない添付ファイルは見つからない扱いにする
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return false
+	}
+	return true
+}
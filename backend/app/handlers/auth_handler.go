@@ -3,17 +3,51 @@ package handlers
 import (
 	"app/models"
 	"app/services"
+	"errors"
+	"log"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
 
 type AuthHandler struct {
-	userService *services.UserService
+	userService    *services.UserService
+	sessionService *services.SessionService
+	accountService *services.AccountService
 }
 
-func NewAuthHandler(userService *services.UserService) *AuthHandler {
-	return &AuthHandler{userService: userService}
+func NewAuthHandler(userService *services.UserService, sessionService *services.SessionService, accountService *services.AccountService) *AuthHandler {
+	return &AuthHandler{
+		userService:    userService,
+		sessionService: sessionService,
+		accountService: accountService,
+	}
+}
+
+// sessionClient describes the device making the request
+func sessionClient(c *gin.Context) models.SessionClient {
+	return models.SessionClient{
+		UserAgent: c.Request.UserAgent(),
+		IPAddress: c.ClientIP(),
+	}
+}
+
+// respondThrottled は試行回数の制限に達した場合に429を返す
+func respondThrottled(c *gin.Context, err error) bool {
+	var throttled *services.ThrottledError
+	if !errors.As(err, &throttled) {
+		return false
+	}
+	code := "too_many_attempts"
+	if throttled.Locked {
+		code = "locked_out"
+	}
+	seconds := int(math.Ceil(throttled.RetryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error(), "code": code, "retryAfter": seconds})
+	return true
 }
 
 // Register handles user registration
@@ -24,12 +58,20 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
-	user, err := h.userService.Register(req)
+	user, err := h.userService.Register(req, sessionClient(c))
 	if err != nil {
+		if respondThrottled(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	// 確認メールの送信に失敗しても登録は完了しており、再送できる
+	if err := h.accountService.SendEmailVerification(user.ID); err != nil {
+		log.Printf("確認メールの送信エラー: %v", err)
+	}
+
 	c.JSON(http.StatusCreated, user)
 }
 
@@ -41,8 +83,15 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	user, err := h.userService.Login(req)
+	user, err := h.userService.Login(req, sessionClient(c))
 	if err != nil {
+		if respondThrottled(c, err) {
+			return
+		}
+		if errors.Is(err, services.ErrEmailNotVerified) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "code": "email_not_verified"})
+			return
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 		return
 	}
@@ -50,74 +99,210 @@ func (h *AuthHandler) Login(c *gin.Context) {
 	c.JSON(http.StatusOK, user)
 }
 
-// GetCurrentUser returns the current authenticated user
-func (h *AuthHandler) GetCurrentUser(c *gin.Context) {
-	userID, exists := c.Get("userID")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+// LoginTwoFactor はパスワード認証で返されたチャレンジトークンと、
+// 認証アプリのコードまたはリカバリーコードでログインを完了する
+func (h *AuthHandler) LoginTwoFactor(c *gin.Context) {
+	var req models.TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	code := req.Code
+	if code == "" {
+		code = req.RecoveryCode
+	}
+	if code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code or recoveryCode is required"})
+		return
+	}
+
+	user, err := h.userService.CompleteTwoFactorLogin(req.ChallengeToken, code, sessionClient(c))
+	if err != nil {
+		if respondThrottled(c, err) {
+			return
+		}
+		if errors.Is(err, services.ErrInvalidLoginChallenge) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error(), "code": "challenge_expired"})
+			return
+		}
+		if errors.Is(err, services.ErrInvalidTwoFactorCode) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// Refresh exchanges a refresh token for a new access token and refresh token
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var req models.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	user, err := h.userService.GetUserByID(userID.(string))
+	tokens, err := h.sessionService.Refresh(req.RefreshToken, sessionClient(c))
 	if err != nil {
+		if errors.Is(err, services.ErrInvalidRefreshToken) || errors.Is(err, services.ErrRefreshTokenReused) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"id":        user.ID,
-		"username":  user.Username,
-		"email":     user.Email,
-		"createdAt": user.CreatedAt,
-	})
+	c.JSON(http.StatusOK, tokens)
 }
 
-// GetUserById returns a user by ID
-func (h *AuthHandler) GetUserById(c *gin.Context) {
-	// URLからユーザーIDを取得
-	userID := c.Param("id")
-	if userID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "ユーザーIDが指定されていません"})
+// Logout は現在のセッションを失効させる
+func (h *AuthHandler) Logout(c *gin.Context) {
+	err := h.sessionService.RevokeSession(c.GetString("userID"), c.GetString("sessionID"), models.SessionRevokedLogout)
+	if err != nil && !errors.Is(err, services.ErrSessionNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// ユーザー情報を取得
-	user, err := h.userService.GetUserByID(userID)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// GetSessions はログイン中のセッション（端末とIPアドレス）の一覧を返す
+func (h *AuthHandler) GetSessions(c *gin.Context) {
+	sessions, err := h.sessionService.GetSessions(c.GetString("userID"), c.GetString("sessionID"))
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "ユーザーが見つかりません"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// ユーザー情報を返す
-	c.JSON(http.StatusOK, gin.H{
-		"id":        user.ID,
-		"username":  user.Username,
-		"createdAt": user.CreatedAt,
-	})
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
 }
 
-// SearchUsers handles user search requests
-func (h *AuthHandler) SearchUsers(c *gin.Context) {
-	// Get query parameter
-	query := c.Query("q")
-	if query == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "検索クエリが必要です"})
+// RevokeSession は指定したセッションを失効させ、そのWebSocket接続を切断する
+func (h *AuthHandler) RevokeSession(c *gin.Context) {
+	err := h.sessionService.RevokeSession(c.GetString("userID"), c.Param("id"), models.SessionRevokedByUser)
+	if err != nil {
+		if errors.Is(err, services.ErrSessionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Get current user ID from context
-	userID, exists := c.Get("userID")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "認証が必要です"})
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+// RevokeOtherSessions は現在のセッション以外をすべて失効させる。
+// includeCurrent=true の場合は現在のセッションも失効させる
+func (h *AuthHandler) RevokeOtherSessions(c *gin.Context) {
+	keep := c.GetString("sessionID")
+	if c.Query("includeCurrent") == "true" {
+		keep = ""
+	}
+
+	revoked, err := h.sessionService.RevokeAllSessions(c.GetString("userID"), keep, models.SessionRevokedByUser)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"revoked": revoked})
+}
+
+// ChangePassword は現在のパスワードを確認してからパスワードを変更し、
+// 他のセッションをすべて失効させる
+func (h *AuthHandler) ChangePassword(c *gin.Context) {
+	var req models.ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Search for users
-	users, err := h.userService.SearchUsers(query, userID.(string))
+	err := h.accountService.ChangePassword(c.GetString("userID"), c.GetString("sessionID"), req.CurrentPassword, req.NewPassword)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "ユーザー検索に失敗しました"})
+		if errors.Is(err, services.ErrIncorrectPassword) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed"})
+}
+
+// RequestPasswordReset はパスワード再設定用のリンクをメールで送る。
+// 登録されていないアドレスでも同じレスポンスを返す
+func (h *AuthHandler) RequestPasswordReset(c *gin.Context) {
+	var req models.EmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.accountService.RequestPasswordReset(req.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "If the address is registered, a reset link has been sent"})
+}
+
+// ResetPassword はメールのトークンで新しいパスワードを設定する
+func (h *AuthHandler) ResetPassword(c *gin.Context) {
+	var req models.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.accountService.ResetPassword(req.Token, req.NewPassword); err != nil {
+		if errors.Is(err, services.ErrInvalidAccountToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset"})
+}
+
+// VerifyEmail はメールのトークンでメールアドレスを確認済みにする
+func (h *AuthHandler) VerifyEmail(c *gin.Context) {
+	var req models.VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.accountService.VerifyEmail(req.Token); err != nil {
+		if errors.Is(err, services.ErrInvalidAccountToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email address verified"})
+}
+
+// ResendEmailVerification は確認メールを再送する。
+// 登録されていないアドレスでも同じレスポンスを返す
+func (h *AuthHandler) ResendEmailVerification(c *gin.Context) {
+	var req models.EmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.accountService.ResendEmailVerification(req.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, users)
+	c.JSON(http.StatusAccepted, gin.H{"message": "If the address needs verification, a new link has been sent"})
 }
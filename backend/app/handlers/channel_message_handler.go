@@ -3,8 +3,10 @@ package handlers
 import (
 	"app/models"
 	"app/services"
+	"errors"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -16,6 +18,7 @@ type ChannelMessageHandler struct {
 	channelMessageService *services.ChannelMessageService
 	serverService         *services.ServerService
 	wsService             *services.WebSocketService
+	commandService        *services.CommandService
 }
 
 // NewChannelMessageHandler creates a new channel message handler
@@ -31,6 +34,11 @@ func (h *ChannelMessageHandler) SetWebSocketService(wsService *services.WebSocke
 	h.wsService = wsService
 }
 
+// SetCommandService sets the service that handles slash commands in new messages
+func (h *ChannelMessageHandler) SetCommandService(commandService *services.CommandService) {
+	h.commandService = commandService
+}
+
 // GetChannelMessages retrieves all messages for a specific channel
 func (h *ChannelMessageHandler) GetChannelMessages(c *gin.Context) {
 	channelId := c.Param("id")
@@ -40,15 +48,22 @@ func (h *ChannelMessageHandler) GetChannelMessages(c *gin.Context) {
 	}
 
 	// Check if user is authenticated
-	_, exists := c.Get("userID")
+	userId, exists := c.Get("userID")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	// For now, we'll skip the channel membership check
-	// In a real implementation, you would check if the user is a member of the channel
-	// using a method like h.serverService.IsChannelMember(channelId, userId.(string))
+	// Check if user has access to the channel (direct conversations are limited to participants)
+	hasAccess, err := h.serverService.HasChannelAccess(channelId, userId.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !hasAccess {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this channel"})
+		return
+	}
 
 	// Get messages
 	messages, err := h.channelMessageService.GetChannelMessages(channelId)
@@ -82,9 +97,15 @@ func (h *ChannelMessageHandler) CreateChannelMessage(c *gin.Context) {
 		return
 	}
 
-	// For now, we'll skip the channel membership check
-	// In a real implementation, you would check if the user is a member of the channel
-	// using a method like h.serverService.IsChannelMember(channelID, userId.(string))
+	hasAccess, err := h.serverService.HasChannelAccess(channelID, userId.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !hasAccess {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this channel"})
+		return
+	}
 
 	// Parse request
 	var req models.ChannelMessageRequest
@@ -93,32 +114,46 @@ func (h *ChannelMessageHandler) CreateChannelMessage(c *gin.Context) {
 		return
 	}
 
+	// Messages starting with "/" are dispatched to the command registry instead of being saved
+	if h.commandService != nil && services.IsCommand(req.Content) {
+		h.executeCommand(c, channelID, userId.(string), req.Content)
+		return
+	}
+	// "//text" posts "/text" as plain text
+	if strings.HasPrefix(req.Content, "//") {
+		req.Content = req.Content[1:]
+	}
+
 	// Create message
 	message := models.ChannelMessage{
 		ID:        uuid.New().String(),
 		ChannelId: channelID,
 		UserId:    userId.(string),
+		Type:      models.MessageTypeUser,
 		Content:   req.Content,
 		Timestamp: time.Now(),
 		IsEdited:  false,
 		IsDeleted: false,
 	}
 
-	// Save message
-	if err := h.channelMessageService.SaveChannelMessage(message); err != nil {
+	// Save message, claiming the uploaded attachments it was posted with
+	err = h.channelMessageService.SaveChannelMessageWithAttachments(message, req.Attachments)
+	if errors.Is(err, services.ErrTooManyAttachments) || errors.Is(err, services.ErrAttachmentsUnavailable) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-
-	// Handle attachments if any
 	if len(req.Attachments) > 0 {
-		// In a real implementation, you would process each attachment
-		// For now, we'll just log that there are attachments
-		c.JSON(http.StatusCreated, gin.H{
-			"message": message,
-			"note":    "Attachments were provided but not processed in this implementation",
-		})
-		return
+		// 添付ファイルの情報を含めて返す
+		saved, err := h.channelMessageService.GetMessageByID(message.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		message = *saved
 	}
 
 	// レスポンスを返す
@@ -134,6 +169,34 @@ func (h *ChannelMessageHandler) CreateChannelMessage(c *gin.Context) {
 	}
 }
 
+// executeCommand runs a slash command and returns its public and ephemeral replies
+func (h *ChannelMessageHandler) executeCommand(c *gin.Context, channelID, userID, content string) {
+	result, err := h.commandService.Execute(channelID, userID, content)
+	if err != nil {
+		if errors.Is(err, services.ErrUnknownCommand) {
+			name, _, _, _ := services.ParseCommand(content)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown command: /" + name})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{}
+	status := http.StatusOK
+	if result != nil {
+		if result.Message != nil {
+			response["message"] = result.Message
+			status = http.StatusCreated
+		}
+		if result.Ephemeral != nil {
+			response["ephemeral"] = result.Ephemeral
+		}
+	}
+
+	c.JSON(status, response)
+}
+
 // EditChannelMessage edits a message
 func (h *ChannelMessageHandler) EditChannelMessage(c *gin.Context) {
 	messageID := c.Param("id")
@@ -168,7 +231,7 @@ func (h *ChannelMessageHandler) EditChannelMessage(c *gin.Context) {
 	}
 
 	// Edit message
-	if err := h.channelMessageService.EditChannelMessage(messageID, req.Content); err != nil {
+	if err := h.channelMessageService.EditChannelMessage(messageID, req.Content, userId.(string)); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -200,6 +263,68 @@ func (h *ChannelMessageHandler) EditChannelMessage(c *gin.Context) {
 	}
 }
 
+// GetMessageRevisions returns the edit history of a message to its author and server moderators
+func (h *ChannelMessageHandler) GetMessageRevisions(c *gin.Context) {
+	messageID := c.Param("id")
+	if messageID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Message ID is required"})
+		return
+	}
+
+	// Check if user is authenticated
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	message, err := h.channelMessageService.GetMessageByID(messageID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	// Only the author and server moderators may read revisions
+	if message.UserId != userId.(string) {
+		serverId, err := h.serverService.GetServerIdByChannelId(message.ChannelId)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Direct conversations have no moderators
+		isModerator := false
+		if serverId != "" {
+			isModerator, err = h.serverService.IsServerModerator(serverId, userId.(string))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if !isModerator {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You are not allowed to view revisions of this message"})
+			return
+		}
+	}
+
+	revisions, err := h.channelMessageService.GetMessageRevisions(messageID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// revisionsがnilの場合は空の配列を返す
+	if revisions == nil {
+		revisions = []models.ChannelMessageRevision{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"messageId": messageID,
+		"current":   message.Content,
+		"revisions": revisions,
+	})
+}
+
 // DeleteChannelMessage deletes a message
 func (h *ChannelMessageHandler) DeleteChannelMessage(c *gin.Context) {
 	messageID := c.Param("id")
@@ -252,37 +377,77 @@ func (h *ChannelMessageHandler) DeleteChannelMessage(c *gin.Context) {
 	}
 }
 
-// UploadChannelAttachment uploads a file attachment for a channel message
+// UploadChannelAttachment uploads a file. The file is uploaded to a channel
+// (the :id route parameter or the channelId form field) and returned as an
+// unposted attachment whose ID is then sent with CreateChannelMessage. With
+// a messageId form field it is instead attached to that existing message.
 func (h *ChannelMessageHandler) UploadChannelAttachment(c *gin.Context) {
 	// Check if user is authenticated
-	_, exists := c.Get("userID")
+	userId, exists := c.Get("userID")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	// Get message ID
-	messageID := c.PostForm("messageId")
-	if messageID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Message ID is required"})
+	// Get file
+	file, ok := uploadedFile(c, h.channelMessageService.Uploads())
+	if !ok {
 		return
 	}
 
-	// Get file
-	file, err := c.FormFile("file")
+	channelID := c.Param("id")
+	if channelID == "" {
+		channelID = c.PostForm("channelId")
+	}
+	messageID := c.PostForm("messageId")
+
+	if messageID != "" {
+		// Only the author may attach files to a message
+		isAuthor, err := h.channelMessageService.IsMessageAuthor(messageID, userId.(string))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !isAuthor {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You are not the author of this message"})
+			return
+		}
+	} else {
+		if channelID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Channel ID or message ID is required"})
+			return
+		}
+		hasAccess, err := h.serverService.HasChannelAccess(channelID, userId.(string))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !hasAccess {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this channel"})
+			return
+		}
+	}
+
+	// Save attachment
+	attachmentId, err := h.channelMessageService.SaveChannelAttachment(file, channelID, messageID, userId.(string))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
+		if respondUploadError(c, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Save attachment
-	attachmentId, err := h.channelMessageService.SaveChannelAttachment(file, messageID)
+	attachment, err := h.channelMessageService.GetAttachmentInfo(attachmentId)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"attachmentId": attachmentId})
+	c.JSON(http.StatusCreated, gin.H{
+		"attachmentId": attachmentId,
+		"attachment":   attachment,
+	})
 }
 
 // GetChannelAttachment retrieves an attachment
@@ -293,6 +458,15 @@ func (h *ChannelMessageHandler) GetChannelAttachment(c *gin.Context) {
 		return
 	}
 
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	if !checkAttachmentAccess(c, h.channelMessageService, h.serverService, attachmentId, userId.(string)) {
+		return
+	}
+
 	// Get attachment
 	attachment, err := h.channelMessageService.GetChannelAttachment(attachmentId)
 	if err != nil {
@@ -300,5 +474,211 @@ func (h *ChannelMessageHandler) GetChannelAttachment(c *gin.Context) {
 		return
 	}
 
-	c.File(attachment.FilePath)
+	serveAttachmentFile(c, h.channelMessageService.Files(), attachment)
+}
+
+// GetPinnedMessages lists the pinned messages of a channel
+func (h *ChannelMessageHandler) GetPinnedMessages(c *gin.Context) {
+	channelID := c.Param("id")
+	if channelID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Channel ID is required"})
+		return
+	}
+
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	hasAccess, err := h.serverService.HasChannelAccess(channelID, userId.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !hasAccess {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this channel"})
+		return
+	}
+
+	pins, err := h.channelMessageService.GetPinnedMessages(channelID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// pinsがnilの場合は空の配列を返す
+	if pins == nil {
+		pins = []models.PinnedMessage{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"pins":    pins,
+		"maxPins": services.MaxPinsPerChannel,
+	})
+}
+
+// PinMessage pins a message to a channel
+func (h *ChannelMessageHandler) PinMessage(c *gin.Context) {
+	h.setMessagePinned(c, true)
+}
+
+// UnpinMessage removes a message from a channel's pins
+func (h *ChannelMessageHandler) UnpinMessage(c *gin.Context) {
+	h.setMessagePinned(c, false)
+}
+
+// setMessagePinned pins or unpins a message and records a system message in the channel
+func (h *ChannelMessageHandler) setMessagePinned(c *gin.Context, pinned bool) {
+	channelID := c.Param("id")
+	messageID := c.Param("messageId")
+	if channelID == "" || messageID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Channel ID and message ID are required"})
+		return
+	}
+
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	canPin, err := h.serverService.CanPinMessages(channelID, userId.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !canPin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to manage pins in this channel"})
+		return
+	}
+
+	if pinned {
+		err = h.channelMessageService.PinMessage(channelID, messageID, userId.(string))
+	} else {
+		err = h.channelMessageService.UnpinMessage(channelID, messageID)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrMessageNotInChannel), errors.Is(err, services.ErrNotPinned):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrAlreadyPinned), errors.Is(err, services.ErrPinLimitReached):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	content := "pinned a message to this channel."
+	if !pinned {
+		content = "unpinned a message from this channel."
+	}
+	systemMessage, err := h.channelMessageService.SaveSystemMessage(channelID, userId.(string), content)
+	if err != nil {
+		log.Printf("システムメッセージの保存エラー: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"messageId": messageID,
+		"pinned":    pinned,
+	})
+
+	// WebSocketでブロードキャスト（WebSocketサービスが設定されている場合）
+	if h.wsService != nil {
+		if err := h.wsService.BroadcastMessagePin(channelID, messageID, pinned); err != nil {
+			log.Printf("WebSocketブロードキャストエラー: %v", err)
+		}
+		if systemMessage != nil {
+			if err := h.wsService.BroadcastNewMessage(channelID, systemMessage); err != nil {
+				log.Printf("WebSocketブロードキャストエラー: %v", err)
+			}
+		}
+	}
+}
+
+// UpdateChannelTopic lets any channel member change the topic
+func (h *ChannelMessageHandler) UpdateChannelTopic(c *gin.Context) {
+	channelID := c.Param("id")
+	if channelID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Channel ID is required"})
+		return
+	}
+
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.ChannelTopicRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	channel, systemMessage, err := h.setChannelTopic(channelID, userId.(string), req.Topic)
+	if err != nil {
+		if errors.Is(err, errNoChannelAccess) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this channel"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"channel": channel,
+	})
+
+	h.broadcastTopicChange(channelID, channel, systemMessage)
+}
+
+// errNoChannelAccess is returned when the caller cannot access the channel
+var errNoChannelAccess = errors.New("no channel access")
+
+// setChannelTopic checks access, stores the topic and records a system message
+func (h *ChannelMessageHandler) setChannelTopic(channelID, userID, topic string) (models.Channel, *models.ChannelMessage, error) {
+	hasAccess, err := h.serverService.HasChannelAccess(channelID, userID)
+	if err != nil {
+		return models.Channel{}, nil, err
+	}
+	if !hasAccess {
+		return models.Channel{}, nil, errNoChannelAccess
+	}
+
+	if err := h.serverService.SetChannelTopic(channelID, topic, userID); err != nil {
+		return models.Channel{}, nil, err
+	}
+
+	channel, err := h.serverService.GetChannelByID(channelID)
+	if err != nil {
+		return models.Channel{}, nil, err
+	}
+
+	content := "changed the topic to: " + topic
+	if topic == "" {
+		content = "cleared the topic."
+	}
+	systemMessage, err := h.channelMessageService.SaveSystemMessage(channelID, userID, content)
+	if err != nil {
+		log.Printf("システムメッセージの保存エラー: %v", err)
+	}
+
+	return channel, systemMessage, nil
+}
+
+// broadcastTopicChange sends the updated channel and its system message to connected clients
+func (h *ChannelMessageHandler) broadcastTopicChange(channelID string, channel models.Channel, systemMessage *models.ChannelMessage) {
+	if h.wsService == nil {
+		return
+	}
+	if err := h.wsService.BroadcastChannelUpdate(channelID, channel); err != nil {
+		log.Printf("WebSocketブロードキャストエラー: %v", err)
+	}
+	if systemMessage != nil {
+		if err := h.wsService.BroadcastNewMessage(channelID, systemMessage); err != nil {
+			log.Printf("WebSocketブロードキャストエラー: %v", err)
+		}
+	}
 }
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"app/models"
+	"app/services"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CommandHandler handles slash command discovery and bot command registration
+type CommandHandler struct {
+	commandService *services.CommandService
+	serverService  *services.ServerService
+}
+
+// NewCommandHandler creates a new command handler
+func NewCommandHandler(commandService *services.CommandService, serverService *services.ServerService) *CommandHandler {
+	return &CommandHandler{
+		commandService: commandService,
+		serverService:  serverService,
+	}
+}
+
+// GetChannelCommands lists the commands available in a channel with their argument schemas
+func (h *CommandHandler) GetChannelCommands(c *gin.Context) {
+	channelID := c.Param("id")
+	if channelID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Channel ID is required"})
+		return
+	}
+
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	hasAccess, err := h.serverService.HasChannelAccess(channelID, userId.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !hasAccess {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this channel"})
+		return
+	}
+
+	commands, err := h.commandService.ListCommands(channelID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"commands": commands})
+}
+
+// GetBotCommands lists the bot commands registered for a server
+func (h *CommandHandler) GetBotCommands(c *gin.Context) {
+	serverID := c.Param("id")
+
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	isMember, err := h.serverService.IsServerMember(serverID, userId.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !isMember {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this server"})
+		return
+	}
+
+	commands, err := h.commandService.GetBotCommands(serverID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// commandsがnilの場合は空の配列を返す
+	if commands == nil {
+		commands = []models.BotCommand{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"commands": commands})
+}
+
+// RegisterBotCommand registers a bot command for a server.
+// The signing secret used for callback signatures is only returned here.
+func (h *CommandHandler) RegisterBotCommand(c *gin.Context) {
+	serverID := c.Param("id")
+
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.BotCommandRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	isModerator, err := h.serverService.IsServerModerator(serverID, userId.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !isModerator {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only server owners and admins can register commands"})
+		return
+	}
+
+	command, secret, err := h.commandService.RegisterBotCommand(serverID, userId.(string), req)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidCommandName), errors.Is(err, services.ErrInvalidCallbackURL):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrCommandNameTaken):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"command":       command,
+		"signingSecret": secret,
+	})
+}
+
+// DeleteBotCommand removes a bot command from a server
+func (h *CommandHandler) DeleteBotCommand(c *gin.Context) {
+	serverID := c.Param("id")
+	name := c.Param("name")
+
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	isModerator, err := h.serverService.IsServerModerator(serverID, userId.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !isModerator {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only server owners and admins can remove commands"})
+		return
+	}
+
+	if err := h.commandService.DeleteBotCommand(serverID, name); err != nil {
+		if errors.Is(err, services.ErrUnknownCommand) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Command removed"})
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"app/models"
+	"app/services"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DirectMessageHandler handles direct conversation HTTP requests.
+// Messages inside a conversation are served by ChannelMessageHandler.
+type DirectMessageHandler struct {
+	directMessageService *services.DirectMessageService
+}
+
+// NewDirectMessageHandler creates a new direct message handler
+func NewDirectMessageHandler(directMessageService *services.DirectMessageService) *DirectMessageHandler {
+	return &DirectMessageHandler{
+		directMessageService: directMessageService,
+	}
+}
+
+// GetConversations lists the user's open conversations ordered by latest activity
+func (h *DirectMessageHandler) GetConversations(c *gin.Context) {
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	conversations, err := h.directMessageService.GetUserConversations(userId.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// conversationsがnilの場合は空の配列を返す
+	if conversations == nil {
+		conversations = []models.DirectConversation{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"conversations": conversations,
+	})
+}
+
+// OpenConversation opens a one-to-one conversation or creates a group conversation
+func (h *DirectMessageHandler) OpenConversation(c *gin.Context) {
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.DirectConversationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	conversation, created, err := h.directMessageService.OpenConversation(userId.(string), req.UserIds, req.Name)
+	if err != nil {
+		if errors.Is(err, services.ErrTooManyParticipants) || errors.Is(err, services.ErrUnknownParticipant) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	c.JSON(status, gin.H{
+		"conversation": conversation,
+	})
+}
+
+// GetConversation returns a single conversation the user takes part in
+func (h *DirectMessageHandler) GetConversation(c *gin.Context) {
+	conversationId := c.Param("id")
+	if conversationId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Conversation ID is required"})
+		return
+	}
+
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	conversation, err := h.directMessageService.GetConversation(conversationId, userId.(string))
+	if err != nil {
+		if errors.Is(err, services.ErrConversationNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"conversation": conversation,
+	})
+}
+
+// CloseConversation hides a conversation from the user's list until it is reopened
+func (h *DirectMessageHandler) CloseConversation(c *gin.Context) {
+	h.setConversationClosed(c, true)
+}
+
+// ReopenConversation shows a previously closed conversation again
+func (h *DirectMessageHandler) ReopenConversation(c *gin.Context) {
+	h.setConversationClosed(c, false)
+}
+
+// setConversationClosed updates the caller's closed flag for a conversation
+func (h *DirectMessageHandler) setConversationClosed(c *gin.Context, closed bool) {
+	conversationId := c.Param("id")
+	if conversationId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Conversation ID is required"})
+		return
+	}
+
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if err := h.directMessageService.SetConversationClosed(conversationId, userId.(string), closed); err != nil {
+		if errors.Is(err, services.ErrConversationNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"conversationId": conversationId,
+		"closed":         closed,
+	})
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"app/models"
+	"app/services"
+	"app/storage"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ExportHandler handles channel and server history export requests
+type ExportHandler struct {
+	exportService *services.ExportService
+}
+
+// NewExportHandler creates a new export handler
+func NewExportHandler(exportService *services.ExportService) *ExportHandler {
+	return &ExportHandler{
+		exportService: exportService,
+	}
+}
+
+// ExportChannel starts a background export of a channel
+func (h *ExportHandler) ExportChannel(c *gin.Context) {
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	channelID := c.Param("id")
+	if _, err := uuid.Parse(channelID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel ID"})
+		return
+	}
+
+	job, err := h.exportService.ExportChannel(channelID, userId.(string))
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"export": job,
+	})
+}
+
+// ExportServer starts a background export of every channel in a server
+func (h *ExportHandler) ExportServer(c *gin.Context) {
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	serverID := c.Param("id")
+	if _, err := uuid.Parse(serverID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid server ID"})
+		return
+	}
+
+	job, err := h.exportService.ExportServer(serverID, userId.(string))
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"export": job,
+	})
+}
+
+// ExportAccount returns the user's personal data export: their profile,
+// memberships, own messages, AI chats and uploaded files. A new export is
+// started unless one is in progress or ready for download.
+func (h *ExportHandler) ExportAccount(c *gin.Context) {
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	job, err := h.exportService.AccountExport(userId.(string))
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	status := http.StatusAccepted
+	if job.Status == models.ExportStatusCompleted {
+		status = http.StatusOK
+	}
+	c.JSON(status, gin.H{
+		"export": job,
+	})
+}
+
+// GetExports lists the user's exports
+func (h *ExportHandler) GetExports(c *gin.Context) {
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	jobs, err := h.exportService.GetUserExports(userId.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"exports": jobs,
+	})
+}
+
+// GetExport returns an export's status and progress for polling
+func (h *ExportHandler) GetExport(c *gin.Context) {
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	exportID := c.Param("id")
+	if _, err := uuid.Parse(exportID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": services.ErrExportNotFound.Error()})
+		return
+	}
+
+	job, err := h.exportService.GetExport(exportID, userId.(string))
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"export": job,
+	})
+}
+
+// DownloadExport redirects to or streams the finished zip archive
+func (h *ExportHandler) DownloadExport(c *gin.Context) {
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	exportID := c.Param("id")
+	if _, err := uuid.Parse(exportID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": services.ErrExportNotFound.Error()})
+		return
+	}
+
+	filePath, fileName, err := h.exportService.GetDownloadPath(exportID, userId.(string))
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	if _, _, err := h.exportService.Files().Resolve(filePath); errors.Is(err, storage.ErrUnknownLocator) {
+		// ストレージ移行前にローカルの./exportsへ書き出したアーカイブは期限切れまでそのまま返す
+		c.FileAttachment(filePath, fileName)
+		return
+	}
+	serveAttachmentFile(c, h.exportService.Files(), models.ChannelAttachment{
+		FileName:    fileName,
+		FileType:    "other",
+		FilePath:    filePath,
+		ContentType: "application/zip",
+	})
+}
+
+// respondError maps export service errors to HTTP responses
+func (h *ExportHandler) respondError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrExportNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrExportForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrExportNotReady):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrNothingToExport):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
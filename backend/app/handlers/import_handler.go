@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"app/models"
+	"app/services"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ImportHandler handles Slack and Discord import requests from administrators
+type ImportHandler struct {
+	importService *services.ImportService
+}
+
+// NewImportHandler creates a new import handler
+func NewImportHandler(importService *services.ImportService) *ImportHandler {
+	return &ImportHandler{
+		importService: importService,
+	}
+}
+
+// Import imports an uploaded export archive.
+// Form fields: file, format ("slack" or "discord"), serverId or serverName, dryRun.
+func (h *ImportHandler) Import(c *gin.Context) {
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(c.PostForm("dryRun"))
+	opts := models.ImportOptions{
+		Format:     c.PostForm("format"),
+		ServerId:   c.PostForm("serverId"),
+		ServerName: c.PostForm("serverName"),
+		OwnerId:    userId.(string),
+		DryRun:     dryRun,
+	}
+
+	// Archives are read with random access, so keep the upload in a temporary file
+	tmpDir, err := os.MkdirTemp("", "import-*")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpPath := filepath.Join(tmpDir, filepath.Base(file.Filename))
+	if err := c.SaveUploadedFile(file, tmpPath); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	report, err := h.importService.ImportFile(tmpPath, opts)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrUnsupportedImportFormat), errors.Is(err, services.ErrImportTargetRequired),
+			errors.Is(err, services.ErrInvalidImportArchive):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrImportServerNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	status := http.StatusCreated
+	if report.DryRun {
+		status = http.StatusOK
+	}
+	c.JSON(status, gin.H{
+		"report": report,
+	})
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"app/services"
+)
+
+// JWKSHandler publishes the public keys that verify access tokens
+type JWKSHandler struct {
+	keys *services.KeyManager
+}
+
+// NewJWKSHandler creates a new JWKS handler
+func NewJWKSHandler(keys *services.KeyManager) *JWKSHandler {
+	return &JWKSHandler{keys: keys}
+}
+
+// GetJWKS はアクセストークンの検証用公開鍵をJWK Set形式で返す。
+// ローテーション中は新旧両方の鍵が含まれる
+func (h *JWKSHandler) GetJWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.keys.JWKS())
+}
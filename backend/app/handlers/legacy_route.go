@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Modes for the deprecated /api/channels/... message routes, set with the
+// LEGACY_MESSAGE_ROUTES environment variable. The deprecation path is:
+//
+//  1. "enabled" (default): routes work through MessageHandler and every response
+//     carries Deprecation, Sunset and Link headers pointing at the replacement.
+//  2. "gone": routes answer 410 Gone with the replacement URL.
+//
+// Once the routes have been "gone" for a release, MessageHandler and the legacy
+// models can be deleted together with the route registrations.
+const (
+	LegacyRoutesEnabled = "enabled"
+	LegacyRoutesGone    = "gone"
+)
+
+// LegacyRoute marks a route as deprecated in favour of successor, a path template
+// whose :params are filled from the request (for example "/api/channel-messages/:id").
+// sunset is an optional HTTP date announced in the Sunset header.
+func LegacyRoute(mode, sunset, successor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		replacement := successor
+		for _, param := range c.Params {
+			replacement = strings.ReplaceAll(replacement, ":"+param.Key, param.Value)
+		}
+
+		if mode == LegacyRoutesGone {
+			c.JSON(http.StatusGone, gin.H{
+				"error":     "This endpoint has been removed",
+				"successor": replacement,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Header("Deprecation", "true")
+		if sunset != "" {
+			c.Header("Sunset", sunset)
+		}
+		c.Header("Link", "<"+replacement+">; rel=\"successor-version\"")
+		log.Printf("非推奨のエンドポイントが呼び出されました: %s %s (User-Agent: %s)", c.Request.Method, c.FullPath(), c.Request.UserAgent())
+		c.Next()
+	}
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"app/services"
+)
+
+// LoginThrottleHandler lets administrators lift login lockouts
+type LoginThrottleHandler struct {
+	throttleService *services.LoginThrottleService
+}
+
+// NewLoginThrottleHandler creates a new login throttle handler
+func NewLoginThrottleHandler(throttleService *services.LoginThrottleService) *LoginThrottleHandler {
+	return &LoginThrottleHandler{throttleService: throttleService}
+}
+
+// UnlockAccount はユーザーのログイン失敗回数とロックをリセットする
+func (h *LoginThrottleHandler) UnlockAccount(c *gin.Context) {
+	wasLocked, err := h.throttleService.UnlockAccount(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, services.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account unlocked", "wasLocked": wasLocked})
+}
@@ -1,7 +1,6 @@
 package handlers
 
 import (
-	"fmt"
 	"log"
 	"net/http"
 	"time"
@@ -13,18 +12,21 @@ import (
 	"app/services"
 )
 
-// MessageHandler handles message-related requests
+// MessageHandler serves the deprecated /api/channels/... message routes.
+// It is a compatibility shim: requests are translated to ChannelMessageService
+// and responses keep the legacy models.Message shape. New clients should use
+// /api/channel-messages; see LegacyRoute for the deprecation path.
 type MessageHandler struct {
-	messageService *services.MessageService
-	serverService  *services.ServerService
-	wsService      *services.WebSocketService
+	channelMessageService *services.ChannelMessageService
+	serverService         *services.ServerService
+	wsService             *services.WebSocketService
 }
 
 // NewMessageHandler creates a new message handler
-func NewMessageHandler(messageService *services.MessageService, serverService *services.ServerService) *MessageHandler {
+func NewMessageHandler(channelMessageService *services.ChannelMessageService, serverService *services.ServerService) *MessageHandler {
 	return &MessageHandler{
-		messageService: messageService,
-		serverService:  serverService,
+		channelMessageService: channelMessageService,
+		serverService:         serverService,
 	}
 }
 
@@ -33,6 +35,22 @@ func (h *MessageHandler) SetWebSocketService(wsService *services.WebSocketServic
 	h.wsService = wsService
 }
 
+// toLegacyMessage converts a channel message to the legacy response format
+func toLegacyMessage(message models.ChannelMessage) models.Message {
+	return models.Message{
+		ID:          message.ID,
+		Content:     message.Content,
+		Role:        "user",
+		Timestamp:   message.Timestamp,
+		ChannelId:   message.ChannelId,
+		UserId:      message.UserId,
+		Attachments: message.Attachments,
+		IsEdited:    message.IsEdited,
+		IsDeleted:   message.IsDeleted,
+		EditedAt:    message.EditedAt,
+	}
+}
+
 // SendChannelMessage sends a message to a channel
 func (h *MessageHandler) SendChannelMessage(c *gin.Context) {
 	channelID := c.Param("id")
@@ -69,49 +87,31 @@ func (h *MessageHandler) SendChannelMessage(c *gin.Context) {
 	}
 
 	// Create message
-	messageId := uuid.New().String()
-	message := models.Message{
-		ID:        messageId,
+	message := models.ChannelMessage{
+		ID:        uuid.New().String(),
 		ChannelId: channelID,
 		UserId:    userId.(string),
+		Type:      models.MessageTypeUser,
 		Content:   req.Content,
-		Role:      "user",
 		Timestamp: time.Now(),
 	}
 
-	// Handle file uploads if any
-	var attachments []string
-	form, err := c.MultipartForm()
-	if err == nil && form.File != nil {
-		files := form.File["files"]
-		for _, file := range files {
-			// Save file and get path
-			filePath, err := h.messageService.SaveAttachment(file, messageId)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "ファイルのアップロードに失敗しました"})
-				return
-			}
-			attachments = append(attachments, filePath)
-		}
-	}
-
-	// Add attachments to message
-	message.Attachments = attachments
-
 	// Save message
-	if err := h.messageService.SaveMessage(message); err != nil {
+	if err := h.channelMessageService.SaveChannelMessage(message); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	legacyMessage := toLegacyMessage(message)
+
 	// レスポンスを返す
 	c.JSON(http.StatusCreated, gin.H{
-		"message": message,
+		"message": legacyMessage,
 	})
 
 	// WebSocketでブロードキャスト（WebSocketサービスが設定されている場合）
 	if h.wsService != nil {
-		if err := h.wsService.BroadcastNewMessage(channelID, message); err != nil {
+		if err := h.wsService.BroadcastNewMessage(channelID, legacyMessage); err != nil {
 			log.Printf("WebSocketブロードキャストエラー: %v", err)
 		}
 	}
@@ -144,15 +144,26 @@ func (h *MessageHandler) GetChannelMessages(c *gin.Context) {
 	}
 
 	// Get messages
-	messages, err := h.messageService.GetChannelMessages(channelID)
+	channelMessages, err := h.channelMessageService.GetChannelMessages(channelID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// messagesがnilの場合は空の配列を返す
-	if messages == nil {
-		messages = []models.Message{}
+	messages := make([]models.Message, 0, len(channelMessages))
+	for _, cm := range channelMessages {
+		messages = append(messages, models.Message{
+			ID:          cm.ID,
+			Content:     cm.Content,
+			Role:        "user",
+			Timestamp:   cm.Timestamp,
+			ChannelId:   cm.ChannelId,
+			UserId:      cm.UserId,
+			Attachments: cm.Attachments,
+			IsEdited:    cm.IsEdited,
+			IsDeleted:   cm.IsDeleted,
+			EditedAt:    cm.EditedAt,
+		})
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -176,7 +187,7 @@ func (h *MessageHandler) EditMessage(c *gin.Context) {
 	}
 
 	// Check if user is the author of the message
-	isAuthor, err := h.messageService.IsMessageAuthor(messageID, userId.(string))
+	isAuthor, err := h.channelMessageService.IsMessageAuthor(messageID, userId.(string))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -196,39 +207,32 @@ func (h *MessageHandler) EditMessage(c *gin.Context) {
 	}
 
 	// Edit message
-	if err := h.messageService.EditMessage(messageID, req.Content); err != nil {
+	if err := h.channelMessageService.EditChannelMessage(messageID, req.Content, userId.(string)); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// メッセージのチャンネルIDを取得
-	var channelID string
-	err = h.messageService.DB.QueryRow("SELECT channel_id FROM messages WHERE id = $1", messageID).Scan(&channelID)
-	if err != nil {
-		log.Printf("メッセージのチャンネルID取得エラー: %v", err)
-	}
-
 	// レスポンスを返す
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Message updated successfully",
 	})
 
 	// WebSocketでブロードキャスト（WebSocketサービスが設定されている場合）
-	if h.wsService != nil && channelID != "" {
+	if h.wsService != nil {
 		// 更新されたメッセージを取得
-		updatedMessage, err := h.messageService.GetMessageByID(messageID)
+		updatedMessage, err := h.channelMessageService.GetMessageByID(messageID)
 		if err != nil {
 			log.Printf("更新されたメッセージの取得エラー: %v", err)
 			return
 		}
 
-		if err := h.wsService.BroadcastMessageUpdate(channelID, updatedMessage); err != nil {
+		if err := h.wsService.BroadcastMessageUpdate(updatedMessage.ChannelId, toLegacyMessage(*updatedMessage)); err != nil {
 			log.Printf("WebSocketブロードキャストエラー: %v", err)
 		}
 	}
 }
 
-// DeleteMessage deletes a message
+// DeleteMessage deletes a message. Authors and server moderators may delete.
 func (h *MessageHandler) DeleteMessage(c *gin.Context) {
 	messageID := c.Param("id")
 	if messageID == "" {
@@ -243,38 +247,51 @@ func (h *MessageHandler) DeleteMessage(c *gin.Context) {
 		return
 	}
 
+	message, err := h.channelMessageService.GetMessageByID(messageID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
 	// Check if user can delete the message
-	canDelete, err := h.messageService.CanDeleteMessage(messageID, userId.(string))
+	canDelete, err := h.channelMessageService.IsMessageAuthor(messageID, userId.(string))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if !canDelete {
+		serverID, err := h.serverService.GetServerIdByChannelId(message.ChannelId)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if serverID != "" {
+			canDelete, err = h.serverService.IsServerModerator(serverID, userId.(string))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+	}
 	if !canDelete {
 		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to delete this message"})
 		return
 	}
 
 	// Delete message
-	if err := h.messageService.DeleteMessage(messageID); err != nil {
+	if err := h.channelMessageService.DeleteChannelMessage(messageID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// メッセージのチャンネルIDを取得
-	var channelID string
-	err = h.messageService.DB.QueryRow("SELECT channel_id FROM messages WHERE id = $1", messageID).Scan(&channelID)
-	if err != nil {
-		log.Printf("メッセージのチャンネルID取得エラー: %v", err)
-	}
-
 	// レスポンスを返す
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Message deleted successfully",
 	})
 
 	// WebSocketでブロードキャスト（WebSocketサービスが設定されている場合）
-	if h.wsService != nil && channelID != "" {
-		if err := h.wsService.BroadcastMessageDelete(channelID, messageID); err != nil {
+	if h.wsService != nil {
+		if err := h.wsService.BroadcastMessageDelete(message.ChannelId, messageID); err != nil {
 			log.Printf("WebSocketブロードキャストエラー: %v", err)
 		}
 	}
@@ -288,18 +305,28 @@ func (h *MessageHandler) GetAttachment(c *gin.Context) {
 		return
 	}
 
+	// Get user ID from context
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	if !checkAttachmentAccess(c, h.channelMessageService, h.serverService, attachmentID, userId.(string)) {
+		return
+	}
+
 	// Get attachment
-	attachment, err := h.messageService.GetAttachment(attachmentID)
+	attachment, err := h.channelMessageService.GetChannelAttachment(attachmentID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	// Serve file
-	c.File(attachment.FilePath)
+	serveAttachmentFile(c, h.channelMessageService.Files(), attachment)
 }
 
-// UploadFile uploads a file
+// UploadFile uploads a file as a new message in the channel
 func (h *MessageHandler) UploadFile(c *gin.Context) {
 	// Get channel ID
 	channelID := c.Param("id")
@@ -327,47 +354,44 @@ func (h *MessageHandler) UploadFile(c *gin.Context) {
 	}
 
 	// Get file
-	file, err := c.FormFile("file")
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
+	file, ok := uploadedFile(c, h.channelMessageService.Uploads())
+	if !ok {
 		return
 	}
 
-	fmt.Println("File:", file)
-	fmt.Println("File name:", file.Filename)
-	fmt.Println("File size:", file.Size)
-
-	// Create a message ID for the attachment
-	messageID := uuid.New().String()
-
-	// Save file and get path
-	filePath, err := h.messageService.SaveAttachment(file, messageID)
+	// Upload the file first, then post a message that claims it, so a
+	// rejected upload leaves no message behind
+	attachmentID, err := h.channelMessageService.SaveChannelAttachment(file, channelID, "", userId.(string))
 	if err != nil {
-		fmt.Println("SaveAttachment error:", err)
+		if respondUploadError(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "ファイルのアップロードに失敗しました: " + err.Error()})
 		return
 	}
-	fmt.Println("File saved at:", filePath)
 
-	// Create a message with the attachments
-	message := models.Message{
-		ID:          messageID,
-		ChannelId:   channelID,
-		UserId:      userId.(string),
-		Content:     "ファイルがアップロードされました",
-		Role:        "user",
-		Timestamp:   time.Now(),
-		Attachments: []string{filePath},
+	message := models.ChannelMessage{
+		ID:        uuid.New().String(),
+		ChannelId: channelID,
+		UserId:    userId.(string),
+		Type:      models.MessageTypeUser,
+		Content:   "ファイルがアップロードされました",
+		Timestamp: time.Now(),
+	}
+	if err := h.channelMessageService.SaveChannelMessageWithAttachments(message, []string{attachmentID}); err != nil {
+		// The unposted upload is removed by the attachment garbage collector
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
-	// Save message
-	if err := h.messageService.SaveMessage(message); err != nil {
+	attachment, err := h.channelMessageService.GetChannelAttachment(attachmentID)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "File uploaded successfully",
-		"path":    filePath,
+		"path":    h.channelMessageService.AttachmentURL(attachment),
 	})
 }
@@ -29,15 +29,16 @@ func AuthMiddleware(userService *services.UserService) gin.HandlerFunc {
 
 		// Validate the token
 		tokenString := parts[1]
-		userID, err := userService.ValidateToken(tokenString)
+		claims, err := userService.ValidateAccessToken(tokenString)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
 			c.Abort()
 			return
 		}
 
-		// Set the user ID in the context
-		c.Set("userID", userID)
+		// Set the user and session IDs in the context
+		c.Set("userID", claims.UserID)
+		c.Set("sessionID", claims.SessionID)
 		c.Next()
 	}
 }
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"app/models"
+	"app/services"
+)
+
+// OIDCHandler handles sign-in through OpenID Connect identity providers
+type OIDCHandler struct {
+	oidcService          *services.OIDCService
+	userService          *services.UserService
+	passwordLoginEnabled bool
+}
+
+// NewOIDCHandler creates a new OIDC handler. passwordLoginEnabled is
+// reported to the login page.
+func NewOIDCHandler(oidcService *services.OIDCService, userService *services.UserService, passwordLoginEnabled bool) *OIDCHandler {
+	return &OIDCHandler{
+		oidcService:          oidcService,
+		userService:          userService,
+		passwordLoginEnabled: passwordLoginEnabled,
+	}
+}
+
+// GetAuthMethods はログイン方法（パスワードログインの可否と外部IDプロバイダーの一覧）を返す
+func (h *OIDCHandler) GetAuthMethods(c *gin.Context) {
+	c.JSON(http.StatusOK, models.AuthMethods{
+		PasswordLoginEnabled: h.passwordLoginEnabled,
+		Providers:            h.oidcService.Providers(),
+	})
+}
+
+// Authorize はIDプロバイダーでのサインインを開始し、ブラウザの遷移先URLを返す。
+// クライアントはstateを保存し、コールバックで一致することを確認する
+func (h *OIDCHandler) Authorize(c *gin.Context) {
+	authorization, err := h.oidcService.StartLogin(c.Param("provider"))
+	if err != nil {
+		if errors.Is(err, services.ErrUnknownOIDCProvider) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("OIDCサインインの開始エラー: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "IDプロバイダーに接続できませんでした"})
+		return
+	}
+
+	c.JSON(http.StatusOK, authorization)
+}
+
+// Callback はIDプロバイダーから戻された認可コードでサインインを完了する。
+// 2段階認証が有効なユーザーにはパスワードログインと同じくチャレンジを返す
+func (h *OIDCHandler) Callback(c *gin.Context) {
+	var req models.OIDCCallbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, err := h.oidcService.CompleteLogin(req.State, req.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidOIDCState), errors.Is(err, services.ErrUnknownOIDCProvider):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrOIDCEmailNotVerified), errors.Is(err, services.ErrOIDCSignupDisabled):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			log.Printf("OIDCサインインエラー: %v", err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "IDプロバイダーでのサインインに失敗しました"})
+		}
+		return
+	}
+
+	response, err := h.userService.LoginUser(userID, sessionClient(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"app/models"
+	"app/services"
+)
+
+// PersonalAccessTokenHandler handles the current user's personal access tokens
+type PersonalAccessTokenHandler struct {
+	tokenService *services.PersonalAccessTokenService
+}
+
+// NewPersonalAccessTokenHandler creates a new personal access token handler
+func NewPersonalAccessTokenHandler(tokenService *services.PersonalAccessTokenService) *PersonalAccessTokenHandler {
+	return &PersonalAccessTokenHandler{tokenService: tokenService}
+}
+
+// GetTokens は有効なパーソナルアクセストークンの一覧と、指定できるスコープを返す
+func (h *PersonalAccessTokenHandler) GetTokens(c *gin.Context) {
+	tokens, err := h.tokenService.GetTokens(c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tokens": tokens,
+		"scopes": models.TokenScopes,
+	})
+}
+
+// CreateToken はパーソナルアクセストークンを作成する。
+// トークンが表示されるのはこのレスポンスの一度だけ
+func (h *PersonalAccessTokenHandler) CreateToken(c *gin.Context) {
+	var req models.CreatePersonalAccessTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := h.tokenService.CreateToken(c.GetString("userID"), req)
+	if err != nil {
+		if errors.Is(err, services.ErrTooManyPersonalAccessTokens) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, services.ErrUnknownTokenScope) || errors.Is(err, services.ErrTokenNameRequired) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, token)
+}
+
+// RevokeToken はパーソナルアクセストークンを失効させる
+func (h *PersonalAccessTokenHandler) RevokeToken(c *gin.Context) {
+	if err := h.tokenService.RevokeToken(c.GetString("userID"), c.Param("id")); err != nil {
+		if errors.Is(err, services.ErrPersonalAccessTokenNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked"})
+}
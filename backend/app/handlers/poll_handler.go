@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"app/models"
+	"app/services"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// PollHandler handles poll-related HTTP requests
+type PollHandler struct {
+	pollService   *services.PollService
+	serverService *services.ServerService
+	wsService     *services.WebSocketService
+}
+
+// NewPollHandler creates a new poll handler
+func NewPollHandler(pollService *services.PollService, serverService *services.ServerService) *PollHandler {
+	return &PollHandler{
+		pollService:   pollService,
+		serverService: serverService,
+	}
+}
+
+// SetWebSocketService はWebSocketServiceを設定する
+func (h *PollHandler) SetWebSocketService(wsService *services.WebSocketService) {
+	h.wsService = wsService
+}
+
+// CreatePoll posts a new poll in a channel
+func (h *PollHandler) CreatePoll(c *gin.Context) {
+	channelID := c.Param("id")
+	if channelID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Channel ID is required"})
+		return
+	}
+
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	hasAccess, err := h.serverService.HasChannelAccess(channelID, userId.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !hasAccess {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this channel"})
+		return
+	}
+
+	var req models.PollRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	message, err := h.pollService.CreatePoll(channelID, userId.(string), req)
+	if err != nil {
+		if errors.Is(err, services.ErrPollDeadline) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": message,
+	})
+
+	// WebSocketでブロードキャスト（WebSocketサービスが設定されている場合）
+	if h.wsService != nil {
+		if err := h.wsService.BroadcastNewMessage(channelID, message); err != nil {
+			log.Printf("WebSocketブロードキャストエラー: %v", err)
+		}
+	}
+}
+
+// GetPoll returns a poll with its results and the caller's votes
+func (h *PollHandler) GetPoll(c *gin.Context) {
+	poll, userId, ok := h.loadAccessiblePoll(c)
+	if !ok {
+		return
+	}
+
+	myVotes, err := h.pollService.GetUserVotes(poll.ID, userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"poll":    poll,
+		"myVotes": myVotes,
+	})
+}
+
+// Vote records the caller's choices in a poll
+func (h *PollHandler) Vote(c *gin.Context) {
+	poll, userId, ok := h.loadAccessiblePoll(c)
+	if !ok {
+		return
+	}
+
+	var req models.PollVoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, optionId := range req.OptionIds {
+		if _, err := uuid.Parse(optionId); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": services.ErrInvalidPollOption.Error()})
+			return
+		}
+	}
+
+	updated, err := h.pollService.Vote(poll.ID, userId, req.OptionIds)
+	if err != nil {
+		h.respondPollError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"poll": updated})
+}
+
+// Unvote removes the caller's vote for one option (optionId query parameter) or all options
+func (h *PollHandler) Unvote(c *gin.Context) {
+	poll, userId, ok := h.loadAccessiblePoll(c)
+	if !ok {
+		return
+	}
+
+	optionId := c.Query("optionId")
+	if optionId != "" {
+		if _, err := uuid.Parse(optionId); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": services.ErrInvalidPollOption.Error()})
+			return
+		}
+	}
+
+	updated, err := h.pollService.Unvote(poll.ID, userId, optionId)
+	if err != nil {
+		h.respondPollError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"poll": updated})
+}
+
+// ClosePoll lets the poll's creator or a moderator close it before its deadline
+func (h *PollHandler) ClosePoll(c *gin.Context) {
+	poll, userId, ok := h.loadAccessiblePoll(c)
+	if !ok {
+		return
+	}
+
+	if poll.CreatedBy != userId {
+		// サーバーのモデレーターも投票を締め切れる（DMにはモデレーターはいない）
+		serverId, err := h.serverService.GetServerIdByChannelId(poll.ChannelId)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		isModerator := false
+		if serverId != "" {
+			isModerator, err = h.serverService.IsServerModerator(serverId, userId)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if !isModerator {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the creator or a moderator can close this poll"})
+			return
+		}
+	}
+
+	closed, err := h.pollService.ClosePoll(poll.ID)
+	if err != nil {
+		h.respondPollError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"poll": closed})
+}
+
+// loadAccessiblePoll loads the poll in the URL and checks the caller can read its channel
+func (h *PollHandler) loadAccessiblePoll(c *gin.Context) (*models.Poll, string, bool) {
+	pollId := c.Param("id")
+	if _, err := uuid.Parse(pollId); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": services.ErrPollNotFound.Error()})
+		return nil, "", false
+	}
+
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, "", false
+	}
+
+	poll, err := h.pollService.GetPoll(pollId)
+	if err != nil {
+		h.respondPollError(c, err)
+		return nil, "", false
+	}
+
+	hasAccess, err := h.serverService.HasChannelAccess(poll.ChannelId, userId.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, "", false
+	}
+	if !hasAccess {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this channel"})
+		return nil, "", false
+	}
+
+	return poll, userId.(string), true
+}
+
+// respondPollError maps poll service errors to HTTP responses
+func (h *PollHandler) respondPollError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrPollNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrPollClosed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidPollOption), errors.Is(err, services.ErrSingleChoicePoll):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"app/models"
+	"app/services"
+)
+
+// maxUserSearchQueryLength is the longest accepted search query, long enough for an email address
+const maxUserSearchQueryLength = 254
+
+// ProfileHandler serves user profiles and lets users edit their own
+type ProfileHandler struct {
+	profileService *services.ProfileService
+	uploads        *services.UploadPolicyService
+}
+
+// NewProfileHandler creates a new profile handler
+func NewProfileHandler(profileService *services.ProfileService, uploads *services.UploadPolicyService) *ProfileHandler {
+	return &ProfileHandler{
+		profileService: profileService,
+		uploads:        uploads,
+	}
+}
+
+// GetCurrentUser はログイン中のユーザーのプロフィールとメールアドレスを返す
+func (h *ProfileHandler) GetCurrentUser(c *gin.Context) {
+	user, err := h.profileService.GetCurrentUser(c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// GetUserProfile は指定したユーザーの公開プロフィールを返す
+func (h *ProfileHandler) GetUserProfile(c *gin.Context) {
+	userID := c.Param("id")
+	if _, err := uuid.Parse(userID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ユーザーが見つかりません"})
+		return
+	}
+
+	profile, err := h.profileService.GetProfile(userID)
+	if err != nil {
+		if errors.Is(err, services.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "ユーザーが見つかりません"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, profile)
+}
+
+// UpdateProfile は表示名・自己紹介・代名詞・タイムゾーン・ステータスを更新する。
+// 指定しなかった項目はそのまま、空文字列を指定した項目は削除される
+func (h *ProfileHandler) UpdateProfile(c *gin.Context) {
+	var req models.UpdateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := h.profileService.UpdateProfile(c.GetString("userID"), req)
+	if err != nil {
+		respondProfileError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// SearchUsers はユーザーを検索する。同じサーバーのメンバーはユーザー名・表示名の一部で、
+// それ以外のユーザーはユーザー名（またはメールアドレス）の完全一致でのみ見つかる
+func (h *ProfileHandler) SearchUsers(c *gin.Context) {
+	query := c.Query("q")
+	if strings.TrimSpace(query) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "検索クエリが必要です"})
+		return
+	}
+	if utf8.RuneCountInString(query) > maxUserSearchQueryLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "検索クエリが長すぎます"})
+		return
+	}
+
+	limit, offset := 0, 0
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limitが不正です"})
+			return
+		}
+		limit = n
+	}
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offsetが不正です"})
+			return
+		}
+		offset = n
+	}
+
+	page, err := h.profileService.SearchUsers(c.GetString("userID"), query, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "ユーザー検索に失敗しました"})
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// UploadAvatar はアップロードされた画像をアバターに設定する
+func (h *ProfileHandler) UploadAvatar(c *gin.Context) {
+	file, ok := uploadedFile(c, h.uploads)
+	if !ok {
+		return
+	}
+
+	user, err := h.profileService.SetAvatar(c.GetString("userID"), file)
+	if err != nil {
+		if respondUploadError(c, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// DeleteAvatar はアバターを削除する
+func (h *ProfileHandler) DeleteAvatar(c *gin.Context) {
+	user, err := h.profileService.RemoveAvatar(c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+func respondProfileError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrInvalidTimezone),
+		errors.Is(err, services.ErrInvalidProfileText),
+		errors.Is(err, services.ErrInvalidStatusEmoji),
+		errors.Is(err, services.ErrStatusExpiryInPast):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
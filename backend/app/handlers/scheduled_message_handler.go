@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"app/models"
+	"app/services"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ScheduledMessageHandler handles scheduled message HTTP requests
+type ScheduledMessageHandler struct {
+	scheduledMessageService *services.ScheduledMessageService
+	serverService           *services.ServerService
+}
+
+// NewScheduledMessageHandler creates a new scheduled message handler
+func NewScheduledMessageHandler(scheduledMessageService *services.ScheduledMessageService, serverService *services.ServerService) *ScheduledMessageHandler {
+	return &ScheduledMessageHandler{
+		scheduledMessageService: scheduledMessageService,
+		serverService:           serverService,
+	}
+}
+
+// ScheduleMessage schedules a message to be posted in a channel later
+func (h *ScheduledMessageHandler) ScheduleMessage(c *gin.Context) {
+	channelID := c.Param("id")
+	if channelID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Channel ID is required"})
+		return
+	}
+
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	hasAccess, err := h.serverService.HasChannelAccess(channelID, userId.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !hasAccess {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this channel"})
+		return
+	}
+
+	var req models.ScheduledMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	scheduled, err := h.scheduledMessageService.ScheduleMessage(channelID, userId.(string), req.Content, req.SendAt)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"scheduledMessage": scheduled,
+	})
+}
+
+// GetScheduledMessages lists the user's scheduled messages and reminders.
+// Optional query parameters: channelId, status (defaults to pending).
+func (h *ScheduledMessageHandler) GetScheduledMessages(c *gin.Context) {
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	channelID := c.Query("channelId")
+	if channelID != "" {
+		if _, err := uuid.Parse(channelID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel ID"})
+			return
+		}
+	}
+
+	status := c.Query("status")
+	switch status {
+	case "", models.ScheduledStatusPending, models.ScheduledStatusSending, models.ScheduledStatusSent,
+		models.ScheduledStatusCancelled, models.ScheduledStatusFailed:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+		return
+	}
+
+	scheduled, err := h.scheduledMessageService.GetUserScheduledMessages(userId.(string), channelID, status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"scheduledMessages": scheduled,
+	})
+}
+
+// UpdateScheduledMessage changes the content or send time of a pending scheduled message
+func (h *ScheduledMessageHandler) UpdateScheduledMessage(c *gin.Context) {
+	id, userId, ok := h.scheduledMessageParams(c)
+	if !ok {
+		return
+	}
+
+	var req models.ScheduledMessageUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Content == nil && req.SendAt == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to update"})
+		return
+	}
+
+	scheduled, err := h.scheduledMessageService.UpdateScheduledMessage(id, userId, req)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"scheduledMessage": scheduled,
+	})
+}
+
+// CancelScheduledMessage cancels a pending scheduled message
+func (h *ScheduledMessageHandler) CancelScheduledMessage(c *gin.Context) {
+	id, userId, ok := h.scheduledMessageParams(c)
+	if !ok {
+		return
+	}
+
+	if err := h.scheduledMessageService.CancelScheduledMessage(id, userId); err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Scheduled message cancelled",
+	})
+}
+
+func (h *ScheduledMessageHandler) scheduledMessageParams(c *gin.Context) (string, string, bool) {
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return "", "", false
+	}
+
+	id := c.Param("id")
+	if _, err := uuid.Parse(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": services.ErrScheduledMessageNotFound.Error()})
+		return "", "", false
+	}
+	return id, userId.(string), true
+}
+
+// respondError maps scheduled message service errors to HTTP responses
+func (h *ScheduledMessageHandler) respondError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrScheduledMessageNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrScheduledMessageLocked):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrScheduleInPast), errors.Is(err, services.ErrScheduleTooFar):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
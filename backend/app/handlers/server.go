@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
@@ -571,6 +572,101 @@ func (h *ServerHandler) DeleteChannel(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "チャンネルが削除されました"})
 }
 
+// UpdateRevisionPolicy sets how long message revisions are kept in a server
+func (h *ServerHandler) UpdateRevisionPolicy(c *gin.Context) {
+	// Get server ID from URL parameter
+	serverId := c.Param("id")
+	if serverId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "サーバーIDが必要です"})
+		return
+	}
+
+	// Get user ID from context
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "認証が必要です"})
+		return
+	}
+
+	var req models.RevisionPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Only the server owner can change the retention policy
+	hasPermission, err := h.serverService.HasChannelManagementPermission(serverId, userId.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "権限の確認に失敗しました"})
+		return
+	}
+
+	if !hasPermission {
+		c.JSON(http.StatusForbidden, gin.H{"error": "保持ポリシーを変更できるのはサーバーの作成者のみです"})
+		return
+	}
+
+	if err := h.serverService.SetRevisionRetention(serverId, req.RetentionDays); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保持ポリシーの更新に失敗しました"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "保持ポリシーが更新されました",
+		"retentionDays": req.RetentionDays,
+	})
+}
+
+// UpdateTwoFactorRequirement はサーバーのオーナーと管理者に2段階認証を必須にするかを設定する
+func (h *ServerHandler) UpdateTwoFactorRequirement(c *gin.Context) {
+	serverId := c.Param("id")
+	if serverId == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "サーバーIDが必要です"})
+		return
+	}
+
+	userId, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "認証が必要です"})
+		return
+	}
+
+	var req models.TwoFactorRequirementRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// オーナーのみ変更できる（必須化されたサーバーでは2段階認証が有効なオーナーのみ）
+	hasPermission, err := h.serverService.HasChannelManagementPermission(serverId, userId.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "権限の確認に失敗しました"})
+		return
+	}
+
+	if !hasPermission {
+		c.JSON(http.StatusForbidden, gin.H{"error": "2段階認証の設定を変更できるのはサーバーの作成者のみです"})
+		return
+	}
+
+	if err := h.serverService.SetTwoFactorRequirement(serverId, userId.(string), req.Required); err != nil {
+		if errors.Is(err, services.ErrTwoFactorNotEnabled) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "必須にするには、先にご自身の2段階認証を有効にしてください",
+				"code":  "two_factor_required",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "2段階認証の設定の更新に失敗しました"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":          "2段階認証の設定が更新されました",
+		"requireTwoFactor": req.Required,
+	})
+}
+
 // GetChannel handles the retrieval of a channel by ID
 func (h *ServerHandler) GetChannel(c *gin.Context) {
 	channelID := c.Param("id")
@@ -601,3 +697,54 @@ func (h *ServerHandler) GetChannel(c *gin.Context) {
 
 	c.JSON(http.StatusOK, channel)
 }
+
+// TransferOwnership はサーバーの所有者を別のメンバーに変更する。元の所有者は管理者になる
+func (h *ServerHandler) TransferOwnership(c *gin.Context) {
+	serverId := c.Param("id")
+	if _, err := uuid.Parse(serverId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "サーバーIDが不正です"})
+		return
+	}
+
+	var req models.TransferServerOwnershipRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.serverService.TransferOwnership(serverId, c.GetString("userID"), req.UserId); err != nil {
+		switch {
+		case errors.Is(err, services.ErrNotServerOwner):
+			c.JSON(http.StatusForbidden, gin.H{"error": "所有者を変更できるのはサーバーの作成者のみです"})
+		case errors.Is(err, services.ErrNewOwnerNotMember), errors.Is(err, services.ErrCannotTransferToSelf):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrNewOwnerNeedsTwoFactor):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "code": "two_factor_required"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "所有者の変更に失敗しました"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "サーバーの所有者を変更しました", "ownerId": req.UserId})
+}
+
+// DeleteServer はサーバーをチャンネル・メッセージごと削除する。所有者のみ実行できる
+func (h *ServerHandler) DeleteServer(c *gin.Context) {
+	serverId := c.Param("id")
+	if _, err := uuid.Parse(serverId); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "サーバーIDが不正です"})
+		return
+	}
+
+	if err := h.serverService.DeleteServer(serverId, c.GetString("userID")); err != nil {
+		if errors.Is(err, services.ErrNotServerOwner) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "サーバーを削除できるのはサーバーの作成者のみです"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "サーバーの削除に失敗しました"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "サーバーを削除しました"})
+}
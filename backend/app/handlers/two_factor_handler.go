@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"app/models"
+	"app/services"
+)
+
+// TwoFactorHandler handles enrollment and management of two-factor authentication
+type TwoFactorHandler struct {
+	twoFactorService *services.TwoFactorService
+}
+
+// NewTwoFactorHandler creates a new two-factor authentication handler
+func NewTwoFactorHandler(twoFactorService *services.TwoFactorService) *TwoFactorHandler {
+	return &TwoFactorHandler{twoFactorService: twoFactorService}
+}
+
+// GetStatus は2段階認証が有効かどうかと、残りのリカバリーコード数を返す
+func (h *TwoFactorHandler) GetStatus(c *gin.Context) {
+	status, err := h.twoFactorService.GetStatus(c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// Enroll は新しいTOTPシークレットを生成し、認証アプリ用のotpauth URIを返す。
+// 確認コードが送られるまで2段階認証は有効にならない
+func (h *TwoFactorHandler) Enroll(c *gin.Context) {
+	enrollment, err := h.twoFactorService.Enroll(c.GetString("userID"))
+	if err != nil {
+		if errors.Is(err, services.ErrTwoFactorAlreadyEnabled) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, enrollment)
+}
+
+// Confirm は認証アプリのコードで登録を確認して2段階認証を有効にし、
+// リカバリーコードを返す（表示されるのはこの一度だけ）
+func (h *TwoFactorHandler) Confirm(c *gin.Context) {
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := h.twoFactorService.ConfirmEnrollment(c.GetString("userID"), req.Code)
+	if err != nil {
+		respondTwoFactorError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, models.RecoveryCodes{RecoveryCodes: codes})
+}
+
+// RegenerateRecoveryCodes はリカバリーコードを作り直す。以前のコードは使えなくなる
+func (h *TwoFactorHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := h.twoFactorService.RegenerateRecoveryCodes(c.GetString("userID"), req.Code)
+	if err != nil {
+		respondTwoFactorError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, models.RecoveryCodes{RecoveryCodes: codes})
+}
+
+// Disable はパスワードとコード（TOTPまたはリカバリーコード）を確認して2段階認証を無効にする
+func (h *TwoFactorHandler) Disable(c *gin.Context) {
+	var req models.DisableTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.twoFactorService.Disable(c.GetString("userID"), req.Password, req.Code); err != nil {
+		respondTwoFactorError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// respondTwoFactorError maps two-factor errors to status codes
+func respondTwoFactorError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrInvalidTwoFactorCode), errors.Is(err, services.ErrIncorrectPassword):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrTwoFactorRequiredByServer):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "code": "two_factor_required"})
+	case errors.Is(err, services.ErrTwoFactorAlreadyEnabled):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrTwoFactorNotEnabled), errors.Is(err, services.ErrTwoFactorNotEnrolled):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
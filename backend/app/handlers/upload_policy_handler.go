@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"errors"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"app/models"
+	"app/services"
+)
+
+// multipartOverhead leaves room for form fields and boundaries on top of the file size limit
+const multipartOverhead = 1 << 20
+
+// UploadPolicyHandler handles server upload policies and storage usage
+type UploadPolicyHandler struct {
+	uploadPolicyService *services.UploadPolicyService
+	serverService       *services.ServerService
+}
+
+// NewUploadPolicyHandler creates a new upload policy handler
+func NewUploadPolicyHandler(uploadPolicyService *services.UploadPolicyService, serverService *services.ServerService) *UploadPolicyHandler {
+	return &UploadPolicyHandler{
+		uploadPolicyService: uploadPolicyService,
+		serverService:       serverService,
+	}
+}
+
+// GetUploadPolicy はサーバーのアップロードポリシーを返す（メンバーのみ）
+func (h *UploadPolicyHandler) GetUploadPolicy(c *gin.Context) {
+	serverID := c.Param("id")
+	isMember, err := h.serverService.IsServerMember(serverID, c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !isMember {
+		c.JSON(http.StatusForbidden, gin.H{"error": "サーバーのメンバーではありません"})
+		return
+	}
+
+	policy, err := h.uploadPolicyService.GetPolicy(serverID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"policy": policy})
+}
+
+// UpdateUploadPolicy はサーバーのアップロードポリシーを更新する（サーバー管理者のみ）
+func (h *UploadPolicyHandler) UpdateUploadPolicy(c *gin.Context) {
+	serverID := c.Param("id")
+	userID := c.GetString("userID")
+
+	var req models.UploadPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hasPermission, err := h.serverService.HasChannelManagementPermission(serverID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "権限の確認に失敗しました"})
+		return
+	}
+	if !hasPermission {
+		c.JSON(http.StatusForbidden, gin.H{"error": "アップロードポリシーを変更する権限がありません"})
+		return
+	}
+
+	policy, err := h.uploadPolicyService.UpdatePolicy(serverID, userID, req)
+	if errors.Is(err, services.ErrInvalidUploadPolicy) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"policy": policy})
+}
+
+// GetServerStorageUsage はサーバーのストレージ使用量を返す（モデレーターのみ）
+func (h *UploadPolicyHandler) GetServerStorageUsage(c *gin.Context) {
+	serverID := c.Param("id")
+	isModerator, err := h.serverService.IsServerModerator(serverID, c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !isModerator {
+		c.JSON(http.StatusForbidden, gin.H{"error": "ストレージ使用量を確認する権限がありません"})
+		return
+	}
+
+	usage, err := h.uploadPolicyService.GetServerUsage(serverID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"usage": usage})
+}
+
+// GetMyStorageUsage は自分のアップロードが使っているストレージ量を返す
+func (h *UploadPolicyHandler) GetMyStorageUsage(c *gin.Context) {
+	usage, err := h.uploadPolicyService.GetUserUsage(c.GetString("userID"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"usage": usage})
+}
+
+// uploadedFile reads the "file" form field, rejecting request bodies over
+// the site-wide size limit before they are buffered. It writes the error
+// response and returns false on failure.
+func uploadedFile(c *gin.Context, uploads *services.UploadPolicyService) (*multipart.FileHeader, bool) {
+	maxFileSize := uploads.Limits().MaxFileSize
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxFileSize+multipartOverhead)
+
+	file, err := c.FormFile("file")
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondUploadError(c, services.FileTooLargeError(maxFileSize))
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
+		return nil, false
+	}
+	return file, true
+}
+
+// respondUploadError writes a structured response for upload rejections.
+// It returns false if err is not an upload rejection.
+func respondUploadError(c *gin.Context, err error) bool {
+	var uploadErr *services.UploadError
+	if !errors.As(err, &uploadErr) {
+		return false
+	}
+	c.JSON(uploadErr.StatusCode(), gin.H{
+		"error":   uploadErr.Message,
+		"code":    uploadErr.Code,
+		"details": uploadErr.Details,
+	})
+	return true
+}
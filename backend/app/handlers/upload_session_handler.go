@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"app/models"
+	"app/services"
+)
+
+// UploadSessionHandler handles resumable uploads.
+//
+//	POST   /api/uploads              start an upload ({channelId or messageId, fileName, fileSize})
+//	PATCH  /api/uploads/:id          send the next chunk; the Upload-Offset header gives its position
+//	HEAD   /api/uploads/:id          Upload-Offset / Upload-Length headers, to resume after a failure
+//	GET    /api/uploads/:id          the same as JSON
+//	POST   /api/uploads/:id/complete create the attachment
+//	DELETE /api/uploads/:id          abort
+type UploadSessionHandler struct {
+	uploadSessionService *services.UploadSessionService
+	serverService        *services.ServerService
+}
+
+// NewUploadSessionHandler creates a new upload session handler
+func NewUploadSessionHandler(uploadSessionService *services.UploadSessionService, serverService *services.ServerService) *UploadSessionHandler {
+	return &UploadSessionHandler{
+		uploadSessionService: uploadSessionService,
+		serverService:        serverService,
+	}
+}
+
+// CreateUploadSession はレジューム可能なアップロードを開始する
+func (h *UploadSessionHandler) CreateUploadSession(c *gin.Context) {
+	var req models.UploadSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID := c.GetString("userID")
+
+	// メッセージを指定しない場合は、チャンネルに投稿前のファイルとしてアップロードする
+	if req.MessageId == "" {
+		if req.ChannelId == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "channelId or messageId is required"})
+			return
+		}
+		hasAccess, err := h.serverService.HasChannelAccess(req.ChannelId, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !hasAccess {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this channel"})
+			return
+		}
+	}
+
+	session, err := h.uploadSessionService.CreateSession(userID, req)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.Header("Location", "/api/uploads/"+session.ID)
+	setUploadHeaders(c, session)
+	c.JSON(http.StatusCreated, gin.H{"upload": session})
+}
+
+// GetUploadSession はアップロードの進捗を返す。HEADでも呼び出せる
+func (h *UploadSessionHandler) GetUploadSession(c *gin.Context) {
+	id, ok := uploadSessionID(c)
+	if !ok {
+		return
+	}
+
+	session, err := h.uploadSessionService.GetSession(id, c.GetString("userID"))
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	setUploadHeaders(c, session)
+	c.JSON(http.StatusOK, gin.H{"upload": session})
+}
+
+// UploadChunk はリクエストボディをUpload-Offsetの位置に書き込む
+func (h *UploadSessionHandler) UploadChunk(c *gin.Context) {
+	id, ok := uploadSessionID(c)
+	if !ok {
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Offset header is required"})
+		return
+	}
+	if c.Request.ContentLength > services.MaxUploadChunkSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error":        "Chunk is too large",
+			"maxChunkSize": services.MaxUploadChunkSize,
+		})
+		return
+	}
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, services.MaxUploadChunkSize)
+
+	session, err := h.uploadSessionService.WriteChunk(id, c.GetString("userID"), offset, body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error":        "Chunk is too large",
+			"maxChunkSize": services.MaxUploadChunkSize,
+		})
+		return
+	}
+	if session != nil {
+		setUploadHeaders(c, session)
+	}
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"upload": session})
+}
+
+// CompleteUploadSession は受信済みのチャンクから添付ファイルを作成する
+func (h *UploadSessionHandler) CompleteUploadSession(c *gin.Context) {
+	id, ok := uploadSessionID(c)
+	if !ok {
+		return
+	}
+
+	session, err := h.uploadSessionService.Complete(id, c.GetString("userID"))
+	if session != nil {
+		setUploadHeaders(c, session)
+	}
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"attachmentId": session.AttachmentId,
+		"upload":       session,
+	})
+}
+
+// AbortUploadSession はアップロードを中止し、受信済みのチャンクを削除する
+func (h *UploadSessionHandler) AbortUploadSession(c *gin.Context) {
+	id, ok := uploadSessionID(c)
+	if !ok {
+		return
+	}
+
+	if err := h.uploadSessionService.Abort(id, c.GetString("userID")); err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Upload aborted"})
+}
+
+func uploadSessionID(c *gin.Context) (string, bool) {
+	id := c.Param("id")
+	if _, err := uuid.Parse(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": services.ErrUploadSessionNotFound.Error()})
+		return "", false
+	}
+	return id, true
+}
+
+// setUploadHeaders reports the upload's progress in headers, so clients can
+// resume with a HEAD request without parsing a body
+func setUploadHeaders(c *gin.Context, session *models.UploadSession) {
+	c.Header("Upload-Offset", strconv.FormatInt(session.ReceivedBytes, 10))
+	c.Header("Upload-Length", strconv.FormatInt(session.FileSize, 10))
+	c.Header("Cache-Control", "no-store")
+}
+
+// respondError maps upload session errors to HTTP responses
+func (h *UploadSessionHandler) respondError(c *gin.Context, err error) {
+	if respondUploadError(c, err) {
+		return
+	}
+	switch {
+	case errors.Is(err, services.ErrUploadSessionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrNotUploadMessageAuthor):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUploadOffsetMismatch),
+		errors.Is(err, services.ErrUploadIncomplete),
+		errors.Is(err, services.ErrUploadSessionBusy),
+		errors.Is(err, services.ErrUploadSessionClosed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUploadChunkTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUploadTargetGone):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrTooManyUploadSessions):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
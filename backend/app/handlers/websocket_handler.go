@@ -67,11 +67,12 @@ func (h *WebSocketHandler) HandleWebSocket(c *gin.Context) {
 	}
 
 	// トークンを検証
-	userID, err := h.userService.ValidateToken(token)
+	claims, err := h.userService.ValidateAccessToken(token)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "無効な認証トークンです"})
 		return
 	}
+	userID := claims.UserID
 
 	// チャンネルの存在確認とアクセス権限の確認
 	hasAccess, err := h.serverService.UserHasChannelAccess(userID, channelID)
@@ -96,6 +97,7 @@ func (h *WebSocketHandler) HandleWebSocket(c *gin.Context) {
 		ID:        h.wsService.GenerateClientID(),
 		Conn:      conn,
 		UserID:    userID,
+		SessionID: claims.SessionID,
 		ChannelID: channelID,
 		Send:      make(chan []byte, 256),
 	}
@@ -0,0 +1,77 @@
+// Package mail sends transactional email such as password reset links.
+//
+// Mail goes through the Mailer interface. SMTPMailer delivers to an SMTP
+// server (a local catcher such as MailHog works for testing) and LogMailer,
+// the default, only writes messages to the log for development.
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidHeader is returned for addresses or subjects containing line breaks
+var ErrInvalidHeader = errors.New("mail: header value contains a line break")
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+}
+
+// Mailer sends email
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// DefaultFrom is the sender address when MAIL_FROM is not set
+const DefaultFrom = "no-reply@localhost"
+
+// FromEnv creates the Mailer selected by MAIL_BACKEND: "log" (the default)
+// or "smtp", configured by SMTP_HOST, SMTP_PORT, SMTP_USERNAME,
+// SMTP_PASSWORD, SMTP_TLS (starttls, tls or none) and MAIL_FROM
+func FromEnv() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = DefaultFrom
+	}
+
+	backend := strings.ToLower(os.Getenv("MAIL_BACKEND"))
+	switch backend {
+	case "", "log":
+		return NewLogMailer(from), nil
+	case "smtp":
+		config := SMTPConfig{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     587,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			TLS:      strings.ToLower(os.Getenv("SMTP_TLS")),
+			From:     from,
+		}
+		if value := os.Getenv("SMTP_PORT"); value != "" {
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SMTP_PORT %q", value)
+			}
+			config.Port = port
+		}
+		return NewSMTPMailer(config)
+	default:
+		return nil, fmt.Errorf("unknown MAIL_BACKEND %q", backend)
+	}
+}
+
+func checkHeader(values ...string) error {
+	for _, value := range values {
+		if strings.ContainsAny(value, "\r\n") {
+			return ErrInvalidHeader
+		}
+	}
+	return nil
+}
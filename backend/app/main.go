@@ -5,11 +5,15 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"app/db"
 	"app/handlers"
+	"app/mail"
+	"app/oidc"
 	"app/services"
+	"app/storage"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -33,16 +37,80 @@ func authMiddleware(userService *services.UserService) gin.HandlerFunc {
 			tokenString = authHeader[7:]
 		}
 
+		// Personal access tokens only reach the routes their scopes allow
+		if services.IsPersonalAccessToken(tokenString) {
+			token, err := userService.ValidatePersonalAccessToken(tokenString, c.ClientIP())
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+				c.Abort()
+				return
+			}
+			scope, ok := tokenRouteScopes[c.Request.Method+" "+c.FullPath()]
+			if !ok {
+				c.JSON(http.StatusForbidden, gin.H{"error": "This endpoint can't be used with a personal access token"})
+				c.Abort()
+				return
+			}
+			if !token.HasScope(scope) {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error": fmt.Sprintf("This token is missing the %s scope", scope),
+					"code":  "insufficient_scope",
+					"scope": scope,
+				})
+				c.Abort()
+				return
+			}
+			c.Set("userID", token.UserID)
+			c.Set("tokenID", token.TokenID)
+			c.Set("tokenScopes", token.Scopes)
+			c.Next()
+			return
+		}
+
 		// Validate the token
-		userID, err := userService.ValidateToken(tokenString)
+		claims, err := userService.ValidateAccessToken(tokenString)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
 		}
 
-		// Set the user ID in the context
-		c.Set("userID", userID)
+		// Set the user and session IDs in the context
+		c.Set("userID", claims.UserID)
+		c.Set("sessionID", claims.SessionID)
+		c.Next()
+	}
+}
+
+// adminMiddleware allows only site administrators. It must run after authMiddleware.
+func adminMiddleware(userService *services.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		isAdmin, err := userService.IsAdmin(c.GetString("userID"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		}
+		if !isAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Administrator access required"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// passwordLoginMiddleware rejects password-based endpoints when password login is disabled
+func passwordLoginMiddleware(enabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !enabled {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "Password login is disabled; sign in with your identity provider",
+				"code":  "password_login_disabled",
+			})
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
@@ -54,6 +122,11 @@ func main() {
 	log.SetOutput(os.Stdout)
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
+	// サブコマンドが指定された場合は管理用CLIとして実行する
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:]))
+	}
+
 	// OpenAIクライアントの初期化
 	apiKey := os.Getenv("OPENAI_API_KEY")
 	if apiKey == "" {
@@ -78,21 +151,175 @@ func main() {
 	chatService := services.NewChatService(db, openaiClient)
 	chatHandler := handlers.NewChatHandler(chatService)
 
+	// ログインセッション（ACCESS_TOKEN_TTL, REFRESH_TOKEN_TTL）
+	accessTokenTTL, err := time.ParseDuration(os.Getenv("ACCESS_TOKEN_TTL"))
+	if err != nil {
+		accessTokenTTL = services.DefaultAccessTokenTTL
+	}
+	refreshTokenTTL, err := time.ParseDuration(os.Getenv("REFRESH_TOKEN_TTL"))
+	if err != nil {
+		refreshTokenTTL = services.DefaultRefreshTokenTTL
+	}
+	// アクセストークンの署名鍵（JWT_SIGNING_ALGORITHM=EdDSA|RS256, SIGNING_KEY_SECRET）
+	keyManager, err := services.KeyManagerFromEnv(db)
+	if err != nil {
+		panic(fmt.Sprintf("署名鍵の設定が不正です: %s", err))
+	}
+	if err := keyManager.Load(); err != nil {
+		panic(fmt.Sprintf("署名鍵の読み込みに失敗しました: %s", err))
+	}
+	jwksHandler := handlers.NewJWKSHandler(keyManager)
+	sessionService := services.NewSessionService(db, keyManager, accessTokenTTL, refreshTokenTTL)
+
+	// メール送信（MAIL_BACKEND=log|smtp）とメール内のリンク先（APP_BASE_URL）
+	mailer, err := mail.FromEnv()
+	if err != nil {
+		panic(fmt.Sprintf("メール送信の設定が不正です: %s", err))
+	}
+	appBaseURL := os.Getenv("APP_BASE_URL")
+	if appBaseURL == "" {
+		appBaseURL = "http://localhost:5173"
+	}
+	accountService := services.NewAccountService(db, mailer, sessionService, appBaseURL)
+
 	// ユーザー認証サービスとハンドラーの初期化
-	userService := services.NewUserService(db)
-	authHandler := handlers.NewAuthHandler(userService)
+	userService := services.NewUserService(db, sessionService)
+	authHandler := handlers.NewAuthHandler(userService, sessionService, accountService)
+
+	// ログイン・登録の試行回数制限とアカウントロック
+	loginThrottleService := services.NewLoginThrottleService(db, mailer, appBaseURL)
+	accountDeletionService := services.NewAccountDeletionService(db, mailer, appBaseURL)
+	accountDeletionHandler := handlers.NewAccountDeletionHandler(accountDeletionService)
+	userService.SetLoginThrottleService(loginThrottleService)
+	accountService.SetLoginThrottleService(loginThrottleService)
+	loginThrottleHandler := handlers.NewLoginThrottleHandler(loginThrottleService)
+
+	// 2段階認証（TOTP_SECRET_KEY, TOTP_ISSUER）
+	twoFactorService, err := services.TwoFactorServiceFromEnv(db)
+	if err != nil {
+		panic(fmt.Sprintf("2段階認証の設定が不正です: %s", err))
+	}
+	userService.SetTwoFactorService(twoFactorService)
+	accountDeletionService.SetTwoFactorService(twoFactorService)
+	twoFactorHandler := handlers.NewTwoFactorHandler(twoFactorService)
+
+	// スクリプト用のパーソナルアクセストークン
+	personalAccessTokenService := services.NewPersonalAccessTokenService(db)
+	userService.SetPersonalAccessTokenService(personalAccessTokenService)
+	personalAccessTokenHandler := handlers.NewPersonalAccessTokenHandler(personalAccessTokenService)
+
+	// 外部IDプロバイダーでのサインイン（OIDC_PROVIDERS, OIDC_<ID>_*）と
+	// パスワードログインの無効化（PASSWORD_LOGIN_ENABLED=false）
+	oidcConfigs, err := oidc.FromEnv(appBaseURL + "/oidc/callback")
+	if err != nil {
+		panic(fmt.Sprintf("OIDCの設定が不正です: %s", err))
+	}
+	passwordLoginEnabled := true
+	if value := os.Getenv("PASSWORD_LOGIN_ENABLED"); value != "" {
+		passwordLoginEnabled, err = strconv.ParseBool(value)
+		if err != nil {
+			panic(fmt.Sprintf("PASSWORD_LOGIN_ENABLED が不正です: %s", value))
+		}
+	}
+	if !passwordLoginEnabled && len(oidcConfigs) == 0 {
+		panic("パスワードログインを無効にする場合は OIDC_PROVIDERS を設定してください")
+	}
+	oidcService := services.NewOIDCService(db, oidcConfigs)
+	oidcHandler := handlers.NewOIDCHandler(oidcService, userService, passwordLoginEnabled)
+	passwordLogin := passwordLoginMiddleware(passwordLoginEnabled)
 
 	// サービスとハンドラーの初期化
 	serverService := services.NewServerService(db)
 	serverHandler := handlers.NewServerHandler(serverService)
 
+	// 添付ファイルの保存先（STORAGE_BACKEND=local|s3）
+	files, err := storage.FromEnv()
+	if err != nil {
+		panic(fmt.Sprintf("ストレージの初期化に失敗しました: %s", err))
+	}
+
+	// アップロード制限（UPLOAD_MAX_FILE_SIZE, UPLOAD_SERVER_QUOTA, UPLOAD_USER_QUOTA）
+	uploadLimits, err := services.UploadLimitsFromEnv()
+	if err != nil {
+		panic(fmt.Sprintf("アップロード制限の設定が不正です: %s", err))
+	}
+	uploadPolicyService := services.NewUploadPolicyService(db, uploadLimits)
+	uploadPolicyHandler := handlers.NewUploadPolicyHandler(uploadPolicyService, serverService)
+
 	// チャンネルメッセージサービスとハンドラーの初期化
-	channelMessageService := services.NewChannelMessageService(db)
+	channelMessageService := services.NewChannelMessageService(db, files, uploadPolicyService)
 	channelMessageHandler := handlers.NewChannelMessageHandler(channelMessageService, serverService)
 
-	// 従来のメッセージサービスとハンドラー（後方互換性のため）
-	messageService := services.NewMessageService(db)
-	messageHandler := handlers.NewMessageHandler(messageService, serverService)
+	// 画像添付ファイルのバックグラウンド処理
+	attachmentProcessingService := services.NewAttachmentProcessingService(db, files, channelMessageService)
+	channelMessageService.SetAttachmentProcessor(attachmentProcessingService)
+
+	// レジューム可能なアップロード
+	uploadSessionService := services.NewUploadSessionService(db, channelMessageService)
+	uploadSessionHandler := handlers.NewUploadSessionHandler(uploadSessionService, serverService)
+	attachmentCleanupService := services.NewAttachmentCleanupService(db, files)
+
+	// プロフィール（アバターは添付ファイルとして処理する）
+	profileService := services.NewProfileService(db, channelMessageService)
+	profileHandler := handlers.NewProfileHandler(profileService, uploadPolicyService)
+
+	// 添付ファイルの署名付きURL（未設定の場合はJWT_SECRETから導出した鍵を使う）
+	attachmentURLSecret := os.Getenv("ATTACHMENT_URL_SECRET")
+	if attachmentURLSecret == "" {
+		attachmentURLSecret = "attachment-url:" + jwtSecret
+	}
+	attachmentURLTTL, err := time.ParseDuration(os.Getenv("ATTACHMENT_URL_TTL"))
+	if err != nil {
+		attachmentURLTTL = services.DefaultAttachmentURLTTL
+	}
+	attachmentURLSigner := services.NewAttachmentURLSigner(attachmentURLSecret, attachmentURLTTL)
+	channelMessageService.SetAttachmentURLSigner(attachmentURLSigner)
+	attachmentHandler := handlers.NewAttachmentHandler(channelMessageService, serverService, userService, attachmentURLSigner)
+
+	// 投票サービスとハンドラーの初期化
+	pollService := services.NewPollService(db)
+	pollHandler := handlers.NewPollHandler(pollService, serverService)
+
+	// ダイレクトメッセージサービスとハンドラーの初期化
+	directMessageService := services.NewDirectMessageService(db)
+	directMessageHandler := handlers.NewDirectMessageHandler(directMessageService)
+
+	// 予約メッセージサービスとハンドラーの初期化
+	scheduledMessageService := services.NewScheduledMessageService(db, channelMessageService, serverService, directMessageService)
+	scheduledMessageHandler := handlers.NewScheduledMessageHandler(scheduledMessageService, serverService)
+
+	// エクスポートサービスとハンドラーの初期化
+	exportService := services.NewExportService(db, channelMessageService, serverService)
+	exportService.SetProfileService(profileService)
+	exportHandler := handlers.NewExportHandler(exportService)
+
+	// インポートサービスとハンドラーの初期化
+	importService := services.NewImportService(db, files)
+	importHandler := handlers.NewImportHandler(importService)
+
+	// スラッシュコマンドサービスとハンドラーの初期化
+	commandService := services.NewCommandService(db, channelMessageService, serverService, chatService, pollService, scheduledMessageService)
+	// ボットのコールバックは本番ではhttpsかつ公開アドレスのみ（ローカルでのボット開発時のみ許可）
+	if value := os.Getenv("BOT_CALLBACK_ALLOW_INSECURE"); value != "" {
+		allow, err := strconv.ParseBool(value)
+		if err != nil {
+			panic(fmt.Sprintf("BOT_CALLBACK_ALLOW_INSECURE が不正です: %s", value))
+		}
+		commandService.SetInsecureBotCallbacks(allow)
+	}
+	commandHandler := handlers.NewCommandHandler(commandService, serverService)
+	channelMessageHandler.SetCommandService(commandService)
+
+	// 従来のメッセージAPI用の互換ハンドラー（ChannelMessageServiceに変換する）
+	messageHandler := handlers.NewMessageHandler(channelMessageService, serverService)
+	legacyRouteMode := os.Getenv("LEGACY_MESSAGE_ROUTES")
+	if legacyRouteMode == "" {
+		legacyRouteMode = handlers.LegacyRoutesEnabled
+	}
+	legacySunset := os.Getenv("LEGACY_MESSAGE_ROUTES_SUNSET")
+	legacy := func(successor string) gin.HandlerFunc {
+		return handlers.LegacyRoute(legacyRouteMode, legacySunset, successor)
+	}
 
 	// WebSocketサービスとハンドラーの初期化
 	wsService := services.NewWebSocketService()
@@ -106,7 +333,7 @@ func main() {
 	// CORSの設定
 	engine.Use(cors.New(cors.Config{
 		AllowOrigins: []string{"http://localhost:3000", "http://localhost:5173", "http://frontend:5173"},
-		AllowMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowHeaders: []string{
 			"Origin",
 			"Content-Type",
@@ -114,31 +341,61 @@ func main() {
 			"Accept-Encoding",
 			"X-CSRF-Token",
 			"Authorization",
+			"Upload-Offset",
 		},
+		// レジューム可能なアップロードの進捗をブラウザから読めるようにする
+		ExposeHeaders:    []string{"Location", "Upload-Offset", "Upload-Length"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
 
-	// 静的ファイルの提供
-	engine.Static("/uploads", "./uploads")
-
 	// ルーティングの設定
 	api := engine.Group("/api")
 	{
 		// 認証関連のエンドポイント
 		auth := api.Group("/auth")
 		{
-			auth.POST("/register", authHandler.Register)
-			auth.POST("/login", authHandler.Login)
-			auth.GET("/me", authMiddleware(userService), authHandler.GetCurrentUser)
+			auth.POST("/register", passwordLogin, authHandler.Register)
+			auth.POST("/login", passwordLogin, authHandler.Login)
+			auth.POST("/login/2fa", authHandler.LoginTwoFactor)
+			auth.POST("/refresh", authHandler.Refresh)
+			auth.POST("/password-reset", passwordLogin, authHandler.RequestPasswordReset)
+			auth.POST("/password-reset/confirm", passwordLogin, authHandler.ResetPassword)
+			auth.POST("/verify-email", authHandler.VerifyEmail)
+			auth.POST("/verify-email/resend", authHandler.ResendEmailVerification)
+			auth.PUT("/password", passwordLogin, authMiddleware(userService), authHandler.ChangePassword)
+			auth.GET("/methods", oidcHandler.GetAuthMethods)
+			auth.POST("/oidc/:provider/authorize", oidcHandler.Authorize)
+			auth.POST("/oidc/callback", oidcHandler.Callback)
+			auth.GET("/me", authMiddleware(userService), profileHandler.GetCurrentUser)
+			auth.POST("/logout", authMiddleware(userService), authHandler.Logout)
+			auth.GET("/sessions", authMiddleware(userService), authHandler.GetSessions)
+			auth.DELETE("/sessions", authMiddleware(userService), authHandler.RevokeOtherSessions)
+			auth.DELETE("/sessions/:id", authMiddleware(userService), authHandler.RevokeSession)
+			auth.GET("/2fa", authMiddleware(userService), twoFactorHandler.GetStatus)
+			auth.POST("/2fa/enroll", authMiddleware(userService), twoFactorHandler.Enroll)
+			auth.POST("/2fa/confirm", authMiddleware(userService), twoFactorHandler.Confirm)
+			auth.POST("/2fa/recovery-codes", authMiddleware(userService), twoFactorHandler.RegenerateRecoveryCodes)
+			auth.DELETE("/2fa", authMiddleware(userService), twoFactorHandler.Disable)
+			auth.GET("/tokens", authMiddleware(userService), personalAccessTokenHandler.GetTokens)
+			auth.POST("/tokens", authMiddleware(userService), personalAccessTokenHandler.CreateToken)
+			auth.DELETE("/tokens/:id", authMiddleware(userService), personalAccessTokenHandler.RevokeToken)
 		}
 
 		// ユーザー関連のエンドポイント
 		users := api.Group("/users", authMiddleware(userService))
 		{
-			users.GET("/me", authHandler.GetCurrentUser) // /api/auth/meと同じ機能
-			users.GET("/:id", authHandler.GetUserById)   // 特定のユーザー情報を取得
-			users.GET("", authHandler.SearchUsers)       // ユーザー検索API
+			users.GET("/me", profileHandler.GetCurrentUser)      // /api/auth/meと同じ機能
+			users.PATCH("/me", profileHandler.UpdateProfile)     // プロフィールの更新
+			users.PUT("/me/avatar", profileHandler.UploadAvatar) // アバターの設定
+			users.DELETE("/me/avatar", profileHandler.DeleteAvatar)
+			users.GET("/:id", profileHandler.GetUserProfile) // 特定のユーザーのプロフィールを取得
+			users.GET("", profileHandler.SearchUsers)        // ユーザー検索API
+			users.GET("/me/storage", uploadPolicyHandler.GetMyStorageUsage)
+			users.GET("/me/export", exportHandler.ExportAccount) // 個人データのエクスポート
+			users.GET("/me/deletion", accountDeletionHandler.GetDeletion)
+			users.POST("/me/deletion", accountDeletionHandler.ScheduleDeletion) // 猶予期間後にアカウントを削除
+			users.DELETE("/me/deletion", accountDeletionHandler.CancelDeletion)
 		}
 
 		// チャット関連のエンドポイント
@@ -167,21 +424,42 @@ func main() {
 			servers.POST("/:id/categories", serverHandler.CreateCategory)
 			servers.POST("/:id/join", serverHandler.JoinServer)
 			servers.GET("/:id/categories", serverHandler.GetServerCategories)
+			servers.PUT("/:id/revision-policy", serverHandler.UpdateRevisionPolicy)
+			servers.PUT("/:id/two-factor-requirement", serverHandler.UpdateTwoFactorRequirement)
+			servers.POST("/:id/transfer", serverHandler.TransferOwnership)
+			servers.DELETE("/:id", serverHandler.DeleteServer)
+			servers.GET("/:id/upload-policy", uploadPolicyHandler.GetUploadPolicy)
+			servers.PUT("/:id/upload-policy", uploadPolicyHandler.UpdateUploadPolicy)
+			servers.GET("/:id/storage", uploadPolicyHandler.GetServerStorageUsage)
+			servers.GET("/:id/commands", commandHandler.GetBotCommands)
+			servers.POST("/:id/commands", commandHandler.RegisterBotCommand)
+			servers.DELETE("/:id/commands/:name", commandHandler.DeleteBotCommand)
+			servers.POST("/:id/exports", exportHandler.ExportServer)
 		}
 
-		// チャンネル関連のエンドポイント（従来のハンドラー - 後方互換性のため）
+		// チャンネル関連のエンドポイント
 		channels := api.Group("/channels", authMiddleware(userService))
 		{
 			channels.GET("/:id", serverHandler.GetChannel)
-			channels.GET("/:id/messages", messageHandler.GetChannelMessages)
-			channels.POST("/:id/messages", messageHandler.SendChannelMessage)
-			channels.PUT("/messages/:id", messageHandler.EditMessage)
-			channels.DELETE("/messages/:id", messageHandler.DeleteMessage)
-			channels.POST("/:id/upload", messageHandler.UploadFile)
-			channels.GET("/attachments/:id", messageHandler.GetAttachment)
+			// 非推奨: /api/channel-messages に移行済み（LEGACY_MESSAGE_ROUTES=gone で410を返す）
+			channels.GET("/:id/messages", legacy("/api/channel-messages/:id"), messageHandler.GetChannelMessages)
+			channels.POST("/:id/messages", legacy("/api/channel-messages/:id"), messageHandler.SendChannelMessage)
+			channels.PUT("/messages/:id", legacy("/api/channel-messages/:id"), messageHandler.EditMessage)
+			channels.DELETE("/messages/:id", legacy("/api/channel-messages/:id"), messageHandler.DeleteMessage)
+			channels.POST("/:id/upload", legacy("/api/channel-messages/attachments"), messageHandler.UploadFile)
+			channels.GET("/attachments/:id", legacy("/api/channel-messages/attachments/:id"), messageHandler.GetAttachment)
 			channels.POST("/:id/members", serverHandler.AddChannelMember)
 			channels.POST("/:id/category", serverHandler.UpdateChannelCategory)
 			channels.DELETE("/:id", serverHandler.DeleteChannel)
+			channels.PUT("/:id/topic", channelMessageHandler.UpdateChannelTopic)
+			channels.GET("/:id/pins", channelMessageHandler.GetPinnedMessages)
+			channels.GET("/:id/commands", commandHandler.GetChannelCommands)
+			channels.POST("/:id/attachments", channelMessageHandler.UploadChannelAttachment)
+			channels.POST("/:id/polls", pollHandler.CreatePoll)
+			channels.POST("/:id/scheduled-messages", scheduledMessageHandler.ScheduleMessage)
+			channels.POST("/:id/exports", exportHandler.ExportChannel)
+			channels.POST("/:id/pins/:messageId", channelMessageHandler.PinMessage)
+			channels.DELETE("/:id/pins/:messageId", channelMessageHandler.UnpinMessage)
 		}
 
 		// 新しいチャンネルメッセージエンドポイント
@@ -191,17 +469,144 @@ func main() {
 			channelMessages.POST("/:id", channelMessageHandler.CreateChannelMessage)
 			channelMessages.PUT("/:id", channelMessageHandler.EditChannelMessage)
 			channelMessages.DELETE("/:id", channelMessageHandler.DeleteChannelMessage)
+			channelMessages.GET("/:id/revisions", channelMessageHandler.GetMessageRevisions)
 			channelMessages.POST("/attachments", channelMessageHandler.UploadChannelAttachment)
 			channelMessages.GET("/attachments/:id", channelMessageHandler.GetChannelAttachment)
 		}
+
+		// レジューム可能なアップロード
+		uploads := api.Group("/uploads")
+		uploads.Use(authMiddleware(userService))
+		{
+			uploads.POST("", uploadSessionHandler.CreateUploadSession)
+			uploads.GET("/:id", uploadSessionHandler.GetUploadSession)
+			uploads.HEAD("/:id", uploadSessionHandler.GetUploadSession)
+			uploads.PATCH("/:id", uploadSessionHandler.UploadChunk)
+			uploads.POST("/:id/complete", uploadSessionHandler.CompleteUploadSession)
+			uploads.DELETE("/:id", uploadSessionHandler.AbortUploadSession)
+		}
+
+		// 添付ファイルのダウンロード（署名付きURLまたはAuthorizationヘッダーで認可する）
+		attachments := api.Group("/attachments")
+		{
+			attachments.GET("/:id", attachmentHandler.DownloadAttachment)
+			attachments.GET("/:id/:name", attachmentHandler.DownloadAttachment)
+			attachments.POST("/:id/url", authMiddleware(userService), attachmentHandler.GetAttachmentURL)
+		}
+
+		// 予約メッセージ関連のエンドポイント
+		scheduledMessages := api.Group("/scheduled-messages", authMiddleware(userService))
+		{
+			scheduledMessages.GET("", scheduledMessageHandler.GetScheduledMessages)
+			scheduledMessages.PUT("/:id", scheduledMessageHandler.UpdateScheduledMessage)
+			scheduledMessages.DELETE("/:id", scheduledMessageHandler.CancelScheduledMessage)
+		}
+
+		// エクスポート関連のエンドポイント
+		exports := api.Group("/exports", authMiddleware(userService))
+		{
+			exports.GET("", exportHandler.GetExports)
+			exports.GET("/:id", exportHandler.GetExport)
+			exports.GET("/:id/download", exportHandler.DownloadExport)
+		}
+
+		// 管理者用のエンドポイント
+		admin := api.Group("/admin", authMiddleware(userService), adminMiddleware(userService))
+		{
+			admin.POST("/imports", importHandler.Import)
+			admin.POST("/users/:id/unlock", loginThrottleHandler.UnlockAccount)
+		}
+
+		// 投票関連のエンドポイント
+		polls := api.Group("/polls", authMiddleware(userService))
+		{
+			polls.GET("/:id", pollHandler.GetPoll)
+			polls.POST("/:id/votes", pollHandler.Vote)
+			polls.DELETE("/:id/votes", pollHandler.Unvote)
+			polls.POST("/:id/close", pollHandler.ClosePoll)
+		}
+
+		// ダイレクトメッセージ関連のエンドポイント
+		// メッセージ・添付ファイル・編集・削除は /api/channel-messages/:id でも利用できる
+		dms := api.Group("/dms", authMiddleware(userService))
+		{
+			dms.GET("", directMessageHandler.GetConversations)
+			dms.POST("", directMessageHandler.OpenConversation)
+			dms.GET("/:id", directMessageHandler.GetConversation)
+			dms.POST("/:id/close", directMessageHandler.CloseConversation)
+			dms.POST("/:id/reopen", directMessageHandler.ReopenConversation)
+			dms.GET("/:id/messages", channelMessageHandler.GetChannelMessages)
+			dms.POST("/:id/messages", channelMessageHandler.CreateChannelMessage)
+			dms.POST("/:id/attachments", channelMessageHandler.UploadChannelAttachment)
+			dms.POST("/:id/scheduled-messages", scheduledMessageHandler.ScheduleMessage)
+		}
 	}
 
+	// アクセストークンの検証用公開鍵
+	engine.GET("/.well-known/jwks.json", jwksHandler.GetJWKS)
+
 	// WebSocketエンドポイント
 	engine.GET("/ws/channels/:channelId", wsHandler.HandleWebSocket)
 
 	// メッセージの更新・削除時にWebSocketでブロードキャストするためのフックを設定
 	messageHandler.SetWebSocketService(wsService)
 	channelMessageHandler.SetWebSocketService(wsService)
+	commandService.SetWebSocketService(wsService)
+	pollService.SetWebSocketService(wsService)
+	pollHandler.SetWebSocketService(wsService)
+
+	// セッションを失効させたときにそのWebSocket接続を切断する
+	sessionService.SetWebSocketService(wsService)
+
+	// 締め切り時刻を過ぎた投票を自動で締め切る
+	pollService.StartAutoClose(30 * time.Second)
+
+	// アップロードされた画像のサムネイル生成とメタデータ除去を行うワーカーを起動
+	attachmentProcessingService.SetWebSocketService(wsService)
+	attachmentProcessingService.Start(5 * time.Second)
+
+	// プロフィールの変更を同じサーバーのメンバーに配信
+	profileService.SetWebSocketService(wsService)
+
+	// 予約メッセージとリマインダーを配信するスケジューラーを起動
+	scheduledMessageService.SetWebSocketService(wsService)
+	scheduledMessageService.Start(15 * time.Second)
+
+	// 中断されたエクスポートを再開し、期限切れのアーカイブを定期的に削除
+	if err := exportService.ResumeInterruptedExports(); err != nil {
+		log.Printf("エクスポート再開エラー: %v", err)
+	}
+	exportService.StartCleanup(time.Hour)
+
+	// 期限切れの未完了アップロードとそのチャンクを定期的に削除
+	uploadSessionService.StartCleanup(15 * time.Minute)
+
+	// メッセージに添付されなかったファイルや削除されたメッセージの添付ファイルを定期的に削除
+	attachmentCleanupService.StartCleanup(10 * time.Minute)
+
+	// 他のレプリカでローテーションされた署名鍵を取り込む
+	keyManager.Start(time.Minute)
+
+	// 期限切れのリフレッシュトークンと古いセッションを定期的に削除
+	sessionService.StartCleanup(time.Hour)
+
+	// 期限切れのパスワード再設定・メールアドレス確認用トークンを定期的に削除
+	accountService.StartCleanup(time.Hour)
+
+	// 期限切れのログインチャレンジと未完了の2段階認証登録を定期的に削除
+	twoFactorService.StartCleanup(15 * time.Minute)
+
+	// 完了しなかったIDプロバイダーでのサインインを定期的に削除
+	oidcService.StartCleanup(15 * time.Minute)
+
+	// 期限切れのログイン試行記録を定期的に削除
+	loginThrottleService.StartCleanup(time.Hour)
+
+	// 有効期限が切れたカスタムステータスを定期的に消去
+	profileService.StartStatusExpiry(time.Minute)
+
+	// 猶予期間が過ぎたアカウントを定期的に削除
+	accountDeletionService.Start(time.Hour)
 
 	// サーバーの設定と起動
 	server := &http.Server{
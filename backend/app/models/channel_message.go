@@ -4,18 +4,27 @@ import (
 	"time"
 )
 
+// Message types stored in channel_messages.message_type
+const (
+	MessageTypeUser   = "user"
+	MessageTypeSystem = "system"
+)
+
 // ChannelMessage represents a message in a server channel
 type ChannelMessage struct {
 	ID          string    `json:"id"`
 	ChannelId   string    `json:"channelId"`
 	UserId      string    `json:"userId"`
+	Type        string    `json:"type"` // "user", "system", "bot" or "poll"
 	Content     string    `json:"content"`
 	Timestamp   time.Time `json:"timestamp"`
 	IsEdited    bool      `json:"isEdited"`
 	IsDeleted   bool      `json:"isDeleted"`
 	EditedAt    time.Time `json:"editedAt,omitempty"`
 	Attachments []string  `json:"attachments,omitempty"`
-	// Attachments will be loaded separately
+	// AttachmentDetails describes the same attachments, in the same order
+	AttachmentDetails []AttachmentInfo `json:"attachmentDetails,omitempty"`
+	Poll              *Poll            `json:"poll,omitempty"`
 }
 
 // ChannelMessageWithUser includes user information with the message
@@ -24,23 +33,68 @@ type ChannelMessageWithUser struct {
 	ChannelId   string    `json:"channelId"`
 	UserId      string    `json:"userId"`
 	Username    string    `json:"username"`
+	DisplayName string    `json:"displayName,omitempty"`
+	AvatarURL   string    `json:"avatarUrl,omitempty"`
+	Type        string    `json:"type"`
 	Content     string    `json:"content"`
 	Timestamp   time.Time `json:"timestamp"`
 	IsEdited    bool      `json:"isEdited"`
 	IsDeleted   bool      `json:"isDeleted"`
 	EditedAt    time.Time `json:"editedAt,omitempty"`
 	Attachments []string  `json:"attachments,omitempty"`
+	// AttachmentDetails describes the same attachments, in the same order
+	AttachmentDetails []AttachmentInfo `json:"attachmentDetails,omitempty"`
+	Poll              *Poll            `json:"poll,omitempty"`
 }
 
 // ChannelAttachment represents a file attachment for a channel message
 type ChannelAttachment struct {
-	ID         string    `json:"id"`
-	MessageId  string    `json:"messageId"`
-	FileName   string    `json:"fileName"`
-	FileType   string    `json:"fileType"` // "image", "video", "document", etc.
-	FilePath   string    `json:"filePath"`
-	FileSize   int64     `json:"fileSize"`
-	UploadedAt time.Time `json:"uploadedAt"`
+	ID          string    `json:"id"`
+	ChannelId   string    `json:"channelId,omitempty"`
+	MessageId   string    `json:"messageId"` // empty until a message claims the attachment
+	FileName    string    `json:"fileName"`
+	FileType    string    `json:"fileType"` // "image", "video", "document", etc.
+	ContentType string    `json:"contentType,omitempty"`
+	FilePath    string    `json:"filePath"`
+	FileSize    int64     `json:"fileSize"`
+	UploadedBy  string    `json:"uploadedBy,omitempty"`
+	UploadedAt  time.Time `json:"uploadedAt"`
+	// Filled in by background processing for images
+	Width            int    `json:"width,omitempty"`
+	Height           int    `json:"height,omitempty"`
+	Blurhash         string `json:"blurhash,omitempty"`
+	ProcessingStatus string `json:"processingStatus,omitempty"`
+}
+
+// Attachment processing statuses. Files that are not processed have no status.
+const (
+	AttachmentProcessingPending    = "pending"
+	AttachmentProcessingProcessing = "processing"
+	AttachmentProcessingDone       = "done"
+	AttachmentProcessingFailed     = "failed"
+)
+
+// AttachmentInfo describes an attachment in message payloads
+type AttachmentInfo struct {
+	ID               string                `json:"id"`
+	FileName         string                `json:"fileName"`
+	FileType         string                `json:"fileType"`
+	ContentType      string                `json:"contentType,omitempty"`
+	FileSize         int64                 `json:"fileSize"`
+	URL              string                `json:"url"`
+	Width            int                   `json:"width,omitempty"`
+	Height           int                   `json:"height,omitempty"`
+	Blurhash         string                `json:"blurhash,omitempty"`
+	Thumbnails       []AttachmentThumbnail `json:"thumbnails,omitempty"`
+	ProcessingStatus string                `json:"processingStatus,omitempty"`
+}
+
+// AttachmentThumbnail is a downscaled copy of an image attachment
+type AttachmentThumbnail struct {
+	Size   int    `json:"size"` // longest edge requested, in pixels
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
 }
 
 // ChannelMessageRequest represents a request to create or edit a channel message
@@ -53,3 +107,20 @@ type ChannelMessageRequest struct {
 type EditChannelMessageRequest struct {
 	Content string `json:"content" binding:"required"`
 }
+
+// ChannelMessageRevision represents a previous version of an edited channel message
+type ChannelMessageRevision struct {
+	ID           string    `json:"id"`
+	MessageId    string    `json:"messageId"`
+	Content      string    `json:"content"` // Content before the edit was applied
+	EditedBy     string    `json:"editedBy"`
+	EditedByName string    `json:"editedByName"`
+	EditedAt     time.Time `json:"editedAt"`
+}
+
+// PinnedMessage represents a message pinned to a channel
+type PinnedMessage struct {
+	ChannelMessageWithUser
+	PinnedBy string    `json:"pinnedBy"`
+	PinnedAt time.Time `json:"pinnedAt"`
+}
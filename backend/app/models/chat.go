@@ -36,8 +36,8 @@ type ChatSummary struct {
 	FirstMessage  string    `json:"firstMessage"`
 }
 
-// Legacy Message type for backward compatibility during migration
-// This can be removed after migration is complete
+// Message is the legacy message format returned by the deprecated
+// /api/channels/... routes. Remove it together with handlers.MessageHandler.
 type Message struct {
 	ID          string    `json:"id"`
 	Content     string    `json:"content"`
@@ -52,17 +52,6 @@ type Message struct {
 	EditedAt    time.Time `json:"editedAt,omitempty"`
 }
 
-// Attachment represents a file attachment
-type Attachment struct {
-	ID         string    `json:"id"`
-	MessageId  string    `json:"messageId"`
-	FileName   string    `json:"fileName"`
-	FileType   string    `json:"fileType"` // "image", "video", "document", etc.
-	FilePath   string    `json:"filePath"`
-	FileSize   int64     `json:"fileSize"`
-	UploadedAt time.Time `json:"uploadedAt"`
-}
-
 // MessageRequest represents a request to create or edit a message
 type MessageRequest struct {
 	Content     string   `json:"content"`
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"time"
+)
+
+// MessageTypeBot marks messages posted by a command handler on behalf of a bot or assistant
+const MessageTypeBot = "bot"
+
+// CommandArgument describes one argument of a slash command for autocomplete
+type CommandArgument struct {
+	Name        string   `json:"name" binding:"required,max=32"`
+	Description string   `json:"description" binding:"max=100"`
+	Type        string   `json:"type" binding:"omitempty,oneof=string number user channel duration"`
+	Required    bool     `json:"required"`
+	Choices     []string `json:"choices,omitempty"`
+}
+
+// CommandDefinition describes a slash command available in a channel
+type CommandDefinition struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Usage       string            `json:"usage,omitempty"`
+	Arguments   []CommandArgument `json:"arguments"`
+	Source      string            `json:"source"` // "builtin" or "bot"
+	BotUserId   string            `json:"botUserId,omitempty"`
+}
+
+// BotCommand represents a slash command registered by a bot for a server.
+// BotUserId is the account created for the command that its replies are posted as.
+type BotCommand struct {
+	ID          string            `json:"id"`
+	ServerId    string            `json:"serverId"`
+	BotUserId   string            `json:"botUserId"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Arguments   []CommandArgument `json:"arguments"`
+	CallbackURL string            `json:"callbackUrl"`
+	CreatedBy   string            `json:"createdBy"`
+	CreatedAt   time.Time         `json:"createdAt"`
+}
+
+// BotCommandRequest represents the request to register a bot command
+type BotCommandRequest struct {
+	Name        string            `json:"name" binding:"required,min=1,max=32"`
+	Description string            `json:"description" binding:"max=100"`
+	Arguments   []CommandArgument `json:"arguments" binding:"dive"`
+	CallbackURL string            `json:"callbackUrl" binding:"required,url"`
+}
+
+// EphemeralMessage is a command reply delivered only to the user who ran the command
+type EphemeralMessage struct {
+	ID        string    `json:"id"`
+	ChannelId string    `json:"channelId"`
+	Command   string    `json:"command"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
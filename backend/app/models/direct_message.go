@@ -0,0 +1,36 @@
+package models
+
+import (
+	"time"
+)
+
+// Conversation kinds stored in channels.kind
+const (
+	ChannelKindServer  = "server"
+	ChannelKindDM      = "dm"
+	ChannelKindGroupDM = "group_dm"
+)
+
+// DirectConversation represents a one-to-one or group conversation outside of servers
+type DirectConversation struct {
+	ID            string              `json:"id"`
+	Kind          string              `json:"kind"` // "dm" or "group_dm"
+	Name          string              `json:"name"`
+	CreatedBy     string              `json:"createdBy"`
+	Participants  []DirectParticipant `json:"participants"`
+	CreatedAt     time.Time           `json:"createdAt"`
+	LastMessageAt *time.Time          `json:"lastMessageAt,omitempty"`
+}
+
+// DirectParticipant represents a user taking part in a direct conversation
+type DirectParticipant struct {
+	UserId   string `json:"userId"`
+	Username string `json:"username"`
+}
+
+// DirectConversationRequest represents the request to open a direct conversation
+type DirectConversationRequest struct {
+	// UserIds lists the other participants; the caller is always included
+	UserIds []string `json:"userIds" binding:"required,min=1"`
+	Name    string   `json:"name" binding:"max=50"`
+}
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"time"
+)
+
+// Export scopes
+const (
+	ExportScopeChannel = "channel"
+	ExportScopeServer  = "server"
+	// ExportScopeAccount is a personal data export of the requester's own account
+	ExportScopeAccount = "account"
+)
+
+// Export job statuses
+const (
+	ExportStatusQueued    = "queued"
+	ExportStatusRunning   = "running"
+	ExportStatusCompleted = "completed"
+	ExportStatusFailed    = "failed"
+	ExportStatusExpired   = "expired"
+)
+
+// ExportJob tracks a background export of channel history
+type ExportJob struct {
+	ID                string     `json:"id"`
+	RequestedBy       string     `json:"requestedBy"`
+	Scope             string     `json:"scope"` // "channel", "server" or "account"
+	ServerId          string     `json:"serverId,omitempty"`
+	ChannelId         string     `json:"channelId,omitempty"`
+	Status            string     `json:"status"`   // "queued", "running", "completed", "failed" or "expired"
+	Progress          int        `json:"progress"` // percentage of channels processed
+	TotalChannels     int        `json:"totalChannels"`
+	ProcessedChannels int        `json:"processedChannels"`
+	ProcessedMessages int        `json:"processedMessages"`
+	FileSize          int64      `json:"fileSize,omitempty"`
+	Error             string     `json:"error,omitempty"`
+	DownloadURL       string     `json:"downloadUrl,omitempty"`
+	CreatedAt         time.Time  `json:"createdAt"`
+	StartedAt         *time.Time `json:"startedAt,omitempty"`
+	CompletedAt       *time.Time `json:"completedAt,omitempty"`
+	ExpiresAt         *time.Time `json:"expiresAt,omitempty"`
+
+	FilePath string `json:"-"`
+}
+
+// ExportManifest is written as manifest.json at the root of an export archive
+type ExportManifest struct {
+	ExportId    string                `json:"exportId"`
+	Scope       string                `json:"scope"`
+	ServerId    string                `json:"serverId,omitempty"`
+	ServerName  string                `json:"serverName,omitempty"`
+	ExportedBy  string                `json:"exportedBy"`
+	ExportedAt  time.Time             `json:"exportedAt"`
+	Channels    []ExportedChannelInfo `json:"channels"`
+	FormatNotes string                `json:"formatNotes"`
+}
+
+// ExportedChannelInfo describes one channel in an export manifest
+type ExportedChannelInfo struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Directory    string `json:"directory"`
+	MessageCount int    `json:"messageCount"`
+}
+
+// ExportedChannel is the content of a channel's messages.json in an export archive
+type ExportedChannel struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Topic       string            `json:"topic"`
+	Kind        string            `json:"kind"`
+	Messages    []ExportedMessage `json:"messages"`
+}
+
+// ExportedMessage is a message with its attachment metadata in an export archive
+type ExportedMessage struct {
+	ID          string               `json:"id"`
+	UserId      string               `json:"userId"`
+	Username    string               `json:"username"`
+	Type        string               `json:"type"`
+	Content     string               `json:"content"`
+	Timestamp   time.Time            `json:"timestamp"`
+	IsEdited    bool                 `json:"isEdited"`
+	EditedAt    *time.Time           `json:"editedAt,omitempty"`
+	Attachments []ExportedAttachment `json:"attachments"`
+	Poll        *Poll                `json:"poll,omitempty"`
+}
+
+// ExportedAttachment is attachment metadata plus its path inside the archive
+type ExportedAttachment struct {
+	ID          string    `json:"id"`
+	FileName    string    `json:"fileName"`
+	FileType    string    `json:"fileType"`
+	FileSize    int64     `json:"fileSize"`
+	UploadedAt  time.Time `json:"uploadedAt"`
+	ArchivePath string    `json:"archivePath,omitempty"` // empty when the file was missing on disk
+}
+
+// ExportedMemberships is the content of memberships.json in an account export
+type ExportedMemberships struct {
+	Servers  []ExportedServerMembership  `json:"servers"`
+	Channels []ExportedChannelMembership `json:"channels"`
+}
+
+// ExportedServerMembership is a server the user is a member of
+type ExportedServerMembership struct {
+	ServerId   string    `json:"serverId"`
+	ServerName string    `json:"serverName"`
+	Role       string    `json:"role"`
+	JoinedAt   time.Time `json:"joinedAt"`
+}
+
+// ExportedChannelMembership is a private channel or direct conversation the
+// user was added to
+type ExportedChannelMembership struct {
+	ChannelId string    `json:"channelId"`
+	Name      string    `json:"name,omitempty"`
+	Kind      string    `json:"kind"`
+	ServerId  string    `json:"serverId,omitempty"`
+	AddedAt   time.Time `json:"addedAt"`
+}
+
+// ExportedChat is one AI chat with its messages in an account export
+type ExportedChat struct {
+	ID        string           `json:"id"`
+	Title     string           `json:"title"`
+	CreatedAt time.Time        `json:"createdAt"`
+	Messages  []ChatbotMessage `json:"messages"`
+}
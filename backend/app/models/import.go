@@ -0,0 +1,36 @@
+package models
+
+// Supported import formats
+const (
+	ImportFormatSlack   = "slack"
+	ImportFormatDiscord = "discord"
+)
+
+// ImportOptions controls how an export archive is imported
+type ImportOptions struct {
+	Format     string // "slack" or "discord"
+	ServerId   string // import into this existing server, or
+	ServerName string // create a new server with this name
+	OwnerId    string // owner of a newly created server
+	DryRun     bool   // parse and map everything, then roll back
+}
+
+// ImportReport summarizes what an import did, or would do in a dry run
+type ImportReport struct {
+	Format   string `json:"format"`
+	DryRun   bool   `json:"dryRun"`
+	ServerId string `json:"serverId,omitempty"`
+
+	UsersMatched      int `json:"usersMatched"`
+	UsersPlaceholder  int `json:"usersPlaceholder"`
+	ChannelsCreated   int `json:"channelsCreated"`
+	ChannelsExisting  int `json:"channelsExisting"`
+	MessagesImported  int `json:"messagesImported"`
+	MessagesSkipped   int `json:"messagesSkipped"` // already imported by an earlier run
+	ThreadReplies     int `json:"threadReplies"`
+	Reactions         int `json:"reactions"`
+	AttachmentsStored int `json:"attachmentsStored"`
+	AttachmentsMissed int `json:"attachmentsMissing"` // referenced but not included in the archive
+
+	Warnings []string `json:"warnings"`
+}
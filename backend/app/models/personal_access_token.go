@@ -0,0 +1,54 @@
+package models
+
+import (
+	"time"
+)
+
+// Scopes a personal access token can be granted
+const (
+	ScopeMessagesRead  = "messages:read"
+	ScopeMessagesWrite = "messages:write"
+	ScopeChannelsRead  = "channels:read"
+	ScopeChannelsWrite = "channels:write"
+	ScopeChatsRead     = "chats:read"
+	ScopeChatsWrite    = "chats:write"
+	ScopeUsersRead     = "users:read"
+)
+
+// TokenScopes lists every scope, in the order they are shown to users
+var TokenScopes = []string{
+	ScopeMessagesRead,
+	ScopeMessagesWrite,
+	ScopeChannelsRead,
+	ScopeChannelsWrite,
+	ScopeChatsRead,
+	ScopeChatsWrite,
+	ScopeUsersRead,
+}
+
+// PersonalAccessToken describes a token without its secret
+type PersonalAccessToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	TokenHint  string     `json:"tokenHint"` // the first characters of the token
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	LastUsedIP string     `json:"lastUsedIp,omitempty"`
+}
+
+// CreatedPersonalAccessToken is returned once, when a token is created;
+// the token itself can't be retrieved again
+type CreatedPersonalAccessToken struct {
+	PersonalAccessToken
+	Token string `json:"token"`
+}
+
+// CreatePersonalAccessTokenRequest creates a personal access token
+type CreatePersonalAccessTokenRequest struct {
+	Name   string   `json:"name" binding:"required,max=100"`
+	Scopes []string `json:"scopes" binding:"required,min=1"`
+	// ExpiresInDays defaults to 30
+	ExpiresInDays int `json:"expiresInDays" binding:"min=0,max=366"`
+}
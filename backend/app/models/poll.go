@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+)
+
+// MessageTypePoll marks a channel message that carries a poll
+const MessageTypePoll = "poll"
+
+// Poll represents a vote attached to a channel message
+type Poll struct {
+	ID            string       `json:"id"`
+	MessageId     string       `json:"messageId"`
+	ChannelId     string       `json:"channelId"`
+	Question      string       `json:"question"`
+	AllowMultiple bool         `json:"allowMultiple"`
+	IsAnonymous   bool         `json:"isAnonymous"`
+	ClosesAt      *time.Time   `json:"closesAt,omitempty"`
+	ClosedAt      *time.Time   `json:"closedAt,omitempty"`
+	IsClosed      bool         `json:"isClosed"`
+	CreatedBy     string       `json:"createdBy"`
+	CreatedAt     time.Time    `json:"createdAt"`
+	Options       []PollOption `json:"options"`
+	TotalVotes    int          `json:"totalVotes"`
+	VoterCount    int          `json:"voterCount"`
+}
+
+// PollOption is one choice of a poll with its current tally
+type PollOption struct {
+	ID        string `json:"id"`
+	Text      string `json:"text"`
+	Position  int    `json:"position"`
+	VoteCount int    `json:"voteCount"`
+	// Voters lists user IDs; omitted for anonymous polls
+	Voters []string `json:"voters,omitempty"`
+}
+
+// PollRequest represents the request to create a poll
+type PollRequest struct {
+	Question      string     `json:"question" binding:"required,max=300"`
+	Options       []string   `json:"options" binding:"required,min=2,max=10,dive,required,max=100"`
+	AllowMultiple bool       `json:"allowMultiple"`
+	IsAnonymous   bool       `json:"isAnonymous"`
+	ClosesAt      *time.Time `json:"closesAt"`
+}
+
+// PollVoteRequest represents the request to vote in a poll
+type PollVoteRequest struct {
+	OptionIds []string `json:"optionIds" binding:"required,min=1"`
+}
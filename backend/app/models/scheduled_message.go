@@ -0,0 +1,49 @@
+package models
+
+import (
+	"time"
+)
+
+// Kinds of scheduled messages
+const (
+	ScheduledKindMessage  = "message"
+	ScheduledKindReminder = "reminder"
+)
+
+// Statuses of scheduled messages
+const (
+	ScheduledStatusPending   = "pending"
+	ScheduledStatusSending   = "sending"
+	ScheduledStatusSent      = "sent"
+	ScheduledStatusCancelled = "cancelled"
+	ScheduledStatusFailed    = "failed"
+)
+
+// ScheduledMessage is a channel message or personal reminder to be posted later
+type ScheduledMessage struct {
+	ID        string     `json:"id"`
+	ChannelId string     `json:"channelId"`
+	UserId    string     `json:"userId"`
+	Kind      string     `json:"kind"` // "message" or "reminder"
+	Content   string     `json:"content"`
+	SendAt    time.Time  `json:"sendAt"`
+	Status    string     `json:"status"` // "pending", "sending", "sent", "cancelled" or "failed"
+	MessageId string     `json:"messageId"`
+	Attempts  int        `json:"attempts"`
+	LastError string     `json:"lastError,omitempty"`
+	SentAt    *time.Time `json:"sentAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+}
+
+// ScheduledMessageRequest is the body for scheduling a channel message
+type ScheduledMessageRequest struct {
+	Content string    `json:"content" binding:"required"`
+	SendAt  time.Time `json:"sendAt" binding:"required"`
+}
+
+// ScheduledMessageUpdateRequest is the body for editing a pending scheduled message
+type ScheduledMessageUpdateRequest struct {
+	Content *string    `json:"content" binding:"omitempty,min=1"`
+	SendAt  *time.Time `json:"sendAt"`
+}
@@ -32,6 +32,8 @@ type Channel struct {
 	Name        string    `json:"name"`
 	Description string    `json:"description"`
 	IsPrivate   bool      `json:"isPrivate"`
+	Kind        string    `json:"kind"` // "server", "dm" or "group_dm"
+	Topic       string    `json:"topic"`
 	CreatedAt   time.Time `json:"createdAt"`
 	UpdatedAt   time.Time `json:"updatedAt"`
 }
@@ -76,6 +78,8 @@ type ServerResponse struct {
 	OwnerId     string    `json:"ownerId"`
 	CreatedAt   time.Time `json:"createdAt"`
 	MemberCount int       `json:"memberCount"`
+	// RequireTwoFactor suspends owner and admin privileges of members without 2FA
+	RequireTwoFactor bool `json:"requireTwoFactor"`
 }
 
 // ChannelResponse represents the channel data returned to clients
@@ -102,3 +106,24 @@ type CategoryResponse struct {
 	Position  int       `json:"position"`
 	CreatedAt time.Time `json:"createdAt"`
 }
+
+// RevisionPolicyRequest represents the request to update how long message revisions are kept
+type RevisionPolicyRequest struct {
+	// RetentionDays is the number of days to keep revisions; 0 keeps them forever
+	RetentionDays int `json:"retentionDays" binding:"min=0,max=3650"`
+}
+
+// TransferServerOwnershipRequest names the member who becomes the server's owner
+type TransferServerOwnershipRequest struct {
+	UserId string `json:"userId" binding:"required,uuid"`
+}
+
+// TwoFactorRequirementRequest turns the server's two-factor requirement for owners and admins on or off
+type TwoFactorRequirementRequest struct {
+	Required bool `json:"required"`
+}
+
+// ChannelTopicRequest represents the request to change a channel's topic
+type ChannelTopicRequest struct {
+	Topic string `json:"topic" binding:"max=250"`
+}
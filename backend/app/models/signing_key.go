@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+)
+
+// Access token signing algorithms
+const (
+	SigningAlgorithmEdDSA = "EdDSA"
+	SigningAlgorithmRS256 = "RS256"
+)
+
+// SigningKey describes an access token signing key, without its private part
+type SigningKey struct {
+	Kid         string     `json:"kid"`
+	Algorithm   string     `json:"algorithm"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ActivatedAt time.Time  `json:"activatedAt"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	Signing     bool       `json:"signing"` // whether new tokens are signed with this key
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517, RFC 8037)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv,omitempty"` // OKP
+	X   string `json:"x,omitempty"`   // OKP
+	N   string `json:"n,omitempty"`   // RSA
+	E   string `json:"e,omitempty"`   // RSA
+}
+
+// JWKSet is the document served at /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
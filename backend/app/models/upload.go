@@ -0,0 +1,91 @@
+package models
+
+import (
+	"time"
+)
+
+// Upload rejection codes returned in the "code" field of error responses
+const (
+	UploadErrorFileTooLarge        = "file_too_large"
+	UploadErrorTypeNotAllowed      = "type_not_allowed"
+	UploadErrorContentMismatch     = "content_mismatch"
+	UploadErrorImageMetadata       = "image_metadata_unsupported"
+	UploadErrorServerQuotaExceeded = "server_quota_exceeded"
+	UploadErrorUserQuotaExceeded   = "user_quota_exceeded"
+)
+
+// UploadPolicy is the effective upload configuration of a server.
+// Limits are in bytes; a quota of 0 means unlimited.
+type UploadPolicy struct {
+	ServerId     string     `json:"serverId"`
+	MaxFileSize  int64      `json:"maxFileSize"`
+	StorageQuota int64      `json:"storageQuota"`
+	AllowedTypes []string   `json:"allowedTypes"` // MIME patterns such as "image/*"; empty allows every type
+	DeniedTypes  []string   `json:"deniedTypes"`
+	IsCustom     bool       `json:"isCustom"` // false when the site defaults apply
+	UpdatedAt    *time.Time `json:"updatedAt,omitempty"`
+}
+
+// UploadPolicyRequest updates a server's upload policy. Omitted limits use the site defaults.
+type UploadPolicyRequest struct {
+	MaxFileSize  *int64   `json:"maxFileSize" binding:"omitempty,min=1"`
+	StorageQuota *int64   `json:"storageQuota" binding:"omitempty,min=0"`
+	AllowedTypes []string `json:"allowedTypes" binding:"max=100,dive,min=1,max=255"`
+	DeniedTypes  []string `json:"deniedTypes" binding:"max=100,dive,min=1,max=255"`
+}
+
+// StorageUsage reports how much attachment storage is in use. QuotaBytes 0 means unlimited.
+type StorageUsage struct {
+	UsedBytes       int64 `json:"usedBytes"`
+	QuotaBytes      int64 `json:"quotaBytes"`
+	AttachmentCount int   `json:"attachmentCount"`
+}
+
+// UserStorageUsage is one member's share of a server's storage
+type UserStorageUsage struct {
+	UserId          string `json:"userId"`
+	Username        string `json:"username"`
+	UsedBytes       int64  `json:"usedBytes"`
+	AttachmentCount int    `json:"attachmentCount"`
+}
+
+// ServerStorageUsage reports a server's storage with its largest uploaders
+type ServerStorageUsage struct {
+	StorageUsage
+	TopUploaders []UserStorageUsage `json:"topUploaders"`
+}
+
+// Upload session statuses
+const (
+	UploadSessionActive     = "active"
+	UploadSessionCompleting = "completing"
+	UploadSessionCompleted  = "completed"
+)
+
+// UploadSession is a resumable upload. Chunks are sent in order at
+// ReceivedBytes until it reaches FileSize, then the session is completed
+// into an attachment.
+type UploadSession struct {
+	ID            string    `json:"id"`
+	UserId        string    `json:"userId"`
+	ChannelId     string    `json:"channelId"`
+	MessageId     string    `json:"messageId,omitempty"`
+	FileName      string    `json:"fileName"`
+	FileSize      int64     `json:"fileSize"`
+	ReceivedBytes int64     `json:"receivedBytes"`
+	Status        string    `json:"status"`
+	AttachmentId  string    `json:"attachmentId,omitempty"`
+	MaxChunkSize  int64     `json:"maxChunkSize"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// UploadSessionRequest starts a resumable upload. Without MessageId the file
+// is uploaded to ChannelId and attached when a message is posted with it.
+type UploadSessionRequest struct {
+	ChannelId string `json:"channelId" binding:"omitempty,uuid"`
+	MessageId string `json:"messageId" binding:"omitempty,uuid"`
+	FileName  string `json:"fileName" binding:"required,max=255"`
+	FileSize  int64  `json:"fileSize" binding:"required,min=1"`
+}
@@ -12,6 +12,79 @@ type User struct {
 	Password  string    `json:"-"` // Password is not included in JSON responses
 	CreatedAt time.Time `json:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt"`
+	// EmailVerified is false until the user follows the link in the verification email
+	EmailVerified bool `json:"-"`
+}
+
+// UserProfile is the public part of a user, as shown to other users
+type UserProfile struct {
+	ID          string      `json:"id"`
+	Username    string      `json:"username"`
+	DisplayName string      `json:"displayName,omitempty"`
+	AvatarURL   string      `json:"avatarUrl,omitempty"`
+	Bio         string      `json:"bio,omitempty"`
+	Pronouns    string      `json:"pronouns,omitempty"`
+	Timezone    string      `json:"timezone,omitempty"` // IANA name, e.g. "Asia/Tokyo"
+	Status      *UserStatus `json:"status,omitempty"`
+	CreatedAt   time.Time   `json:"createdAt"`
+}
+
+// UserStatus is a custom status such as "🌴 On vacation"
+type UserStatus struct {
+	Text      string     `json:"text,omitempty"`
+	Emoji     string     `json:"emoji,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// CurrentUser is the signed-in user's own profile, with their private details
+type CurrentUser struct {
+	UserProfile
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"emailVerified"`
+	// Discoverable users show up in user search
+	Discoverable bool `json:"discoverable"`
+	// EmailDiscoverable users can be found by their exact email address,
+	// which is then shown in search results
+	EmailDiscoverable bool `json:"emailDiscoverable"`
+}
+
+// UpdateProfileRequest changes profile fields. Fields left out are kept; an
+// empty string clears a field.
+type UpdateProfileRequest struct {
+	DisplayName *string `json:"displayName" binding:"omitempty,max=64"`
+	Bio         *string `json:"bio" binding:"omitempty,max=500"`
+	Pronouns    *string `json:"pronouns" binding:"omitempty,max=40"`
+	Timezone    *string `json:"timezone" binding:"omitempty,max=64"`
+	// Status replaces the custom status; one without text or emoji clears it
+	Status            *UserStatusRequest `json:"status"`
+	Discoverable      *bool              `json:"discoverable"`
+	EmailDiscoverable *bool              `json:"emailDiscoverable"`
+}
+
+// UserSearchResult is a user found by search. Email is only set for users
+// who opted in to being found by it.
+type UserSearchResult struct {
+	ID          string `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName,omitempty"`
+	AvatarURL   string `json:"avatarUrl,omitempty"`
+	Email       string `json:"email,omitempty"`
+	// SharesServer is set when the user is a member of one of the caller's servers
+	SharesServer bool `json:"sharesServer"`
+}
+
+// UserSearchPage is one page of user search results, best matches first
+type UserSearchPage struct {
+	Users []UserSearchResult `json:"users"`
+	// NextOffset is the offset of the next page, if there is one
+	NextOffset *int `json:"nextOffset,omitempty"`
+}
+
+// UserStatusRequest sets a custom status, optionally until ExpiresAt
+type UserStatusRequest struct {
+	Text      string     `json:"text" binding:"max=128"`
+	Emoji     string     `json:"emoji" binding:"max=64"`
+	ExpiresAt *time.Time `json:"expiresAt"`
 }
 
 // UserResponse is the data structure returned to clients after authentication
@@ -20,9 +93,183 @@ type UserResponse struct {
 	Username  string    `json:"username"`
 	Email     string    `json:"email"`
 	CreatedAt time.Time `json:"createdAt"`
-	Token     string    `json:"token"`
+	AuthTokens
+}
+
+// LoginResponse is returned by the password step of a login. Without
+// two-factor authentication it carries the user and tokens; otherwise only
+// a challenge token to complete the login with a code.
+type LoginResponse struct {
+	*UserResponse
+	TwoFactorRequired  bool       `json:"twoFactorRequired,omitempty"`
+	ChallengeToken     string     `json:"challengeToken,omitempty"`
+	ChallengeExpiresAt *time.Time `json:"challengeExpiresAt,omitempty"`
+}
+
+// RegisterResponse is returned by registration. No session is started
+// until the email address has been verified.
+type RegisterResponse struct {
+	ID                   string    `json:"id"`
+	Username             string    `json:"username"`
+	Email                string    `json:"email"`
+	CreatedAt            time.Time `json:"createdAt"`
+	VerificationRequired bool      `json:"verificationRequired"`
+}
+
+// AuthTokens are issued on login and on every refresh. Token is a short-lived
+// access token; RefreshToken can be exchanged once for a new pair.
+type AuthTokens struct {
+	Token        string    `json:"token"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	RefreshToken string    `json:"refreshToken"`
+	SessionId    string    `json:"sessionId"`
+}
+
+// RefreshRequest exchanges a refresh token for new tokens
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken" binding:"required"`
+}
+
+// SessionClient describes the device a session was created or refreshed from
+type SessionClient struct {
+	UserAgent string
+	IPAddress string
+}
+
+// Session is a login session as listed to its user
+type Session struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"` // e.g. "Chrome on Windows", derived from the user agent
+	UserAgent  string    `json:"userAgent"`
+	IPAddress  string    `json:"ipAddress"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"` // the session of the request's access token
+}
+
+// ChangePasswordRequest changes the current user's password
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword" binding:"required"`
+	NewPassword     string `json:"newPassword" binding:"required,min=6,max=72"`
+}
+
+// EmailRequest asks for a password reset or verification email
+type EmailRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// ResetPasswordRequest sets a new password with a token from a reset email
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"newPassword" binding:"required,min=6,max=72"`
 }
 
+// VerifyEmailRequest confirms an email address with a token from a verification email
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// TwoFactorLoginRequest completes a login with a TOTP code or a recovery code
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challengeToken" binding:"required"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recoveryCode"`
+}
+
+// TwoFactorCodeRequest carries a TOTP code, e.g. to confirm enrollment
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// DisableTwoFactorRequest turns two-factor authentication off. Code may be
+// a TOTP code or a recovery code.
+type DisableTwoFactorRequest struct {
+	Password string `json:"password"` // not needed by users without a password
+	Code     string `json:"code" binding:"required"`
+}
+
+// AccountDeletionRequest confirms a request to delete the signed-in account.
+// Users without a password give a TOTP or recovery code instead, or sign in
+// again shortly before.
+type AccountDeletionRequest struct {
+	Password string `json:"password"` // not needed by users without a password
+	Code     string `json:"code"`     // only used by users without a password
+}
+
+// AccountDeletion describes the state of a user's account deletion
+type AccountDeletion struct {
+	// ScheduledFor is when the account will be deleted, unless cancelled before
+	ScheduledFor *time.Time `json:"scheduledFor,omitempty"`
+	// OwnedServers must be transferred or deleted before the account can be
+	OwnedServers []OwnedServer `json:"ownedServers"`
+}
+
+// OwnedServer is a server owned by a user who wants to delete their account
+type OwnedServer struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// TwoFactorStatus describes a user's two-factor authentication
+type TwoFactorStatus struct {
+	Enabled                bool       `json:"enabled"`
+	EnabledAt              *time.Time `json:"enabledAt,omitempty"`
+	RecoveryCodesRemaining int        `json:"recoveryCodesRemaining"`
+}
+
+// TwoFactorEnrollment is returned when enrollment starts. The secret is
+// shown for manual entry; URI is for QR codes.
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// RecoveryCodes are shown to the user once, when they are generated
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// AuthProvider is an external identity provider users can sign in with
+type AuthProvider struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// AuthMethods tells the login page how users can sign in
+type AuthMethods struct {
+	PasswordLoginEnabled bool           `json:"passwordLoginEnabled"`
+	Providers            []AuthProvider `json:"providers"`
+}
+
+// OIDCAuthorization starts a sign-in with an identity provider. The client
+// keeps State to check that the callback belongs to the sign-in it started.
+type OIDCAuthorization struct {
+	AuthorizationURL string `json:"authorizationUrl"`
+	State            string `json:"state"`
+}
+
+// OIDCCallbackRequest completes a sign-in with the parameters the identity
+// provider added to the redirect URL
+type OIDCCallbackRequest struct {
+	State string `json:"state" binding:"required"`
+	Code  string `json:"code" binding:"required"`
+}
+
+// Purposes of account tokens sent by email
+const (
+	AccountTokenPasswordReset     = "password_reset"
+	AccountTokenEmailVerification = "email_verification"
+)
+
+// Reasons recorded when a session is revoked
+const (
+	SessionRevokedLogout   = "logout"
+	SessionRevokedByUser   = "revoked"
+	SessionRevokedReuse    = "refresh_token_reuse"
+	SessionRevokedPassword = "password_changed"
+)
+
 // LoginRequest represents the login request data structure
 type LoginRequest struct {
 	Email    string `json:"email" binding:"required,email"`
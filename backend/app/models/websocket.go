@@ -12,13 +12,14 @@ type WebSocketClient struct {
 	ID        string
 	Conn      *websocket.Conn
 	UserID    string
+	SessionID string // ログインセッション。セッションが失効すると切断される
 	ChannelID string
 	Send      chan []byte
 }
 
 // WebSocketMessage はWebSocketを通じて送受信されるメッセージの構造体
 type WebSocketMessage struct {
-	Type      string      `json:"type"`                // メッセージタイプ: "message", "message_update", "message_delete"
+	Type      string      `json:"type"`                // メッセージタイプ: "message", "message_update", "message_delete", "message_pin", "message_unpin", "channel_update", "profile_update", "ephemeral", "session_revoked"
 	Message   interface{} `json:"message,omitempty"`   // メッセージ本体（新規または更新）
 	MessageID string      `json:"messageId,omitempty"` // メッセージID（削除時に使用）
 	Timestamp time.Time   `json:"timestamp"`           // タイムスタンプ
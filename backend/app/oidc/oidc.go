@@ -0,0 +1,137 @@
+// Package oidc signs users in with external OpenID Connect identity
+// providers using the authorization code flow with PKCE.
+//
+// A Provider discovers its endpoints from the issuer's
+// /.well-known/openid-configuration on first use, builds authorization URLs,
+// exchanges codes for tokens and validates ID tokens against the issuer's
+// published keys. Storing state between the redirect and the callback is
+// left to the caller.
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultScopes are requested when a provider doesn't configure its own
+var DefaultScopes = []string{"openid", "email", "profile"}
+
+var providerIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// Config configures one identity provider
+type Config struct {
+	// ID identifies the provider in URLs and linked identities, e.g. "corp"
+	ID string
+	// Name is shown on the login button
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string // empty for public clients
+	// RedirectURL is where the provider sends the browser back with the code
+	RedirectURL string
+	Scopes      []string
+	// AllowSignup creates accounts for people who have none yet; otherwise
+	// only existing accounts can sign in
+	AllowSignup bool
+}
+
+// FromEnv reads the providers listed in OIDC_PROVIDERS (comma separated
+// ids). Each provider <ID> is configured by OIDC_<ID>_ISSUER,
+// OIDC_<ID>_CLIENT_ID, OIDC_<ID>_CLIENT_SECRET, OIDC_<ID>_NAME,
+// OIDC_<ID>_SCOPES (space separated), OIDC_<ID>_REDIRECT_URL (defaults to
+// defaultRedirectURL) and OIDC_<ID>_ALLOW_SIGNUP (true by default).
+func FromEnv(defaultRedirectURL string) ([]Config, error) {
+	var configs []Config
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		id = strings.ToLower(strings.TrimSpace(id))
+		if id == "" {
+			continue
+		}
+		if !providerIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("invalid OIDC provider id %q", id)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("OIDC provider %q is listed twice", id)
+		}
+		seen[id] = true
+
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(id, "-", "_")) + "_"
+		config := Config{
+			ID:           id,
+			Name:         os.Getenv(prefix + "NAME"),
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			Scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+			AllowSignup:  true,
+		}
+		if config.Name == "" {
+			config.Name = id
+		}
+		if config.RedirectURL == "" {
+			config.RedirectURL = defaultRedirectURL
+		}
+		if len(config.Scopes) == 0 {
+			config.Scopes = DefaultScopes
+		}
+		if value := os.Getenv(prefix + "ALLOW_SIGNUP"); value != "" {
+			allow, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %sALLOW_SIGNUP %q", prefix, value)
+			}
+			config.AllowSignup = allow
+		}
+		if err := config.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", prefix, err)
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+func (c Config) validate() error {
+	if c.Issuer == "" || c.ClientID == "" {
+		return errors.New("ISSUER and CLIENT_ID must be set")
+	}
+	issuer, err := url.Parse(c.Issuer)
+	if err != nil || issuer.Host == "" || (issuer.Scheme != "https" && issuer.Scheme != "http") {
+		return fmt.Errorf("invalid issuer %q", c.Issuer)
+	}
+	if _, err := url.Parse(c.RedirectURL); err != nil || c.RedirectURL == "" {
+		return fmt.Errorf("invalid redirect URL %q", c.RedirectURL)
+	}
+	hasOpenID := false
+	for _, scope := range c.Scopes {
+		hasOpenID = hasOpenID || scope == "openid"
+	}
+	if !hasOpenID {
+		return errors.New(`scopes must include "openid"`)
+	}
+	return nil
+}
+
+// RandomString returns a random URL-safe string for state, nonce and PKCE
+// code verifiers (43 characters, as RFC 7636 requires at least)
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge derives the S256 PKCE code challenge from a code verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,365 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"app/mail"
+	"app/models"
+)
+
+const (
+	// AccountDeletionGracePeriod is how long a requested deletion can still be cancelled
+	AccountDeletionGracePeriod = 14 * 24 * time.Hour
+	// DeletedUserID is the tombstone account that deleted users' messages are reassigned to
+	DeletedUserID = "00000000-0000-0000-0000-000000000000"
+	// deletionReauthWindow is how recently a user without a password must have
+	// signed in to delete their account without a two-factor code
+	deletionReauthWindow = 10 * time.Minute
+)
+
+var (
+	ErrAccountDeletionNotScheduled = errors.New("account deletion is not scheduled")
+	ErrReauthenticationRequired    = errors.New("sign in again or enter a two-factor authentication code to confirm it's you")
+)
+
+// OwnedServersError is returned when a user who still owns servers asks to
+// delete their account
+type OwnedServersError struct {
+	Servers []models.OwnedServer
+}
+
+func (e *OwnedServersError) Error() string {
+	return fmt.Sprintf("transfer or delete the %d server(s) you own before deleting your account", len(e.Servers))
+}
+
+// AccountDeletionService deletes accounts once the grace period after a
+// request passes. Deleting anonymizes what others still see: the user's
+// channel messages, edits, pins and polls are reassigned to the DeletedUserID
+// tombstone, while their AI chats, sessions, memberships, reactions, votes
+// and everything else tied to the account are removed with it.
+type AccountDeletionService struct {
+	db        *sql.DB
+	mailer    mail.Mailer
+	baseURL   string
+	twoFactor *TwoFactorService
+}
+
+// NewAccountDeletionService creates a new AccountDeletionService. baseURL is
+// the frontend URL that links in emails point to.
+func NewAccountDeletionService(db *sql.DB, mailer mail.Mailer, baseURL string) *AccountDeletionService {
+	return &AccountDeletionService{db: db, mailer: mailer, baseURL: baseURL}
+}
+
+// SetTwoFactorService sets the service that checks codes from users without a password
+func (s *AccountDeletionService) SetTwoFactorService(twoFactor *TwoFactorService) {
+	s.twoFactor = twoFactor
+}
+
+// GetDeletion returns when the user's account is scheduled to be deleted,
+// and the servers that stand in the way
+func (s *AccountDeletionService) GetDeletion(userID string) (*models.AccountDeletion, error) {
+	var scheduledFor sql.NullTime
+	err := s.db.QueryRow("SELECT deletion_scheduled_at FROM users WHERE id = $1", userID).Scan(&scheduledFor)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	owned, err := ownedServers(s.db, userID)
+	if err != nil {
+		return nil, err
+	}
+	deletion := &models.AccountDeletion{OwnedServers: owned}
+	if scheduledFor.Valid {
+		deletion.ScheduledFor = &scheduledFor.Time
+	}
+	return deletion, nil
+}
+
+// ScheduleDeletion schedules the user's account to be deleted after the
+// grace period, once their password is confirmed. Users without a password,
+// who sign in through an identity provider, confirm with a two-factor code
+// instead, or by having signed in to sessionID within deletionReauthWindow.
+// It fails with an OwnedServersError while they own servers. Asking again
+// keeps the date already scheduled.
+func (s *AccountDeletionService) ScheduleDeletion(userID, sessionID string, req models.AccountDeletionRequest) (*models.AccountDeletion, error) {
+	var username, email, hashedPassword string
+	err := s.db.QueryRow(
+		"SELECT username, email, password FROM users WHERE id = $1", userID,
+	).Scan(&username, &email, &hashedPassword)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hashedPassword != "" {
+		if bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(req.Password)) != nil {
+			return nil, ErrIncorrectPassword
+		}
+	} else if err := s.confirmWithoutPassword(userID, sessionID, req.Code); err != nil {
+		return nil, err
+	}
+
+	owned, err := ownedServers(s.db, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(owned) > 0 {
+		return nil, &OwnedServersError{Servers: owned}
+	}
+
+	var scheduledFor time.Time
+	if err := s.db.QueryRow(`
+		UPDATE users SET deletion_scheduled_at = COALESCE(deletion_scheduled_at, $1)
+		WHERE id = $2
+		RETURNING deletion_scheduled_at
+	`, time.Now().Add(AccountDeletionGracePeriod), userID).Scan(&scheduledFor); err != nil {
+		return nil, err
+	}
+
+	sendMail(s.mailer, mail.Message{
+		To:      email,
+		Subject: "アカウントの削除を受け付けました",
+		Text: fmt.Sprintf(`%s さん
+
+アカウントの削除を受け付けました。アカウントは %s に削除されます。
+それまでは、次のページから削除を取り消せます。
+
+%s
+
+削除されると、送信したメッセージは「Deleted user」の投稿として残り、
+AIチャットの履歴とその他のアカウント情報は完全に消去されます。
+必要なデータは、削除の前にエクスポートしてください。
+`, username, scheduledFor.Format("2006-01-02 15:04 MST"), s.baseURL+"/settings/account"),
+	})
+
+	return &models.AccountDeletion{ScheduledFor: &scheduledFor, OwnedServers: []models.OwnedServer{}}, nil
+}
+
+// confirmWithoutPassword checks a two-factor code, if one was given, or else
+// that the user signed in to the session recently
+func (s *AccountDeletionService) confirmWithoutPassword(userID, sessionID, code string) error {
+	if code != "" && s.twoFactor != nil {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := s.twoFactor.verifySecondFactor(tx, userID, code); err != nil {
+			if err == ErrTwoFactorNotEnrolled {
+				return ErrTwoFactorNotEnabled
+			}
+			return err
+		}
+		return tx.Commit()
+	}
+
+	var signedInAt time.Time
+	err := s.db.QueryRow(
+		"SELECT created_at FROM user_sessions WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		nullIfEmpty(sessionID), userID,
+	).Scan(&signedInAt)
+	if err == sql.ErrNoRows || (err == nil && time.Since(signedInAt) > deletionReauthWindow) {
+		return ErrReauthenticationRequired
+	}
+	return err
+}
+
+// CancelDeletion cancels a scheduled deletion of the user's account
+func (s *AccountDeletionService) CancelDeletion(userID string) error {
+	var username, email string
+	err := s.db.QueryRow(`
+		UPDATE users SET deletion_scheduled_at = NULL
+		WHERE id = $1 AND deletion_scheduled_at IS NOT NULL
+		RETURNING username, email
+	`, userID).Scan(&username, &email)
+	if err == sql.ErrNoRows {
+		return ErrAccountDeletionNotScheduled
+	}
+	if err != nil {
+		return err
+	}
+
+	sendMail(s.mailer, mail.Message{
+		To:      email,
+		Subject: "アカウントの削除を取り消しました",
+		Text: fmt.Sprintf(`%s さん
+
+アカウントの削除を取り消しました。アカウントはこれまでどおり利用できます。
+`, username),
+	})
+	return nil
+}
+
+// Start deletes the accounts whose grace period has passed every interval
+func (s *AccountDeletionService) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.deleteDueAccounts(); err != nil {
+				log.Printf("アカウント削除処理エラー: %v", err)
+			}
+		}
+	}()
+}
+
+func (s *AccountDeletionService) deleteDueAccounts() error {
+	rows, err := s.db.Query(
+		"SELECT id FROM users WHERE deletion_scheduled_at <= $1 ORDER BY deletion_scheduled_at", time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		if err := s.deleteAccount(userID); err != nil {
+			log.Printf("ユーザー %s のアカウント削除エラー: %v", userID, err)
+		}
+	}
+	return nil
+}
+
+// deleteAccount anonymizes and deletes an account whose deletion is due.
+// Accounts that came to own a server during the grace period are kept and
+// their deletion cancelled.
+func (s *AccountDeletionService) deleteAccount(userID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Another replica may be deleting the same account
+	var username, email string
+	var scheduledFor sql.NullTime
+	err = tx.QueryRow(
+		"SELECT username, email, deletion_scheduled_at FROM users WHERE id = $1 FOR UPDATE SKIP LOCKED", userID,
+	).Scan(&username, &email, &scheduledFor)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !scheduledFor.Valid || scheduledFor.Time.After(time.Now()) {
+		return nil
+	}
+
+	owned, err := ownedServers(tx, userID)
+	if err != nil {
+		return err
+	}
+	if len(owned) > 0 {
+		if _, err := tx.Exec("UPDATE users SET deletion_scheduled_at = NULL WHERE id = $1", userID); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		sendMail(s.mailer, mail.Message{
+			To:      email,
+			Subject: "アカウントを削除できませんでした",
+			Text: fmt.Sprintf(`%s さん
+
+所有しているサーバーがあるため、アカウントを削除できませんでした。
+サーバーの所有者を変更するか、サーバーを削除してから、もう一度削除をリクエストしてください。
+
+%s
+`, username, s.baseURL+"/settings/account"),
+		})
+		return nil
+	}
+
+	// Archives of the user's exports are queued for the attachment garbage
+	// collector, which deletes them from storage once the rows are gone
+	if _, err := tx.Exec(`
+		INSERT INTO attachment_file_deletions (file_path, created_at)
+		SELECT file_path, $2::timestamp FROM export_jobs WHERE requested_by = $1 AND file_path IS NOT NULL
+		ON CONFLICT (file_path) DO NOTHING
+	`, userID, time.Now()); err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		// What other members still see is kept, attributed to the tombstone
+		"UPDATE channel_messages SET user_id = $2 WHERE user_id = $1",
+		"UPDATE channel_message_revisions SET edited_by = $2 WHERE edited_by = $1",
+		"UPDATE channel_pins SET pinned_by = $2 WHERE pinned_by = $1",
+		"UPDATE polls SET created_by = $2 WHERE created_by = $1",
+		"UPDATE bot_commands SET created_by = $2 WHERE created_by = $1",
+	} {
+		if _, err := tx.Exec(query, userID, DeletedUserID); err != nil {
+			return err
+		}
+	}
+	// AI chats are private to the user and purged with their messages
+	if _, err := tx.Exec("DELETE FROM chats WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	// Sessions, tokens, memberships, reactions, votes, scheduled messages and
+	// exports go with the user. The avatar is no longer referenced, so the
+	// attachment garbage collector removes it.
+	if _, err := tx.Exec("DELETE FROM users WHERE id = $1", userID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	sendMail(s.mailer, mail.Message{
+		To:      email,
+		Subject: "アカウントを削除しました",
+		Text: fmt.Sprintf(`%s さん
+
+リクエストに従い、アカウントを削除しました。ご利用ありがとうございました。
+`, username),
+	})
+	log.Printf("ユーザー %s のアカウントを削除しました", userID)
+	return nil
+}
+
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// ownedServers lists the servers a user owns
+func ownedServers(db querier, userID string) ([]models.OwnedServer, error) {
+	rows, err := db.Query("SELECT id, name FROM servers WHERE owner_id = $1 ORDER BY created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	servers := []models.OwnedServer{}
+	for rows.Next() {
+		var server models.OwnedServer
+		if err := rows.Scan(&server.ID, &server.Name); err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	return servers, rows.Err()
+}
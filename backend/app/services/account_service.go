@@ -0,0 +1,346 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"app/mail"
+	"app/models"
+)
+
+const (
+	// PasswordResetTokenTTL is how long a password reset link works
+	PasswordResetTokenTTL = time.Hour
+	// EmailVerificationTokenTTL is how long an email verification link works
+	EmailVerificationTokenTTL = 48 * time.Hour
+	// accountEmailInterval is the minimum time between two emails of the same kind to a user
+	accountEmailInterval = time.Minute
+	// accountMailTimeout bounds sending one email
+	accountMailTimeout = 30 * time.Second
+)
+
+var (
+	ErrInvalidAccountToken = errors.New("this link is invalid or has expired")
+	ErrIncorrectPassword   = errors.New("current password is incorrect")
+	ErrEmailNotVerified    = errors.New("email address has not been verified")
+)
+
+// AccountService handles password changes, password resets and email
+// verification. Reset and verification links carry single-use tokens that
+// are stored hashed in account_tokens; requesting a new link invalidates
+// the previous one.
+type AccountService struct {
+	db       *sql.DB
+	mailer   mail.Mailer
+	sessions *SessionService
+	baseURL  string
+	throttle *LoginThrottleService
+}
+
+// NewAccountService creates a new AccountService. baseURL is the frontend
+// URL that links in emails point to.
+func NewAccountService(db *sql.DB, mailer mail.Mailer, sessions *SessionService, baseURL string) *AccountService {
+	return &AccountService{
+		db:       db,
+		mailer:   mailer,
+		sessions: sessions,
+		baseURL:  baseURL,
+	}
+}
+
+// SetLoginThrottleService lets a password reset lift a login lockout
+func (s *AccountService) SetLoginThrottleService(throttle *LoginThrottleService) {
+	s.throttle = throttle
+}
+
+// ChangePassword changes a user's password after checking the current one,
+// and revokes every other session of the user
+func (s *AccountService) ChangePassword(userID, sessionID, currentPassword, newPassword string) error {
+	var hashedPassword string
+	err := s.db.QueryRow("SELECT password FROM users WHERE id = $1", userID).Scan(&hashedPassword)
+	if err == sql.ErrNoRows {
+		return errors.New("user not found")
+	}
+	if err != nil {
+		return err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(currentPassword)) != nil {
+		return ErrIncorrectPassword
+	}
+
+	if err := s.setPassword(s.db, userID, newPassword); err != nil {
+		return err
+	}
+	_, err = s.sessions.RevokeAllSessions(userID, sessionID, models.SessionRevokedPassword)
+	return err
+}
+
+// RequestPasswordReset emails a reset link if a user has this address.
+// It reports success either way so it can't be used to find accounts.
+func (s *AccountService) RequestPasswordReset(email string) error {
+	var userID, username, userEmail string
+	err := s.db.QueryRow(
+		"SELECT id, username, email FROM users WHERE LOWER(email) = LOWER($1)", email,
+	).Scan(&userID, &username, &userEmail)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := s.issueToken(userID, userEmail, models.AccountTokenPasswordReset, PasswordResetTokenTTL)
+	if err != nil || token == "" {
+		return err
+	}
+
+	s.send(mail.Message{
+		To:      userEmail,
+		Subject: "パスワードの再設定",
+		Text: fmt.Sprintf(`%s さん
+
+パスワードの再設定が申請されました。次のリンクから新しいパスワードを設定してください。
+
+%s
+
+このリンクの有効期限は%d分で、一度だけ使用できます。
+心当たりがない場合は、このメールを無視してください。パスワードは変更されません。
+`, username, s.link("/reset-password", token), int(PasswordResetTokenTTL.Minutes())),
+	})
+	return nil
+}
+
+// ResetPassword sets a new password with a token from a reset email, lifts
+// any login lockout and revokes all of the user's sessions. Receiving the
+// email also proves the address, so it is marked verified.
+func (s *AccountService) ResetPassword(token, newPassword string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userID, email, err := consumeAccountToken(tx, token, models.AccountTokenPasswordReset)
+	if err != nil {
+		return err
+	}
+	if err := s.setPassword(tx, userID, newPassword); err != nil {
+		return err
+	}
+	result, err := tx.Exec(
+		"UPDATE users SET email_verified_at = COALESCE(email_verified_at, $1) WHERE id = $2 AND email = $3",
+		time.Now(), userID, email,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		// The address changed after the link was sent
+		return ErrInvalidAccountToken
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// Whoever can read the user's email is the user, locked out or not
+	if s.throttle != nil {
+		if err := s.throttle.clearAccount(email); err != nil {
+			return err
+		}
+	}
+	_, err = s.sessions.RevokeAllSessions(userID, "", models.SessionRevokedPassword)
+	return err
+}
+
+// SendEmailVerification emails a verification link to a user who hasn't verified their address
+func (s *AccountService) SendEmailVerification(userID string) error {
+	var username, email string
+	var verified bool
+	err := s.db.QueryRow(
+		"SELECT username, email, email_verified_at IS NOT NULL FROM users WHERE id = $1", userID,
+	).Scan(&username, &email, &verified)
+	if err != nil {
+		return err
+	}
+	if verified {
+		return nil
+	}
+
+	token, err := s.issueToken(userID, email, models.AccountTokenEmailVerification, EmailVerificationTokenTTL)
+	if err != nil || token == "" {
+		return err
+	}
+
+	s.send(mail.Message{
+		To:      email,
+		Subject: "メールアドレスの確認",
+		Text: fmt.Sprintf(`%s さん
+
+ご登録ありがとうございます。次のリンクを開いてメールアドレスを確認してください。
+
+%s
+
+このリンクの有効期限は%d時間です。
+心当たりがない場合は、このメールを無視してください。
+`, username, s.link("/verify-email", token), int(EmailVerificationTokenTTL.Hours())),
+	})
+	return nil
+}
+
+// ResendEmailVerification sends a new verification link if an unverified
+// user has this address. Like RequestPasswordReset it doesn't reveal whether
+// the address is registered.
+func (s *AccountService) ResendEmailVerification(email string) error {
+	var userID string
+	err := s.db.QueryRow(
+		"SELECT id FROM users WHERE LOWER(email) = LOWER($1) AND email_verified_at IS NULL", email,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.SendEmailVerification(userID)
+}
+
+// VerifyEmail marks an address verified with a token from a verification email
+func (s *AccountService) VerifyEmail(token string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userID, email, err := consumeAccountToken(tx, token, models.AccountTokenEmailVerification)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(
+		"UPDATE users SET email_verified_at = COALESCE(email_verified_at, $1), updated_at = $1 WHERE id = $2 AND email = $3",
+		time.Now(), userID, email,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrInvalidAccountToken
+	}
+	return tx.Commit()
+}
+
+// issueToken creates a token, invalidating the user's earlier tokens for the
+// same purpose. It returns "" without error when one was issued less than
+// accountEmailInterval ago, so repeated requests don't flood the inbox.
+func (s *AccountService) issueToken(userID, email, purpose string, ttl time.Duration) (string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Serialise requests for the same user
+	if _, err := tx.Exec("SELECT 1 FROM users WHERE id = $1 FOR UPDATE", userID); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	var recent bool
+	if err := tx.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM account_tokens WHERE user_id = $1 AND purpose = $2 AND created_at > $3)",
+		userID, purpose, now.Add(-accountEmailInterval),
+	).Scan(&recent); err != nil {
+		return "", err
+	}
+	if recent {
+		return "", nil
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE account_tokens SET used_at = $1 WHERE user_id = $2 AND purpose = $3 AND used_at IS NULL",
+		now, userID, purpose,
+	); err != nil {
+		return "", err
+	}
+	token, err := generateRandomToken()
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO account_tokens (token_hash, user_id, purpose, email, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, hashToken(token), userID, purpose, email, now, now.Add(ttl)); err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// consumeAccountToken marks a token used and returns its user and email address
+func consumeAccountToken(tx *sql.Tx, token, purpose string) (string, string, error) {
+	var userID, email string
+	now := time.Now()
+	err := tx.QueryRow(`
+		UPDATE account_tokens SET used_at = $1
+		WHERE token_hash = $2 AND purpose = $3 AND used_at IS NULL AND expires_at > $1
+		RETURNING user_id, email
+	`, now, hashToken(token), purpose).Scan(&userID, &email)
+	if err == sql.ErrNoRows {
+		return "", "", ErrInvalidAccountToken
+	}
+	return userID, email, err
+}
+
+// execer is satisfied by *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// setPassword hashes and stores a new password
+func (s *AccountService) setPassword(db execer, userID, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %w", err)
+	}
+	_, err = db.Exec("UPDATE users SET password = $1, updated_at = $2 WHERE id = $3", string(hashedPassword), time.Now(), userID)
+	return err
+}
+
+func (s *AccountService) link(path, token string) string {
+	return s.baseURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// send delivers an email in the background; responses don't wait for the
+// mail server, and don't take longer when an address exists
+func (s *AccountService) send(msg mail.Message) {
+	sendMail(s.mailer, msg)
+}
+
+// sendMail delivers an email in the background, logging failures
+func sendMail(mailer mail.Mailer, msg mail.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), accountMailTimeout)
+		defer cancel()
+		if err := mailer.Send(ctx, msg); err != nil {
+			log.Printf("メール送信エラー (%s): %v", msg.Subject, err)
+		}
+	}()
+}
+
+// StartCleanup deletes expired account tokens every interval
+func (s *AccountService) StartCleanup(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := s.db.Exec("DELETE FROM account_tokens WHERE expires_at <= $1", time.Now()); err != nil {
+				log.Printf("アカウントトークンのクリーンアップエラー: %v", err)
+			}
+		}
+	}()
+}
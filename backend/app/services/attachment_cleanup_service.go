@@ -0,0 +1,185 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+
+	"app/storage"
+)
+
+const (
+	// attachmentCleanupBatchSize is how many rows one cleanup step handles at most
+	attachmentCleanupBatchSize = 100
+	// maxFileDeletionAttempts is how often deleting a file is retried before
+	// it is left in attachment_file_deletions for an operator to look at
+	maxFileDeletionAttempts = 10
+)
+
+// AttachmentCleanupService garbage-collects attachments nobody can reach:
+// uploads that no message claimed within UnclaimedAttachmentTTL, uploads to
+// channels that were deleted, attachments whose message was deleted, and
+// avatars no user has any more.
+//
+// Rows are deleted first, queuing their files (and their thumbnails' files)
+// in attachment_file_deletions within the same transaction; the files are
+// deleted from storage afterwards and retried until that succeeds.
+type AttachmentCleanupService struct {
+	db    *sql.DB
+	files *storage.Manager
+}
+
+// NewAttachmentCleanupService creates a new AttachmentCleanupService
+func NewAttachmentCleanupService(db *sql.DB, files *storage.Manager) *AttachmentCleanupService {
+	return &AttachmentCleanupService{
+		db:    db,
+		files: files,
+	}
+}
+
+// StartCleanup runs Cleanup every interval
+func (s *AttachmentCleanupService) StartCleanup(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.Cleanup(); err != nil {
+				log.Printf("添付ファイルのクリーンアップエラー: %v", err)
+			}
+		}
+	}()
+}
+
+// Cleanup deletes unreachable attachments and then their files
+func (s *AttachmentCleanupService) Cleanup() error {
+	for {
+		deleted, err := s.deleteUnreachable()
+		if err != nil {
+			return err
+		}
+		if deleted > 0 {
+			log.Printf("到達できない添付ファイルを %d 件削除しました", deleted)
+		}
+		if deleted < attachmentCleanupBatchSize {
+			break
+		}
+	}
+	return s.deleteQueuedFiles()
+}
+
+// deleteUnreachable deletes one batch of unreachable attachment rows
+func (s *AttachmentCleanupService) deleteUnreachable() (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// The row locks make a concurrent claim wait, and then find the rows gone
+	rows, err := tx.Query(`
+		SELECT id FROM channel_attachments
+		WHERE message_id IS NULL
+		  AND (claimed_at IS NOT NULL OR channel_id IS NULL OR uploaded_at <= $1)
+		  AND NOT EXISTS (SELECT 1 FROM users WHERE users.avatar_attachment_id = channel_attachments.id)
+		ORDER BY uploaded_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	`, time.Now().Add(-UnclaimedAttachmentTTL), attachmentCleanupBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	if err := deleteAttachmentsTx(tx, ids); err != nil {
+		return 0, err
+	}
+	return len(ids), tx.Commit()
+}
+
+// deleteAttachmentsTx deletes attachment rows, with their thumbnails, and
+// queues their files for AttachmentCleanupService to remove from storage
+func deleteAttachmentsTx(tx *sql.Tx, attachmentIds []string) error {
+	if _, err := tx.Exec(`
+		INSERT INTO attachment_file_deletions (file_path, created_at)
+		SELECT file_path, $2::timestamp FROM channel_attachments WHERE id = ANY($1::uuid[])
+		UNION
+		SELECT file_path, $2::timestamp FROM attachment_thumbnails WHERE attachment_id = ANY($1::uuid[])
+		ON CONFLICT (file_path) DO NOTHING
+	`, pq.Array(attachmentIds), time.Now()); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM channel_attachments WHERE id = ANY($1::uuid[])", pq.Array(attachmentIds))
+	return err
+}
+
+// deleteQueuedFiles removes queued files from storage
+func (s *AttachmentCleanupService) deleteQueuedFiles() error {
+	ctx := context.Background()
+	for {
+		rows, err := s.db.Query(`
+			SELECT file_path FROM attachment_file_deletions
+			WHERE attempts < $1
+			ORDER BY created_at
+			LIMIT $2
+		`, maxFileDeletionAttempts, attachmentCleanupBatchSize)
+		if err != nil {
+			return err
+		}
+		var filePaths []string
+		for rows.Next() {
+			var filePath string
+			if err := rows.Scan(&filePath); err != nil {
+				rows.Close()
+				return err
+			}
+			filePaths = append(filePaths, filePath)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		failed := 0
+		for _, filePath := range filePaths {
+			err := s.files.Delete(ctx, filePath)
+			if err == nil || errors.Is(err, storage.ErrNotFound) {
+				if _, err := s.db.Exec("DELETE FROM attachment_file_deletions WHERE file_path = $1", filePath); err != nil {
+					return err
+				}
+				continue
+			}
+
+			failed++
+			log.Printf("添付ファイル %s の削除エラー: %v", filePath, err)
+			if _, err := s.db.Exec(
+				"UPDATE attachment_file_deletions SET attempts = attempts + 1, last_error = $1 WHERE file_path = $2",
+				err.Error(), filePath,
+			); err != nil {
+				return err
+			}
+		}
+		// Stop when the queue is drained, or when storage is failing; the next run retries
+		if len(filePaths) < attachmentCleanupBatchSize || failed > 0 {
+			return nil
+		}
+	}
+}
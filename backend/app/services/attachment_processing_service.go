@@ -0,0 +1,469 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // registers the GIF decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+
+	"app/models"
+	"app/storage"
+)
+
+const (
+	// attachmentProcessingLease is how long a replica owns a claimed attachment
+	attachmentProcessingLease = 5 * time.Minute
+	// attachmentProcessingMaxAttempts is how many times processing is tried before giving up
+	attachmentProcessingMaxAttempts = 3
+	// attachmentProcessingBatchSize is how many attachments one run claims at most
+	attachmentProcessingBatchSize = 10
+	// maxProcessedPixels keeps a small file that decodes to a huge bitmap
+	// (a decompression bomb) from exhausting memory
+	maxProcessedPixels = 50_000_000
+	// originalJPEGQuality is used when an original has to be re-encoded to apply its orientation
+	originalJPEGQuality = 92
+	// thumbnailJPEGQuality is used for thumbnails of opaque images
+	thumbnailJPEGQuality = 80
+	// blurhashSourceEdge is the size the image is reduced to before computing its blurhash
+	blurhashSourceEdge = 32
+)
+
+// ThumbnailSizes are the longest edges, in pixels, thumbnails are generated at.
+// Sizes that are not smaller than the original are skipped.
+var ThumbnailSizes = []int{160, 480, 1024}
+
+// processableImageTypes are the content types AttachmentProcessingService can decode
+var processableImageTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/gif": true}
+
+// unstrippableImageTypes are photo formats that can carry EXIF/GPS metadata
+// but that AttachmentProcessingService cannot decode, so their metadata could
+// never be stripped. They are refused instead of being stored as they are.
+var unstrippableImageTypes = map[string]bool{
+	"image/heic": true, "image/heif": true, "image/webp": true, "image/tiff": true, "image/avif": true,
+}
+
+// errUnprocessableImage marks failures that retrying cannot fix
+var errUnprocessableImage = errors.New("unprocessable image")
+
+// attachmentProcessingStatus returns the initial processing status for a new
+// attachment: pending for images that get thumbnails, NULL for everything else.
+func attachmentProcessingStatus(contentType string) sql.NullString {
+	if processableImageTypes[contentType] {
+		return sql.NullString{String: models.AttachmentProcessingPending, Valid: true}
+	}
+	return sql.NullString{}
+}
+
+// AttachmentProcessingService processes image attachments in the background:
+// it strips EXIF/GPS metadata from the stored original, generates thumbnails,
+// and records the dimensions and a blurhash placeholder.
+//
+// Work is tracked in channel_attachments.processing_status and claimed with
+// SELECT ... FOR UPDATE SKIP LOCKED like scheduled messages, so several
+// replicas can run the processor and an attachment whose replica crashed is
+// picked up again once its lease expires.
+type AttachmentProcessingService struct {
+	db                    *sql.DB
+	files                 *storage.Manager
+	channelMessageService *ChannelMessageService
+	wsService             *WebSocketService
+	wake                  chan struct{}
+}
+
+// NewAttachmentProcessingService creates a new AttachmentProcessingService
+func NewAttachmentProcessingService(db *sql.DB, files *storage.Manager, channelMessageService *ChannelMessageService) *AttachmentProcessingService {
+	return &AttachmentProcessingService{
+		db:                    db,
+		files:                 files,
+		channelMessageService: channelMessageService,
+		wake:                  make(chan struct{}, 1),
+	}
+}
+
+// SetWebSocketService sets the WebSocket service used to push processed attachments to clients
+func (s *AttachmentProcessingService) SetWebSocketService(wsService *WebSocketService) {
+	s.wsService = wsService
+}
+
+// Enqueue wakes the processor so a new upload does not wait for the next tick
+func (s *AttachmentProcessingService) Enqueue() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start processes pending attachments every interval and whenever Enqueue is called
+func (s *AttachmentProcessingService) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.wake:
+			}
+			if err := s.runPending(); err != nil {
+				log.Printf("添付ファイルの処理エラー: %v", err)
+			}
+		}
+	}()
+}
+
+// processingJob is a claimed attachment
+type processingJob struct {
+	id, messageId, filePath, contentType string
+	attempts                             int
+}
+
+// runPending claims and processes batches until no work is left
+func (s *AttachmentProcessingService) runPending() error {
+	for {
+		jobs, err := s.claimPending()
+		if err != nil {
+			return err
+		}
+		if len(jobs) == 0 {
+			return nil
+		}
+		for _, job := range jobs {
+			if err := s.process(job); err != nil {
+				log.Printf("添付ファイル %s の処理エラー: %v", job.id, err)
+				s.recordFailure(job, err)
+				continue
+			}
+			s.broadcast(job.messageId)
+		}
+	}
+}
+
+// claimPending marks pending attachments as being processed by this replica.
+// Attachments left in 'processing' after their lease expired are claimed again.
+func (s *AttachmentProcessingService) claimPending() ([]processingJob, error) {
+	now := time.Now()
+	rows, err := s.db.Query(`
+		UPDATE channel_attachments
+		SET processing_status = 'processing', processing_locked_until = $2,
+		    processing_attempts = processing_attempts + 1
+		WHERE id IN (
+			SELECT id FROM channel_attachments
+			WHERE (processing_status = 'pending' AND (processing_locked_until IS NULL OR processing_locked_until <= $1))
+			   OR (processing_status = 'processing' AND processing_locked_until < $1)
+			ORDER BY uploaded_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, COALESCE(message_id::text, ''), file_path, COALESCE(content_type, ''), processing_attempts
+	`, now, now.Add(attachmentProcessingLease), attachmentProcessingBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []processingJob
+	for rows.Next() {
+		var job processingJob
+		if err := rows.Scan(&job.id, &job.messageId, &job.filePath, &job.contentType, &job.attempts); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// processedThumbnail is a generated thumbnail waiting to be recorded
+type processedThumbnail struct {
+	size, width, height int
+	contentType         string
+	filePath            string
+	fileSize            int64
+}
+
+// process strips the original's metadata, generates thumbnails and records the results
+func (s *AttachmentProcessingService) process(job processingJob) error {
+	ctx := context.Background()
+	backend, key, err := s.files.Resolve(job.filePath)
+	if err != nil {
+		return err
+	}
+	reader, err := backend.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUnprocessableImage, err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxProcessedPixels {
+		return fmt.Errorf("%w: %dx%d pixels exceeds the processing limit", errUnprocessableImage, config.Width, config.Height)
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUnprocessableImage, err)
+	}
+
+	// Rewrite the original without metadata. A JPEG whose EXIF orientation
+	// rotates it has to be re-encoded upright, since dropping the tag alone
+	// would make it display sideways.
+	img := toRGBA(decoded)
+	var original []byte
+	switch format {
+	case "jpeg":
+		if orientation := jpegOrientation(data); orientation != 1 {
+			img = applyOrientation(img, orientation)
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: originalJPEGQuality}); err != nil {
+				return err
+			}
+			original = buf.Bytes()
+		} else if original, err = stripJPEGMetadata(data); err != nil {
+			return fmt.Errorf("%w: %v", errUnprocessableImage, err)
+		}
+	case "png":
+		if original, err = stripPNGMetadata(data); err != nil {
+			return fmt.Errorf("%w: %v", errUnprocessableImage, err)
+		}
+	}
+	fileSize := int64(len(data))
+	if original != nil && !bytes.Equal(original, data) {
+		if err := backend.Put(ctx, key, bytes.NewReader(original), int64(len(original)), job.contentType); err != nil {
+			return fmt.Errorf("failed to store stripped original: %v", err)
+		}
+		fileSize = int64(len(original))
+	}
+
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	thumbnails, err := s.generateThumbnails(ctx, job.id, img)
+	if err != nil {
+		return err
+	}
+	blurhash := encodeBlurhash(resizeToFit(img, blurhashSourceEdge), 4, 3)
+
+	return s.finish(job, width, height, fileSize, blurhash, thumbnails)
+}
+
+// generateThumbnails stores a downscaled copy of img for every thumbnail size
+// smaller than the image. Images with transparency are kept as PNG.
+func (s *AttachmentProcessingService) generateThumbnails(ctx context.Context, attachmentId string, img *image.RGBA) ([]processedThumbnail, error) {
+	var thumbnails []processedThumbnail
+	longest := max(img.Bounds().Dx(), img.Bounds().Dy())
+	// Each size is reduced from the previous one, which is much cheaper than
+	// starting from the original every time and looks the same at these ratios
+	source := img
+	for i := len(ThumbnailSizes) - 1; i >= 0; i-- {
+		size := ThumbnailSizes[i]
+		if size >= longest {
+			continue
+		}
+		source = resizeToFit(source, size)
+
+		var buf bytes.Buffer
+		contentType, ext := "image/jpeg", ".jpg"
+		if source.Opaque() {
+			if err := jpeg.Encode(&buf, source, &jpeg.Options{Quality: thumbnailJPEGQuality}); err != nil {
+				return nil, err
+			}
+		} else {
+			contentType, ext = "image/png", ".png"
+			if err := png.Encode(&buf, source); err != nil {
+				return nil, err
+			}
+		}
+
+		fileSize := int64(buf.Len())
+		key := "channel_attachments/thumbnails/" + attachmentId + "-" + strconv.Itoa(size) + ext
+		filePath, err := s.files.Put(ctx, key, &buf, fileSize, contentType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store thumbnail: %v", err)
+		}
+		thumbnails = append(thumbnails, processedThumbnail{
+			size:        size,
+			width:       source.Bounds().Dx(),
+			height:      source.Bounds().Dy(),
+			contentType: contentType,
+			filePath:    filePath,
+			fileSize:    fileSize,
+		})
+	}
+	return thumbnails, nil
+}
+
+// finish records the processing results and replaces any earlier thumbnails
+func (s *AttachmentProcessingService) finish(job processingJob, width, height int, fileSize int64, blurhash string, thumbnails []processedThumbnail) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE channel_attachments
+		SET width = $1, height = $2, blurhash = $3, file_size = $4, processing_status = 'done',
+		    processing_locked_until = NULL, processing_error = NULL, processed_at = $5
+		WHERE id = $6 AND processing_status = 'processing'
+	`, width, height, blurhash, fileSize, time.Now(), job.id)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		if err != nil {
+			return err
+		}
+		// Another replica took over, or the attachment was deleted meanwhile.
+		// A deleted attachment's original may have been rewritten after the
+		// garbage collector removed it, so it goes with the thumbnails.
+		var exists bool
+		if err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM channel_attachments WHERE id = $1)", job.id).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			s.deleteFiles(append(thumbnailPaths(thumbnails), job.filePath))
+		}
+		return nil
+	}
+
+	rows, err := tx.Query("DELETE FROM attachment_thumbnails WHERE attachment_id = $1 RETURNING file_path", job.id)
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for rows.Next() {
+		var filePath string
+		if err := rows.Scan(&filePath); err != nil {
+			rows.Close()
+			return err
+		}
+		stale = append(stale, filePath)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, thumbnail := range thumbnails {
+		if _, err := tx.Exec(`
+			INSERT INTO attachment_thumbnails (attachment_id, size, width, height, content_type, file_path, file_size, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		`, job.id, thumbnail.size, thumbnail.width, thumbnail.height, thumbnail.contentType,
+			thumbnail.filePath, thumbnail.fileSize, now); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// Files of earlier runs are usually overwritten in place; remove the rest
+	current := make(map[string]bool, len(thumbnails))
+	for _, filePath := range thumbnailPaths(thumbnails) {
+		current[filePath] = true
+	}
+	var unused []string
+	for _, filePath := range stale {
+		if !current[filePath] {
+			unused = append(unused, filePath)
+		}
+	}
+	s.deleteFiles(unused)
+	return nil
+}
+
+// recordFailure puts a failed attachment back in the queue with a growing
+// backoff, and marks it failed once it runs out of attempts or cannot be decoded.
+func (s *AttachmentProcessingService) recordFailure(job processingJob, cause error) {
+	var err error
+	if job.attempts >= attachmentProcessingMaxAttempts || errors.Is(cause, errUnprocessableImage) {
+		_, err = s.db.Exec(`
+			UPDATE channel_attachments
+			SET processing_status = 'failed', processing_error = $1, processing_locked_until = NULL, processed_at = $2
+			WHERE id = $3 AND processing_status = 'processing'
+		`, cause.Error(), time.Now(), job.id)
+		if err == nil {
+			s.broadcast(job.messageId)
+		}
+	} else {
+		backoff := time.Duration(job.attempts) * time.Minute
+		_, err = s.db.Exec(`
+			UPDATE channel_attachments
+			SET processing_status = 'pending', processing_error = $1, processing_locked_until = $2
+			WHERE id = $3 AND processing_status = 'processing'
+		`, cause.Error(), time.Now().Add(backoff), job.id)
+	}
+	if err != nil {
+		log.Printf("添付ファイル %s の状態更新エラー: %v", job.id, err)
+	}
+}
+
+// broadcast pushes the message with its updated attachments to the channel.
+// Attachments not posted yet have no message to update.
+func (s *AttachmentProcessingService) broadcast(messageId string) {
+	if s.wsService == nil || messageId == "" {
+		return
+	}
+	message, err := s.channelMessageService.GetMessageByID(messageId)
+	if err != nil {
+		log.Printf("メッセージ %s の取得エラー: %v", messageId, err)
+		return
+	}
+	s.wsService.BroadcastMessageUpdate(message.ChannelId, message)
+}
+
+// deleteFiles removes stored files, logging failures
+func (s *AttachmentProcessingService) deleteFiles(filePaths []string) {
+	for _, filePath := range filePaths {
+		if err := s.files.Delete(context.Background(), filePath); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("サムネイル %s の削除エラー: %v", filePath, err)
+		}
+	}
+}
+
+func thumbnailPaths(thumbnails []processedThumbnail) []string {
+	filePaths := make([]string, len(thumbnails))
+	for i, thumbnail := range thumbnails {
+		filePaths[i] = thumbnail.filePath
+	}
+	return filePaths
+}
+
+// loadThumbnails loads the thumbnails of the given attachments, keyed by attachment ID
+func loadThumbnails(db *sql.DB, attachmentIds []string) (map[string][]models.AttachmentThumbnail, error) {
+	rows, err := db.Query(`
+		SELECT attachment_id, size, width, height
+		FROM attachment_thumbnails
+		WHERE attachment_id = ANY($1::uuid[])
+		ORDER BY size ASC
+	`, pq.Array(attachmentIds))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	thumbnails := make(map[string][]models.AttachmentThumbnail)
+	for rows.Next() {
+		var attachmentId string
+		var thumbnail models.AttachmentThumbnail
+		if err := rows.Scan(&attachmentId, &thumbnail.Size, &thumbnail.Width, &thumbnail.Height); err != nil {
+			return nil, err
+		}
+		thumbnails[attachmentId] = append(thumbnails[attachmentId], thumbnail)
+	}
+	return thumbnails, rows.Err()
+}
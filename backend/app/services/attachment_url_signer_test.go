@@ -0,0 +1,59 @@
+package services
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAttachmentURLSignerVerify(t *testing.T) {
+	signer := NewAttachmentURLSigner("secret", time.Minute)
+	future := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name         string
+		attachmentId string
+		expires      string
+		signature    string
+		want         error
+	}{
+		{"valid", "a1", future, signer.sign("a1", future), nil},
+		{"expired", "a1", past, signer.sign("a1", past), ErrAttachmentSignatureExpired},
+		{"other attachment", "a2", future, signer.sign("a1", future), ErrAttachmentSignatureInvalid},
+		{"extended expiry", "a1", future, signer.sign("a1", past), ErrAttachmentSignatureInvalid},
+		{"tampered signature", "a1", future, strings.Repeat("0", 64), ErrAttachmentSignatureInvalid},
+		{"empty signature", "a1", future, "", ErrAttachmentSignatureInvalid},
+		{"malformed expiry", "a1", "soon", signer.sign("a1", "soon"), ErrAttachmentSignatureInvalid},
+		{"other secret", "a1", future, NewAttachmentURLSigner("other", time.Minute).sign("a1", future), ErrAttachmentSignatureInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := signer.Verify(tt.attachmentId, tt.expires, tt.signature); !errors.Is(err, tt.want) {
+				t.Errorf("Verify() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttachmentURLSignerSignedURL(t *testing.T) {
+	signer := NewAttachmentURLSigner("secret", time.Minute)
+	signed, expiresAt := signer.SignedURL("a1", "photo 1.png")
+
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/api/attachments/a1/photo 1.png"; u.Path != want {
+		t.Errorf("path = %q, want %q", u.Path, want)
+	}
+	if got := u.Query().Get("expires"); got != strconv.FormatInt(expiresAt.Unix(), 10) {
+		t.Errorf("expires = %q, want %d", got, expiresAt.Unix())
+	}
+	if err := signer.Verify("a1", u.Query().Get("expires"), u.Query().Get("signature")); err != nil {
+		t.Errorf("Verify() of a freshly signed URL = %v", err)
+	}
+}
@@ -1,31 +1,132 @@
 package services
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
-	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 
 	"app/models"
+	"app/storage"
 )
 
 // ChannelMessageService handles channel message operations
 type ChannelMessageService struct {
-	DB *sql.DB
+	DB        *sql.DB
+	files     *storage.Manager
+	uploads   *UploadPolicyService
+	urlSigner *AttachmentURLSigner
+	processor *AttachmentProcessingService
 }
 
 // NewChannelMessageService creates a new ChannelMessageService
-func NewChannelMessageService(db *sql.DB) *ChannelMessageService {
+func NewChannelMessageService(db *sql.DB, files *storage.Manager, uploads *UploadPolicyService) *ChannelMessageService {
 	return &ChannelMessageService{
-		DB: db,
+		DB:      db,
+		files:   files,
+		uploads: uploads,
 	}
 }
 
+// Uploads returns the service that enforces upload limits
+func (s *ChannelMessageService) Uploads() *UploadPolicyService {
+	return s.uploads
+}
+
+// Files returns the storage that holds attachment files
+func (s *ChannelMessageService) Files() *storage.Manager {
+	return s.files
+}
+
+// SetAttachmentURLSigner sets the signer used for attachment URLs in returned messages
+func (s *ChannelMessageService) SetAttachmentURLSigner(signer *AttachmentURLSigner) {
+	s.urlSigner = signer
+}
+
+// SetAttachmentProcessor sets the processor that is woken up when images are uploaded
+func (s *ChannelMessageService) SetAttachmentProcessor(processor *AttachmentProcessingService) {
+	s.processor = processor
+}
+
+// attachmentURL returns the URL clients use to download an attachment
+func (s *ChannelMessageService) attachmentURL(attachmentId, fileName string) string {
+	if s.urlSigner == nil {
+		return AttachmentPath(attachmentId, fileName)
+	}
+	signedURL, _ := s.urlSigner.SignedURL(attachmentId, fileName)
+	return signedURL
+}
+
+// thumbnailURL returns the URL of an attachment's thumbnail. The signature
+// covers the attachment, so thumbnails share the original's URL.
+func thumbnailURL(attachmentURL string, size int) string {
+	separator := "?"
+	if strings.Contains(attachmentURL, "?") {
+		separator = "&"
+	}
+	return attachmentURL + separator + "size=" + strconv.Itoa(size)
+}
+
+// avatarRef is a user's avatar as loaded with avatarJoins
+type avatarRef struct {
+	attachmentId string
+	fileName     string
+	hasThumbnail bool
+}
+
+// avatarColumns and avatarJoins load the avatar of the user aliased u
+const avatarColumns = "COALESCE(av.id::text, ''), COALESCE(av.file_name, ''), avt.size IS NOT NULL"
+
+var avatarJoins = `LEFT JOIN channel_attachments av ON av.id = u.avatar_attachment_id
+		LEFT JOIN attachment_thumbnails avt ON avt.attachment_id = av.id AND avt.size = ` + strconv.Itoa(AvatarThumbnailSize)
+
+// avatarURL returns the URL of an avatar, preferring its smallest thumbnail
+// once processing has made one
+func (s *ChannelMessageService) avatarURL(avatar avatarRef) string {
+	if avatar.attachmentId == "" {
+		return ""
+	}
+	downloadURL := s.attachmentURL(avatar.attachmentId, avatar.fileName)
+	if avatar.hasThumbnail {
+		return thumbnailURL(downloadURL, AvatarThumbnailSize)
+	}
+	return downloadURL
+}
+
+// MaxPinsPerChannel is the maximum number of messages that can be pinned in a channel
+const MaxPinsPerChannel = 50
+
+const (
+	// MaxAttachmentsPerMessage is how many attachments one message can claim
+	MaxAttachmentsPerMessage = 10
+	// UnclaimedAttachmentTTL is how long an uploaded attachment waits for a
+	// message to claim it before the garbage collector removes it
+	UnclaimedAttachmentTTL = 24 * time.Hour
+)
+
+// Errors returned when posting a message with attachments
+var (
+	ErrTooManyAttachments     = fmt.Errorf("a message can have at most %d attachments", MaxAttachmentsPerMessage)
+	ErrAttachmentsUnavailable = errors.New("attachments must be your own unposted uploads to this channel")
+)
+
+// Errors returned by pin operations
+var (
+	ErrPinLimitReached     = fmt.Errorf("a channel can have at most %d pinned messages", MaxPinsPerChannel)
+	ErrAlreadyPinned       = errors.New("message is already pinned")
+	ErrNotPinned           = errors.New("message is not pinned")
+	ErrMessageNotInChannel = errors.New("message does not belong to this channel")
+)
+
 // SaveChannelMessage saves a channel message to the database
 func (s *ChannelMessageService) SaveChannelMessage(message models.ChannelMessage) error {
 	tx, err := s.DB.Begin()
@@ -34,27 +135,122 @@ func (s *ChannelMessageService) SaveChannelMessage(message models.ChannelMessage
 	}
 	defer tx.Rollback()
 
+	if err := saveChannelMessageTx(tx, message); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SaveChannelMessageWithAttachments saves a message and claims previously
+// uploaded attachments for it in one transaction. Every attachment must have
+// been uploaded by the message's author to its channel and not be claimed
+// yet, otherwise nothing is saved and ErrAttachmentsUnavailable is returned.
+func (s *ChannelMessageService) SaveChannelMessageWithAttachments(message models.ChannelMessage, attachmentIds []string) error {
+	attachmentIds = uniqueStrings(attachmentIds)
+	if len(attachmentIds) > MaxAttachmentsPerMessage {
+		return ErrTooManyAttachments
+	}
+	for _, id := range attachmentIds {
+		if _, err := uuid.Parse(id); err != nil {
+			return ErrAttachmentsUnavailable
+		}
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := saveChannelMessageTx(tx, message); err != nil {
+		return err
+	}
+	if len(attachmentIds) > 0 {
+		result, err := tx.Exec(`
+			UPDATE channel_attachments
+			SET message_id = $1, claimed_at = $2
+			WHERE id = ANY($3::uuid[]) AND message_id IS NULL AND claimed_at IS NULL
+			  AND channel_id = $4 AND uploaded_by = $5 AND uploaded_at > $6
+		`, message.ID, time.Now(), pq.Array(attachmentIds), message.ChannelId, message.UserId,
+			time.Now().Add(-UnclaimedAttachmentTTL))
+		if err != nil {
+			return err
+		}
+		claimed, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if claimed != int64(len(attachmentIds)) {
+			return ErrAttachmentsUnavailable
+		}
+	}
+
+	return tx.Commit()
+}
+
+// saveChannelMessageTx inserts a channel message within an existing transaction
+func saveChannelMessageTx(tx *sql.Tx, message models.ChannelMessage) error {
+	if message.Type == "" {
+		message.Type = models.MessageTypeUser
+	}
+
 	// Insert message
-	_, err = tx.Exec(
-		`INSERT INTO channel_messages (id, content, channel_id, user_id, timestamp, is_edited, is_deleted) 
-		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+	_, err := tx.Exec(
+		`INSERT INTO channel_messages (id, content, channel_id, user_id, timestamp, is_edited, is_deleted, message_type) 
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
 		message.ID, message.Content, message.ChannelId, message.UserId,
-		message.Timestamp, message.IsEdited, message.IsDeleted,
+		message.Timestamp, message.IsEdited, message.IsDeleted, message.Type,
 	)
 	if err != nil {
 		return err
 	}
 
-	return tx.Commit()
+	// Track activity so direct conversations can be listed by latest message
+	_, err = tx.Exec(
+		"UPDATE channels SET last_message_at = $1 WHERE id = $2 AND (last_message_at IS NULL OR last_message_at < $1)",
+		message.Timestamp, message.ChannelId,
+	)
+	if err != nil {
+		return err
+	}
+
+	// A new message reopens a direct conversation for participants who closed it
+	_, err = tx.Exec(`
+		UPDATE channel_members cm
+		SET is_closed = false
+		FROM channels c
+		WHERE cm.channel_id = c.id AND c.id = $1 AND c.kind <> 'server' AND cm.is_closed = true
+	`, message.ChannelId)
+	return err
+}
+
+// SaveSystemMessage saves a system message attributed to the acting user
+func (s *ChannelMessageService) SaveSystemMessage(channelId, userId, content string) (*models.ChannelMessage, error) {
+	message := models.ChannelMessage{
+		ID:        uuid.New().String(),
+		ChannelId: channelId,
+		UserId:    userId,
+		Type:      models.MessageTypeSystem,
+		Content:   content,
+		Timestamp: time.Now(),
+	}
+
+	if err := s.SaveChannelMessage(message); err != nil {
+		return nil, err
+	}
+	return &message, nil
 }
 
 // GetChannelMessages retrieves all messages for a specific channel
 func (s *ChannelMessageService) GetChannelMessages(channelId string) ([]models.ChannelMessageWithUser, error) {
 	rows, err := s.DB.Query(`
 		SELECT cm.id, cm.content, cm.channel_id, cm.user_id, cm.timestamp, 
-		       cm.is_edited, cm.is_deleted, cm.edited_at, u.username
+		       cm.is_edited, cm.is_deleted, cm.edited_at, u.username, cm.message_type,
+		       COALESCE(u.display_name, ''), `+avatarColumns+`
 		FROM channel_messages cm
 		JOIN users u ON cm.user_id = u.id
+		`+avatarJoins+`
 		WHERE cm.channel_id = $1 AND cm.is_deleted = false
 		ORDER BY cm.timestamp ASC
 	`, channelId)
@@ -67,15 +263,18 @@ func (s *ChannelMessageService) GetChannelMessages(channelId string) ([]models.C
 	for rows.Next() {
 		var message models.ChannelMessageWithUser
 		var editedAt sql.NullTime
+		var avatar avatarRef
 
 		err := rows.Scan(
 			&message.ID, &message.Content, &message.ChannelId, &message.UserId,
 			&message.Timestamp, &message.IsEdited, &message.IsDeleted, &editedAt,
-			&message.Username,
+			&message.Username, &message.Type,
+			&message.DisplayName, &avatar.attachmentId, &avatar.fileName, &avatar.hasThumbnail,
 		)
 		if err != nil {
 			return nil, err
 		}
+		message.AvatarURL = s.avatarURL(avatar)
 
 		if editedAt.Valid {
 			message.EditedAt = editedAt.Time
@@ -83,17 +282,55 @@ func (s *ChannelMessageService) GetChannelMessages(channelId string) ([]models.C
 
 		messages = append(messages, message)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(messages) > 0 {
+		messageIds := make([]string, len(messages))
+		for i, message := range messages {
+			messageIds[i] = message.ID
+		}
+		attachments, err := s.loadAttachments(messageIds)
+		if err != nil {
+			return nil, err
+		}
+		for i := range messages {
+			messages[i].Attachments, messages[i].AttachmentDetails = attachmentFields(attachments[messages[i].ID])
+		}
+	}
+
+	// Attach poll results to poll messages
+	var pollMessageIds []string
+	for _, message := range messages {
+		if message.Type == models.MessageTypePoll {
+			pollMessageIds = append(pollMessageIds, message.ID)
+		}
+	}
+	if len(pollMessageIds) > 0 {
+		polls, err := loadPollsByMessageIds(s.DB, pollMessageIds)
+		if err != nil {
+			return nil, err
+		}
+		for i := range messages {
+			if poll, ok := polls[messages[i].ID]; ok {
+				messages[i].Poll = poll
+			}
+		}
+	}
 
 	return messages, nil
 }
 
-// IsMessageAuthor checks if the user is the author of the message
+// IsMessageAuthor checks if the user is the author of the message.
+// System messages are attributed to the acting user but have no author, and
+// neither do bot messages, which are posted by bot accounts.
 func (s *ChannelMessageService) IsMessageAuthor(messageId, userId string) (bool, error) {
 	var count int
 	err := s.DB.QueryRow(`
 		SELECT COUNT(*) FROM channel_messages 
-		WHERE id = $1 AND user_id = $2
-	`, messageId, userId).Scan(&count)
+		WHERE id = $1 AND user_id = $2 AND message_type NOT IN ($3, $4)
+	`, messageId, userId, models.MessageTypeSystem, models.MessageTypeBot).Scan(&count)
 
 	if err != nil {
 		return false, err
@@ -102,45 +339,138 @@ func (s *ChannelMessageService) IsMessageAuthor(messageId, userId string) (bool,
 	return count > 0, nil
 }
 
-// EditChannelMessage edits a channel message
-func (s *ChannelMessageService) EditChannelMessage(messageId, content string) error {
-	_, err := s.DB.Exec(`
+// EditChannelMessage edits a channel message and records the previous content as a revision
+func (s *ChannelMessageService) EditChannelMessage(messageId, content, editorId string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the message so concurrent edits produce consecutive revisions
+	var previousContent string
+	var serverId sql.NullString
+	err = tx.QueryRow(`
+		SELECT cm.content, c.server_id
+		FROM channel_messages cm
+		JOIN channels c ON cm.channel_id = c.id
+		WHERE cm.id = $1
+		FOR UPDATE OF cm
+	`, messageId).Scan(&previousContent, &serverId)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	_, err = tx.Exec(`
+		INSERT INTO channel_message_revisions (id, message_id, content, edited_by, edited_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, uuid.New().String(), messageId, previousContent, editorId, now)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
 		UPDATE channel_messages 
 		SET content = $1, is_edited = true, edited_at = $2
 		WHERE id = $3
-	`, content, time.Now(), messageId)
+	`, content, now, messageId)
+	if err != nil {
+		return err
+	}
 
-	return err
+	// Drop revisions that have fallen outside the server's retention policy
+	if serverId.Valid {
+		if err := pruneServerRevisions(tx, serverId.String); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
-// DeleteChannelMessage marks a channel message as deleted
-func (s *ChannelMessageService) DeleteChannelMessage(messageId string) error {
-	_, err := s.DB.Exec(`
-		UPDATE channel_messages 
-		SET is_deleted = true
-		WHERE id = $1
+// GetMessageRevisions retrieves the revisions of a message that are still within the retention policy
+func (s *ChannelMessageService) GetMessageRevisions(messageId string) ([]models.ChannelMessageRevision, error) {
+	rows, err := s.DB.Query(`
+		SELECT r.id, r.message_id, r.content, r.edited_by, u.username, r.edited_at
+		FROM channel_message_revisions r
+		JOIN users u ON r.edited_by = u.id
+		JOIN channel_messages cm ON r.message_id = cm.id
+		JOIN channels c ON cm.channel_id = c.id
+		LEFT JOIN servers s ON c.server_id = s.id
+		WHERE r.message_id = $1 AND (
+			s.revision_retention_days IS NULL OR
+			r.edited_at >= NOW() - make_interval(days => s.revision_retention_days)
+		)
+		ORDER BY r.edited_at ASC
 	`, messageId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []models.ChannelMessageRevision
+	for rows.Next() {
+		var revision models.ChannelMessageRevision
+		if err := rows.Scan(
+			&revision.ID, &revision.MessageId, &revision.Content,
+			&revision.EditedBy, &revision.EditedByName, &revision.EditedAt,
+		); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, rows.Err()
+}
 
+// pruneServerRevisions deletes revisions older than the server's retention policy
+func pruneServerRevisions(tx *sql.Tx, serverId string) error {
+	_, err := tx.Exec(`
+		DELETE FROM channel_message_revisions r
+		USING channel_messages cm, channels c, servers s
+		WHERE r.message_id = cm.id AND cm.channel_id = c.id AND c.server_id = s.id
+		  AND s.id = $1 AND s.revision_retention_days IS NOT NULL
+		  AND r.edited_at < NOW() - make_interval(days => s.revision_retention_days)
+	`, serverId)
 	return err
 }
 
-// SaveChannelAttachment saves a file attachment for a channel message
-func (s *ChannelMessageService) SaveChannelAttachment(file *multipart.FileHeader, messageId string) (string, error) {
-	// Create uploads directory if it doesn't exist
-	uploadsDir := "./uploads/channel_attachments"
-	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create uploads directory: %v", err)
+// DeleteChannelMessage marks a channel message as deleted. Its attachments
+// are detached, which leaves them to AttachmentCleanupService like those of
+// a message that no longer exists.
+func (s *ChannelMessageService) DeleteChannelMessage(messageId string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	// Generate a unique ID for the attachment
-	attachmentId := uuid.New().String()
-
-	// Get the file extension
-	fileExt := filepath.Ext(file.Filename)
+	if _, err := tx.Exec(`
+		UPDATE channel_messages 
+		SET is_deleted = true
+		WHERE id = $1
+	`, messageId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE channel_attachments SET message_id = NULL WHERE message_id = $1", messageId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	// Create a unique filename
-	filename := fmt.Sprintf("%s%s", attachmentId, fileExt)
-	filePath := filepath.Join(uploadsDir, filename)
+// SaveChannelAttachment saves a file attachment. With a messageId the file
+// is attached to that existing message; otherwise it is uploaded to the
+// channel unclaimed, and is linked once a message claims it with
+// SaveChannelMessageWithAttachments. The file is checked against the
+// server's upload policy and the quotas first; rejections are returned as
+// *UploadError.
+func (s *ChannelMessageService) SaveChannelAttachment(file *multipart.FileHeader, channelId, messageId, userId string) (string, error) {
+	target, err := s.attachmentTarget(channelId, messageId)
+	if err != nil {
+		return "", err
+	}
 
 	// Open the source file
 	src, err := file.Open()
@@ -149,50 +479,314 @@ func (s *ChannelMessageService) SaveChannelAttachment(file *multipart.FileHeader
 	}
 	defer src.Close()
 
-	// Create the destination file
-	dst, err := os.Create(filePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to create destination file: %v", err)
+	// Validate the file from its first bytes before storing anything
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("failed to read uploaded file: %v", err)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to read uploaded file: %v", err)
 	}
-	defer dst.Close()
 
-	// Copy the file content
-	if _, err = io.Copy(dst, src); err != nil {
-		return "", fmt.Errorf("failed to copy file content: %v", err)
+	return s.saveAttachment(target, userId, file.Filename, file.Size, head[:n], src)
+}
+
+// attachmentTarget is where a new attachment is stored: a channel, and an
+// existing message in it when the upload is attached directly
+type attachmentTarget struct {
+	serverId  string // "" for direct messages
+	channelId string // "" for files that don't belong to a channel, such as avatars
+	messageId string
+	// link, if set, runs in the transaction that records the attachment, so
+	// the garbage collector never sees it unreferenced
+	link func(tx *sql.Tx, attachmentId string) error
+}
+
+// attachmentTarget resolves the channel (and server) of a new attachment.
+// A messageId takes precedence over channelId.
+func (s *ChannelMessageService) attachmentTarget(channelId, messageId string) (attachmentTarget, error) {
+	target := attachmentTarget{channelId: channelId, messageId: messageId}
+	var err error
+	if messageId != "" {
+		err = s.DB.QueryRow(`
+			SELECT cm.channel_id, COALESCE(ch.server_id::text, '')
+			FROM channel_messages cm
+			JOIN channels ch ON cm.channel_id = ch.id
+			WHERE cm.id = $1 AND cm.is_deleted = false
+		`, messageId).Scan(&target.channelId, &target.serverId)
+	} else {
+		err = s.DB.QueryRow(
+			"SELECT COALESCE(server_id::text, '') FROM channels WHERE id = $1", channelId,
+		).Scan(&target.serverId)
 	}
+	if err != nil {
+		return target, fmt.Errorf("添付先の取得に失敗しました: %w", err)
+	}
+	return target, nil
+}
 
-	// Save attachment info to database
-	_, err = s.DB.Exec(`
-		INSERT INTO channel_attachments (id, message_id, file_name, file_type, file_path, file_size, uploaded_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-	`, attachmentId, messageId, file.Filename, getFileType(file.Filename), filePath, file.Size, time.Now())
+// saveAttachment validates a file from its first bytes, stores content and
+// records the attachment within the quotas
+func (s *ChannelMessageService) saveAttachment(target attachmentTarget, userId, fileName string, size int64, head []byte, content io.Reader) (string, error) {
+	contentType, err := s.uploads.CheckFile(target.serverId, fileName, size, head)
+	if err != nil {
+		return "", err
+	}
 
+	// Generate a unique ID for the attachment and store the file content
+	attachmentId := uuid.New().String()
+	ctx := context.Background()
+	filePath, err := s.files.Put(ctx, AttachmentKey(attachmentId, fileName), content, size, contentType)
 	if err != nil {
-		// Clean up the file if database insert fails
-		os.Remove(filePath)
+		return "", fmt.Errorf("failed to store file: %v", err)
+	}
+
+	// Save attachment info to database, within the quotas
+	if err := s.insertAttachment(target, userId, models.ChannelAttachment{
+		ID:          attachmentId,
+		ChannelId:   target.channelId,
+		MessageId:   target.messageId,
+		FileName:    fileName,
+		FileType:    getFileType(contentType),
+		ContentType: contentType,
+		FilePath:    filePath,
+		FileSize:    size,
+		UploadedAt:  time.Now(),
+	}); err != nil {
+		// Clean up the file if the insert fails
+		s.files.Delete(ctx, filePath)
+		var uploadErr *UploadError
+		if errors.As(err, &uploadErr) {
+			return "", err
+		}
 		return "", fmt.Errorf("failed to save attachment to database: %v", err)
 	}
 
 	return attachmentId, nil
 }
 
+// insertAttachment records an attachment after checking the quotas
+func (s *ChannelMessageService) insertAttachment(target attachmentTarget, userId string, attachment models.ChannelAttachment) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.uploads.checkQuotaTx(tx, target.serverId, userId, attachment.FileSize); err != nil {
+		return err
+	}
+	channelId := sql.NullString{String: attachment.ChannelId, Valid: attachment.ChannelId != ""}
+	// Attachments uploaded straight to a message are claimed right away
+	messageId := sql.NullString{String: attachment.MessageId, Valid: attachment.MessageId != ""}
+	var claimedAt interface{}
+	if messageId.Valid {
+		claimedAt = attachment.UploadedAt
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO channel_attachments (id, channel_id, message_id, claimed_at, file_name, file_type, content_type,
+		                                 file_path, file_size, uploaded_by, uploaded_at, processing_status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`, attachment.ID, channelId, messageId, claimedAt, attachment.FileName, attachment.FileType,
+		attachment.ContentType, attachment.FilePath, attachment.FileSize, userId, attachment.UploadedAt,
+		attachmentProcessingStatus(attachment.ContentType)); err != nil {
+		return err
+	}
+	if target.link != nil {
+		if err := target.link(tx, attachment.ID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if s.processor != nil && processableImageTypes[attachment.ContentType] {
+		s.processor.Enqueue()
+	}
+	return nil
+}
+
+// AttachmentKey is the storage key of an attachment file
+func AttachmentKey(attachmentId, fileName string) string {
+	return "channel_attachments/" + attachmentId + filepath.Ext(fileName)
+}
+
 // GetChannelAttachment retrieves attachment information
 func (s *ChannelMessageService) GetChannelAttachment(attachmentId string) (models.ChannelAttachment, error) {
 	var attachment models.ChannelAttachment
 
 	err := s.DB.QueryRow(`
-		SELECT id, message_id, file_name, file_type, file_path, file_size, uploaded_at
+		SELECT id, COALESCE(channel_id::text, ''), COALESCE(message_id::text, ''), file_name, file_type,
+		       COALESCE(content_type, ''), file_path, file_size,
+		       COALESCE(uploaded_by::text, ''), uploaded_at, COALESCE(width, 0), COALESCE(height, 0),
+		       COALESCE(blurhash, ''), COALESCE(processing_status, '')
 		FROM channel_attachments
 		WHERE id = $1
 	`, attachmentId).Scan(
-		&attachment.ID, &attachment.MessageId, &attachment.FileName,
-		&attachment.FileType, &attachment.FilePath, &attachment.FileSize,
-		&attachment.UploadedAt,
+		&attachment.ID, &attachment.ChannelId, &attachment.MessageId, &attachment.FileName,
+		&attachment.FileType, &attachment.ContentType, &attachment.FilePath, &attachment.FileSize,
+		&attachment.UploadedBy, &attachment.UploadedAt, &attachment.Width, &attachment.Height,
+		&attachment.Blurhash, &attachment.ProcessingStatus,
 	)
 
 	return attachment, err
 }
 
+// GetAttachmentThumbnail returns a thumbnail of an attachment as a
+// ChannelAttachment, so it can be served like the original
+func (s *ChannelMessageService) GetAttachmentThumbnail(attachment models.ChannelAttachment, size int) (models.ChannelAttachment, error) {
+	thumbnail := attachment
+	err := s.DB.QueryRow(`
+		SELECT width, height, content_type, file_path, file_size
+		FROM attachment_thumbnails
+		WHERE attachment_id = $1 AND size = $2
+	`, attachment.ID, size).Scan(
+		&thumbnail.Width, &thumbnail.Height, &thumbnail.ContentType, &thumbnail.FilePath, &thumbnail.FileSize,
+	)
+	if err != nil {
+		return models.ChannelAttachment{}, err
+	}
+	ext := ".jpg"
+	if thumbnail.ContentType == "image/png" {
+		ext = ".png"
+	}
+	thumbnail.FileName = strings.TrimSuffix(attachment.FileName, filepath.Ext(attachment.FileName)) + "-" + strconv.Itoa(size) + ext
+	thumbnail.FileType = getFileType(thumbnail.ContentType)
+	return thumbnail, nil
+}
+
+// GetAttachmentOwner resolves who may read an attachment: the members of the
+// channel it was posted in or, while no message has claimed it yet, only its
+// uploader. Exactly one of channelId and uploaderId is set. Attachments left
+// behind by deleted messages return sql.ErrNoRows.
+func (s *ChannelMessageService) GetAttachmentOwner(attachmentId string) (channelId, uploaderId string, err error) {
+	var messageChannelId, uploadedBy sql.NullString
+	var claimed bool
+	err = s.DB.QueryRow(`
+		SELECT cm.channel_id, ca.uploaded_by, ca.claimed_at IS NOT NULL
+		FROM channel_attachments ca
+		LEFT JOIN channel_messages cm ON ca.message_id = cm.id AND cm.is_deleted = false
+		WHERE ca.id = $1
+	`, attachmentId).Scan(&messageChannelId, &uploadedBy, &claimed)
+	switch {
+	case err != nil:
+		return "", "", err
+	case messageChannelId.Valid:
+		return messageChannelId.String, "", nil
+	case !claimed && uploadedBy.Valid:
+		return "", uploadedBy.String, nil
+	default:
+		return "", "", sql.ErrNoRows
+	}
+}
+
+// AttachmentURL returns a download URL for an attachment. The caller must
+// already have checked that the requester can access the attachment's channel.
+func (s *ChannelMessageService) AttachmentURL(attachment models.ChannelAttachment) string {
+	return s.attachmentURL(attachment.ID, attachment.FileName)
+}
+
+// loadAttachments loads the attachments of the given messages with their
+// download and thumbnail URLs, keyed by message ID
+func (s *ChannelMessageService) loadAttachments(messageIds []string) (map[string][]models.AttachmentInfo, error) {
+	loaded, err := s.queryAttachmentInfos("message_id = ANY($1::uuid[])", pq.Array(messageIds))
+	if err != nil {
+		return nil, err
+	}
+	attachments := make(map[string][]models.AttachmentInfo)
+	for _, attachment := range loaded {
+		attachments[attachment.messageId] = append(attachments[attachment.messageId], attachment.info)
+	}
+	return attachments, nil
+}
+
+// GetAttachmentInfo describes one attachment as it appears in messages. The
+// caller must already have checked that the requester can access it.
+func (s *ChannelMessageService) GetAttachmentInfo(attachmentId string) (*models.AttachmentInfo, error) {
+	loaded, err := s.queryAttachmentInfos("id = $1", attachmentId)
+	if err != nil {
+		return nil, err
+	}
+	if len(loaded) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &loaded[0].info, nil
+}
+
+// messageAttachment is an attachment description with the message it belongs to
+type messageAttachment struct {
+	messageId string
+	info      models.AttachmentInfo
+}
+
+// queryAttachmentInfos loads the attachments matching condition, in upload
+// order, with their URLs and thumbnails
+func (s *ChannelMessageService) queryAttachmentInfos(condition string, arg interface{}) ([]messageAttachment, error) {
+	rows, err := s.DB.Query(`
+		SELECT id, COALESCE(message_id::text, ''), file_name, file_type, COALESCE(content_type, ''), file_size,
+		       COALESCE(width, 0), COALESCE(height, 0), COALESCE(blurhash, ''), COALESCE(processing_status, '')
+		FROM channel_attachments
+		WHERE `+condition+`
+		ORDER BY uploaded_at ASC
+	`, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var loaded []messageAttachment
+	var imageIds []string
+	for rows.Next() {
+		var attachment messageAttachment
+		info := &attachment.info
+		err := rows.Scan(
+			&info.ID, &attachment.messageId, &info.FileName, &info.FileType, &info.ContentType, &info.FileSize,
+			&info.Width, &info.Height, &info.Blurhash, &info.ProcessingStatus,
+		)
+		if err != nil {
+			return nil, err
+		}
+		info.URL = s.attachmentURL(info.ID, info.FileName)
+		if info.ProcessingStatus == models.AttachmentProcessingDone {
+			imageIds = append(imageIds, info.ID)
+		}
+		loaded = append(loaded, attachment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(imageIds) > 0 {
+		thumbnails, err := loadThumbnails(s.DB, imageIds)
+		if err != nil {
+			return nil, err
+		}
+		for i := range loaded {
+			info := &loaded[i].info
+			for _, thumbnail := range thumbnails[info.ID] {
+				thumbnail.URL = thumbnailURL(info.URL, thumbnail.Size)
+				info.Thumbnails = append(info.Thumbnails, thumbnail)
+			}
+		}
+	}
+	return loaded, nil
+}
+
+// attachmentFields splits loaded attachments into the URL list older clients
+// read and the detailed descriptions
+func attachmentFields(attachments []models.AttachmentInfo) ([]string, []models.AttachmentInfo) {
+	if len(attachments) == 0 {
+		return nil, nil
+	}
+	urls := make([]string, len(attachments))
+	for i, attachment := range attachments {
+		urls[i] = attachment.URL
+	}
+	return urls, attachments
+}
+
 // GetChannelMessageAttachments retrieves all attachments for a message
 func (s *ChannelMessageService) GetChannelMessageAttachments(messageId string) ([]models.ChannelAttachment, error) {
 	rows, err := s.DB.Query(`
@@ -225,49 +819,167 @@ func (s *ChannelMessageService) GetChannelMessageAttachments(messageId string) (
 // GetMessageByID gets a message by ID
 func (s *ChannelMessageService) GetMessageByID(messageID string) (*models.ChannelMessage, error) {
 	query := `
-		SELECT id, channel_id, user_id, content, is_edited, is_deleted
+		SELECT id, channel_id, user_id, content, timestamp, is_edited, is_deleted, edited_at, message_type
 		FROM channel_messages
 		WHERE id = $1
 	`
 
 	var message models.ChannelMessage
+	var editedAt sql.NullTime
 	err := s.DB.QueryRow(query, messageID).Scan(
 		&message.ID,
 		&message.ChannelId,
 		&message.UserId,
 		&message.Content,
+		&message.Timestamp,
 		&message.IsEdited,
 		&message.IsDeleted,
+		&editedAt,
+		&message.Type,
 	)
+	if editedAt.Valid {
+		message.EditedAt = editedAt.Time
+	}
 
 	if err != nil {
 		return nil, fmt.Errorf("メッセージの取得に失敗しました: %w", err)
 	}
 
 	// 添付ファイルを取得
-	attachmentsQuery := `
-		SELECT id, file_path, file_name, file_type, file_size
-		FROM channel_attachments
-		WHERE message_id = $1
-	`
-
-	rows, err := s.DB.Query(attachmentsQuery, messageID)
+	attachments, err := s.loadAttachments([]string{messageID})
 	if err != nil {
 		return nil, fmt.Errorf("添付ファイルの取得に失敗しました: %w", err)
 	}
+	message.Attachments, message.AttachmentDetails = attachmentFields(attachments[messageID])
+
+	if message.Type == models.MessageTypePoll {
+		polls, err := loadPollsByMessageIds(s.DB, []string{message.ID})
+		if err != nil {
+			return nil, fmt.Errorf("投票の取得に失敗しました: %w", err)
+		}
+		message.Poll = polls[message.ID]
+	}
+
+	return &message, nil
+}
+
+// PinMessage pins a message to its channel, enforcing the per-channel cap
+func (s *ChannelMessageService) PinMessage(channelId, messageId, userId string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the channel row so concurrent pins cannot exceed the cap
+	if _, err := tx.Exec("SELECT id FROM channels WHERE id = $1 FOR UPDATE", channelId); err != nil {
+		return err
+	}
+
+	var inChannel bool
+	err = tx.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM channel_messages WHERE id = $1 AND channel_id = $2 AND is_deleted = false)",
+		messageId, channelId,
+	).Scan(&inChannel)
+	if err != nil {
+		return err
+	}
+	if !inChannel {
+		return ErrMessageNotInChannel
+	}
+
+	var alreadyPinned bool
+	err = tx.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM channel_pins WHERE channel_id = $1 AND message_id = $2)",
+		channelId, messageId,
+	).Scan(&alreadyPinned)
+	if err != nil {
+		return err
+	}
+	if alreadyPinned {
+		return ErrAlreadyPinned
+	}
+
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM channel_pins WHERE channel_id = $1", channelId).Scan(&count); err != nil {
+		return err
+	}
+	if count >= MaxPinsPerChannel {
+		return ErrPinLimitReached
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO channel_pins (channel_id, message_id, pinned_by, pinned_at) VALUES ($1, $2, $3, $4)",
+		channelId, messageId, userId, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UnpinMessage removes a pinned message from its channel
+func (s *ChannelMessageService) UnpinMessage(channelId, messageId string) error {
+	result, err := s.DB.Exec(
+		"DELETE FROM channel_pins WHERE channel_id = $1 AND message_id = $2",
+		channelId, messageId,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotPinned
+	}
+	return nil
+}
+
+// GetPinnedMessages retrieves the pinned messages of a channel, most recently pinned first
+func (s *ChannelMessageService) GetPinnedMessages(channelId string) ([]models.PinnedMessage, error) {
+	rows, err := s.DB.Query(`
+		SELECT cm.id, cm.content, cm.channel_id, cm.user_id, cm.timestamp,
+		       cm.is_edited, cm.is_deleted, cm.edited_at, u.username, cm.message_type,
+		       p.pinned_by, p.pinned_at, COALESCE(u.display_name, ''), `+avatarColumns+`
+		FROM channel_pins p
+		JOIN channel_messages cm ON p.message_id = cm.id
+		JOIN users u ON cm.user_id = u.id
+		`+avatarJoins+`
+		WHERE p.channel_id = $1 AND cm.is_deleted = false
+		ORDER BY p.pinned_at DESC
+	`, channelId)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
-	var attachments []string
+	var pins []models.PinnedMessage
 	for rows.Next() {
-		var id, filePath, fileName, fileType string
-		var fileSize int64
-		if err := rows.Scan(&id, &filePath, &fileName, &fileType, &fileSize); err != nil {
-			return nil, fmt.Errorf("添付ファイルの読み込みに失敗しました: %w", err)
+		var pin models.PinnedMessage
+		var editedAt sql.NullTime
+		var avatar avatarRef
+
+		err := rows.Scan(
+			&pin.ID, &pin.Content, &pin.ChannelId, &pin.UserId,
+			&pin.Timestamp, &pin.IsEdited, &pin.IsDeleted, &editedAt,
+			&pin.Username, &pin.Type, &pin.PinnedBy, &pin.PinnedAt,
+			&pin.DisplayName, &avatar.attachmentId, &avatar.fileName, &avatar.hasThumbnail,
+		)
+		if err != nil {
+			return nil, err
 		}
-		attachments = append(attachments, filePath)
-	}
+		pin.AvatarURL = s.avatarURL(avatar)
 
-	message.Attachments = attachments
+		if editedAt.Valid {
+			pin.EditedAt = editedAt.Time
+		}
 
-	return &message, nil
+		pins = append(pins, pin)
+	}
+
+	return pins, rows.Err()
 }
@@ -249,6 +249,17 @@ func (s *ChatService) AddMessage(chatID string, message string, userID string) (
 	}, nil
 }
 
+// AskAssistant は会話履歴なしで単発の質問に回答する（/ask コマンド用）
+func (s *ChatService) AskAssistant(question string) (string, error) {
+	return s.generateOpenAIResponse([]models.ChatbotMessage{
+		{
+			Content:   question,
+			Role:      "user",
+			Timestamp: time.Now(),
+		},
+	})
+}
+
 func (s *ChatService) generateOpenAIResponse(messages []models.ChatbotMessage) (string, error) {
 	// OpenAIのメッセージフォーマットに変換
 	openaiMessages := []openai.ChatCompletionMessage{
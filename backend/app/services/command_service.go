@@ -0,0 +1,838 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"app/models"
+)
+
+// Errors returned by CommandService
+var (
+	ErrUnknownCommand     = errors.New("unknown command")
+	ErrCommandNameTaken   = errors.New("a command with this name already exists")
+	ErrInvalidCommandName = errors.New("command names may only contain lowercase letters, digits, '-' and '_'")
+	ErrInvalidCallbackURL = errors.New("the callback URL must be an https URL")
+	// errForbiddenCallbackAddress is returned when dialing a callback that
+	// resolves to the loopback, private or link-local network
+	errForbiddenCallbackAddress = errors.New("callback address is not publicly routable")
+)
+
+// AssistantUserID is the account that posts /ask answers
+const AssistantUserID = "00000000-0000-0000-0000-000000000001"
+
+const (
+	// botCommandTimeout bounds how long a bot callback may take to answer
+	botCommandTimeout = 5 * time.Second
+	// maxBotResponseSize bounds the body read from a bot callback; longer
+	// responses fail to decode
+	maxBotResponseSize = 64 * 1024
+	// maxBotReplyLength is the longest reply, in characters, a bot can post
+	maxBotReplyLength = 4000
+)
+
+var commandNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// CommandContext carries the invocation of a slash command
+type CommandContext struct {
+	ChannelID string
+	ServerID  string // empty for direct conversations
+	UserID    string
+	Name      string
+	Args      []string // arguments split on whitespace, honoring double quotes
+	RawArgs   string   // everything after the command name
+}
+
+// CommandResult is what a command handler produces.
+// Message is posted publicly in the channel; Ephemeral is shown only to the caller.
+type CommandResult struct {
+	Message   *models.ChannelMessage
+	Ephemeral *models.EphemeralMessage
+
+	// persisted is set when the handler already saved and broadcast Message itself
+	persisted bool
+}
+
+// CommandHandlerFunc handles a slash command invocation
+type CommandHandlerFunc func(ctx *CommandContext) (*CommandResult, error)
+
+type registeredCommand struct {
+	definition models.CommandDefinition
+	handler    CommandHandlerFunc
+}
+
+// CommandService parses slash commands in channel messages and dispatches them
+// to built-in handlers or to bot commands registered for the channel's server
+type CommandService struct {
+	db                    *sql.DB
+	channelMessageService *ChannelMessageService
+	serverService         *ServerService
+	chatService           *ChatService
+	pollService           *PollService
+	schedulerService      *ScheduledMessageService
+	wsService             *WebSocketService
+	httpClient            *http.Client
+	commands              map[string]*registeredCommand
+	// insecureCallbacks allows http callbacks on private networks, for developing bots locally
+	insecureCallbacks bool
+}
+
+// NewCommandService creates a new CommandService with the built-in commands registered
+func NewCommandService(db *sql.DB, channelMessageService *ChannelMessageService, serverService *ServerService, chatService *ChatService, pollService *PollService, schedulerService *ScheduledMessageService) *CommandService {
+	s := &CommandService{
+		db:                    db,
+		channelMessageService: channelMessageService,
+		serverService:         serverService,
+		chatService:           chatService,
+		pollService:           pollService,
+		schedulerService:      schedulerService,
+		commands:              make(map[string]*registeredCommand),
+	}
+	s.httpClient = s.newCallbackClient()
+	s.registerBuiltinCommands()
+	return s
+}
+
+// SetInsecureBotCallbacks lets bots use http callbacks and addresses on
+// private networks. Only meant for development: otherwise any server
+// moderator could make the backend call internal services.
+func (s *CommandService) SetInsecureBotCallbacks(allow bool) {
+	s.insecureCallbacks = allow
+}
+
+// newCallbackClient returns the client bot callbacks are called with. The
+// address is checked after DNS resolution, on every connection including
+// redirects, so a public name can't point it at an internal service.
+func (s *CommandService) newCallbackClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: botCommandTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if s.insecureCallbacks {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return errForbiddenCallbackAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: botCommandTimeout,
+		Transport: &http.Transport{
+			// A proxy would make the dialed address the proxy's, not the bot's
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: botCommandTimeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("too many redirects")
+			}
+			return s.checkCallbackURL(req.URL.String())
+		},
+	}
+}
+
+// checkCallbackURL checks that a bot callback URL uses https, or http when
+// insecure callbacks are allowed
+func (s *CommandService) checkCallbackURL(callbackURL string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil || u.Host == "" || u.User != nil {
+		return ErrInvalidCallbackURL
+	}
+	if u.Scheme != "https" && !(s.insecureCallbacks && u.Scheme == "http") {
+		return ErrInvalidCallbackURL
+	}
+	return nil
+}
+
+// isPublicIP reports whether ip is a globally routable unicast address
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	// Carrier-grade NAT (100.64.0.0/10) is internal to the provider's network
+	if ip4 := ip.To4(); ip4 != nil && ip4[0] == 100 && ip4[1]&0xc0 == 64 {
+		return false
+	}
+	return true
+}
+
+// SetWebSocketService はWebSocketServiceを設定する
+func (s *CommandService) SetWebSocketService(wsService *WebSocketService) {
+	s.wsService = wsService
+}
+
+// Register adds a built-in command to the registry
+func (s *CommandService) Register(definition models.CommandDefinition, handler CommandHandlerFunc) {
+	definition.Source = "builtin"
+	if definition.Arguments == nil {
+		definition.Arguments = []models.CommandArgument{}
+	}
+	s.commands[definition.Name] = &registeredCommand{definition: definition, handler: handler}
+}
+
+// IsCommand reports whether a message should be handled as a slash command.
+// Messages starting with "//" are plain text with the first slash removed.
+func IsCommand(content string) bool {
+	return strings.HasPrefix(content, "/") && !strings.HasPrefix(content, "//")
+}
+
+// ParseCommand splits "/name args..." into its name and arguments
+func ParseCommand(content string) (name string, args []string, rawArgs string, ok bool) {
+	if !IsCommand(content) {
+		return "", nil, "", false
+	}
+
+	body := strings.TrimPrefix(content, "/")
+	end := strings.IndexFunc(body, unicode.IsSpace)
+	if end == -1 {
+		end = len(body)
+	}
+	name = strings.ToLower(body[:end])
+	if name == "" {
+		return "", nil, "", false
+	}
+
+	rawArgs = strings.TrimSpace(body[end:])
+	return name, splitCommandArgs(rawArgs), rawArgs, true
+}
+
+// splitCommandArgs splits on whitespace while keeping double-quoted text together
+func splitCommandArgs(raw string) []string {
+	var args []string
+	var current strings.Builder
+	inQuotes := false
+	hasToken := false
+
+	for _, r := range raw {
+		switch {
+		case r == '"' || r == '“' || r == '”':
+			inQuotes = !inQuotes
+			hasToken = true
+		case unicode.IsSpace(r) && !inQuotes:
+			if hasToken {
+				args = append(args, current.String())
+				current.Reset()
+				hasToken = false
+			}
+		default:
+			current.WriteRune(r)
+			hasToken = true
+		}
+	}
+	if hasToken {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// Execute runs the command contained in a message and delivers its replies
+func (s *CommandService) Execute(channelID, userID, content string) (*CommandResult, error) {
+	name, args, rawArgs, ok := ParseCommand(content)
+	if !ok {
+		return nil, ErrUnknownCommand
+	}
+
+	serverID, err := s.serverService.GetServerIdByChannelId(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := &CommandContext{
+		ChannelID: channelID,
+		ServerID:  serverID,
+		UserID:    userID,
+		Name:      name,
+		Args:      args,
+		RawArgs:   rawArgs,
+	}
+
+	var result *CommandResult
+	if command, ok := s.commands[name]; ok {
+		result, err = command.handler(ctx)
+	} else {
+		result, err = s.executeBotCommand(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.deliver(ctx, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListCommands returns the commands available in a channel for autocomplete
+func (s *CommandService) ListCommands(channelID string) ([]models.CommandDefinition, error) {
+	var definitions []models.CommandDefinition
+	for _, command := range s.commands {
+		definitions = append(definitions, command.definition)
+	}
+
+	serverID, err := s.serverService.GetServerIdByChannelId(channelID)
+	if err != nil {
+		return nil, err
+	}
+	if serverID != "" {
+		botCommands, err := s.GetBotCommands(serverID)
+		if err != nil {
+			return nil, err
+		}
+		for _, command := range botCommands {
+			// Built-in commands take precedence over bot commands with the same name
+			if _, ok := s.commands[command.Name]; ok {
+				continue
+			}
+			definitions = append(definitions, models.CommandDefinition{
+				Name:        command.Name,
+				Description: command.Description,
+				Arguments:   command.Arguments,
+				Source:      "bot",
+				BotUserId:   command.BotUserId,
+			})
+		}
+	}
+
+	sort.Slice(definitions, func(i, j int) bool {
+		return definitions[i].Name < definitions[j].Name
+	})
+	return definitions, nil
+}
+
+// deliver saves and broadcasts public replies and pushes ephemeral replies to the caller
+func (s *CommandService) deliver(ctx *CommandContext, result *CommandResult) error {
+	if result == nil {
+		return nil
+	}
+
+	if result.Message != nil && !result.persisted {
+		if result.Message.ID == "" {
+			result.Message.ID = uuid.New().String()
+		}
+		if result.Message.Timestamp.IsZero() {
+			result.Message.Timestamp = time.Now()
+		}
+		result.Message.ChannelId = ctx.ChannelID
+		if err := s.channelMessageService.SaveChannelMessage(*result.Message); err != nil {
+			return err
+		}
+		s.broadcastNewMessage(ctx.ChannelID, result.Message)
+	}
+
+	if result.Ephemeral != nil && s.wsService != nil {
+		if err := s.wsService.SendEphemeral(ctx.ChannelID, ctx.UserID, result.Ephemeral); err != nil {
+			log.Printf("WebSocket一時メッセージ送信エラー: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// broadcastNewMessage broadcasts a message if the WebSocket service is configured
+func (s *CommandService) broadcastNewMessage(channelID string, message *models.ChannelMessage) {
+	if s.wsService == nil {
+		return
+	}
+	if err := s.wsService.BroadcastNewMessage(channelID, message); err != nil {
+		log.Printf("WebSocketブロードキャストエラー: %v", err)
+	}
+}
+
+// publicReply builds a result that posts content in the channel as the given user
+func publicReply(userID, messageType, content string) *CommandResult {
+	return &CommandResult{
+		Message: &models.ChannelMessage{
+			UserId:  userID,
+			Type:    messageType,
+			Content: content,
+		},
+	}
+}
+
+// ephemeralReply builds a result that is shown only to the caller
+func ephemeralReply(ctx *CommandContext, content string) *CommandResult {
+	return &CommandResult{
+		Ephemeral: &models.EphemeralMessage{
+			ID:        uuid.New().String(),
+			ChannelId: ctx.ChannelID,
+			Command:   ctx.Name,
+			Content:   content,
+			Timestamp: time.Now(),
+		},
+	}
+}
+
+// registerBuiltinCommands registers the commands shipped with the server
+func (s *CommandService) registerBuiltinCommands() {
+	s.Register(models.CommandDefinition{
+		Name:        "shrug",
+		Description: "Appends ¯\\_(ツ)_/¯ to your message",
+		Usage:       "/shrug [message]",
+		Arguments: []models.CommandArgument{
+			{Name: "message", Description: "Text to send before the shrug", Type: "string"},
+		},
+	}, s.shrugCommand)
+
+	s.Register(models.CommandDefinition{
+		Name:        "topic",
+		Description: "Shows or changes the channel topic",
+		Usage:       "/topic [new topic]",
+		Arguments: []models.CommandArgument{
+			{Name: "topic", Description: "New topic; leave empty to show the current one", Type: "string"},
+		},
+	}, s.topicCommand)
+
+	s.Register(models.CommandDefinition{
+		Name:        "remind",
+		Description: "Reminds you about something later",
+		Usage:       "/remind me in <duration> <message>",
+		Arguments: []models.CommandArgument{
+			{Name: "who", Description: "Who to remind", Type: "string", Required: true, Choices: []string{"me"}},
+			{Name: "when", Description: "For example: in 2h, in 30m, in 1d", Type: "duration", Required: true},
+			{Name: "message", Description: "What to be reminded about", Type: "string", Required: true},
+		},
+	}, s.remindCommand)
+
+	s.Register(models.CommandDefinition{
+		Name:        "poll",
+		Description: "Starts a poll in the channel",
+		Usage:       `/poll "question" "option 1" "option 2" ... [--multi] [--anonymous] [--close 2h]`,
+		Arguments: []models.CommandArgument{
+			{Name: "question", Description: "The question to ask", Type: "string", Required: true},
+			{Name: "options", Description: "Two to ten quoted options", Type: "string", Required: true},
+			{Name: "--multi", Description: "Allow choosing several options", Type: "string"},
+			{Name: "--anonymous", Description: "Hide who voted for what", Type: "string"},
+			{Name: "--close", Description: "Close the poll after a duration, for example 2h", Type: "duration"},
+		},
+	}, s.pollCommand)
+
+	s.Register(models.CommandDefinition{
+		Name:        "ask",
+		Description: "Asks the AI assistant and posts the answer in the channel",
+		Usage:       "/ask <question>",
+		Arguments: []models.CommandArgument{
+			{Name: "question", Description: "What to ask the assistant", Type: "string", Required: true},
+		},
+	}, s.askCommand)
+}
+
+// shrugCommand posts the caller's text followed by a shrug
+func (s *CommandService) shrugCommand(ctx *CommandContext) (*CommandResult, error) {
+	content := strings.TrimSpace(ctx.RawArgs + ` ¯\_(ツ)_/¯`)
+	return publicReply(ctx.UserID, models.MessageTypeUser, content), nil
+}
+
+// topicCommand shows the current topic or changes it
+func (s *CommandService) topicCommand(ctx *CommandContext) (*CommandResult, error) {
+	if ctx.RawArgs == "" {
+		channel, err := s.serverService.GetChannelByID(ctx.ChannelID)
+		if err != nil {
+			return nil, err
+		}
+		if channel.Topic == "" {
+			return ephemeralReply(ctx, "This channel has no topic."), nil
+		}
+		return ephemeralReply(ctx, "Current topic: "+channel.Topic), nil
+	}
+
+	topic := ctx.RawArgs
+	if len([]rune(topic)) > 250 {
+		return ephemeralReply(ctx, "Topics can be at most 250 characters."), nil
+	}
+
+	if err := s.serverService.SetChannelTopic(ctx.ChannelID, topic, ctx.UserID); err != nil {
+		return nil, err
+	}
+
+	channel, err := s.serverService.GetChannelByID(ctx.ChannelID)
+	if err != nil {
+		return nil, err
+	}
+
+	systemMessage, err := s.channelMessageService.SaveSystemMessage(ctx.ChannelID, ctx.UserID, "changed the topic to: "+topic)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.wsService != nil {
+		if err := s.wsService.BroadcastChannelUpdate(ctx.ChannelID, channel); err != nil {
+			log.Printf("WebSocketブロードキャストエラー: %v", err)
+		}
+	}
+	s.broadcastNewMessage(ctx.ChannelID, systemMessage)
+
+	return &CommandResult{Message: systemMessage, persisted: true}, nil
+}
+
+// remindCommand schedules a reminder delivered to the caller's own direct conversation
+func (s *CommandService) remindCommand(ctx *CommandContext) (*CommandResult, error) {
+	delay, text, ok := parseReminder(ctx.Args)
+	if !ok {
+		return ephemeralReply(ctx, "Usage: /remind me in <duration> <message> (for example: /remind me in 2h check the build)"), nil
+	}
+
+	if _, err := s.schedulerService.ScheduleReminder(ctx.UserID, text, time.Now().Add(delay)); err != nil {
+		if errors.Is(err, ErrScheduleTooFar) {
+			return ephemeralReply(ctx, "Reminders can be set at most one year ahead."), nil
+		}
+		return nil, err
+	}
+
+	return ephemeralReply(ctx, fmt.Sprintf("OK, I will remind you in %s: %s", delay, text)), nil
+}
+
+// pollCommand creates a structured poll from quoted arguments and flags
+func (s *CommandService) pollCommand(ctx *CommandContext) (*CommandResult, error) {
+	usage := `Usage: /poll "question" "option 1" "option 2" ... [--multi] [--anonymous] [--close 2h]`
+
+	var req models.PollRequest
+	var texts []string
+	for i := 0; i < len(ctx.Args); i++ {
+		switch strings.ToLower(ctx.Args[i]) {
+		case "--multi":
+			req.AllowMultiple = true
+		case "--anonymous", "--anon":
+			req.IsAnonymous = true
+		case "--close":
+			if i+1 >= len(ctx.Args) {
+				return ephemeralReply(ctx, usage), nil
+			}
+			delay, err := parseHumanDuration(ctx.Args[i+1])
+			if err != nil || delay <= 0 {
+				return ephemeralReply(ctx, "Invalid close time: "+ctx.Args[i+1]), nil
+			}
+			closesAt := time.Now().Add(delay)
+			req.ClosesAt = &closesAt
+			i++
+		default:
+			texts = append(texts, ctx.Args[i])
+		}
+	}
+
+	if len(texts) < 3 || len(texts) > 11 {
+		return ephemeralReply(ctx, usage), nil
+	}
+	req.Question = texts[0]
+	req.Options = texts[1:]
+	if len([]rune(req.Question)) > 300 {
+		return ephemeralReply(ctx, "Poll questions can be at most 300 characters."), nil
+	}
+	for _, option := range req.Options {
+		if len([]rune(option)) > 100 {
+			return ephemeralReply(ctx, "Poll options can be at most 100 characters."), nil
+		}
+	}
+
+	message, err := s.pollService.CreatePoll(ctx.ChannelID, ctx.UserID, req)
+	if err != nil {
+		return nil, err
+	}
+	s.broadcastNewMessage(ctx.ChannelID, message)
+
+	return &CommandResult{Message: message, persisted: true}, nil
+}
+
+// askCommand posts the question and then, as AssistantUserID, the answer once it arrives
+func (s *CommandService) askCommand(ctx *CommandContext) (*CommandResult, error) {
+	if ctx.RawArgs == "" {
+		return ephemeralReply(ctx, "Usage: /ask <question>"), nil
+	}
+	if s.chatService == nil {
+		return ephemeralReply(ctx, "The assistant is not available."), nil
+	}
+
+	question := ctx.RawArgs
+	answerCtx := *ctx
+	go func() {
+		answer, err := s.chatService.AskAssistant(question)
+		if err != nil {
+			log.Printf("/ask の応答生成エラー: %v", err)
+			s.deliver(&answerCtx, ephemeralReply(&answerCtx, "The assistant could not answer right now."))
+			return
+		}
+		if err := s.deliver(&answerCtx, publicReply(AssistantUserID, models.MessageTypeBot, answer)); err != nil {
+			log.Printf("/ask の応答保存エラー: %v", err)
+		}
+	}()
+
+	return publicReply(ctx.UserID, models.MessageTypeUser, "/ask "+question), nil
+}
+
+// parseReminder parses "me in 2h text" or "in 2h text"
+func parseReminder(args []string) (time.Duration, string, bool) {
+	if len(args) > 0 && strings.EqualFold(args[0], "me") {
+		args = args[1:]
+	}
+	if len(args) < 3 || !strings.EqualFold(args[0], "in") {
+		return 0, "", false
+	}
+
+	delay, err := parseHumanDuration(args[1])
+	if err != nil || delay <= 0 {
+		return 0, "", false
+	}
+
+	return delay, strings.Join(args[2:], " "), true
+}
+
+// parseHumanDuration parses Go durations plus a "d" suffix for days (for example "1d12h")
+func parseHumanDuration(value string) (time.Duration, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	var days time.Duration
+	if i := strings.Index(value, "d"); i > 0 {
+		var n int
+		if _, err := fmt.Sscanf(value[:i], "%d", &n); err != nil {
+			return 0, err
+		}
+		days = time.Duration(n) * 24 * time.Hour
+		value = value[i+1:]
+		if value == "" {
+			return days, nil
+		}
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	return days + d, nil
+}
+
+// RegisterBotCommand registers a bot command for a server and returns its
+// signing secret. The command gets an account of its own that its public
+// replies are posted as, so a bot never speaks as a member.
+func (s *CommandService) RegisterBotCommand(serverID, createdBy string, req models.BotCommandRequest) (*models.BotCommand, string, error) {
+	name := strings.ToLower(strings.TrimPrefix(req.Name, "/"))
+	if !commandNamePattern.MatchString(name) {
+		return nil, "", ErrInvalidCommandName
+	}
+	if _, ok := s.commands[name]; ok {
+		return nil, "", ErrCommandNameTaken
+	}
+
+	if err := s.checkCallbackURL(req.CallbackURL); err != nil {
+		return nil, "", err
+	}
+
+	arguments := req.Arguments
+	if arguments == nil {
+		arguments = []models.CommandArgument{}
+	}
+	argumentsJSON, err := json.Marshal(arguments)
+	if err != nil {
+		return nil, "", err
+	}
+
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return nil, "", err
+	}
+	secret := hex.EncodeToString(secretBytes)
+
+	command := &models.BotCommand{
+		ID:          uuid.New().String(),
+		ServerId:    serverID,
+		BotUserId:   uuid.New().String(),
+		Name:        name,
+		Description: req.Description,
+		Arguments:   arguments,
+		CallbackURL: req.CallbackURL,
+		CreatedBy:   createdBy,
+		CreatedAt:   time.Now(),
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	// Like the deleted-user tombstone, the bot account can't sign in: it has
+	// no password and its email is not an address
+	botUsername := "bot-" + command.ID
+	if _, err := tx.Exec(`
+		INSERT INTO users (id, username, email, password, display_name, discoverable, created_at, updated_at)
+		VALUES ($1, $2, $2, '', $3, FALSE, $4, $4)
+	`, command.BotUserId, botUsername, "/"+name, command.CreatedAt); err != nil {
+		return nil, "", err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO bot_commands (id, server_id, bot_user_id, name, description, arguments, callback_url, signing_secret, created_by, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $10)
+	`, command.ID, serverID, command.BotUserId, name, req.Description, argumentsJSON, req.CallbackURL, secret, createdBy, command.CreatedAt)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			return nil, "", ErrCommandNameTaken
+		}
+		return nil, "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+
+	return command, secret, nil
+}
+
+// DeleteBotCommand removes a bot command from a server
+func (s *CommandService) DeleteBotCommand(serverID, name string) error {
+	result, err := s.db.Exec("DELETE FROM bot_commands WHERE server_id = $1 AND name = $2", serverID, strings.ToLower(name))
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrUnknownCommand
+	}
+	return nil
+}
+
+// GetBotCommands returns the bot commands registered for a server
+func (s *CommandService) GetBotCommands(serverID string) ([]models.BotCommand, error) {
+	rows, err := s.db.Query(`
+		SELECT id, server_id, bot_user_id, name, description, arguments, callback_url, created_by, created_at
+		FROM bot_commands
+		WHERE server_id = $1
+		ORDER BY name ASC
+	`, serverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var commands []models.BotCommand
+	for rows.Next() {
+		var command models.BotCommand
+		var argumentsJSON []byte
+		if err := rows.Scan(
+			&command.ID, &command.ServerId, &command.BotUserId, &command.Name, &command.Description,
+			&argumentsJSON, &command.CallbackURL, &command.CreatedBy, &command.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(argumentsJSON, &command.Arguments); err != nil {
+			return nil, err
+		}
+		commands = append(commands, command)
+	}
+
+	return commands, rows.Err()
+}
+
+// botCommandPayload is the JSON body sent to a bot's callback URL
+type botCommandPayload struct {
+	Command   string    `json:"command"`
+	Args      []string  `json:"args"`
+	RawArgs   string    `json:"rawArgs"`
+	ChannelID string    `json:"channelId"`
+	ServerID  string    `json:"serverId"`
+	UserID    string    `json:"userId"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// botCommandResponse is the JSON body a bot answers with
+type botCommandResponse struct {
+	Content   string `json:"content"`
+	Ephemeral bool   `json:"ephemeral"`
+}
+
+// executeBotCommand forwards a command to the bot that registered it in the channel's server
+func (s *CommandService) executeBotCommand(ctx *CommandContext) (*CommandResult, error) {
+	if ctx.ServerID == "" {
+		return nil, ErrUnknownCommand
+	}
+
+	var botUserID, callbackURL, secret string
+	err := s.db.QueryRow(
+		"SELECT bot_user_id, callback_url, signing_secret FROM bot_commands WHERE server_id = $1 AND name = $2",
+		ctx.ServerID, ctx.Name,
+	).Scan(&botUserID, &callbackURL, &secret)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUnknownCommand
+		}
+		return nil, err
+	}
+
+	// Commands registered before callbacks had to use https are refused too
+	if err := s.checkCallbackURL(callbackURL); err != nil {
+		return ephemeralReply(ctx, fmt.Sprintf("/%s is not available: its callback URL must use https.", ctx.Name)), nil
+	}
+
+	body, err := json.Marshal(botCommandPayload{
+		Command:   ctx.Name,
+		Args:      ctx.Args,
+		RawArgs:   ctx.RawArgs,
+		ChannelID: ctx.ChannelID,
+		ServerID:  ctx.ServerID,
+		UserID:    ctx.UserID,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Command-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		log.Printf("ボットコマンド /%s の呼び出しエラー: %v", ctx.Name, err)
+		return ephemeralReply(ctx, fmt.Sprintf("/%s did not respond.", ctx.Name)), nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return ephemeralReply(ctx, fmt.Sprintf("/%s failed with status %d.", ctx.Name, resp.StatusCode)), nil
+	}
+
+	var reply botCommandResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxBotResponseSize)).Decode(&reply); err != nil {
+		return ephemeralReply(ctx, fmt.Sprintf("/%s returned an invalid response.", ctx.Name)), nil
+	}
+	if reply.Content == "" {
+		return nil, nil
+	}
+	reply.Content = truncateRunes(reply.Content, maxBotReplyLength)
+	if reply.Ephemeral {
+		return ephemeralReply(ctx, reply.Content), nil
+	}
+	return publicReply(botUserID, models.MessageTypeBot, reply.Content), nil
+}
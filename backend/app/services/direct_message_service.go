@@ -0,0 +1,284 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"app/models"
+)
+
+// MaxGroupDMParticipants is the largest number of users allowed in a group DM, including its creator
+const MaxGroupDMParticipants = 10
+
+// Errors returned by DirectMessageService
+var (
+	ErrTooManyParticipants  = fmt.Errorf("a group conversation can have at most %d participants", MaxGroupDMParticipants)
+	ErrUnknownParticipant   = errors.New("one or more users do not exist")
+	ErrConversationNotFound = errors.New("conversation not found")
+)
+
+// DirectMessageService handles direct conversations between users outside of servers.
+// Conversations are stored as channels without a server, so messages and attachments
+// go through ChannelMessageService like any other channel.
+type DirectMessageService struct {
+	db *sql.DB
+}
+
+// NewDirectMessageService creates a new DirectMessageService
+func NewDirectMessageService(db *sql.DB) *DirectMessageService {
+	return &DirectMessageService{
+		db: db,
+	}
+}
+
+// OpenConversation returns the one-to-one conversation between the users, creating it if needed,
+// or creates a new group conversation when more than two users (or a name) are given.
+// The boolean result reports whether a new conversation was created.
+func (s *DirectMessageService) OpenConversation(creatorId string, userIds []string, name string) (*models.DirectConversation, bool, error) {
+	participants, err := uniqueParticipants(creatorId, userIds)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(participants) > MaxGroupDMParticipants {
+		return nil, false, ErrTooManyParticipants
+	}
+
+	var count int
+	err = s.db.QueryRow("SELECT COUNT(*) FROM users WHERE id = ANY($1::uuid[])", pq.Array(participants)).Scan(&count)
+	if err != nil {
+		return nil, false, err
+	}
+	if count != len(participants) {
+		return nil, false, ErrUnknownParticipant
+	}
+
+	kind := models.ChannelKindGroupDM
+	var dmKey sql.NullString
+	if len(participants) <= 2 && name == "" {
+		kind = models.ChannelKindDM
+		dmKey = sql.NullString{String: strings.Join(participants, ":"), Valid: true}
+
+		// Reuse the existing one-to-one conversation and reopen it for the caller
+		var channelId string
+		err := s.db.QueryRow("SELECT id FROM channels WHERE dm_key = $1", dmKey.String).Scan(&channelId)
+		if err == nil {
+			if err := s.SetConversationClosed(channelId, creatorId, false); err != nil {
+				return nil, false, err
+			}
+			conversation, err := s.GetConversation(channelId, creatorId)
+			return conversation, false, err
+		}
+		if err != sql.ErrNoRows {
+			return nil, false, err
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	channelId := uuid.New().String()
+	now := time.Now()
+
+	_, err = tx.Exec(`
+		INSERT INTO channels (id, server_id, name, description, is_private, kind, dm_key, created_by, created_at, updated_at)
+		VALUES ($1, NULL, $2, '', true, $3, $4, $5, $6, $6)
+	`, channelId, name, kind, dmKey, creatorId, now)
+	if err != nil {
+		// Another request created the same one-to-one conversation first
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" && dmKey.Valid {
+			tx.Rollback()
+			return s.OpenConversation(creatorId, userIds, name)
+		}
+		return nil, false, err
+	}
+
+	for _, userId := range participants {
+		_, err = tx.Exec(
+			"INSERT INTO channel_members (id, channel_id, user_id, added_at) VALUES ($1, $2, $3, $4)",
+			uuid.New().String(), channelId, userId, now,
+		)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+
+	conversation, err := s.GetConversation(channelId, creatorId)
+	return conversation, true, err
+}
+
+// GetUserConversations returns the user's open conversations ordered by latest activity
+func (s *DirectMessageService) GetUserConversations(userId string) ([]models.DirectConversation, error) {
+	rows, err := s.db.Query(`
+		SELECT c.id, c.kind, c.name, c.created_by, c.created_at, c.last_message_at
+		FROM channels c
+		JOIN channel_members cm ON cm.channel_id = c.id
+		WHERE cm.user_id = $1 AND cm.is_closed = false AND c.kind IN ('dm', 'group_dm')
+		ORDER BY COALESCE(c.last_message_at, c.created_at) DESC
+	`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conversations []models.DirectConversation
+	for rows.Next() {
+		conversation, err := scanConversation(rows)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, conversation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range conversations {
+		participants, err := s.getParticipants(conversations[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		conversations[i].Participants = participants
+	}
+
+	return conversations, nil
+}
+
+// GetConversation returns a conversation the user takes part in
+func (s *DirectMessageService) GetConversation(channelId, userId string) (*models.DirectConversation, error) {
+	row := s.db.QueryRow(`
+		SELECT c.id, c.kind, c.name, c.created_by, c.created_at, c.last_message_at
+		FROM channels c
+		JOIN channel_members cm ON cm.channel_id = c.id
+		WHERE c.id = $1 AND cm.user_id = $2 AND c.kind IN ('dm', 'group_dm')
+	`, channelId, userId)
+
+	conversation, err := scanConversation(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrConversationNotFound
+		}
+		return nil, err
+	}
+
+	participants, err := s.getParticipants(channelId)
+	if err != nil {
+		return nil, err
+	}
+	conversation.Participants = participants
+
+	return &conversation, nil
+}
+
+// SetConversationClosed hides a conversation from the user's list or reopens it
+func (s *DirectMessageService) SetConversationClosed(channelId, userId string, closed bool) error {
+	result, err := s.db.Exec(`
+		UPDATE channel_members cm
+		SET is_closed = $1
+		FROM channels c
+		WHERE cm.channel_id = c.id AND c.id = $2 AND cm.user_id = $3 AND c.kind IN ('dm', 'group_dm')
+	`, closed, channelId, userId)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrConversationNotFound
+	}
+	return nil
+}
+
+// getParticipants returns the users taking part in a conversation
+func (s *DirectMessageService) getParticipants(channelId string) ([]models.DirectParticipant, error) {
+	rows, err := s.db.Query(`
+		SELECT u.id, u.username
+		FROM channel_members cm
+		JOIN users u ON cm.user_id = u.id
+		WHERE cm.channel_id = $1
+		ORDER BY cm.added_at ASC, u.username ASC
+	`, channelId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var participants []models.DirectParticipant
+	for rows.Next() {
+		var participant models.DirectParticipant
+		if err := rows.Scan(&participant.UserId, &participant.Username); err != nil {
+			return nil, err
+		}
+		participants = append(participants, participant)
+	}
+
+	return participants, rows.Err()
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanConversation scans a conversation row without its participants
+func scanConversation(row rowScanner) (models.DirectConversation, error) {
+	var conversation models.DirectConversation
+	var createdBy sql.NullString
+	var lastMessageAt sql.NullTime
+
+	err := row.Scan(
+		&conversation.ID, &conversation.Kind, &conversation.Name,
+		&createdBy, &conversation.CreatedAt, &lastMessageAt,
+	)
+	if err != nil {
+		return conversation, err
+	}
+
+	conversation.CreatedBy = createdBy.String
+	if lastMessageAt.Valid {
+		conversation.LastMessageAt = &lastMessageAt.Time
+	}
+
+	return conversation, nil
+}
+
+// uniqueParticipants returns the sorted, de-duplicated participant IDs including the creator.
+// IDs are canonicalized first, so the same user in different case yields the same dm_key.
+func uniqueParticipants(creatorId string, userIds []string) ([]string, error) {
+	seen := map[string]bool{}
+	var participants []string
+	for _, userId := range append([]string{creatorId}, userIds...) {
+		userId = strings.TrimSpace(userId)
+		if userId == "" {
+			continue
+		}
+		parsed, err := uuid.Parse(userId)
+		if err != nil {
+			return nil, ErrUnknownParticipant
+		}
+		userId = parsed.String()
+		if seen[userId] {
+			continue
+		}
+		seen[userId] = true
+		participants = append(participants, userId)
+	}
+	sort.Strings(participants)
+	return participants, nil
+}
@@ -0,0 +1,1025 @@
+package services
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"app/models"
+	"app/storage"
+)
+
+// Errors returned by ExportService
+var (
+	ErrExportNotFound  = errors.New("export not found")
+	ErrExportForbidden = errors.New("you must be able to read every exported channel")
+	ErrExportNotReady  = errors.New("export is not ready for download")
+	ErrNothingToExport = errors.New("there are no channels to export")
+)
+
+const (
+	// exportRetention is how long a finished archive can be downloaded
+	exportRetention = 7 * 24 * time.Hour
+	// exportLease is how long a replica owns the job it is building. The lease
+	// is renewed while the archive is written, so a job whose lease expires
+	// was left behind by a replica that crashed or hung.
+	exportLease = 2 * time.Minute
+)
+
+// errExportLeaseLost stops a build whose job was claimed by another replica
+var errExportLeaseLost = errors.New("export was taken over by another worker")
+
+// ExportService builds zip archives of channel history in the background.
+// Each archive contains manifest.json and, per channel, messages.json,
+// messages.md, transcript.html and the attachment files. Account exports
+// hold only the requester's own messages, plus their profile, memberships
+// and AI chats.
+type ExportService struct {
+	db                    *sql.DB
+	channelMessageService *ChannelMessageService
+	serverService         *ServerService
+	profileService        *ProfileService
+}
+
+// NewExportService creates a new ExportService
+func NewExportService(db *sql.DB, channelMessageService *ChannelMessageService, serverService *ServerService) *ExportService {
+	return &ExportService{
+		db:                    db,
+		channelMessageService: channelMessageService,
+		serverService:         serverService,
+	}
+}
+
+// Files returns the storage the archives are kept in
+func (s *ExportService) Files() *storage.Manager {
+	return s.channelMessageService.Files()
+}
+
+// SetProfileService sets the service whose profiles go into account exports
+func (s *ExportService) SetProfileService(profileService *ProfileService) {
+	s.profileService = profileService
+}
+
+// ExportChannel starts an export of a single channel
+func (s *ExportService) ExportChannel(channelId, userId string) (*models.ExportJob, error) {
+	hasAccess, err := s.serverService.HasChannelAccess(channelId, userId)
+	if err != nil {
+		return nil, err
+	}
+	if !hasAccess {
+		return nil, ErrExportForbidden
+	}
+
+	serverId, err := s.serverService.GetServerIdByChannelId(channelId)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &models.ExportJob{
+		Scope:         models.ExportScopeChannel,
+		ServerId:      serverId,
+		ChannelId:     channelId,
+		TotalChannels: 1,
+	}
+	return s.start(job, userId, []string{channelId})
+}
+
+// ExportServer starts an export of every channel in a server. The requester must
+// be able to read all of them, including private channels.
+func (s *ExportService) ExportServer(serverId, userId string) (*models.ExportJob, error) {
+	channelIds, err := s.exportableServerChannels(serverId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &models.ExportJob{
+		Scope:         models.ExportScopeServer,
+		ServerId:      serverId,
+		TotalChannels: len(channelIds),
+	}
+	return s.start(job, userId, channelIds)
+}
+
+// exportableServerChannels lists the server's channels, failing if any is unreadable
+func (s *ExportService) exportableServerChannels(serverId, userId string) ([]string, error) {
+	isMember, err := s.serverService.IsServerMember(serverId, userId)
+	if err != nil {
+		return nil, err
+	}
+	if !isMember {
+		return nil, ErrExportForbidden
+	}
+
+	rows, err := s.db.Query("SELECT id FROM channels WHERE server_id = $1 ORDER BY created_at", serverId)
+	if err != nil {
+		return nil, err
+	}
+	var channelIds []string
+	for rows.Next() {
+		var channelId string
+		if err := rows.Scan(&channelId); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		channelIds = append(channelIds, channelId)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(channelIds) == 0 {
+		return nil, ErrNothingToExport
+	}
+
+	for _, channelId := range channelIds {
+		hasAccess, err := s.serverService.HasChannelAccess(channelId, userId)
+		if err != nil {
+			return nil, err
+		}
+		if !hasAccess {
+			return nil, ErrExportForbidden
+		}
+	}
+	return channelIds, nil
+}
+
+// AccountExport returns the user's personal data export, starting one when
+// none is in progress or ready for download
+func (s *ExportService) AccountExport(userId string) (*models.ExportJob, error) {
+	row := s.db.QueryRow(`
+		SELECT id, requested_by, scope, server_id, channel_id, status, total_channels,
+		       processed_channels, processed_messages, file_path, file_size, error,
+		       created_at, started_at, completed_at, expires_at
+		FROM export_jobs
+		WHERE requested_by = $1 AND scope = $2 AND status IN ('queued', 'running', 'completed')
+		ORDER BY created_at DESC
+		LIMIT 1
+	`, userId, models.ExportScopeAccount)
+	job, err := scanExportJob(row)
+	if err == nil {
+		return &job, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	channelIds, err := s.accountChannels(userId)
+	if err != nil {
+		return nil, err
+	}
+	return s.start(&models.ExportJob{
+		Scope:         models.ExportScopeAccount,
+		TotalChannels: len(channelIds),
+	}, userId, channelIds)
+}
+
+// accountChannels lists the channels the user has posted in, including ones
+// they can no longer read
+func (s *ExportService) accountChannels(userId string) ([]string, error) {
+	rows, err := s.db.Query(`
+		SELECT channel_id FROM channel_messages
+		WHERE user_id = $1 AND is_deleted = false
+		GROUP BY channel_id
+		ORDER BY MIN(timestamp)
+	`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channelIds []string
+	for rows.Next() {
+		var channelId string
+		if err := rows.Scan(&channelId); err != nil {
+			return nil, err
+		}
+		channelIds = append(channelIds, channelId)
+	}
+	return channelIds, rows.Err()
+}
+
+// start records a queued job and builds the archive in the background
+func (s *ExportService) start(job *models.ExportJob, userId string, channelIds []string) (*models.ExportJob, error) {
+	job.ID = uuid.New().String()
+	job.RequestedBy = userId
+	job.Status = models.ExportStatusQueued
+	job.CreatedAt = time.Now()
+
+	_, err := s.db.Exec(`
+		INSERT INTO export_jobs (id, requested_by, scope, server_id, channel_id, status, total_channels, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, job.ID, userId, job.Scope, nullIfEmpty(job.ServerId), nullIfEmpty(job.ChannelId),
+		job.Status, job.TotalChannels, job.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	go s.run(job, channelIds)
+	return job, nil
+}
+
+// GetExport returns an export job requested by the user
+func (s *ExportService) GetExport(exportId, userId string) (*models.ExportJob, error) {
+	row := s.db.QueryRow(`
+		SELECT id, requested_by, scope, server_id, channel_id, status, total_channels,
+		       processed_channels, processed_messages, file_path, file_size, error,
+		       created_at, started_at, completed_at, expires_at
+		FROM export_jobs
+		WHERE id = $1 AND requested_by = $2
+	`, exportId, userId)
+
+	job, err := scanExportJob(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrExportNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// GetUserExports lists the user's export jobs, newest first
+func (s *ExportService) GetUserExports(userId string) ([]models.ExportJob, error) {
+	rows, err := s.db.Query(`
+		SELECT id, requested_by, scope, server_id, channel_id, status, total_channels,
+		       processed_channels, processed_messages, file_path, file_size, error,
+		       created_at, started_at, completed_at, expires_at
+		FROM export_jobs
+		WHERE requested_by = $1
+		ORDER BY created_at DESC
+	`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []models.ExportJob{}
+	for rows.Next() {
+		job, err := scanExportJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// GetDownloadPath returns the archive of a completed export and a file name for it
+func (s *ExportService) GetDownloadPath(exportId, userId string) (string, string, error) {
+	job, err := s.GetExport(exportId, userId)
+	if err != nil {
+		return "", "", err
+	}
+	if job.Status != models.ExportStatusCompleted || job.FilePath == "" {
+		return "", "", ErrExportNotReady
+	}
+	name := fmt.Sprintf("export-%s-%s.zip", job.Scope, job.CreatedAt.Format("20060102-150405"))
+	return job.FilePath, name, nil
+}
+
+// ResumeInterruptedExports restarts jobs that no replica is building: ones
+// still queued, and running ones whose lease expired because the replica
+// building them stopped. Jobs are claimed atomically, so a job is resumed by
+// at most one replica. Archives are rebuilt from scratch.
+func (s *ExportService) ResumeInterruptedExports() error {
+	now := time.Now()
+	rows, err := s.db.Query(`
+		UPDATE export_jobs
+		SET status = 'running', started_at = $1, locked_until = $2, locked_by = gen_random_uuid(),
+		    processed_channels = 0, processed_messages = 0
+		WHERE id IN (
+			SELECT id FROM export_jobs
+			WHERE status = 'queued'
+			   OR (status = 'running' AND (locked_until IS NULL OR locked_until < $1))
+			ORDER BY created_at
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, requested_by, scope, server_id, channel_id, status, total_channels,
+		          processed_channels, processed_messages, file_path, file_size, error,
+		          created_at, started_at, completed_at, expires_at, locked_by
+	`, now, now.Add(exportLease))
+	if err != nil {
+		return err
+	}
+	var jobs []models.ExportJob
+	var leases []string
+	for rows.Next() {
+		var lease string
+		job, err := scanExportJob(rows, &lease)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		jobs = append(jobs, job)
+		leases = append(leases, lease)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range jobs {
+		job := &jobs[i]
+		// Access is checked again since membership may have changed
+		var channelIds []string
+		switch job.Scope {
+		case models.ExportScopeServer:
+			channelIds, err = s.exportableServerChannels(job.ServerId, job.RequestedBy)
+		case models.ExportScopeAccount:
+			channelIds, err = s.accountChannels(job.RequestedBy)
+		default:
+			channelIds, err = s.exportableChannel(job.ChannelId, job.RequestedBy)
+		}
+		if err != nil {
+			s.fail(job.ID, leases[i], err)
+			continue
+		}
+		go s.build(job, leases[i], channelIds)
+	}
+	return nil
+}
+
+// exportableChannel checks that the user can still read a channel being exported
+func (s *ExportService) exportableChannel(channelId, userId string) ([]string, error) {
+	hasAccess, err := s.serverService.HasChannelAccess(channelId, userId)
+	if err != nil {
+		return nil, err
+	}
+	if !hasAccess {
+		return nil, ErrExportForbidden
+	}
+	return []string{channelId}, nil
+}
+
+// StartCleanup removes expired archives and resumes abandoned jobs at the
+// given interval
+func (s *ExportService) StartCleanup(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.removeExpiredExports(); err != nil {
+				log.Printf("エクスポートのクリーンアップエラー: %v", err)
+			}
+			if err := s.ResumeInterruptedExports(); err != nil {
+				log.Printf("エクスポート再開エラー: %v", err)
+			}
+		}
+	}()
+}
+
+func (s *ExportService) removeExpiredExports() error {
+	rows, err := s.db.Query(`
+		UPDATE export_jobs SET status = 'expired'
+		WHERE status = 'completed' AND expires_at <= $1
+		RETURNING file_path
+	`, time.Now())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var filePath sql.NullString
+		if err := rows.Scan(&filePath); err != nil {
+			return err
+		}
+		if filePath.Valid {
+			s.removeArchive(filePath.String)
+		}
+	}
+	return rows.Err()
+}
+
+// run claims a newly queued job and builds its archive. The job is left alone
+// if another replica resumed it first.
+func (s *ExportService) run(job *models.ExportJob, channelIds []string) {
+	now := time.Now()
+	lease := uuid.New().String()
+	result, err := s.db.Exec(`
+		UPDATE export_jobs
+		SET status = 'running', started_at = $1, total_channels = $2, processed_channels = 0, processed_messages = 0,
+		    locked_until = $3, locked_by = $4
+		WHERE id = $5
+		  AND (status = 'queued' OR (status = 'running' AND (locked_until IS NULL OR locked_until < $1)))
+	`, now, len(channelIds), now.Add(exportLease), lease, job.ID)
+	if err != nil {
+		log.Printf("エクスポート %s の開始エラー: %v", job.ID, err)
+		return
+	}
+	if claimed, err := result.RowsAffected(); err != nil || claimed == 0 {
+		return
+	}
+	s.build(job, lease, channelIds)
+}
+
+// build writes the archive of a job claimed under lease, renewing the lease
+// until it is done. The result is only recorded while the lease is held.
+func (s *ExportService) build(job *models.ExportJob, lease string, channelIds []string) {
+	done := make(chan struct{})
+	defer close(done)
+	go s.renewLease(job.ID, lease, done)
+
+	filePath, size, err := s.buildArchive(job, lease, channelIds)
+	if err == errExportLeaseLost {
+		log.Printf("エクスポート %s は別のワーカーに引き継がれました", job.ID)
+		return
+	}
+	if err != nil {
+		log.Printf("エクスポート %s の作成エラー: %v", job.ID, err)
+		s.fail(job.ID, lease, err)
+		return
+	}
+
+	now := time.Now()
+	result, err := s.db.Exec(`
+		UPDATE export_jobs
+		SET status = 'completed', file_path = $1, file_size = $2, completed_at = $3, expires_at = $4,
+		    locked_until = NULL, locked_by = NULL
+		WHERE id = $5 AND locked_by = $6
+	`, filePath, size, now, now.Add(exportRetention), job.ID, lease)
+	if err != nil {
+		log.Printf("エクスポート %s の完了記録エラー: %v", job.ID, err)
+		return
+	}
+	if recorded, err := result.RowsAffected(); err == nil && recorded == 0 {
+		// Another replica owns the job now and writes its own archive
+		s.removeArchive(filePath)
+	}
+}
+
+// removeArchive deletes a stored archive. Archives written before exports
+// moved to the storage backend are plain paths below ./exports.
+func (s *ExportService) removeArchive(locator string) {
+	err := s.Files().Delete(context.Background(), locator)
+	if errors.Is(err, storage.ErrUnknownLocator) {
+		err = os.Remove(locator)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		log.Printf("エクスポートファイル削除エラー: %v", err)
+	}
+}
+
+// renewLease extends the job's lease until done is closed
+func (s *ExportService) renewLease(exportId, lease string, done <-chan struct{}) {
+	ticker := time.NewTicker(exportLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, err := s.db.Exec(
+				"UPDATE export_jobs SET locked_until = $1 WHERE id = $2 AND locked_by = $3",
+				time.Now().Add(exportLease), exportId, lease,
+			); err != nil {
+				log.Printf("エクスポート %s のリース更新エラー: %v", exportId, err)
+			}
+		}
+	}
+}
+
+func (s *ExportService) fail(exportId, lease string, cause error) {
+	if _, err := s.db.Exec(`
+		UPDATE export_jobs
+		SET status = 'failed', error = $1, completed_at = $2, locked_until = NULL, locked_by = NULL
+		WHERE id = $3 AND locked_by = $4
+	`, cause.Error(), time.Now(), exportId, lease); err != nil {
+		log.Printf("エクスポート %s の失敗記録エラー: %v", exportId, err)
+	}
+}
+
+// buildArchive writes the zip file to a temporary file and stores it in the
+// storage backend once complete, returning its locator. The key includes the
+// lease so that a replica that lost the job never overwrites the archive of
+// the one that took it over.
+func (s *ExportService) buildArchive(job *models.ExportJob, lease string, channelIds []string) (string, int64, error) {
+	file, err := os.CreateTemp("", "export-*.zip")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+	manifest := models.ExportManifest{
+		ExportId:    job.ID,
+		Scope:       job.Scope,
+		ServerId:    job.ServerId,
+		ExportedBy:  job.RequestedBy,
+		ExportedAt:  time.Now(),
+		FormatNotes: "Each channel directory contains messages.json (machine-readable), messages.md, transcript.html and the attachment files.",
+	}
+	if job.ServerId != "" {
+		if err := s.db.QueryRow("SELECT name FROM servers WHERE id = $1", job.ServerId).Scan(&manifest.ServerName); err != nil {
+			return "", 0, err
+		}
+	}
+
+	// An account export only holds the requester's own messages
+	author := ""
+	if job.Scope == models.ExportScopeAccount {
+		author = job.RequestedBy
+		manifest.FormatNotes = "profile.json, memberships.json and chats.json (AI chats) describe the account. " +
+			"Each channel directory contains the account's own messages in messages.json (machine-readable), " +
+			"messages.md and transcript.html, and the files attached to them."
+		if err := s.writeAccount(archive, job.RequestedBy); err != nil {
+			return "", 0, err
+		}
+	}
+
+	usedDirs := map[string]bool{}
+	processedMessages := 0
+	for i, channelId := range channelIds {
+		info, err := s.writeChannel(archive, channelId, author, usedDirs)
+		if err != nil {
+			return "", 0, err
+		}
+		manifest.Channels = append(manifest.Channels, info)
+		processedMessages += info.MessageCount
+
+		result, err := s.db.Exec(`
+			UPDATE export_jobs SET total_channels = $1, processed_channels = $2, processed_messages = $3
+			WHERE id = $4 AND locked_by = $5
+		`, len(channelIds), i+1, processedMessages, job.ID, lease)
+		if err != nil {
+			log.Printf("エクスポート %s の進捗更新エラー: %v", job.ID, err)
+		} else if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+			return "", 0, errExportLeaseLost
+		}
+	}
+
+	if err := writeZipJSON(archive, "manifest.json", manifest); err != nil {
+		return "", 0, err
+	}
+	if err := archive.Close(); err != nil {
+		return "", 0, err
+	}
+
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	locator, err := s.Files().Put(context.Background(), exportKey(job.ID, lease), file, size, "application/zip")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to store export archive: %v", err)
+	}
+	return locator, size, nil
+}
+
+// exportKey is the storage key of the archive built for a job under lease
+func exportKey(exportId, lease string) string {
+	return "exports/" + exportId + "-" + lease + ".zip"
+}
+
+var unsafeDirChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// writeChannel adds one channel's files to the archive. If author is set,
+// only their messages are included.
+func (s *ExportService) writeChannel(archive *zip.Writer, channelId, author string, usedDirs map[string]bool) (models.ExportedChannelInfo, error) {
+	channel, err := s.serverService.GetChannelByID(channelId)
+	if err != nil {
+		return models.ExportedChannelInfo{}, err
+	}
+
+	dir := strings.Trim(unsafeDirChars.ReplaceAllString(channel.Name, "-"), "-")
+	if dir == "" || usedDirs[dir] {
+		dir = strings.TrimPrefix(dir+"-"+channel.ID[:8], "-")
+	}
+	usedDirs[dir] = true
+	dir = path.Join("channels", dir)
+
+	messages, err := s.channelMessageService.GetChannelMessages(channelId)
+	if err != nil {
+		return models.ExportedChannelInfo{}, err
+	}
+	attachments, err := s.channelAttachments(channelId)
+	if err != nil {
+		return models.ExportedChannelInfo{}, err
+	}
+
+	exported := models.ExportedChannel{
+		ID:          channel.ID,
+		Name:        channel.Name,
+		Description: channel.Description,
+		Topic:       channel.Topic,
+		Kind:        channel.Kind,
+		Messages:    make([]models.ExportedMessage, 0, len(messages)),
+	}
+	for _, message := range messages {
+		if author != "" && message.UserId != author {
+			continue
+		}
+		entry := models.ExportedMessage{
+			ID:          message.ID,
+			UserId:      message.UserId,
+			Username:    message.Username,
+			Type:        message.Type,
+			Content:     message.Content,
+			Timestamp:   message.Timestamp,
+			IsEdited:    message.IsEdited,
+			Attachments: []models.ExportedAttachment{},
+			Poll:        message.Poll,
+		}
+		if message.IsEdited && !message.EditedAt.IsZero() {
+			editedAt := message.EditedAt
+			entry.EditedAt = &editedAt
+		}
+
+		for _, attachment := range attachments[message.ID] {
+			archivePath := path.Join("attachments", attachment.ID+"-"+filepath.Base(attachment.FileName))
+			if attachment.ProcessingStatus != "" && attachment.ProcessingStatus != models.AttachmentProcessingDone {
+				// Like downloads, image originals are left out until their metadata is stripped
+				archivePath = ""
+			} else if err := copyFileToZip(archive, s.channelMessageService.Files(), attachment.FilePath, path.Join(dir, archivePath)); err != nil {
+				if !errors.Is(err, storage.ErrNotFound) && !errors.Is(err, storage.ErrUnknownLocator) {
+					return models.ExportedChannelInfo{}, err
+				}
+				// Keep the metadata even when the file itself is gone
+				archivePath = ""
+			}
+			entry.Attachments = append(entry.Attachments, models.ExportedAttachment{
+				ID:          attachment.ID,
+				FileName:    attachment.FileName,
+				FileType:    attachment.FileType,
+				FileSize:    attachment.FileSize,
+				UploadedAt:  attachment.UploadedAt,
+				ArchivePath: archivePath,
+			})
+		}
+		exported.Messages = append(exported.Messages, entry)
+	}
+
+	if err := writeZipJSON(archive, path.Join(dir, "messages.json"), exported); err != nil {
+		return models.ExportedChannelInfo{}, err
+	}
+	if err := writeZipFile(archive, path.Join(dir, "messages.md"), []byte(renderExportMarkdown(exported))); err != nil {
+		return models.ExportedChannelInfo{}, err
+	}
+	transcript, err := archive.Create(path.Join(dir, "transcript.html"))
+	if err != nil {
+		return models.ExportedChannelInfo{}, err
+	}
+	if err := exportTranscriptTemplate.Execute(transcript, exported); err != nil {
+		return models.ExportedChannelInfo{}, err
+	}
+
+	return models.ExportedChannelInfo{
+		ID:           channel.ID,
+		Name:         channel.Name,
+		Directory:    dir,
+		MessageCount: len(exported.Messages),
+	}, nil
+}
+
+// writeAccount adds the user's profile, avatar, memberships and AI chats to the archive
+func (s *ExportService) writeAccount(archive *zip.Writer, userId string) error {
+	if s.profileService != nil {
+		profile, err := s.profileService.GetCurrentUser(userId)
+		if err != nil {
+			return err
+		}
+		// The avatar is included as a file; its signed URL would soon expire
+		profile.AvatarURL = ""
+		if err := writeZipJSON(archive, "profile.json", profile); err != nil {
+			return err
+		}
+	}
+
+	var avatarId, avatarName, avatarPath sql.NullString
+	if err := s.db.QueryRow(`
+		SELECT ca.id, ca.file_name, ca.file_path
+		FROM users u
+		LEFT JOIN channel_attachments ca ON ca.id = u.avatar_attachment_id
+		WHERE u.id = $1
+	`, userId).Scan(&avatarId, &avatarName, &avatarPath); err != nil {
+		return err
+	}
+	if avatarId.Valid {
+		name := path.Join("avatar", filepath.Base(avatarName.String))
+		err := copyFileToZip(archive, s.channelMessageService.Files(), avatarPath.String, name)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) && !errors.Is(err, storage.ErrUnknownLocator) {
+			return err
+		}
+	}
+
+	memberships, err := s.accountMemberships(userId)
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(archive, "memberships.json", memberships); err != nil {
+		return err
+	}
+
+	chats, err := s.accountChats(userId)
+	if err != nil {
+		return err
+	}
+	return writeZipJSON(archive, "chats.json", chats)
+}
+
+// accountMemberships lists the user's servers, and the private channels and
+// direct conversations they were added to
+func (s *ExportService) accountMemberships(userId string) (models.ExportedMemberships, error) {
+	memberships := models.ExportedMemberships{
+		Servers:  []models.ExportedServerMembership{},
+		Channels: []models.ExportedChannelMembership{},
+	}
+
+	rows, err := s.db.Query(`
+		SELECT s.id, s.name, sm.role, sm.joined_at
+		FROM server_members sm
+		JOIN servers s ON s.id = sm.server_id
+		WHERE sm.user_id = $1
+		ORDER BY sm.joined_at
+	`, userId)
+	if err != nil {
+		return memberships, err
+	}
+	for rows.Next() {
+		var server models.ExportedServerMembership
+		if err := rows.Scan(&server.ServerId, &server.ServerName, &server.Role, &server.JoinedAt); err != nil {
+			rows.Close()
+			return memberships, err
+		}
+		memberships.Servers = append(memberships.Servers, server)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return memberships, err
+	}
+
+	rows, err = s.db.Query(`
+		SELECT c.id, COALESCE(c.name, ''), c.kind, c.server_id, cm.added_at
+		FROM channel_members cm
+		JOIN channels c ON c.id = cm.channel_id
+		WHERE cm.user_id = $1
+		ORDER BY cm.added_at
+	`, userId)
+	if err != nil {
+		return memberships, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var channel models.ExportedChannelMembership
+		var serverId sql.NullString
+		if err := rows.Scan(&channel.ChannelId, &channel.Name, &channel.Kind, &serverId, &channel.AddedAt); err != nil {
+			return memberships, err
+		}
+		channel.ServerId = serverId.String
+		memberships.Channels = append(memberships.Channels, channel)
+	}
+	return memberships, rows.Err()
+}
+
+// accountChats loads the user's AI chats with their messages
+func (s *ExportService) accountChats(userId string) ([]models.ExportedChat, error) {
+	rows, err := s.db.Query(`
+		SELECT c.id, COALESCE(c.title, ''), c.created_at, m.id, m.content, m.role, m.timestamp
+		FROM chats c
+		LEFT JOIN chatbot_messages m ON m.chat_id = c.id
+		WHERE c.user_id = $1
+		ORDER BY c.created_at, c.id, m.timestamp
+	`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chats := []models.ExportedChat{}
+	for rows.Next() {
+		var chat models.ExportedChat
+		var messageId, content, role sql.NullString
+		var timestamp sql.NullTime
+		if err := rows.Scan(&chat.ID, &chat.Title, &chat.CreatedAt, &messageId, &content, &role, &timestamp); err != nil {
+			return nil, err
+		}
+		if len(chats) == 0 || chats[len(chats)-1].ID != chat.ID {
+			chat.Messages = []models.ChatbotMessage{}
+			chats = append(chats, chat)
+		}
+		if messageId.Valid {
+			last := &chats[len(chats)-1]
+			last.Messages = append(last.Messages, models.ChatbotMessage{
+				ID:        messageId.String,
+				ChatId:    chat.ID,
+				Content:   content.String,
+				Role:      role.String,
+				Timestamp: timestamp.Time,
+			})
+		}
+	}
+	return chats, rows.Err()
+}
+
+// channelAttachments loads the attachments of a channel's messages keyed by message ID
+func (s *ExportService) channelAttachments(channelId string) (map[string][]models.ChannelAttachment, error) {
+	rows, err := s.db.Query(`
+		SELECT ca.id, ca.message_id, ca.file_name, ca.file_type, ca.file_path, ca.file_size, ca.uploaded_at,
+		       COALESCE(ca.processing_status, '')
+		FROM channel_attachments ca
+		JOIN channel_messages cm ON ca.message_id = cm.id
+		WHERE cm.channel_id = $1 AND cm.is_deleted = false
+		ORDER BY ca.uploaded_at
+	`, channelId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := map[string][]models.ChannelAttachment{}
+	for rows.Next() {
+		var attachment models.ChannelAttachment
+		if err := rows.Scan(
+			&attachment.ID, &attachment.MessageId, &attachment.FileName,
+			&attachment.FileType, &attachment.FilePath, &attachment.FileSize,
+			&attachment.UploadedAt, &attachment.ProcessingStatus,
+		); err != nil {
+			return nil, err
+		}
+		attachments[attachment.MessageId] = append(attachments[attachment.MessageId], attachment)
+	}
+	return attachments, rows.Err()
+}
+
+// renderExportMarkdown renders a channel as a Markdown transcript
+func renderExportMarkdown(channel models.ExportedChannel) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# #%s\n\n", channel.Name)
+	if channel.Topic != "" {
+		fmt.Fprintf(&b, "> %s\n\n", channel.Topic)
+	}
+	if channel.Description != "" {
+		fmt.Fprintf(&b, "%s\n\n", channel.Description)
+	}
+
+	lastDay := ""
+	for _, message := range channel.Messages {
+		day := message.Timestamp.UTC().Format("2006-01-02")
+		if day != lastDay {
+			fmt.Fprintf(&b, "## %s\n\n", day)
+			lastDay = day
+		}
+
+		fmt.Fprintf(&b, "**%s** _%s UTC_", message.Username, message.Timestamp.UTC().Format("15:04"))
+		if message.IsEdited {
+			b.WriteString(" _(edited)_")
+		}
+		b.WriteString("\n\n")
+		if message.Content != "" {
+			b.WriteString(message.Content)
+			b.WriteString("\n\n")
+		}
+		for _, attachment := range message.Attachments {
+			if attachment.ArchivePath == "" {
+				fmt.Fprintf(&b, "- 📎 %s (file not available)\n", attachment.FileName)
+				continue
+			}
+			fmt.Fprintf(&b, "- 📎 [%s](%s)\n", attachment.FileName, attachment.ArchivePath)
+		}
+		if len(message.Attachments) > 0 {
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+var exportTranscriptTemplate = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"datetime": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04 UTC") },
+	"isImage":  func(fileType string) bool { return fileType == "image" },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>#{{.Name}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; max-width: 860px; margin: 2rem auto; padding: 0 1rem; color: #1d1c1d; }
+header { border-bottom: 1px solid #ddd; margin-bottom: 1rem; }
+.topic { color: #616061; }
+.message { padding: .5rem 0; border-bottom: 1px solid #f2f2f2; }
+.message.system { color: #616061; font-style: italic; }
+.author { font-weight: bold; }
+.time, .edited { color: #868686; font-size: .85em; margin-left: .5rem; }
+.content { white-space: pre-wrap; margin-top: .25rem; }
+.attachments img { max-width: 360px; display: block; margin-top: .5rem; }
+.poll { margin-top: .25rem; padding-left: 1rem; border-left: 3px solid #ddd; }
+</style>
+</head>
+<body>
+<header>
+<h1>#{{.Name}}</h1>
+{{if .Topic}}<p class="topic">{{.Topic}}</p>{{end}}
+{{if .Description}}<p>{{.Description}}</p>{{end}}
+</header>
+{{range .Messages}}
+<div class="message {{.Type}}" id="m-{{.ID}}">
+<span class="author">{{.Username}}</span><span class="time">{{datetime .Timestamp}}</span>{{if .IsEdited}}<span class="edited">(edited)</span>{{end}}
+{{if .Content}}<div class="content">{{.Content}}</div>{{end}}
+{{with .Poll}}<div class="poll"><strong>{{.Question}}</strong><ul>{{range .Options}}<li>{{.Text}}: {{.VoteCount}}</li>{{end}}</ul></div>{{end}}
+{{if .Attachments}}<div class="attachments">{{range .Attachments}}
+{{if .ArchivePath}}{{if isImage .FileType}}<a href="{{.ArchivePath}}"><img src="{{.ArchivePath}}" alt="{{.FileName}}"></a>{{else}}<div>📎 <a href="{{.ArchivePath}}">{{.FileName}}</a></div>{{end}}{{else}}<div>📎 {{.FileName}} (file not available)</div>{{end}}
+{{end}}</div>{{end}}
+</div>
+{{end}}
+</body>
+</html>
+`))
+
+func writeZipJSON(archive *zip.Writer, name string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeZipFile(archive, name, data)
+}
+
+func writeZipFile(archive *zip.Writer, name string, data []byte) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func copyFileToZip(archive *zip.Writer, files *storage.Manager, locator, name string) error {
+	source, err := files.Open(context.Background(), locator)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, source)
+	return err
+}
+
+func nullIfEmpty(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// scanExportJob reads the job columns, followed by any extra ones into dest
+func scanExportJob(row rowScanner, dest ...interface{}) (models.ExportJob, error) {
+	var job models.ExportJob
+	var serverId, channelId, filePath, exportError sql.NullString
+	var fileSize sql.NullInt64
+	var startedAt, completedAt, expiresAt sql.NullTime
+	err := row.Scan(append([]interface{}{
+		&job.ID, &job.RequestedBy, &job.Scope, &serverId, &channelId, &job.Status,
+		&job.TotalChannels, &job.ProcessedChannels, &job.ProcessedMessages,
+		&filePath, &fileSize, &exportError, &job.CreatedAt, &startedAt, &completedAt, &expiresAt,
+	}, dest...)...)
+	if err != nil {
+		return job, err
+	}
+
+	job.ServerId = serverId.String
+	job.ChannelId = channelId.String
+	job.FilePath = filePath.String
+	job.FileSize = fileSize.Int64
+	job.Error = exportError.String
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if completedAt.Valid {
+		job.CompletedAt = &completedAt.Time
+	}
+	if expiresAt.Valid {
+		job.ExpiresAt = &expiresAt.Time
+	}
+
+	switch {
+	case job.Status == models.ExportStatusCompleted:
+		job.Progress = 100
+		job.DownloadURL = fmt.Sprintf("/api/exports/%s/download", job.ID)
+	case job.TotalChannels > 0:
+		job.Progress = job.ProcessedChannels * 100 / job.TotalChannels
+	}
+	return job, nil
+}
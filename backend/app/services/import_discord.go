@@ -0,0 +1,272 @@
+package services
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Discord exports are the JSON files written by DiscordChatExporter, one per
+// channel or thread. Either a single .json file or a zip of several exports can
+// be imported; attachments are included when the zip also holds the media
+// files referenced by relative URLs (exported with --media).
+
+type discordExport struct {
+	Guild struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"guild"`
+	Channel struct {
+		ID         string `json:"id"`
+		Type       string `json:"type"`
+		CategoryID string `json:"categoryId"`
+		Category   string `json:"category"`
+		Name       string `json:"name"`
+		Topic      string `json:"topic"`
+	} `json:"channel"`
+	Messages []discordMessage `json:"messages"`
+}
+
+type discordAuthor struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Nickname string `json:"nickname"`
+	IsBot    bool   `json:"isBot"`
+}
+
+type discordMessage struct {
+	ID              string        `json:"id"`
+	Type            string        `json:"type"`
+	Timestamp       string        `json:"timestamp"`
+	TimestampEdited *string       `json:"timestampEdited"`
+	Content         string        `json:"content"`
+	Author          discordAuthor `json:"author"`
+	Attachments     []struct {
+		ID       string `json:"id"`
+		URL      string `json:"url"`
+		FileName string `json:"fileName"`
+	} `json:"attachments"`
+	Reactions []struct {
+		Emoji struct {
+			Name string `json:"name"`
+		} `json:"emoji"`
+		Users []discordAuthor `json:"users"`
+	} `json:"reactions"`
+}
+
+// discordThreadTypes are channel types that are threads under a parent channel
+var discordThreadTypes = map[string]bool{
+	"GuildPublicThread":  true,
+	"GuildPrivateThread": true,
+	"GuildNewsThread":    true,
+}
+
+// discordSkippedTypes are system events rather than conversation
+var discordSkippedTypes = map[string]bool{
+	"RecipientAdd":         true,
+	"RecipientRemove":      true,
+	"GuildMemberJoin":      true,
+	"ChannelNameChange":    true,
+	"ChannelIconChange":    true,
+	"ChannelPinnedMessage": true,
+	"ThreadCreated":        true,
+}
+
+// discordSource is one export file plus a way to open files next to it
+type discordSource struct {
+	name     string
+	export   discordExport
+	openFile func(name string) func() (io.ReadCloser, error)
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+func parseDiscordExport(filePath string) (*importArchive, io.Closer, error) {
+	if strings.EqualFold(filepath.Ext(filePath), ".json") {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer file.Close()
+
+		var export discordExport
+		if err := json.NewDecoder(file).Decode(&export); err != nil {
+			return nil, nil, ErrInvalidImportArchive
+		}
+		// Media referenced by a single JSON file cannot be resolved safely
+		source := discordSource{name: filepath.Base(filePath), export: export, openFile: func(string) func() (io.ReadCloser, error) { return nil }}
+		archive, err := buildDiscordArchive([]discordSource{source})
+		return archive, nopCloser{}, err
+	}
+
+	reader, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, nil, ErrInvalidImportArchive
+	}
+
+	files := map[string]*zip.File{}
+	for _, file := range reader.File {
+		files[file.Name] = file
+	}
+
+	var sources []discordSource
+	for _, file := range reader.File {
+		if !strings.HasSuffix(strings.ToLower(file.Name), ".json") {
+			continue
+		}
+		var export discordExport
+		if err := readZipJSON(file, &export); err != nil {
+			reader.Close()
+			return nil, nil, err
+		}
+		if export.Channel.ID == "" {
+			continue
+		}
+		dir := path.Dir(file.Name)
+		sources = append(sources, discordSource{
+			name:   file.Name,
+			export: export,
+			openFile: func(name string) func() (io.ReadCloser, error) {
+				if media := files[path.Clean(path.Join(dir, name))]; media != nil {
+					return media.Open
+				}
+				return nil
+			},
+		})
+	}
+	if len(sources) == 0 {
+		reader.Close()
+		return nil, nil, ErrInvalidImportArchive
+	}
+
+	archive, err := buildDiscordArchive(sources)
+	if err != nil {
+		reader.Close()
+		return nil, nil, err
+	}
+	return archive, reader, nil
+}
+
+func buildDiscordArchive(sources []discordSource) (*importArchive, error) {
+	archive := &importArchive{
+		Users: map[string]*importUser{},
+	}
+	channels := map[string]*importChannel{}
+
+	// Channels first, so threads can be merged into their parent channel
+	sort.SliceStable(sources, func(i, j int) bool {
+		return !discordThreadTypes[sources[i].export.Channel.Type] && discordThreadTypes[sources[j].export.Channel.Type]
+	})
+
+	for _, source := range sources {
+		export := source.export
+		if archive.ServerName == "" {
+			archive.ServerName = export.Guild.Name
+		}
+
+		isThread := discordThreadTypes[export.Channel.Type]
+		channelID := export.Channel.ID
+		if isThread {
+			channelID = export.Channel.CategoryID
+		}
+
+		channel := channels[channelID]
+		if channel == nil {
+			name := export.Channel.Name
+			if isThread {
+				// The parent channel was not part of the export
+				name = export.Channel.Category
+			}
+			channel = &importChannel{
+				ExternalID: channelID,
+				Name:       name,
+				Topic:      export.Channel.Topic,
+			}
+			channels[channelID] = channel
+			archive.Channels = append(archive.Channels, channel)
+		}
+
+		for _, message := range export.Messages {
+			converted, err := convertDiscordMessage(archive, message, source)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", source.name, err)
+			}
+			if converted == nil {
+				continue
+			}
+			// A thread started from a message shares that message's ID
+			if isThread {
+				converted.ParentID = export.Channel.ID
+			}
+			channel.Messages = append(channel.Messages, converted)
+		}
+	}
+	return archive, nil
+}
+
+func convertDiscordMessage(archive *importArchive, message discordMessage, source discordSource) (*importMessage, error) {
+	if discordSkippedTypes[message.Type] {
+		return nil, nil
+	}
+	timestamp, err := time.Parse(time.RFC3339, message.Timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp %q", message.Timestamp)
+	}
+
+	registerDiscordUser(archive, message.Author)
+	converted := &importMessage{
+		ExternalID: message.ID,
+		UserID:     message.Author.ID,
+		Text:       message.Content,
+		Timestamp:  timestamp,
+	}
+	if message.TimestampEdited != nil {
+		if editedAt, err := time.Parse(time.RFC3339, *message.TimestampEdited); err == nil {
+			converted.EditedAt = &editedAt
+		}
+	}
+
+	for _, reaction := range message.Reactions {
+		var userIDs []string
+		for _, user := range reaction.Users {
+			registerDiscordUser(archive, user)
+			userIDs = append(userIDs, user.ID)
+		}
+		converted.Reactions = append(converted.Reactions, importReaction{Emoji: reaction.Emoji.Name, UserIDs: userIDs})
+	}
+
+	for _, attachment := range message.Attachments {
+		file := importFile{ExternalID: attachment.ID, Name: attachment.FileName}
+		// Media exported alongside the JSON is referenced by a relative path
+		if parsed, err := url.Parse(attachment.URL); err == nil && parsed.Scheme == "" && parsed.Path != "" {
+			file.open = source.openFile(parsed.Path)
+		}
+		converted.Files = append(converted.Files, file)
+	}
+	return converted, nil
+}
+
+func registerDiscordUser(archive *importArchive, author discordAuthor) {
+	if author.ID == "" || archive.Users[author.ID] != nil {
+		return
+	}
+	username := author.Name
+	if username == "" {
+		username = author.Nickname
+	}
+	archive.Users[author.ID] = &importUser{
+		ExternalID: author.ID,
+		Username:   username,
+		IsBot:      author.IsBot,
+	}
+}
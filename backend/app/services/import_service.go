@@ -0,0 +1,637 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"app/models"
+	"app/storage"
+)
+
+// Errors returned by ImportService
+var (
+	ErrUnsupportedImportFormat = errors.New("format must be \"slack\" or \"discord\"")
+	ErrImportTargetRequired    = errors.New("either a target server ID or a new server name and owner is required")
+	ErrImportServerNotFound    = errors.New("target server not found")
+	ErrInvalidImportArchive    = errors.New("the file is not a valid export archive")
+)
+
+// placeholderPassword is stored for placeholder users. It is not a bcrypt hash,
+// so no password ever matches it and placeholders cannot log in.
+const placeholderPassword = "!"
+
+// ImportService imports Slack and Discord export archives into servers, channels,
+// channel_messages and channel_attachments. Both formats are first parsed into a
+// neutral importArchive and then written by the same code.
+type ImportService struct {
+	db    *sql.DB
+	files *storage.Manager
+}
+
+// NewImportService creates a new ImportService
+func NewImportService(db *sql.DB, files *storage.Manager) *ImportService {
+	return &ImportService{
+		db:    db,
+		files: files,
+	}
+}
+
+// importArchive is the source-independent form of an export
+type importArchive struct {
+	ServerName string
+	Users      map[string]*importUser
+	Channels   []*importChannel
+}
+
+type importUser struct {
+	ExternalID string
+	Username   string
+	Email      string
+	IsBot      bool
+}
+
+type importChannel struct {
+	ExternalID  string
+	Name        string
+	Topic       string
+	Description string
+	IsPrivate   bool
+	MemberIDs   []string
+	Messages    []*importMessage
+}
+
+type importMessage struct {
+	ExternalID string
+	UserID     string
+	Text       string
+	Timestamp  time.Time
+	EditedAt   *time.Time
+	ParentID   string // external ID of the thread's first message
+	Reactions  []importReaction
+	Files      []importFile
+}
+
+type importReaction struct {
+	Emoji   string
+	UserIDs []string
+}
+
+type importFile struct {
+	ExternalID string
+	Name       string
+	// open returns the file contents, or nil when the archive does not include the file
+	open func() (io.ReadCloser, error)
+}
+
+// ImportFile imports the export at filePath. In a dry run everything is written
+// inside a transaction that is rolled back, so the report shows exactly what a
+// real run would do.
+func (s *ImportService) ImportFile(filePath string, opts models.ImportOptions) (*models.ImportReport, error) {
+	if opts.ServerId == "" && opts.OwnerId == "" {
+		return nil, ErrImportTargetRequired
+	}
+
+	var archive *importArchive
+	var closer io.Closer
+	var err error
+	switch opts.Format {
+	case models.ImportFormatSlack:
+		archive, closer, err = parseSlackExport(filePath)
+	case models.ImportFormatDiscord:
+		archive, closer, err = parseDiscordExport(filePath)
+	default:
+		return nil, ErrUnsupportedImportFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	// A new server is named after the source workspace unless a name was given
+	if opts.ServerId == "" && opts.ServerName == "" {
+		opts.ServerName = archive.ServerName
+	}
+	if opts.ServerId == "" && opts.ServerName == "" {
+		return nil, ErrImportTargetRequired
+	}
+
+	run := &importRun{
+		files:    s.files,
+		source:   opts.Format,
+		archive:  archive,
+		opts:     opts,
+		users:    map[string]string{},
+		messages: map[string]string{},
+		report: &models.ImportReport{
+			Format:   opts.Format,
+			DryRun:   opts.DryRun,
+			Warnings: []string{},
+		},
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	run.tx = tx
+
+	if err := run.execute(); err != nil {
+		run.removeWrittenFiles()
+		return nil, err
+	}
+
+	if opts.DryRun {
+		return run.report, nil
+	}
+	if err := tx.Commit(); err != nil {
+		run.removeWrittenFiles()
+		return nil, err
+	}
+	return run.report, nil
+}
+
+// importRun holds the state of a single import
+type importRun struct {
+	tx       *sql.Tx
+	files    *storage.Manager
+	source   string
+	archive  *importArchive
+	opts     models.ImportOptions
+	report   *models.ImportReport
+	serverID string
+
+	users        map[string]string // external user ID -> local user ID
+	messages     map[string]string // external message ID -> local message ID
+	writtenFiles []string
+}
+
+func (r *importRun) execute() error {
+	if err := r.resolveServer(); err != nil {
+		return err
+	}
+
+	for _, channel := range r.archive.Channels {
+		if err := r.importChannel(channel); err != nil {
+			return fmt.Errorf("channel %s: %w", channel.Name, err)
+		}
+	}
+	return nil
+}
+
+// resolveServer uses the target server or creates a new one owned by opts.OwnerId
+func (r *importRun) resolveServer() error {
+	if r.opts.ServerId != "" {
+		var exists bool
+		err := r.tx.QueryRow("SELECT EXISTS(SELECT 1 FROM servers WHERE id = $1)", r.opts.ServerId).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrImportServerNotFound
+		}
+		r.serverID = r.opts.ServerId
+		r.report.ServerId = r.serverID
+		return nil
+	}
+
+	now := time.Now()
+	r.serverID = uuid.New().String()
+	r.report.ServerId = r.serverID
+	name := truncateRunes(r.opts.ServerName, 50)
+	if _, err := r.tx.Exec(
+		"INSERT INTO servers (id, name, description, owner_id, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $5)",
+		r.serverID, name, truncateRunes("Imported from "+r.source, 200), r.opts.OwnerId, now,
+	); err != nil {
+		return err
+	}
+	_, err := r.tx.Exec(
+		"INSERT INTO server_members (id, server_id, user_id, role, joined_at, updated_at) VALUES ($1, $2, $3, 'owner', $4, $4)",
+		uuid.New().String(), r.serverID, r.opts.OwnerId, now,
+	)
+	return err
+}
+
+func (r *importRun) importChannel(channel *importChannel) error {
+	channelID, err := r.resolveChannel(channel)
+	if err != nil {
+		return err
+	}
+
+	for _, memberID := range channel.MemberIDs {
+		userID, err := r.resolveUser(memberID)
+		if err != nil {
+			return err
+		}
+		if channel.IsPrivate {
+			if _, err := r.tx.Exec(`
+				INSERT INTO channel_members (id, channel_id, user_id, added_at) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (channel_id, user_id) DO NOTHING
+			`, uuid.New().String(), channelID, userID, time.Now()); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Oldest first so thread parents exist before their replies
+	sort.SliceStable(channel.Messages, func(i, j int) bool {
+		return channel.Messages[i].Timestamp.Before(channel.Messages[j].Timestamp)
+	})
+
+	var lastMessageAt time.Time
+	for _, message := range channel.Messages {
+		if err := r.importMessage(channelID, message); err != nil {
+			return err
+		}
+		if message.Timestamp.After(lastMessageAt) {
+			lastMessageAt = message.Timestamp
+		}
+	}
+
+	if !lastMessageAt.IsZero() {
+		_, err := r.tx.Exec(
+			"UPDATE channels SET last_message_at = $1 WHERE id = $2 AND (last_message_at IS NULL OR last_message_at < $1)",
+			lastMessageAt, channelID,
+		)
+		return err
+	}
+	return nil
+}
+
+var unsafeChannelNameChars = regexp.MustCompile(`[^\p{L}\p{N}_-]+`)
+
+// resolveChannel finds a channel created by an earlier run or creates it
+func (r *importRun) resolveChannel(channel *importChannel) (string, error) {
+	localID, err := r.lookupMapping("channel", channel.ExternalID)
+	if err != nil {
+		return "", err
+	}
+	if localID != "" {
+		r.report.ChannelsExisting++
+		return localID, nil
+	}
+
+	name := strings.Trim(unsafeChannelNameChars.ReplaceAllString(strings.ToLower(channel.Name), "-"), "-")
+	if name == "" {
+		name = "imported"
+	}
+	description := channel.Description
+	if description == "" {
+		description = channel.Topic
+	}
+
+	localID = uuid.New().String()
+	now := time.Now()
+	_, err = r.tx.Exec(`
+		INSERT INTO channels (id, server_id, name, description, is_private, kind, topic, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, 'server', $6, $7, $7)
+	`, localID, r.serverID, truncateRunes(name, 50), truncateRunes(description, 200),
+		channel.IsPrivate, truncateRunes(channel.Topic, 250), now)
+	if err != nil {
+		return "", err
+	}
+	if err := r.saveMapping("channel", channel.ExternalID, localID); err != nil {
+		return "", err
+	}
+	r.report.ChannelsCreated++
+	return localID, nil
+}
+
+// resolveUser maps a source user to a local user: an earlier mapping, an
+// account with the same email, or a new placeholder user. The user is added
+// to the target server.
+func (r *importRun) resolveUser(externalID string) (string, error) {
+	if userID, ok := r.users[externalID]; ok {
+		return userID, nil
+	}
+
+	userID, err := r.lookupMapping("user", externalID)
+	if err != nil {
+		return "", err
+	}
+
+	source := r.archive.Users[externalID]
+	unlisted := source == nil
+	if unlisted {
+		source = &importUser{ExternalID: externalID, Username: externalID}
+	}
+
+	if userID == "" && source.Email != "" {
+		err := r.tx.QueryRow("SELECT id FROM users WHERE LOWER(email) = LOWER($1)", source.Email).Scan(&userID)
+		if err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+		if userID != "" {
+			r.report.UsersMatched++
+			if err := r.saveMapping("user", externalID, userID); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if userID == "" {
+		userID, err = r.createPlaceholderUser(source)
+		if err != nil {
+			return "", err
+		}
+		r.report.UsersPlaceholder++
+		if unlisted {
+			r.warn(fmt.Sprintf("user %s is not listed in the export; created a placeholder named after the ID", externalID))
+		}
+	}
+
+	now := time.Now()
+	if _, err := r.tx.Exec(`
+		INSERT INTO server_members (id, server_id, user_id, role, joined_at, updated_at)
+		VALUES ($1, $2, $3, 'member', $4, $4)
+		ON CONFLICT (server_id, user_id) DO NOTHING
+	`, uuid.New().String(), r.serverID, userID, now); err != nil {
+		return "", err
+	}
+
+	r.users[externalID] = userID
+	return userID, nil
+}
+
+var unsafeUsernameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+func (r *importRun) createPlaceholderUser(source *importUser) (string, error) {
+	base := strings.Trim(unsafeUsernameChars.ReplaceAllString(source.Username, "-"), "-.")
+	if base == "" {
+		base = "user"
+	}
+	base = truncateRunes(base, 30)
+
+	// Pick a free username: name, name-2, name-3, ...
+	username := base
+	for i := 2; ; i++ {
+		var taken bool
+		if err := r.tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)", username).Scan(&taken); err != nil {
+			return "", err
+		}
+		if !taken {
+			break
+		}
+		username = fmt.Sprintf("%s-%d", base, i)
+	}
+
+	userID := uuid.New().String()
+	email := fmt.Sprintf("%s-%s@placeholder.invalid", r.source, strings.ToLower(unsafeUsernameChars.ReplaceAllString(source.ExternalID, "")))
+	now := time.Now()
+	if _, err := r.tx.Exec(`
+		INSERT INTO users (id, username, email, password, is_placeholder, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, TRUE, $5, $5)
+	`, userID, username, email, placeholderPassword, now); err != nil {
+		return "", err
+	}
+	if err := r.saveMapping("user", source.ExternalID, userID); err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+func (r *importRun) importMessage(channelID string, message *importMessage) error {
+	existingID, err := r.lookupMapping("message", message.ExternalID)
+	if err != nil {
+		return err
+	}
+	if existingID != "" {
+		r.messages[message.ExternalID] = existingID
+		r.report.MessagesSkipped++
+		return nil
+	}
+
+	userID, err := r.resolveUser(message.UserID)
+	if err != nil {
+		return err
+	}
+
+	var parentID interface{}
+	if message.ParentID != "" && message.ParentID != message.ExternalID {
+		localParent, err := r.localMessageID(message.ParentID)
+		if err != nil {
+			return err
+		}
+		if localParent != "" {
+			parentID = localParent
+			r.report.ThreadReplies++
+		} else {
+			r.warn(fmt.Sprintf("thread parent %s of message %s was not found; imported as a top-level message", message.ParentID, message.ExternalID))
+		}
+	}
+
+	messageType := models.MessageTypeUser
+	if source := r.archive.Users[message.UserID]; source != nil && source.IsBot {
+		messageType = models.MessageTypeBot
+	}
+
+	localID := uuid.New().String()
+	content := message.Text
+
+	// Check attachment availability first so missing files can be noted in the content
+	var missing []string
+	var available []importFile
+	for _, file := range message.Files {
+		if file.open == nil {
+			missing = append(missing, file.Name)
+			continue
+		}
+		available = append(available, file)
+	}
+	for _, name := range missing {
+		r.report.AttachmentsMissed++
+		if content != "" {
+			content += "\n"
+		}
+		content += fmt.Sprintf("[attachment not included in the export: %s]", name)
+	}
+
+	var editedAt interface{}
+	if message.EditedAt != nil {
+		editedAt = *message.EditedAt
+	}
+	if _, err := r.tx.Exec(`
+		INSERT INTO channel_messages (id, channel_id, user_id, content, timestamp, is_edited, is_deleted, edited_at, message_type, parent_message_id)
+		VALUES ($1, $2, $3, $4, $5, $6, FALSE, $7, $8, $9)
+	`, localID, channelID, userID, content, message.Timestamp, message.EditedAt != nil, editedAt, messageType, parentID); err != nil {
+		return err
+	}
+	if err := r.saveMapping("message", message.ExternalID, localID); err != nil {
+		return err
+	}
+	r.messages[message.ExternalID] = localID
+	r.report.MessagesImported++
+
+	for _, reaction := range message.Reactions {
+		for _, reactorID := range reaction.UserIDs {
+			reactor, err := r.resolveUser(reactorID)
+			if err != nil {
+				return err
+			}
+			result, err := r.tx.Exec(`
+				INSERT INTO message_reactions (message_id, user_id, emoji, created_at) VALUES ($1, $2, $3, $4)
+				ON CONFLICT DO NOTHING
+			`, localID, reactor, truncateRunes(reaction.Emoji, 100), message.Timestamp)
+			if err != nil {
+				return err
+			}
+			if affected, _ := result.RowsAffected(); affected > 0 {
+				r.report.Reactions++
+			}
+		}
+	}
+
+	for _, file := range available {
+		if err := r.storeAttachment(channelID, localID, userID, message.Timestamp, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeAttachment copies a file from the archive into attachment storage.
+// Dry runs only check that the file can be read. Imports are not subject to
+// upload policies, but the content type is still detected from the content.
+func (r *importRun) storeAttachment(channelID, messageID, userID string, uploadedAt time.Time, file importFile) error {
+	source, err := file.open()
+	if err != nil {
+		return fmt.Errorf("failed to read attachment %s: %w", file.Name, err)
+	}
+	defer source.Close()
+
+	attachmentID := uuid.New().String()
+	fileName := truncateRunes(filepath.Base(file.Name), 255)
+
+	buffered := bufio.NewReaderSize(source, sniffLength)
+	head, err := buffered.Peek(sniffLength)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read attachment %s: %w", file.Name, err)
+	}
+	contentType, ok := detectContentType(fileName, head)
+	if !ok {
+		r.warn(fmt.Sprintf("attachment %s does not match its extension; stored as %s", file.Name, contentType))
+	}
+	if unstrippableImageTypes[contentType] {
+		r.warn(fmt.Sprintf("attachment %s skipped: metadata can't be removed from %s images", file.Name, contentType))
+		return nil
+	}
+
+	var filePath string
+	counter := &countingReader{reader: buffered}
+	if r.opts.DryRun {
+		if _, err := io.Copy(io.Discard, counter); err != nil {
+			return err
+		}
+	} else {
+		filePath, err = r.files.Put(context.Background(), AttachmentKey(attachmentID, fileName), counter, -1, contentType)
+		if err != nil {
+			return err
+		}
+		r.writtenFiles = append(r.writtenFiles, filePath)
+	}
+	size := counter.n
+
+	if _, err := r.tx.Exec(`
+		INSERT INTO channel_attachments (id, channel_id, message_id, claimed_at, file_name, file_type, content_type,
+		                                 file_path, file_size, uploaded_by, uploaded_at, processing_status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $4, $11)
+	`, attachmentID, channelID, messageID, uploadedAt, fileName, getFileType(contentType), contentType, filePath, size, userID,
+		attachmentProcessingStatus(contentType)); err != nil {
+		return err
+	}
+	r.report.AttachmentsStored++
+	return nil
+}
+
+func (r *importRun) localMessageID(externalID string) (string, error) {
+	if localID, ok := r.messages[externalID]; ok {
+		return localID, nil
+	}
+	return r.lookupMapping("message", externalID)
+}
+
+// instanceImportScope is the server_id of mappings shared by every server
+const instanceImportScope = "00000000-0000-0000-0000-000000000000"
+
+// mappingScope returns the server a mapping of the given kind belongs to.
+// Users are shared across servers; channels and messages are not, so the same
+// export can be imported into more than one server.
+func (r *importRun) mappingScope(kind string) string {
+	if kind == "user" {
+		return instanceImportScope
+	}
+	return r.serverID
+}
+
+func (r *importRun) lookupMapping(kind, externalID string) (string, error) {
+	var localID string
+	err := r.tx.QueryRow(
+		"SELECT local_id FROM import_mappings WHERE source = $1 AND server_id = $2 AND kind = $3 AND external_id = $4",
+		r.source, r.mappingScope(kind), kind, externalID,
+	).Scan(&localID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return localID, err
+}
+
+func (r *importRun) saveMapping(kind, externalID, localID string) error {
+	_, err := r.tx.Exec(
+		"INSERT INTO import_mappings (source, server_id, kind, external_id, local_id, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
+		r.source, r.mappingScope(kind), kind, externalID, localID, time.Now(),
+	)
+	return err
+}
+
+// maxImportWarnings keeps reports readable for large archives
+const maxImportWarnings = 100
+
+func (r *importRun) warn(warning string) {
+	if len(r.report.Warnings) == maxImportWarnings {
+		r.report.Warnings = append(r.report.Warnings, "further warnings omitted")
+	}
+	if len(r.report.Warnings) < maxImportWarnings {
+		r.report.Warnings = append(r.report.Warnings, warning)
+	}
+}
+
+// removeWrittenFiles deletes attachment files of an import that was rolled back
+func (r *importRun) removeWrittenFiles() {
+	for _, filePath := range r.writtenFiles {
+		if err := r.files.Delete(context.Background(), filePath); err != nil {
+			log.Printf("インポートのロールバック時に添付ファイルを削除できませんでした: %s: %v", filePath, err)
+		}
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func truncateRunes(value string, max int) string {
+	runes := []rune(value)
+	if len(runes) <= max {
+		return value
+	}
+	return string(runes[:max])
+}
@@ -0,0 +1,302 @@
+package services
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Slack workspace exports are zip files with users.json, channels.json,
+// groups.json (private channels) and one directory per channel holding a JSON
+// file of messages per day. Files are only included when the export was made
+// with attachments, under __uploads/<file id>/<name>.
+
+type slackUser struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	IsBot   bool   `json:"is_bot"`
+	Deleted bool   `json:"deleted"`
+	Profile struct {
+		Email       string `json:"email"`
+		DisplayName string `json:"display_name"`
+	} `json:"profile"`
+}
+
+type slackChannel struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+	Topic   struct {
+		Value string `json:"value"`
+	} `json:"topic"`
+	Purpose struct {
+		Value string `json:"value"`
+	} `json:"purpose"`
+}
+
+type slackMessage struct {
+	Type        string `json:"type"`
+	Subtype     string `json:"subtype"`
+	User        string `json:"user"`
+	BotID       string `json:"bot_id"`
+	Username    string `json:"username"`
+	Text        string `json:"text"`
+	Ts          string `json:"ts"`
+	ThreadTs    string `json:"thread_ts"`
+	UserProfile *struct {
+		Name string `json:"name"`
+	} `json:"user_profile"`
+	Edited *struct {
+		Ts string `json:"ts"`
+	} `json:"edited"`
+	Reactions []struct {
+		Name  string   `json:"name"`
+		Users []string `json:"users"`
+	} `json:"reactions"`
+	Files []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"files"`
+}
+
+// slackSkippedSubtypes are membership and housekeeping events, not conversation
+var slackSkippedSubtypes = map[string]bool{
+	"channel_join":    true,
+	"channel_leave":   true,
+	"channel_purpose": true,
+	"channel_topic":   true,
+	"channel_name":    true,
+	"channel_archive": true,
+	"group_join":      true,
+	"group_leave":     true,
+}
+
+func parseSlackExport(filePath string) (*importArchive, io.Closer, error) {
+	reader, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, nil, ErrInvalidImportArchive
+	}
+
+	archive, err := readSlackArchive(&reader.Reader)
+	if err != nil {
+		reader.Close()
+		return nil, nil, err
+	}
+	return archive, reader, nil
+}
+
+func readSlackArchive(reader *zip.Reader) (*importArchive, error) {
+	files := map[string]*zip.File{}
+	uploads := map[string]*zip.File{}
+	for _, file := range reader.File {
+		files[file.Name] = file
+		if parts := strings.Split(file.Name, "/"); len(parts) == 3 && parts[0] == "__uploads" && parts[2] != "" {
+			uploads[parts[1]] = file
+		}
+	}
+	if files["users.json"] == nil || files["channels.json"] == nil {
+		return nil, ErrInvalidImportArchive
+	}
+
+	var users []slackUser
+	if err := readZipJSON(files["users.json"], &users); err != nil {
+		return nil, err
+	}
+	archive := &importArchive{
+		ServerName: "Slack import",
+		Users:      map[string]*importUser{},
+	}
+	for _, user := range users {
+		username := user.Name
+		if user.Profile.DisplayName != "" {
+			username = user.Profile.DisplayName
+		}
+		archive.Users[user.ID] = &importUser{
+			ExternalID: user.ID,
+			Username:   username,
+			Email:      user.Profile.Email,
+			IsBot:      user.IsBot,
+		}
+	}
+
+	var public, private []slackChannel
+	if err := readZipJSON(files["channels.json"], &public); err != nil {
+		return nil, err
+	}
+	if files["groups.json"] != nil {
+		if err := readZipJSON(files["groups.json"], &private); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, source := range append(public, private...) {
+		channel := &importChannel{
+			ExternalID:  source.ID,
+			Name:        source.Name,
+			Topic:       source.Topic.Value,
+			Description: source.Purpose.Value,
+			IsPrivate:   i >= len(public),
+			MemberIDs:   source.Members,
+		}
+
+		// Day files are named YYYY-MM-DD.json inside the channel's directory
+		var dayFiles []string
+		for name := range files {
+			if path.Dir(name) == source.Name && strings.HasSuffix(name, ".json") {
+				dayFiles = append(dayFiles, name)
+			}
+		}
+		sort.Strings(dayFiles)
+
+		for _, name := range dayFiles {
+			var messages []slackMessage
+			if err := readZipJSON(files[name], &messages); err != nil {
+				return nil, err
+			}
+			for _, message := range messages {
+				converted, ok := convertSlackMessage(archive, source.ID, message, uploads)
+				if ok {
+					channel.Messages = append(channel.Messages, converted)
+				}
+			}
+		}
+		archive.Channels = append(archive.Channels, channel)
+	}
+	return archive, nil
+}
+
+func convertSlackMessage(archive *importArchive, channelID string, message slackMessage, uploads map[string]*zip.File) (*importMessage, bool) {
+	if message.Type != "message" || slackSkippedSubtypes[message.Subtype] {
+		return nil, false
+	}
+	timestamp, err := parseSlackTs(message.Ts)
+	if err != nil {
+		return nil, false
+	}
+
+	// Bot posts may have no user; key them by bot ID
+	userID := message.User
+	if userID == "" && message.BotID != "" {
+		userID = message.BotID
+		if archive.Users[userID] == nil {
+			name := message.Username
+			if name == "" {
+				name = message.BotID
+			}
+			archive.Users[userID] = &importUser{ExternalID: userID, Username: name, IsBot: true}
+		}
+	}
+	if userID == "" {
+		return nil, false
+	}
+	if archive.Users[userID] == nil && message.UserProfile != nil && message.UserProfile.Name != "" {
+		archive.Users[userID] = &importUser{ExternalID: userID, Username: message.UserProfile.Name}
+	}
+
+	converted := &importMessage{
+		// Slack timestamps are only unique within a channel
+		ExternalID: channelID + ":" + message.Ts,
+		UserID:     userID,
+		Text:       convertSlackText(archive, message.Text),
+		Timestamp:  timestamp,
+	}
+	if message.ThreadTs != "" && message.ThreadTs != message.Ts {
+		converted.ParentID = channelID + ":" + message.ThreadTs
+	}
+	if message.Edited != nil {
+		if editedAt, err := parseSlackTs(message.Edited.Ts); err == nil {
+			converted.EditedAt = &editedAt
+		}
+	}
+	for _, reaction := range message.Reactions {
+		converted.Reactions = append(converted.Reactions, importReaction{Emoji: ":" + reaction.Name + ":", UserIDs: reaction.Users})
+	}
+	for _, file := range message.Files {
+		imported := importFile{ExternalID: file.ID, Name: file.Name}
+		if upload := uploads[file.ID]; upload != nil {
+			if imported.Name == "" {
+				imported.Name = path.Base(upload.Name)
+			}
+			imported.open = upload.Open
+		}
+		if imported.Name == "" {
+			imported.Name = file.ID
+		}
+		converted.Files = append(converted.Files, imported)
+	}
+	return converted, true
+}
+
+// parseSlackTs parses Slack's "seconds.microseconds" timestamps
+func parseSlackTs(ts string) (time.Time, error) {
+	seconds, fraction, _ := strings.Cut(ts, ".")
+	sec, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid slack timestamp %q", ts)
+	}
+	var micro int64
+	if fraction != "" {
+		fraction = (fraction + "000000")[:6]
+		micro, err = strconv.ParseInt(fraction, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid slack timestamp %q", ts)
+		}
+	}
+	return time.Unix(sec, micro*1000), nil
+}
+
+var slackMarkupPattern = regexp.MustCompile(`<([^<>]+)>`)
+
+// convertSlackText turns Slack's escaped markup into plain text:
+// <@U123> mentions, <#C123|name> channel links and <url|label> links.
+func convertSlackText(archive *importArchive, text string) string {
+	text = slackMarkupPattern.ReplaceAllStringFunc(text, func(match string) string {
+		inner := match[1 : len(match)-1]
+		target, label, hasLabel := strings.Cut(inner, "|")
+		switch {
+		case strings.HasPrefix(target, "@"):
+			if user := archive.Users[target[1:]]; user != nil {
+				return "@" + user.Username
+			}
+			if hasLabel {
+				return "@" + label
+			}
+			return target
+		case strings.HasPrefix(target, "#"):
+			if hasLabel {
+				return "#" + label
+			}
+			return target
+		case strings.HasPrefix(target, "!"):
+			if hasLabel {
+				return label
+			}
+			return "@" + strings.TrimPrefix(target, "!")
+		case hasLabel && label != target:
+			return label + " (" + target + ")"
+		default:
+			return target
+		}
+	})
+	return html.UnescapeString(text)
+}
+
+func readZipJSON(file *zip.File, value interface{}) error {
+	reader, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err := json.NewDecoder(reader).Decode(value); err != nil {
+		return fmt.Errorf("%s: %w", file.Name, ErrInvalidImportArchive)
+	}
+	return nil
+}
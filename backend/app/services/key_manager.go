@@ -0,0 +1,458 @@
+package services
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"app/models"
+)
+
+const (
+	// DefaultKeyRotationGrace is how long a replaced key still verifies tokens.
+	// It must be at least the access token lifetime.
+	DefaultKeyRotationGrace = time.Hour
+	// unknownKidReloadInterval limits how often an unknown kid triggers a reload
+	unknownKidReloadInterval = 10 * time.Second
+)
+
+var (
+	ErrUnknownSigningKey        = errors.New("token is signed with an unknown key")
+	ErrNoSigningKey             = errors.New("no signing key is active")
+	ErrUnsupportedSigningMethod = errors.New("unsupported signing algorithm; use EdDSA or RS256")
+)
+
+// signingKey is a key loaded into memory
+type signingKey struct {
+	kid         string
+	algorithm   string
+	private     crypto.Signer
+	public      crypto.PublicKey
+	createdAt   time.Time
+	activatedAt time.Time
+	expiresAt   sql.NullTime
+}
+
+func (k *signingKey) usable(now time.Time) bool {
+	return !k.expiresAt.Valid || k.expiresAt.Time.After(now)
+}
+
+// KeyManager holds the keys that sign and verify access tokens.
+//
+// Keys live in the signing_keys table so every replica uses the same ones;
+// each replica reloads them periodically, and immediately when it sees a
+// token with a kid it doesn't know. Private keys are encrypted with a key
+// derived from the secret passed to NewKeyManager.
+type KeyManager struct {
+	db         *sql.DB
+	aead       cipher.AEAD
+	algorithm  string
+	mu         sync.RWMutex
+	keys       map[string]*signingKey
+	lastReload time.Time
+}
+
+// NewKeyManager creates a KeyManager. algorithm is used for keys it
+// generates: EdDSA or RS256. Call Load before using it.
+func NewKeyManager(db *sql.DB, secret string, algorithm string) (*KeyManager, error) {
+	if algorithm != models.SigningAlgorithmEdDSA && algorithm != models.SigningAlgorithmRS256 {
+		return nil, ErrUnsupportedSigningMethod
+	}
+	aead, err := newAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyManager{
+		db:        db,
+		aead:      aead,
+		algorithm: algorithm,
+		keys:      make(map[string]*signingKey),
+	}, nil
+}
+
+// KeyManagerFromEnv creates a KeyManager configured by JWT_SIGNING_ALGORITHM
+// (EdDSA by default) and SIGNING_KEY_SECRET, which encrypts the private keys
+// and is derived from JWT_SECRET when unset
+func KeyManagerFromEnv(db *sql.DB) (*KeyManager, error) {
+	algorithm := os.Getenv("JWT_SIGNING_ALGORITHM")
+	if algorithm == "" {
+		algorithm = models.SigningAlgorithmEdDSA
+	}
+	secret := os.Getenv("SIGNING_KEY_SECRET")
+	if secret == "" {
+		jwtSecret := os.Getenv("JWT_SECRET")
+		if jwtSecret == "" {
+			return nil, errors.New("SIGNING_KEY_SECRET or JWT_SECRET must be set")
+		}
+		secret = "signing-keys:" + jwtSecret
+	}
+	return NewKeyManager(db, secret, algorithm)
+}
+
+// Load loads the keys from the database, generating the first key if there
+// is no key that can sign
+func (m *KeyManager) Load() error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Replicas starting together must not each create a key
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('signing_keys'))"); err != nil {
+		return err
+	}
+	now := time.Now()
+	var signable int
+	if err := tx.QueryRow(
+		"SELECT COUNT(*) FROM signing_keys WHERE activated_at <= $1 AND (expires_at IS NULL OR expires_at > $1)",
+		now,
+	).Scan(&signable); err != nil {
+		return err
+	}
+	if signable == 0 {
+		key, err := m.insertKey(tx, m.algorithm, now)
+		if err != nil {
+			return err
+		}
+		log.Printf("署名鍵 %s (%s) を生成しました", key.Kid, key.Algorithm)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return m.reload()
+}
+
+// Start reloads the keys every interval, so keys rotated elsewhere are picked up
+func (m *KeyManager) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := m.reload(); err != nil {
+				log.Printf("署名鍵の再読み込みエラー: %v", err)
+			}
+		}
+	}()
+}
+
+// reload replaces the in-memory keys with the usable keys in the database
+func (m *KeyManager) reload() error {
+	rows, err := m.db.Query(`
+		SELECT kid, algorithm, private_key, public_key, created_at, activated_at, expires_at
+		FROM signing_keys
+		WHERE expires_at IS NULL OR expires_at > $1
+	`, time.Now())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	keys := make(map[string]*signingKey)
+	for rows.Next() {
+		var key signingKey
+		var sealed, publicDER []byte
+		if err := rows.Scan(&key.kid, &key.algorithm, &sealed, &publicDER,
+			&key.createdAt, &key.activatedAt, &key.expiresAt); err != nil {
+			return err
+		}
+		if key.private, err = m.openPrivateKey(key.kid, sealed); err != nil {
+			return fmt.Errorf("signing key %s: %w", key.kid, err)
+		}
+		if key.public, err = x509.ParsePKIXPublicKey(publicDER); err != nil {
+			return fmt.Errorf("signing key %s: %w", key.kid, err)
+		}
+		keys[key.kid] = &key
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.keys = keys
+	m.lastReload = time.Now()
+	m.mu.Unlock()
+	return nil
+}
+
+// Sign signs claims with the current signing key, setting the kid header
+func (m *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	key := m.currentKey()
+	if key == nil {
+		return "", ErrNoSigningKey
+	}
+	token := jwt.NewWithClaims(signingMethod(key.algorithm), claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// currentKey returns the most recently activated usable key
+func (m *KeyManager) currentKey() *signingKey {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	var current *signingKey
+	for _, key := range m.keys {
+		if !key.usable(now) || key.activatedAt.After(now) {
+			continue
+		}
+		if current == nil || key.activatedAt.After(current.activatedAt) {
+			current = key
+		}
+	}
+	return current
+}
+
+// Keyfunc returns the public key a token was signed with, for jwt.Parse.
+// The token's alg must be the algorithm of the key its kid names.
+func (m *KeyManager) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, ErrUnknownSigningKey
+	}
+
+	key := m.lookup(kid)
+	if key == nil {
+		// The key may have been rotated in by another replica
+		m.mu.RLock()
+		stale := time.Since(m.lastReload) > unknownKidReloadInterval
+		m.mu.RUnlock()
+		if stale {
+			if err := m.reload(); err != nil {
+				return nil, err
+			}
+			key = m.lookup(kid)
+		}
+	}
+	if key == nil || !key.usable(time.Now()) {
+		return nil, ErrUnknownSigningKey
+	}
+	if token.Method.Alg() != key.algorithm {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.public, nil
+}
+
+func (m *KeyManager) lookup(kid string) *signingKey {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.keys[kid]
+}
+
+// JWKS returns the public keys that verify tokens, including keys that
+// will start signing soon, so verifiers can cache them ahead of use
+func (m *KeyManager) JWKS() models.JWKSet {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	set := models.JWKSet{Keys: []models.JWK{}}
+	for _, key := range m.sortedKeys() {
+		if !key.usable(now) {
+			continue
+		}
+		jwk := models.JWK{Kid: key.kid, Alg: key.algorithm, Use: "sig"}
+		switch public := key.public.(type) {
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// sortedKeys returns the loaded keys, newest first. The caller holds m.mu.
+func (m *KeyManager) sortedKeys() []*signingKey {
+	keys := make([]*signingKey, 0, len(m.keys))
+	for _, key := range m.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].activatedAt.After(keys[j].activatedAt)
+	})
+	return keys
+}
+
+// Rotate creates a new key that starts signing after publishAhead. The keys
+// signing until then stop verifying grace after the new key activates.
+func (m *KeyManager) Rotate(algorithm string, publishAhead, grace time.Duration) (*models.SigningKey, error) {
+	if algorithm == "" {
+		algorithm = m.algorithm
+	}
+	if algorithm != models.SigningAlgorithmEdDSA && algorithm != models.SigningAlgorithmRS256 {
+		return nil, ErrUnsupportedSigningMethod
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('signing_keys'))"); err != nil {
+		return nil, err
+	}
+	activatedAt := time.Now().Add(publishAhead)
+	if _, err := tx.Exec(
+		"UPDATE signing_keys SET expires_at = $1 WHERE expires_at IS NULL",
+		activatedAt.Add(grace),
+	); err != nil {
+		return nil, err
+	}
+	key, err := m.insertKey(tx, algorithm, activatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return key, m.reload()
+}
+
+// ListKeys returns the keys that haven't expired, newest first
+func (m *KeyManager) ListKeys() []models.SigningKey {
+	current := m.currentKey()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := []models.SigningKey{}
+	for _, key := range m.sortedKeys() {
+		info := models.SigningKey{
+			Kid:         key.kid,
+			Algorithm:   key.algorithm,
+			CreatedAt:   key.createdAt,
+			ActivatedAt: key.activatedAt,
+			Signing:     key == current,
+		}
+		if key.expiresAt.Valid {
+			info.ExpiresAt = &key.expiresAt.Time
+		}
+		keys = append(keys, info)
+	}
+	return keys
+}
+
+// insertKey generates a key and stores it
+func (m *KeyManager) insertKey(tx *sql.Tx, algorithm string, activatedAt time.Time) (*models.SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch algorithm {
+	case models.SigningAlgorithmEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case models.SigningAlgorithmRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, ErrUnsupportedSigningMethod
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	// The kid is derived from the public key, as in RFC 7638 thumbprints
+	sum := sha256.Sum256(publicDER)
+	kid := base64.RawURLEncoding.EncodeToString(sum[:16])
+	sealed, err := m.sealPrivateKey(kid, privateDER)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if _, err := tx.Exec(`
+		INSERT INTO signing_keys (kid, algorithm, private_key, public_key, created_at, activated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, kid, algorithm, sealed, publicDER, now, activatedAt); err != nil {
+		return nil, err
+	}
+
+	return &models.SigningKey{
+		Kid:         kid,
+		Algorithm:   algorithm,
+		CreatedAt:   now,
+		ActivatedAt: activatedAt,
+	}, nil
+}
+
+// newAEAD creates an AES-256-GCM cipher with a key derived from secret
+func newAEAD(secret string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealPrivateKey encrypts a PKCS#8 private key; the kid is authenticated
+// so a sealed key can't be swapped onto another row
+func (m *KeyManager) sealPrivateKey(kid string, privateDER []byte) ([]byte, error) {
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return m.aead.Seal(nonce, nonce, privateDER, []byte(kid)), nil
+}
+
+func (m *KeyManager) openPrivateKey(kid string, sealed []byte) (crypto.Signer, error) {
+	if len(sealed) < m.aead.NonceSize() {
+		return nil, errors.New("sealed private key is too short")
+	}
+	nonce, ciphertext := sealed[:m.aead.NonceSize()], sealed[m.aead.NonceSize():]
+	privateDER, err := m.aead.Open(nil, nonce, ciphertext, []byte(kid))
+	if err != nil {
+		return nil, errors.New("cannot decrypt private key; was SIGNING_KEY_SECRET changed?")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(privateDER)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedSigningMethod
+	}
+	return signer, nil
+}
+
+func signingMethod(algorithm string) jwt.SigningMethod {
+	if algorithm == models.SigningAlgorithmRS256 {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
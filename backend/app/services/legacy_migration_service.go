@@ -0,0 +1,278 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// LegacyMigrationReport summarizes a legacy data migration run
+type LegacyMigrationReport struct {
+	LegacyTablesFound    bool `json:"legacyTablesFound"`
+	ChannelMessages      int  `json:"channelMessages"`
+	ChatbotMessages      int  `json:"chatbotMessages"`
+	Attachments          int  `json:"attachments"`
+	Skipped              int  `json:"skipped"` // rows whose channel, chat or user no longer exists
+	LegacyTablesDropped  bool `json:"legacyTablesDropped"`
+	RemainingLegacyRows  int  `json:"remainingLegacyRows"`
+	RemainingAttachments int  `json:"remainingAttachments"`
+}
+
+// LegacyMigrationService copies rows left in the legacy messages and attachments
+// tables into channel_messages, chatbot_messages and channel_attachments.
+//
+// Rows are copied in batches ordered by ID. Every insert ignores rows that already
+// exist, and each batch commits together with a checkpoint in legacy_migration_state,
+// so the migration can be interrupted and re-run at any time.
+type LegacyMigrationService struct {
+	db *sql.DB
+}
+
+// NewLegacyMigrationService creates a new LegacyMigrationService
+func NewLegacyMigrationService(db *sql.DB) *LegacyMigrationService {
+	return &LegacyMigrationService{
+		db: db,
+	}
+}
+
+// legacyMessageSteps copy one batch of legacy messages; $1 is the last copied ID
+// (or NULL) and $2 the batch size. Each returns the IDs it looked at.
+var legacyMessageSteps = []struct {
+	name  string
+	query string
+}{
+	{
+		name: "channel_messages",
+		query: `
+			WITH batch AS (
+				SELECT m.id, m.channel_id, m.user_id, m.content, m.timestamp,
+				       COALESCE(m.is_edited, FALSE) AS is_edited, COALESCE(m.is_deleted, FALSE) AS is_deleted, m.edited_at,
+				       EXISTS(SELECT 1 FROM channels c WHERE c.id = m.channel_id)
+				           AND EXISTS(SELECT 1 FROM users u WHERE u.id = m.user_id) AS copyable
+				FROM messages m
+				WHERE m.channel_id IS NOT NULL AND ($1::uuid IS NULL OR m.id > $1::uuid)
+				ORDER BY m.id
+				LIMIT $2
+			), copied AS (
+				INSERT INTO channel_messages (id, channel_id, user_id, content, timestamp, is_edited, is_deleted, edited_at)
+				SELECT id, channel_id, user_id, content, timestamp, is_edited, is_deleted, edited_at
+				FROM batch WHERE copyable
+				ON CONFLICT (id) DO NOTHING
+				RETURNING id
+			)
+			SELECT b.id, b.copyable, EXISTS(SELECT 1 FROM copied WHERE copied.id = b.id)
+			FROM batch b ORDER BY b.id`,
+	},
+	{
+		name: "chatbot_messages",
+		query: `
+			WITH batch AS (
+				SELECT m.id, m.chat_id, m.content, COALESCE(m.role, 'user') AS role, m.timestamp,
+				       EXISTS(SELECT 1 FROM chats c WHERE c.id = m.chat_id) AS copyable
+				FROM messages m
+				WHERE m.chat_id IS NOT NULL AND m.channel_id IS NULL AND ($1::uuid IS NULL OR m.id > $1::uuid)
+				ORDER BY m.id
+				LIMIT $2
+			), copied AS (
+				INSERT INTO chatbot_messages (id, chat_id, content, role, timestamp)
+				SELECT id, chat_id, content, role, timestamp
+				FROM batch WHERE copyable
+				ON CONFLICT (id) DO NOTHING
+				RETURNING id
+			)
+			SELECT b.id, b.copyable, EXISTS(SELECT 1 FROM copied WHERE copied.id = b.id)
+			FROM batch b ORDER BY b.id`,
+	},
+	{
+		name: "channel_attachments",
+		query: `
+			WITH batch AS (
+				SELECT a.id, a.message_id, a.file_name, a.file_type, a.file_path, a.file_size, a.uploaded_at,
+				       EXISTS(SELECT 1 FROM channel_messages cm WHERE cm.id = a.message_id) AS copyable
+				FROM attachments a
+				WHERE ($1::uuid IS NULL OR a.id > $1::uuid)
+				ORDER BY a.id
+				LIMIT $2
+			), copied AS (
+				INSERT INTO channel_attachments (id, channel_id, message_id, claimed_at, file_name, file_type, file_path, file_size, uploaded_by, uploaded_at)
+				SELECT id, (SELECT cm.channel_id FROM channel_messages cm WHERE cm.id = batch.message_id), message_id, uploaded_at,
+				       file_name, file_type, file_path, file_size,
+				       (SELECT cm.user_id FROM channel_messages cm WHERE cm.id = batch.message_id), uploaded_at
+				FROM batch WHERE copyable
+				ON CONFLICT (id) DO NOTHING
+				RETURNING id
+			)
+			SELECT b.id, b.copyable, EXISTS(SELECT 1 FROM copied WHERE copied.id = b.id)
+			FROM batch b ORDER BY b.id`,
+	},
+}
+
+// Run copies all remaining legacy rows. When dropLegacyTables is set and every
+// legacy row has a counterpart in the new tables, the legacy tables are dropped.
+func (s *LegacyMigrationService) Run(batchSize int, dropLegacyTables bool) (*LegacyMigrationReport, error) {
+	report := &LegacyMigrationReport{}
+
+	found, err := s.legacyTablesExist()
+	if err != nil {
+		return nil, err
+	}
+	report.LegacyTablesFound = found
+	if !found {
+		return report, nil
+	}
+
+	// Attachments run last so that their messages have already been copied
+	for _, step := range legacyMessageSteps {
+		copied, skipped, err := s.runStep(step.name, step.query, batchSize)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", step.name, err)
+		}
+		switch step.name {
+		case "channel_messages":
+			report.ChannelMessages = copied
+		case "chatbot_messages":
+			report.ChatbotMessages = copied
+		case "channel_attachments":
+			report.Attachments = copied
+		}
+		report.Skipped += skipped
+	}
+
+	if err := s.countRemaining(report); err != nil {
+		return nil, err
+	}
+
+	if dropLegacyTables {
+		if report.RemainingLegacyRows > 0 || report.RemainingAttachments > 0 {
+			return report, fmt.Errorf("%d messages and %d attachments have no counterpart in the new tables; not dropping legacy tables",
+				report.RemainingLegacyRows, report.RemainingAttachments)
+		}
+		if _, err := s.db.Exec("DROP TABLE IF EXISTS attachments; DROP TABLE IF EXISTS messages"); err != nil {
+			return report, err
+		}
+		report.LegacyTablesDropped = true
+	}
+	return report, nil
+}
+
+// runStep copies one kind of row batch by batch, resuming from its checkpoint
+func (s *LegacyMigrationService) runStep(name, query string, batchSize int) (int, int, error) {
+	var lastID sql.NullString
+	var completedAt sql.NullTime
+	err := s.db.QueryRow(
+		"SELECT last_id, completed_at FROM legacy_migration_state WHERE name = $1", name,
+	).Scan(&lastID, &completedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, 0, err
+	}
+	if err == sql.ErrNoRows {
+		now := time.Now()
+		if _, err := s.db.Exec(
+			"INSERT INTO legacy_migration_state (name, started_at, updated_at) VALUES ($1, $2, $2)", name, now,
+		); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// A completed step is rescanned from the start in case new legacy rows were
+	// written by an old client since the last run; existing rows are skipped cheaply.
+	if completedAt.Valid {
+		lastID = sql.NullString{}
+	}
+
+	totalCopied, totalSkipped := 0, 0
+	for {
+		copied, skipped, nextID, err := s.copyBatch(name, query, lastID, batchSize)
+		if err != nil {
+			return totalCopied, totalSkipped, err
+		}
+		totalCopied += copied
+		totalSkipped += skipped
+		if !nextID.Valid {
+			break
+		}
+		lastID = nextID
+	}
+
+	_, err = s.db.Exec(
+		"UPDATE legacy_migration_state SET completed_at = $1, updated_at = $1 WHERE name = $2", time.Now(), name,
+	)
+	return totalCopied, totalSkipped, err
+}
+
+// copyBatch copies one batch and saves the checkpoint in the same transaction.
+// It returns an invalid nextID when there was nothing left to copy.
+func (s *LegacyMigrationService) copyBatch(name, query string, lastID sql.NullString, batchSize int) (int, int, sql.NullString, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, 0, sql.NullString{}, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(query, lastID, batchSize)
+	if err != nil {
+		return 0, 0, sql.NullString{}, err
+	}
+
+	copied, skipped, seen := 0, 0, 0
+	var nextID sql.NullString
+	for rows.Next() {
+		var id string
+		var copyable, inserted bool
+		if err := rows.Scan(&id, &copyable, &inserted); err != nil {
+			rows.Close()
+			return 0, 0, sql.NullString{}, err
+		}
+		seen++
+		nextID = sql.NullString{String: id, Valid: true}
+		if !copyable {
+			skipped++
+		} else if inserted {
+			copied++
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, sql.NullString{}, err
+	}
+	if seen == 0 {
+		return 0, 0, sql.NullString{}, nil
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE legacy_migration_state
+		SET last_id = $1, copied = copied + $2, skipped = skipped + $3, updated_at = $4, completed_at = NULL
+		WHERE name = $5
+	`, nextID, copied, skipped, time.Now(), name); err != nil {
+		return 0, 0, sql.NullString{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, sql.NullString{}, err
+	}
+	return copied, skipped, nextID, nil
+}
+
+// countRemaining counts legacy rows that still have no counterpart in the new tables
+func (s *LegacyMigrationService) countRemaining(report *LegacyMigrationReport) error {
+	err := s.db.QueryRow(`
+		SELECT COUNT(*) FROM messages m
+		WHERE NOT EXISTS(SELECT 1 FROM channel_messages cm WHERE cm.id = m.id)
+		  AND NOT EXISTS(SELECT 1 FROM chatbot_messages bm WHERE bm.id = m.id)
+	`).Scan(&report.RemainingLegacyRows)
+	if err != nil {
+		return err
+	}
+	return s.db.QueryRow(`
+		SELECT COUNT(*) FROM attachments a
+		WHERE NOT EXISTS(SELECT 1 FROM channel_attachments ca WHERE ca.id = a.id)
+	`).Scan(&report.RemainingAttachments)
+}
+
+func (s *LegacyMigrationService) legacyTablesExist() (bool, error) {
+	var messages, attachments sql.NullString
+	err := s.db.QueryRow("SELECT to_regclass('messages')::text, to_regclass('attachments')::text").Scan(&messages, &attachments)
+	if err != nil {
+		return false, err
+	}
+	return messages.Valid && attachments.Valid, nil
+}
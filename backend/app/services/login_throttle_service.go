@@ -0,0 +1,362 @@
+package services
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"app/mail"
+	"app/models"
+)
+
+// Throttle scopes, each with its own policy in throttlePolicies
+const (
+	throttleScopeAccount  = "account"  // login failures per email address
+	throttleScopeIP       = "ip"       // login failures per client IP
+	throttleScopeRegister = "register" // registrations per client IP
+)
+
+// throttlePolicy describes how repeated failures are slowed down and then locked out
+type throttlePolicy struct {
+	// freeFailures are allowed without any delay
+	freeFailures int
+	// baseDelay is the wait after the first failure past freeFailures. It
+	// doubles with every further failure, up to maxDelay.
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	// lockoutAfter failures lock the key for lockoutDuration, doubling with
+	// each consecutive lockout up to maxLockout
+	lockoutAfter    int
+	lockoutDuration time.Duration
+	maxLockout      time.Duration
+	// resetAfter this long without a failure, earlier failures are forgotten
+	resetAfter time.Duration
+}
+
+var throttlePolicies = map[string]throttlePolicy{
+	throttleScopeAccount: {
+		freeFailures:    3,
+		baseDelay:       time.Second,
+		maxDelay:        time.Minute,
+		lockoutAfter:    10,
+		lockoutDuration: 15 * time.Minute,
+		maxLockout:      24 * time.Hour,
+		resetAfter:      24 * time.Hour,
+	},
+	// Higher limits, since many users can share an address behind NAT
+	throttleScopeIP: {
+		freeFailures:    20,
+		baseDelay:       time.Second,
+		maxDelay:        5 * time.Minute,
+		lockoutAfter:    100,
+		lockoutDuration: time.Hour,
+		maxLockout:      24 * time.Hour,
+		resetAfter:      24 * time.Hour,
+	},
+	// Every registration counts, successful or not
+	throttleScopeRegister: {
+		freeFailures:    5,
+		baseDelay:       time.Minute,
+		maxDelay:        time.Hour,
+		lockoutAfter:    20,
+		lockoutDuration: 6 * time.Hour,
+		maxLockout:      24 * time.Hour,
+		resetAfter:      24 * time.Hour,
+	},
+}
+
+// delay is the wait imposed after the given number of failures
+func (p throttlePolicy) delay(failures int) time.Duration {
+	if failures <= p.freeFailures {
+		return 0
+	}
+	return doubled(p.baseDelay, failures-p.freeFailures-1, p.maxDelay)
+}
+
+// lockout is the length of a lockout after the given number of earlier ones
+func (p throttlePolicy) lockout(lockouts int) time.Duration {
+	return doubled(p.lockoutDuration, lockouts, p.maxLockout)
+}
+
+// doubled doubles base the given number of times, capped at max
+func doubled(base time.Duration, times int, max time.Duration) time.Duration {
+	d := base
+	for i := 0; i < times && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// ThrottledError is returned when an account or client has to wait before
+// trying again
+type ThrottledError struct {
+	RetryAfter time.Duration
+	// Locked is set for a lockout, as opposed to a short backoff delay
+	Locked bool
+}
+
+func (e *ThrottledError) Error() string {
+	wait := (e.RetryAfter + time.Second - 1).Truncate(time.Second)
+	if e.Locked {
+		return fmt.Sprintf("temporarily locked after too many failed attempts; try again in %s", wait)
+	}
+	return fmt.Sprintf("too many failed attempts; try again in %s", wait)
+}
+
+// LoginThrottleService slows down password and two-factor code guessing.
+// Failed logins are counted per account and per client IP, and registrations
+// per client IP; past a few failures each further one adds an exponentially
+// growing delay, and enough of them lock the account or IP out for a while.
+// The counters live in Postgres, so the limits hold across replicas. They
+// are checked with plain reads and updated in short transactions under
+// advisory locks; no lock is held while a password is compared.
+type LoginThrottleService struct {
+	db      *sql.DB
+	mailer  mail.Mailer
+	baseURL string
+}
+
+// NewLoginThrottleService creates a new LoginThrottleService. Lockout
+// notifications are sent through mailer, with links to baseURL.
+func NewLoginThrottleService(db *sql.DB, mailer mail.Mailer, baseURL string) *LoginThrottleService {
+	return &LoginThrottleService{
+		db:      db,
+		mailer:  mailer,
+		baseURL: baseURL,
+	}
+}
+
+// CheckLogin returns a *ThrottledError if the account for an email address
+// or the client's IP has to wait before trying again. It takes no locks, so
+// the password check that follows never runs while holding a connection.
+func (s *LoginThrottleService) CheckLogin(email, ipAddress string) error {
+	now := time.Now()
+	if err := checkThrottle(s.db, throttleScopeIP, hashToken(ipAddress), now); err != nil {
+		return err
+	}
+	return checkThrottle(s.db, throttleScopeAccount, accountThrottleKey(email), now)
+}
+
+// LoginFailed records a failed login against the account and the IP. user
+// owns the account and is emailed if this locks it; it is nil when no user
+// has the address.
+func (s *LoginThrottleService) LoginFailed(email, ipAddress string, user *models.User) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	account := accountThrottleKey(email)
+	ip := hashToken(ipAddress)
+	if err := lockThrottle(tx, throttleScopeAccount, account); err != nil {
+		return err
+	}
+	accountLock, err := recordThrottleFailure(tx, throttleScopeAccount, account, now)
+	if err != nil {
+		return err
+	}
+	if err := lockThrottle(tx, throttleScopeIP, ip); err != nil {
+		return err
+	}
+	ipLock, err := recordThrottleFailure(tx, throttleScopeIP, ip, now)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if ipLock > 0 {
+		log.Printf("ログイン失敗が続いたため、IPアドレスを%sロックしました", ipLock)
+	}
+	if accountLock > 0 && user != nil {
+		s.notifyLockout(user, now.Add(accountLock))
+	}
+	return nil
+}
+
+// LoginSucceeded forgets the account's failed attempts. The IP's are kept,
+// so logging in to one account doesn't allow more guesses at others.
+func (s *LoginThrottleService) LoginSucceeded(email string) error {
+	return s.clearAccount(email)
+}
+
+// CheckRegistration counts a registration from an IP address, or returns a
+// *ThrottledError if the IP has registered too often recently
+func (s *LoginThrottleService) CheckRegistration(ipAddress string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	key := hashToken(ipAddress)
+	now := time.Now()
+	if err := lockThrottle(tx, throttleScopeRegister, key); err != nil {
+		return err
+	}
+	if err := checkThrottle(tx, throttleScopeRegister, key, now); err != nil {
+		return err
+	}
+	if _, err := recordThrottleFailure(tx, throttleScopeRegister, key, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnlockAccount clears a user's failed logins and any lockout. It reports
+// whether the account was locked.
+func (s *LoginThrottleService) UnlockAccount(userID string) (bool, error) {
+	if _, err := uuid.Parse(userID); err != nil {
+		return false, ErrUserNotFound
+	}
+	var email string
+	err := s.db.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&email)
+	if err == sql.ErrNoRows {
+		return false, ErrUserNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var wasLocked bool
+	err = s.db.QueryRow(`
+		DELETE FROM auth_throttles WHERE scope = $1 AND key_hash = $2
+		RETURNING locked AND blocked_until > $3
+	`, throttleScopeAccount, accountThrottleKey(email), time.Now()).Scan(&wasLocked)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return wasLocked, err
+}
+
+// clearAccount forgets the failed logins for an email address, for when the
+// owner has proven themselves some other way
+func (s *LoginThrottleService) clearAccount(email string) error {
+	_, err := s.db.Exec(
+		"DELETE FROM auth_throttles WHERE scope = $1 AND key_hash = $2", throttleScopeAccount, accountThrottleKey(email),
+	)
+	return err
+}
+
+// notifyLockout tells a user their account was locked, in case it wasn't them
+func (s *LoginThrottleService) notifyLockout(user *models.User, until time.Time) {
+	sendMail(s.mailer, mail.Message{
+		To:      user.Email,
+		Subject: "アカウントが一時的にロックされました",
+		Text: fmt.Sprintf(`%s さん
+
+ログインの失敗が続いたため、アカウントを一時的にロックしました。
+ロックは %s に自動的に解除されます。
+
+心当たりがない場合は、第三者がパスワードを推測しようとしている可能性があります。
+次のページからパスワードを再設定すると、ロックもすぐに解除されます。
+
+%s
+`, user.Username, until.Format("2006-01-02 15:04 MST"), s.baseURL+"/forgot-password"),
+	})
+}
+
+// StartCleanup deletes counters that have expired every interval
+func (s *LoginThrottleService) StartCleanup(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			now := time.Now()
+			for scope, policy := range throttlePolicies {
+				if _, err := s.db.Exec(`
+					DELETE FROM auth_throttles
+					WHERE scope = $1 AND last_failure_at <= $2 AND (blocked_until IS NULL OR blocked_until <= $3)
+				`, scope, now.Add(-policy.resetAfter), now); err != nil {
+					log.Printf("ログイン試行記録のクリーンアップエラー: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// accountThrottleKey identifies an account by the address used to log in,
+// whether or not a user has it, so lockouts don't reveal which exist
+func accountThrottleKey(email string) string {
+	return hashToken(strings.ToLower(strings.TrimSpace(email)))
+}
+
+// lockThrottle takes a transaction-scoped advisory lock on a counter
+func lockThrottle(tx *sql.Tx, scope, key string) error {
+	sum := sha256.Sum256([]byte(scope + ":" + key))
+	_, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", int64(binary.BigEndian.Uint64(sum[:8])))
+	return err
+}
+
+// checkThrottle returns a *ThrottledError if a counter is blocked
+func checkThrottle(db queryRower, scope, key string, now time.Time) error {
+	var blockedUntil time.Time
+	var locked bool
+	err := db.QueryRow(
+		"SELECT blocked_until, locked FROM auth_throttles WHERE scope = $1 AND key_hash = $2 AND blocked_until > $3",
+		scope, key, now,
+	).Scan(&blockedUntil, &locked)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return &ThrottledError{RetryAfter: blockedUntil.Sub(now), Locked: locked}
+}
+
+// recordThrottleFailure counts a failure and sets the delay before the next
+// attempt. It returns the lockout's length if this failure caused one. The
+// caller must hold the counter's lock.
+func recordThrottleFailure(tx *sql.Tx, scope, key string, now time.Time) (time.Duration, error) {
+	policy := throttlePolicies[scope]
+
+	var failures, lockouts int
+	var lastFailureAt time.Time
+	err := tx.QueryRow(
+		"SELECT failures, lockouts, last_failure_at FROM auth_throttles WHERE scope = $1 AND key_hash = $2",
+		scope, key,
+	).Scan(&failures, &lockouts, &lastFailureAt)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if err == nil && now.Sub(lastFailureAt) >= policy.resetAfter {
+		failures, lockouts = 0, 0
+	}
+
+	failures++
+	var blockedUntil sql.NullTime
+	var lockout time.Duration
+	if failures >= policy.lockoutAfter {
+		lockout = policy.lockout(lockouts)
+		blockedUntil = sql.NullTime{Time: now.Add(lockout), Valid: true}
+		failures = 0
+		lockouts++
+	} else if delay := policy.delay(failures); delay > 0 {
+		blockedUntil = sql.NullTime{Time: now.Add(delay), Valid: true}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO auth_throttles (scope, key_hash, failures, lockouts, last_failure_at, blocked_until, locked)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (scope, key_hash) DO UPDATE SET
+			failures = EXCLUDED.failures,
+			lockouts = EXCLUDED.lockouts,
+			last_failure_at = EXCLUDED.last_failure_at,
+			blocked_until = EXCLUDED.blocked_until,
+			locked = EXCLUDED.locked
+	`, scope, key, failures, lockouts, now, blockedUntil, lockout > 0)
+	return lockout, err
+}
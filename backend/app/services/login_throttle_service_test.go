@@ -0,0 +1,61 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottlePolicyDelay(t *testing.T) {
+	policy := throttlePolicy{
+		freeFailures: 3,
+		baseDelay:    time.Second,
+		maxDelay:     time.Minute,
+	}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{9, 32 * time.Second},
+		{10, time.Minute},
+		{1000, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := policy.delay(tt.failures); got != tt.want {
+			t.Errorf("delay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestThrottlePolicyLockout(t *testing.T) {
+	policy := throttlePolicy{
+		lockoutDuration: 15 * time.Minute,
+		maxLockout:      24 * time.Hour,
+	}
+	tests := []struct {
+		lockouts int
+		want     time.Duration
+	}{
+		{0, 15 * time.Minute},
+		{1, 30 * time.Minute},
+		{2, time.Hour},
+		{6, 16 * time.Hour},
+		{7, 24 * time.Hour},
+		{1000, 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := policy.lockout(tt.lockouts); got != tt.want {
+			t.Errorf("lockout(%d) = %v, want %v", tt.lockouts, got, tt.want)
+		}
+	}
+}
+
+func TestDoubledCapsBaseAboveMax(t *testing.T) {
+	if got := doubled(time.Hour, 0, time.Minute); got != time.Minute {
+		t.Errorf("doubled(1h, 0, 1m) = %v, want 1m", got)
+	}
+}
@@ -0,0 +1,276 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+
+	"app/models"
+	"app/oidc"
+)
+
+const (
+	// OIDCLoginStateTTL is how long a sign-in at an identity provider can take
+	OIDCLoginStateTTL = 10 * time.Minute
+	// oidcRequestTimeout bounds the requests to an identity provider for one sign-in
+	oidcRequestTimeout = 20 * time.Second
+)
+
+var (
+	ErrUnknownOIDCProvider  = errors.New("unknown identity provider")
+	ErrInvalidOIDCState     = errors.New("sign-in is invalid or has expired; start again")
+	ErrOIDCEmailNotVerified = errors.New("the identity provider did not confirm a verified email address")
+	ErrOIDCSignupDisabled   = errors.New("no account exists for this email address")
+)
+
+// OIDCService signs users in with OpenID Connect identity providers.
+//
+// The first sign-in through a provider links the provider's subject to the
+// account with the same email address, which the provider must report as
+// verified, or creates an account if the provider allows signups. Later
+// sign-ins find the account by the linked subject.
+type OIDCService struct {
+	db        *sql.DB
+	providers map[string]*oidc.Provider
+	order     []string
+}
+
+// NewOIDCService creates a new OIDCService for the configured providers
+func NewOIDCService(db *sql.DB, configs []oidc.Config) *OIDCService {
+	s := &OIDCService{
+		db:        db,
+		providers: make(map[string]*oidc.Provider, len(configs)),
+	}
+	for _, config := range configs {
+		s.providers[config.ID] = oidc.NewProvider(config)
+		s.order = append(s.order, config.ID)
+	}
+	return s
+}
+
+// Providers lists the configured providers in configuration order
+func (s *OIDCService) Providers() []models.AuthProvider {
+	providers := make([]models.AuthProvider, 0, len(s.order))
+	for _, id := range s.order {
+		providers = append(providers, models.AuthProvider{ID: id, Name: s.providers[id].Name()})
+	}
+	return providers
+}
+
+// StartLogin begins a sign-in and returns the provider URL to send the
+// browser to. State, nonce and the PKCE code verifier are kept until the
+// callback.
+func (s *OIDCService) StartLogin(providerID string) (*models.OIDCAuthorization, error) {
+	provider, ok := s.providers[providerID]
+	if !ok {
+		return nil, ErrUnknownOIDCProvider
+	}
+
+	var values [3]string
+	for i := range values {
+		value, err := oidc.RandomString()
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	state, nonce, codeVerifier := values[0], values[1], values[2]
+
+	ctx, cancel := context.WithTimeout(context.Background(), oidcRequestTimeout)
+	defer cancel()
+	authURL, err := provider.AuthCodeURL(ctx, state, nonce, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if _, err := s.db.Exec(`
+		INSERT INTO oidc_login_states (state_hash, provider, code_verifier, nonce, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, hashToken(state), providerID, codeVerifier, nonce, now, now.Add(OIDCLoginStateTTL)); err != nil {
+		return nil, err
+	}
+
+	return &models.OIDCAuthorization{AuthorizationURL: authURL, State: state}, nil
+}
+
+// CompleteLogin redeems the code from the provider's callback, validates
+// the ID token and returns the user it belongs to
+func (s *OIDCService) CompleteLogin(state, code string) (string, error) {
+	var providerID, codeVerifier, nonce string
+	err := s.db.QueryRow(`
+		DELETE FROM oidc_login_states
+		WHERE state_hash = $1 AND expires_at > $2
+		RETURNING provider, code_verifier, nonce
+	`, hashToken(state), time.Now()).Scan(&providerID, &codeVerifier, &nonce)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidOIDCState
+	}
+	if err != nil {
+		return "", err
+	}
+	provider, ok := s.providers[providerID]
+	if !ok {
+		// The provider was removed from the configuration during the sign-in
+		return "", ErrUnknownOIDCProvider
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), oidcRequestTimeout)
+	defer cancel()
+	tokens, err := provider.Exchange(ctx, code, codeVerifier)
+	if err != nil {
+		return "", err
+	}
+	claims, err := provider.VerifyIDToken(ctx, tokens.IDToken, nonce)
+	if err != nil {
+		return "", err
+	}
+	return s.linkIdentity(provider, claims)
+}
+
+// linkIdentity finds the user for a provider subject, linking or creating
+// an account on the first sign-in
+func (s *OIDCService) linkIdentity(provider *oidc.Provider, claims *oidc.Claims) (string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var userID string
+	err = tx.QueryRow(`
+		UPDATE user_identities SET email = $1, last_login_at = $2
+		WHERE provider = $3 AND subject = $4
+		RETURNING user_id
+	`, claims.Email, now, provider.ID(), claims.Subject).Scan(&userID)
+	if err == nil {
+		return userID, tx.Commit()
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	// An address the provider hasn't verified could belong to someone else
+	if claims.Email == "" || !bool(claims.EmailVerified) {
+		return "", ErrOIDCEmailNotVerified
+	}
+
+	var verified bool
+	err = tx.QueryRow(
+		"SELECT id, email_verified_at IS NOT NULL FROM users WHERE LOWER(email) = LOWER($1) FOR UPDATE", claims.Email,
+	).Scan(&userID, &verified)
+	switch {
+	case err == nil:
+		if !verified {
+			// Whoever registered the address without confirming it may not
+			// be its owner, so their password must not keep working
+			if _, err := tx.Exec(
+				"UPDATE users SET password = '', email_verified_at = $1, updated_at = $1 WHERE id = $2",
+				now, userID,
+			); err != nil {
+				return "", err
+			}
+		}
+	case err == sql.ErrNoRows:
+		if !provider.AllowSignup() {
+			return "", ErrOIDCSignupDisabled
+		}
+		if userID, err = createOIDCUser(tx, claims, now); err != nil {
+			return "", err
+		}
+	default:
+		return "", err
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO user_identities (provider, subject, user_id, email, created_at, last_login_at)
+		VALUES ($1, $2, $3, $4, $5, $5)
+	`, provider.ID(), claims.Subject, userID, claims.Email, now); err != nil {
+		return "", err
+	}
+	return userID, tx.Commit()
+}
+
+// createOIDCUser creates a verified account without a password; its owner
+// signs in through the provider, or sets a password with a reset link
+func createOIDCUser(tx *sql.Tx, claims *oidc.Claims, now time.Time) (string, error) {
+	base := usernameFromClaims(claims)
+	username := base
+	for attempt := 0; ; attempt++ {
+		var taken bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)", username).Scan(&taken); err != nil {
+			return "", err
+		}
+		if !taken {
+			break
+		}
+		if attempt == 10 {
+			return "", errors.New("could not find a free username")
+		}
+		suffix, err := rand.Int(rand.Reader, big.NewInt(10000))
+		if err != nil {
+			return "", err
+		}
+		username = fmt.Sprintf("%s_%04d", truncateRunes(base, 25), suffix.Int64())
+	}
+
+	userID := uuid.New().String()
+	_, err := tx.Exec(`
+		INSERT INTO users (id, username, email, password, created_at, updated_at, email_verified_at)
+		VALUES ($1, $2, $3, '', $4, $4, $4)
+	`, userID, username, claims.Email, now)
+	if err != nil {
+		return "", fmt.Errorf("error creating user: %w", err)
+	}
+	return userID, nil
+}
+
+// usernameFromClaims picks a username from the provider's preferred
+// username, the person's name or the email address, keeping letters,
+// digits, '_', '-' and '.'
+func usernameFromClaims(claims *oidc.Claims) string {
+	for _, candidate := range []string{
+		claims.PreferredUsername,
+		claims.Name,
+		strings.SplitN(claims.Email, "@", 2)[0],
+	} {
+		username := strings.Map(func(r rune) rune {
+			switch {
+			case unicode.IsLetter(r), unicode.IsDigit(r), r == '_', r == '-', r == '.':
+				return r
+			case unicode.IsSpace(r):
+				return '_'
+			default:
+				return -1
+			}
+		}, strings.TrimSpace(candidate))
+		username = truncateRunes(username, 30)
+		if len([]rune(username)) >= 3 {
+			return username
+		}
+	}
+	return "user"
+}
+
+// StartCleanup deletes abandoned sign-ins every interval
+func (s *OIDCService) StartCleanup(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := s.db.Exec("DELETE FROM oidc_login_states WHERE expires_at <= $1", time.Now()); err != nil {
+				log.Printf("OIDCサインイン状態のクリーンアップエラー: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,222 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"app/models"
+)
+
+const (
+	// PersonalAccessTokenPrefix starts every personal access token, which
+	// tells them apart from JWTs and makes leaked tokens easy to scan for
+	PersonalAccessTokenPrefix = "pat_"
+	// DefaultPersonalAccessTokenDays is the lifetime of a token when none is requested
+	DefaultPersonalAccessTokenDays = 30
+	// maxPersonalAccessTokens is how many active tokens a user can have
+	maxPersonalAccessTokens = 50
+	// tokenLastUsedInterval limits how often last-used tracking writes to the database
+	tokenLastUsedInterval = time.Minute
+	// tokenHintLength is how many characters of a token are kept for display
+	tokenHintLength = 12
+)
+
+var (
+	ErrInvalidPersonalAccessToken  = errors.New("invalid or expired personal access token")
+	ErrPersonalAccessTokenNotFound = errors.New("personal access token not found")
+	ErrTooManyPersonalAccessTokens = fmt.Errorf("you can have at most %d personal access tokens", maxPersonalAccessTokens)
+	ErrUnknownTokenScope           = errors.New("unknown scope")
+	ErrTokenNameRequired           = errors.New("token name is required")
+)
+
+// TokenAuth is an authenticated personal access token
+type TokenAuth struct {
+	TokenID string
+	UserID  string
+	Scopes  []string
+}
+
+// HasScope reports whether the token was granted scope
+func (t *TokenAuth) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// PersonalAccessTokenService manages personal access tokens: long-lived,
+// scoped tokens for scripts that act as a user without holding their
+// session
+type PersonalAccessTokenService struct {
+	db *sql.DB
+}
+
+// NewPersonalAccessTokenService creates a new PersonalAccessTokenService
+func NewPersonalAccessTokenService(db *sql.DB) *PersonalAccessTokenService {
+	return &PersonalAccessTokenService{db: db}
+}
+
+// IsPersonalAccessToken reports whether a bearer token is a personal access token
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, PersonalAccessTokenPrefix)
+}
+
+// CreateToken creates a token; the returned token is the only time it is shown
+func (s *PersonalAccessTokenService) CreateToken(userID string, req models.CreatePersonalAccessTokenRequest) (*models.CreatedPersonalAccessToken, error) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return nil, ErrTokenNameRequired
+	}
+	scopes := uniqueStrings(req.Scopes)
+	for _, scope := range scopes {
+		if !isTokenScope(scope) {
+			return nil, fmt.Errorf("%w %q", ErrUnknownTokenScope, scope)
+		}
+	}
+	days := req.ExpiresInDays
+	if days == 0 {
+		days = DefaultPersonalAccessTokenDays
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Serialise creation for the user so the limit holds
+	if _, err := tx.Exec("SELECT 1 FROM users WHERE id = $1 FOR UPDATE", userID); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var count int
+	if err := tx.QueryRow(
+		"SELECT COUNT(*) FROM personal_access_tokens WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2",
+		userID, now,
+	).Scan(&count); err != nil {
+		return nil, err
+	}
+	if count >= maxPersonalAccessTokens {
+		return nil, ErrTooManyPersonalAccessTokens
+	}
+
+	secret, err := generateRandomToken()
+	if err != nil {
+		return nil, err
+	}
+	token := PersonalAccessTokenPrefix + secret
+	created := &models.CreatedPersonalAccessToken{
+		PersonalAccessToken: models.PersonalAccessToken{
+			ID:        uuid.New().String(),
+			Name:      name,
+			TokenHint: token[:tokenHintLength],
+			Scopes:    scopes,
+			CreatedAt: now,
+			ExpiresAt: now.AddDate(0, 0, days),
+		},
+		Token: token,
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO personal_access_tokens (id, user_id, name, token_hash, token_hint, scopes, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, created.ID, userID, created.Name, hashToken(token), created.TokenHint,
+		pq.Array(created.Scopes), created.CreatedAt, created.ExpiresAt); err != nil {
+		return nil, err
+	}
+	return created, tx.Commit()
+}
+
+// GetTokens lists a user's active tokens, newest first
+func (s *PersonalAccessTokenService) GetTokens(userID string) ([]models.PersonalAccessToken, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, token_hint, scopes, created_at, expires_at, last_used_at, COALESCE(last_used_ip, '')
+		FROM personal_access_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2
+		ORDER BY created_at DESC
+	`, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []models.PersonalAccessToken{}
+	for rows.Next() {
+		var token models.PersonalAccessToken
+		var lastUsedAt sql.NullTime
+		if err := rows.Scan(
+			&token.ID, &token.Name, &token.TokenHint, pq.Array(&token.Scopes),
+			&token.CreatedAt, &token.ExpiresAt, &lastUsedAt, &token.LastUsedIP,
+		); err != nil {
+			return nil, err
+		}
+		if lastUsedAt.Valid {
+			token.LastUsedAt = &lastUsedAt.Time
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeToken revokes one of a user's tokens
+func (s *PersonalAccessTokenService) RevokeToken(userID, tokenID string) error {
+	if _, err := uuid.Parse(tokenID); err != nil {
+		return ErrPersonalAccessTokenNotFound
+	}
+	result, err := s.db.Exec(
+		"UPDATE personal_access_tokens SET revoked_at = $1 WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL",
+		time.Now(), tokenID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrPersonalAccessTokenNotFound
+	}
+	return nil
+}
+
+// ValidateToken checks a token and records when and from where it was used
+func (s *PersonalAccessTokenService) ValidateToken(token, ipAddress string) (*TokenAuth, error) {
+	auth := &TokenAuth{}
+	var lastUsedAt sql.NullTime
+	now := time.Now()
+	err := s.db.QueryRow(`
+		SELECT id, user_id, scopes, last_used_at
+		FROM personal_access_tokens
+		WHERE token_hash = $1 AND revoked_at IS NULL AND expires_at > $2
+	`, hashToken(token), now).Scan(&auth.TokenID, &auth.UserID, pq.Array(&auth.Scopes), &lastUsedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidPersonalAccessToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Scripts may call often; the last use only needs to be roughly right
+	if !lastUsedAt.Valid || now.Sub(lastUsedAt.Time) >= tokenLastUsedInterval {
+		if _, err := s.db.Exec(
+			"UPDATE personal_access_tokens SET last_used_at = $1, last_used_ip = $2 WHERE id = $3",
+			now, ipAddress, auth.TokenID,
+		); err != nil {
+			return nil, err
+		}
+	}
+	return auth, nil
+}
+
+func isTokenScope(scope string) bool {
+	for _, s := range models.TokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,545 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"app/models"
+)
+
+// Errors returned by PollService
+var (
+	ErrPollNotFound      = errors.New("poll not found")
+	ErrPollClosed        = errors.New("poll is closed")
+	ErrInvalidPollOption = errors.New("option does not belong to this poll")
+	ErrSingleChoicePoll  = errors.New("this poll allows only one choice")
+	ErrPollDeadline      = errors.New("close time must be in the future")
+)
+
+// PollService handles polls posted in channels
+type PollService struct {
+	db        *sql.DB
+	wsService *WebSocketService
+}
+
+// NewPollService creates a new PollService
+func NewPollService(db *sql.DB) *PollService {
+	return &PollService{
+		db: db,
+	}
+}
+
+// SetWebSocketService はWebSocketServiceを設定する
+func (s *PollService) SetWebSocketService(wsService *WebSocketService) {
+	s.wsService = wsService
+}
+
+// CreatePoll posts a poll message in a channel
+func (s *PollService) CreatePoll(channelId, userId string, req models.PollRequest) (*models.ChannelMessage, error) {
+	now := time.Now()
+	if req.ClosesAt != nil {
+		if !req.ClosesAt.After(now) {
+			return nil, ErrPollDeadline
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	message := models.ChannelMessage{
+		ID:        uuid.New().String(),
+		ChannelId: channelId,
+		UserId:    userId,
+		Type:      models.MessageTypePoll,
+		Content:   req.Question,
+		Timestamp: now,
+	}
+	if err := saveChannelMessageTx(tx, message); err != nil {
+		return nil, err
+	}
+
+	pollId := uuid.New().String()
+	var closesAt sql.NullTime
+	if req.ClosesAt != nil {
+		closesAt = sql.NullTime{Time: *req.ClosesAt, Valid: true}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO polls (id, message_id, channel_id, question, allow_multiple, is_anonymous, closes_at, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, pollId, message.ID, channelId, req.Question, req.AllowMultiple, req.IsAnonymous, closesAt, userId, now)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, option := range req.Options {
+		_, err = tx.Exec(
+			"INSERT INTO poll_options (id, poll_id, text, position) VALUES ($1, $2, $3, $4)",
+			uuid.New().String(), pollId, strings.TrimSpace(option), i,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	poll, err := s.GetPoll(pollId)
+	if err != nil {
+		return nil, err
+	}
+	message.Poll = poll
+
+	return &message, nil
+}
+
+// GetPoll retrieves a poll with its current results
+func (s *PollService) GetPoll(pollId string) (*models.Poll, error) {
+	var messageId string
+	err := s.db.QueryRow("SELECT message_id FROM polls WHERE id = $1", pollId).Scan(&messageId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrPollNotFound
+		}
+		return nil, err
+	}
+
+	polls, err := loadPollsByMessageIds(s.db, []string{messageId})
+	if err != nil {
+		return nil, err
+	}
+	poll, ok := polls[messageId]
+	if !ok {
+		return nil, ErrPollNotFound
+	}
+	return poll, nil
+}
+
+// GetUserVotes returns the option IDs the user voted for
+func (s *PollService) GetUserVotes(pollId, userId string) ([]string, error) {
+	rows, err := s.db.Query("SELECT option_id FROM poll_votes WHERE poll_id = $1 AND user_id = $2", pollId, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	optionIds := []string{}
+	for rows.Next() {
+		var optionId string
+		if err := rows.Scan(&optionId); err != nil {
+			return nil, err
+		}
+		optionIds = append(optionIds, optionId)
+	}
+	return optionIds, rows.Err()
+}
+
+// Vote records the user's choices. In single-choice polls the new choice replaces the old one.
+func (s *PollService) Vote(pollId, userId string, optionIds []string) (*models.Poll, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	allowMultiple, err := lockOpenPoll(tx, pollId)
+	if err != nil {
+		return nil, err
+	}
+	if !allowMultiple && len(optionIds) > 1 {
+		return nil, ErrSingleChoicePoll
+	}
+
+	var validCount int
+	err = tx.QueryRow(
+		"SELECT COUNT(*) FROM poll_options WHERE poll_id = $1 AND id = ANY($2::uuid[])",
+		pollId, pq.Array(optionIds),
+	).Scan(&validCount)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "22P02" {
+			return nil, ErrInvalidPollOption
+		}
+		return nil, err
+	}
+	if validCount != len(uniqueStrings(optionIds)) {
+		return nil, ErrInvalidPollOption
+	}
+
+	if !allowMultiple {
+		if _, err := tx.Exec("DELETE FROM poll_votes WHERE poll_id = $1 AND user_id = $2", pollId, userId); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	for _, optionId := range uniqueStrings(optionIds) {
+		_, err = tx.Exec(`
+			INSERT INTO poll_votes (poll_id, option_id, user_id, voted_at)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (option_id, user_id) DO NOTHING
+		`, pollId, optionId, userId, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return s.publishResults(pollId)
+}
+
+// Unvote removes the user's vote for one option, or all of their votes when optionId is empty
+func (s *PollService) Unvote(pollId, userId, optionId string) (*models.Poll, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockOpenPoll(tx, pollId); err != nil {
+		return nil, err
+	}
+
+	if optionId == "" {
+		_, err = tx.Exec("DELETE FROM poll_votes WHERE poll_id = $1 AND user_id = $2", pollId, userId)
+	} else {
+		_, err = tx.Exec("DELETE FROM poll_votes WHERE poll_id = $1 AND user_id = $2 AND option_id = $3", pollId, userId, optionId)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return s.publishResults(pollId)
+}
+
+// ClosePoll closes a poll before its deadline and posts the final tally
+func (s *PollService) ClosePoll(pollId string) (*models.Poll, error) {
+	result, err := s.db.Exec("UPDATE polls SET closed_at = $1 WHERE id = $2 AND closed_at IS NULL", time.Now(), pollId)
+	if err != nil {
+		return nil, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 {
+		if _, err := s.GetPoll(pollId); err != nil {
+			return nil, err
+		}
+		return nil, ErrPollClosed
+	}
+
+	return s.finishPoll(pollId)
+}
+
+// StartAutoClose closes polls whose deadline has passed, checking at the given interval
+func (s *PollService) StartAutoClose(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.closeDuePolls(); err != nil {
+				log.Printf("投票の自動締め切りエラー: %v", err)
+			}
+		}
+	}()
+}
+
+// closeDuePolls claims and closes expired polls. The UPDATE ... RETURNING claim
+// makes sure each poll is finished by exactly one replica.
+func (s *PollService) closeDuePolls() error {
+	rows, err := s.db.Query(`
+		UPDATE polls SET closed_at = closes_at
+		WHERE closed_at IS NULL AND closes_at IS NOT NULL AND closes_at <= $1
+		RETURNING id
+	`, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var pollIds []string
+	for rows.Next() {
+		var pollId string
+		if err := rows.Scan(&pollId); err != nil {
+			rows.Close()
+			return err
+		}
+		pollIds = append(pollIds, pollId)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, pollId := range pollIds {
+		if _, err := s.finishPoll(pollId); err != nil {
+			log.Printf("投票 %s の集計メッセージ送信エラー: %v", pollId, err)
+		}
+	}
+	return nil
+}
+
+// finishPoll broadcasts the closed poll and posts a final tally message
+func (s *PollService) finishPoll(pollId string) (*models.Poll, error) {
+	poll, err := s.publishResults(pollId)
+	if err != nil {
+		return nil, err
+	}
+
+	tally := &models.ChannelMessage{
+		ID:        uuid.New().String(),
+		ChannelId: poll.ChannelId,
+		UserId:    poll.CreatedBy,
+		Type:      models.MessageTypeSystem,
+		Content:   formatPollTally(poll),
+		Timestamp: time.Now(),
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := saveChannelMessageTx(tx, *tally); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if s.wsService != nil {
+		if err := s.wsService.BroadcastNewMessage(poll.ChannelId, tally); err != nil {
+			log.Printf("WebSocketブロードキャストエラー: %v", err)
+		}
+	}
+
+	return poll, nil
+}
+
+// publishResults reloads the poll and broadcasts the updated poll message
+func (s *PollService) publishResults(pollId string) (*models.Poll, error) {
+	poll, err := s.GetPoll(pollId)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.wsService != nil {
+		var message models.ChannelMessage
+		err := s.db.QueryRow(`
+			SELECT id, channel_id, user_id, content, timestamp, message_type
+			FROM channel_messages WHERE id = $1
+		`, poll.MessageId).Scan(
+			&message.ID, &message.ChannelId, &message.UserId,
+			&message.Content, &message.Timestamp, &message.Type,
+		)
+		if err != nil {
+			log.Printf("投票メッセージの取得エラー: %v", err)
+			return poll, nil
+		}
+		message.Poll = poll
+
+		if err := s.wsService.BroadcastMessageUpdate(poll.ChannelId, message); err != nil {
+			log.Printf("WebSocketブロードキャストエラー: %v", err)
+		}
+	}
+
+	return poll, nil
+}
+
+// lockOpenPoll locks a poll row and fails if it is closed
+func lockOpenPoll(tx *sql.Tx, pollId string) (bool, error) {
+	var allowMultiple bool
+	var closesAt, closedAt sql.NullTime
+	err := tx.QueryRow(
+		"SELECT allow_multiple, closes_at, closed_at FROM polls WHERE id = $1 FOR UPDATE",
+		pollId,
+	).Scan(&allowMultiple, &closesAt, &closedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, ErrPollNotFound
+		}
+		return false, err
+	}
+	if closedAt.Valid || (closesAt.Valid && !closesAt.Time.After(time.Now())) {
+		return false, ErrPollClosed
+	}
+	return allowMultiple, nil
+}
+
+// loadPollsByMessageIds loads polls with their tallies, keyed by message ID
+func loadPollsByMessageIds(db *sql.DB, messageIds []string) (map[string]*models.Poll, error) {
+	polls := make(map[string]*models.Poll)
+
+	rows, err := db.Query(`
+		SELECT id, message_id, channel_id, question, allow_multiple, is_anonymous,
+		       closes_at, closed_at, created_by, created_at
+		FROM polls
+		WHERE message_id = ANY($1::uuid[])
+	`, pq.Array(messageIds))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byId := make(map[string]*models.Poll)
+	var pollIds []string
+	now := time.Now()
+	for rows.Next() {
+		poll := &models.Poll{Options: []models.PollOption{}}
+		var closesAt, closedAt sql.NullTime
+		if err := rows.Scan(
+			&poll.ID, &poll.MessageId, &poll.ChannelId, &poll.Question, &poll.AllowMultiple,
+			&poll.IsAnonymous, &closesAt, &closedAt, &poll.CreatedBy, &poll.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		if closesAt.Valid {
+			poll.ClosesAt = &closesAt.Time
+		}
+		if closedAt.Valid {
+			poll.ClosedAt = &closedAt.Time
+		}
+		poll.IsClosed = closedAt.Valid || (closesAt.Valid && !closesAt.Time.After(now))
+
+		polls[poll.MessageId] = poll
+		byId[poll.ID] = poll
+		pollIds = append(pollIds, poll.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(pollIds) == 0 {
+		return polls, nil
+	}
+
+	optionRows, err := db.Query(`
+		SELECT o.id, o.poll_id, o.text, o.position, COUNT(v.user_id)
+		FROM poll_options o
+		LEFT JOIN poll_votes v ON v.option_id = o.id
+		WHERE o.poll_id = ANY($1::uuid[])
+		GROUP BY o.id, o.poll_id, o.text, o.position
+		ORDER BY o.position ASC
+	`, pq.Array(pollIds))
+	if err != nil {
+		return nil, err
+	}
+	defer optionRows.Close()
+
+	optionIndex := make(map[string]*models.PollOption)
+	for optionRows.Next() {
+		var option models.PollOption
+		var pollId string
+		if err := optionRows.Scan(&option.ID, &pollId, &option.Text, &option.Position, &option.VoteCount); err != nil {
+			return nil, err
+		}
+		poll := byId[pollId]
+		poll.Options = append(poll.Options, option)
+		poll.TotalVotes += option.VoteCount
+	}
+	if err := optionRows.Err(); err != nil {
+		return nil, err
+	}
+	for _, poll := range byId {
+		for i := range poll.Options {
+			optionIndex[poll.Options[i].ID] = &poll.Options[i]
+		}
+	}
+
+	voterRows, err := db.Query(`
+		SELECT v.poll_id, v.option_id, v.user_id
+		FROM poll_votes v
+		WHERE v.poll_id = ANY($1::uuid[])
+		ORDER BY v.voted_at ASC
+	`, pq.Array(pollIds))
+	if err != nil {
+		return nil, err
+	}
+	defer voterRows.Close()
+
+	voters := make(map[string]map[string]bool)
+	for voterRows.Next() {
+		var pollId, optionId, userId string
+		if err := voterRows.Scan(&pollId, &optionId, &userId); err != nil {
+			return nil, err
+		}
+		if voters[pollId] == nil {
+			voters[pollId] = make(map[string]bool)
+		}
+		voters[pollId][userId] = true
+
+		// Voter identities are never exposed for anonymous polls
+		if !byId[pollId].IsAnonymous {
+			if option, ok := optionIndex[optionId]; ok {
+				option.Voters = append(option.Voters, userId)
+			}
+		}
+	}
+	if err := voterRows.Err(); err != nil {
+		return nil, err
+	}
+	for pollId, users := range voters {
+		byId[pollId].VoterCount = len(users)
+	}
+
+	return polls, nil
+}
+
+// formatPollTally renders the final results of a poll as a message
+func formatPollTally(poll *models.Poll) string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("📊 Poll closed: %s\n", poll.Question))
+
+	best := 0
+	for _, option := range poll.Options {
+		if option.VoteCount > best {
+			best = option.VoteCount
+		}
+	}
+
+	for _, option := range poll.Options {
+		percent := 0
+		if poll.TotalVotes > 0 {
+			percent = option.VoteCount * 100 / poll.TotalVotes
+		}
+		marker := ""
+		if best > 0 && option.VoteCount == best {
+			marker = " 🏆"
+		}
+		b.WriteString(fmt.Sprintf("• %s: %d (%d%%)%s\n", option.Text, option.VoteCount, percent, marker))
+	}
+	b.WriteString(fmt.Sprintf("%d votes from %d people", poll.TotalVotes, poll.VoterCount))
+
+	return b.String()
+}
+
+// uniqueStrings returns the values without duplicates, keeping their order
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	var unique []string
+	for _, value := range values {
+		if seen[value] {
+			continue
+		}
+		seen[value] = true
+		unique = append(unique, value)
+	}
+	return unique
+}
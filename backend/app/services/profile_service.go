@@ -0,0 +1,433 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"strings"
+	"time"
+	_ "time/tzdata" // timezones are validated without relying on the host's zoneinfo
+	"unicode"
+
+	"app/models"
+)
+
+const (
+	// AvatarThumbnailSize is the thumbnail avatars are shown at; it must be one of ThumbnailSizes
+	AvatarThumbnailSize = 160
+	// MaxAvatarSize is the largest avatar image that can be uploaded
+	MaxAvatarSize = 8 << 20
+
+	// DefaultUserSearchLimit and MaxUserSearchLimit bound a page of user search results
+	DefaultUserSearchLimit = 20
+	MaxUserSearchLimit     = 50
+)
+
+var (
+	ErrInvalidTimezone    = errors.New("unknown timezone")
+	ErrInvalidProfileText = errors.New("profile fields can't contain control characters")
+	ErrInvalidStatusEmoji = errors.New("status emoji can't contain spaces")
+	ErrStatusExpiryInPast = errors.New("status expiry must be in the future")
+	ErrEmptySearchQuery   = errors.New("search query is required")
+)
+
+// likeEscaper escapes LIKE wildcards in user input
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// ProfileService manages users' public profiles: display name, avatar, bio,
+// pronouns, timezone and custom status. Changes are pushed to every channel
+// the user can see, so other members update names and avatars live.
+type ProfileService struct {
+	db        *sql.DB
+	messages  *ChannelMessageService
+	wsService *WebSocketService
+}
+
+// NewProfileService creates a new ProfileService. Avatars are stored and
+// processed as attachments through messages.
+func NewProfileService(db *sql.DB, messages *ChannelMessageService) *ProfileService {
+	return &ProfileService{db: db, messages: messages}
+}
+
+// SetWebSocketService sets the WebSocket service used to push profile changes
+func (s *ProfileService) SetWebSocketService(wsService *WebSocketService) {
+	s.wsService = wsService
+}
+
+// GetProfile returns a user's public profile
+func (s *ProfileService) GetProfile(userID string) (*models.UserProfile, error) {
+	user, err := s.GetCurrentUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &user.UserProfile, nil
+}
+
+// GetCurrentUser returns a user's profile together with their private details
+func (s *ProfileService) GetCurrentUser(userID string) (*models.CurrentUser, error) {
+	var user models.CurrentUser
+	var bio, pronouns, timezone, statusText, statusEmoji sql.NullString
+	var statusExpiresAt sql.NullTime
+	var avatar avatarRef
+	err := s.db.QueryRow(`
+		SELECT u.id, u.username, u.email, u.email_verified_at IS NOT NULL, u.created_at,
+		       u.discoverable, u.email_discoverable,
+		       COALESCE(u.display_name, ''), u.bio, u.pronouns, u.timezone,
+		       u.status_text, u.status_emoji, u.status_expires_at, `+avatarColumns+`
+		FROM users u
+		`+avatarJoins+`
+		WHERE u.id = $1
+	`, userID).Scan(
+		&user.ID, &user.Username, &user.Email, &user.EmailVerified, &user.CreatedAt,
+		&user.Discoverable, &user.EmailDiscoverable,
+		&user.DisplayName, &bio, &pronouns, &timezone,
+		&statusText, &statusEmoji, &statusExpiresAt,
+		&avatar.attachmentId, &avatar.fileName, &avatar.hasThumbnail,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user.Bio, user.Pronouns, user.Timezone = bio.String, pronouns.String, timezone.String
+	user.AvatarURL = s.messages.avatarURL(avatar)
+	// An expired status may not have been cleared yet
+	if (statusText.Valid || statusEmoji.Valid) && (!statusExpiresAt.Valid || statusExpiresAt.Time.After(time.Now())) {
+		user.Status = &models.UserStatus{Text: statusText.String, Emoji: statusEmoji.String}
+		if statusExpiresAt.Valid {
+			user.Status.ExpiresAt = &statusExpiresAt.Time
+		}
+	}
+	return &user, nil
+}
+
+// UpdateProfile changes the fields set in req and pushes the new profile
+func (s *ProfileService) UpdateProfile(userID string, req models.UpdateProfileRequest) (*models.CurrentUser, error) {
+	var columns []string
+	var args []interface{}
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		columns = append(columns, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+
+	for _, field := range []struct {
+		column string
+		value  *string
+	}{
+		{"display_name", req.DisplayName},
+		{"bio", req.Bio},
+		{"pronouns", req.Pronouns},
+	} {
+		if field.value == nil {
+			continue
+		}
+		value := strings.TrimSpace(strings.ReplaceAll(*field.value, "\r\n", "\n"))
+		// The bio may span lines; the others are shown on one
+		if hasControlCharacters(value, field.column == "bio") {
+			return nil, ErrInvalidProfileText
+		}
+		set(field.column, nullIfEmpty(value))
+	}
+
+	if req.Timezone != nil {
+		timezone := strings.TrimSpace(*req.Timezone)
+		if timezone != "" {
+			// LoadLocation also accepts "Local", which means nothing to other users
+			if _, err := time.LoadLocation(timezone); err != nil || timezone == "Local" {
+				return nil, fmt.Errorf("%w %q", ErrInvalidTimezone, timezone)
+			}
+		}
+		set("timezone", nullIfEmpty(timezone))
+	}
+
+	if req.Status != nil {
+		text := strings.TrimSpace(req.Status.Text)
+		emoji := strings.TrimSpace(req.Status.Emoji)
+		if hasControlCharacters(text, false) {
+			return nil, ErrInvalidProfileText
+		}
+		if strings.IndexFunc(emoji, unicode.IsSpace) >= 0 || hasControlCharacters(emoji, false) {
+			return nil, ErrInvalidStatusEmoji
+		}
+		var expiresAt interface{}
+		if text != "" || emoji != "" {
+			if req.Status.ExpiresAt != nil {
+				if !req.Status.ExpiresAt.After(time.Now()) {
+					return nil, ErrStatusExpiryInPast
+				}
+				expiresAt = *req.Status.ExpiresAt
+			}
+		}
+		set("status_text", nullIfEmpty(text))
+		set("status_emoji", nullIfEmpty(emoji))
+		set("status_expires_at", expiresAt)
+	}
+
+	if req.Discoverable != nil {
+		set("discoverable", *req.Discoverable)
+	}
+	if req.EmailDiscoverable != nil {
+		set("email_discoverable", *req.EmailDiscoverable)
+	}
+
+	if len(columns) > 0 {
+		set("updated_at", time.Now())
+		args = append(args, userID)
+		result, err := s.db.Exec(
+			fmt.Sprintf("UPDATE users SET %s WHERE id = $%d", strings.Join(columns, ", "), len(args)), args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			return nil, ErrUserNotFound
+		}
+	}
+
+	return s.changed(userID)
+}
+
+// SetAvatar stores an uploaded image as the user's avatar. The image is
+// processed like any image attachment, and the previous avatar is left for
+// the attachment garbage collector.
+func (s *ProfileService) SetAvatar(userID string, file *multipart.FileHeader) (*models.CurrentUser, error) {
+	if file.Size > MaxAvatarSize {
+		return nil, FileTooLargeError(MaxAvatarSize)
+	}
+	src, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open uploaded file: %v", err)
+	}
+	defer src.Close()
+
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, fmt.Errorf("failed to read uploaded file: %v", err)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read uploaded file: %v", err)
+	}
+	if contentType, ok := detectContentType(file.Filename, head[:n]); !ok || !processableImageTypes[contentType] {
+		return nil, &UploadError{
+			Code:    models.UploadErrorTypeNotAllowed,
+			Message: "アバターには JPEG・PNG・GIF 画像を指定してください",
+			Details: map[string]interface{}{"contentType": contentType},
+		}
+	}
+
+	target := attachmentTarget{
+		link: func(tx *sql.Tx, attachmentId string) error {
+			result, err := tx.Exec(
+				"UPDATE users SET avatar_attachment_id = $1, updated_at = $2 WHERE id = $3",
+				attachmentId, time.Now(), userID,
+			)
+			if err != nil {
+				return err
+			}
+			if affected, _ := result.RowsAffected(); affected == 0 {
+				return ErrUserNotFound
+			}
+			return nil
+		},
+	}
+	if _, err := s.messages.saveAttachment(target, userID, file.Filename, file.Size, head[:n], src); err != nil {
+		return nil, err
+	}
+	return s.changed(userID)
+}
+
+// RemoveAvatar clears the user's avatar
+func (s *ProfileService) RemoveAvatar(userID string) (*models.CurrentUser, error) {
+	if _, err := s.db.Exec(
+		"UPDATE users SET avatar_attachment_id = NULL, updated_at = $1 WHERE id = $2 AND avatar_attachment_id IS NOT NULL",
+		time.Now(), userID,
+	); err != nil {
+		return nil, err
+	}
+	return s.changed(userID)
+}
+
+// SearchUsers finds users for userID. Members of servers the caller belongs
+// to match on part of their handle or display name; anyone else only on their
+// exact handle, or their exact email address if they opted in. Users who
+// hid themselves from discovery never match. Exact matches come first, then
+// prefix matches.
+func (s *ProfileService) SearchUsers(userID, query string, limit, offset int) (*models.UserSearchPage, error) {
+	query = strings.TrimPrefix(strings.TrimSpace(query), "@")
+	if query == "" {
+		return nil, ErrEmptySearchQuery
+	}
+	if limit <= 0 || limit > MaxUserSearchLimit {
+		limit = DefaultUserSearchLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	pattern := likeEscaper.Replace(query)
+	rows, err := s.db.Query(`
+		WITH shared AS (
+			SELECT DISTINCT other.user_id FROM server_members mine
+			JOIN server_members other ON other.server_id = mine.server_id
+			WHERE mine.user_id = $1
+		)
+		SELECT u.id, u.username, COALESCE(u.display_name, ''),
+		       CASE WHEN u.email_discoverable THEN u.email ELSE '' END,
+		       shared.user_id IS NOT NULL, `+avatarColumns+`
+		FROM users u
+		LEFT JOIN shared ON shared.user_id = u.id
+		`+avatarJoins+`
+		WHERE u.id <> $1 AND u.discoverable AND (
+			LOWER(u.username) = LOWER($2)
+			OR (u.email_discoverable AND LOWER(u.email) = LOWER($2))
+			OR (shared.user_id IS NOT NULL AND (
+				LOWER(u.username) LIKE LOWER($4) OR LOWER(COALESCE(u.display_name, '')) LIKE LOWER($4)
+			))
+		)
+		ORDER BY
+			CASE
+				WHEN LOWER(u.username) = LOWER($2) OR LOWER(COALESCE(u.display_name, '')) = LOWER($2) THEN 0
+				WHEN u.email_discoverable AND LOWER(u.email) = LOWER($2) THEN 0
+				WHEN LOWER(u.username) LIKE LOWER($3) OR LOWER(COALESCE(u.display_name, '')) LIKE LOWER($3) THEN 1
+				ELSE 2
+			END,
+			LOWER(u.username), u.id
+		LIMIT $5 OFFSET $6
+	`, userID, query, pattern+"%", "%"+pattern+"%", limit+1, offset)
+	if err != nil {
+		return nil, fmt.Errorf("error searching users: %w", err)
+	}
+	defer rows.Close()
+
+	page := &models.UserSearchPage{Users: []models.UserSearchResult{}}
+	for rows.Next() {
+		var user models.UserSearchResult
+		var avatar avatarRef
+		if err := rows.Scan(
+			&user.ID, &user.Username, &user.DisplayName, &user.Email, &user.SharesServer,
+			&avatar.attachmentId, &avatar.fileName, &avatar.hasThumbnail,
+		); err != nil {
+			return nil, fmt.Errorf("error scanning user row: %w", err)
+		}
+		user.AvatarURL = s.messages.avatarURL(avatar)
+		page.Users = append(page.Users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating user rows: %w", err)
+	}
+
+	// One extra row was fetched to tell whether there is another page
+	if len(page.Users) > limit {
+		page.Users = page.Users[:limit]
+		next := offset + limit
+		page.NextOffset = &next
+	}
+	return page, nil
+}
+
+// StartStatusExpiry clears expired custom statuses every interval and
+// pushes the change
+func (s *ProfileService) StartStatusExpiry(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.expireStatuses(); err != nil {
+				log.Printf("ステータスの有効期限切れ処理エラー: %v", err)
+			}
+		}
+	}()
+}
+
+func (s *ProfileService) expireStatuses() error {
+	rows, err := s.db.Query(`
+		UPDATE users SET status_text = NULL, status_emoji = NULL, status_expires_at = NULL
+		WHERE status_expires_at <= $1
+		RETURNING id
+	`, time.Now())
+	if err != nil {
+		return err
+	}
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		if _, err := s.changed(userID); err != nil {
+			log.Printf("ユーザー %s のプロフィール更新の送信エラー: %v", userID, err)
+		}
+	}
+	return nil
+}
+
+// changed loads a user after a change and pushes their public profile
+func (s *ProfileService) changed(userID string) (*models.CurrentUser, error) {
+	user, err := s.GetCurrentUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	if s.wsService != nil {
+		channelIDs, err := s.visibleChannels(userID)
+		if err != nil {
+			log.Printf("ユーザー %s のチャンネルの取得エラー: %v", userID, err)
+		} else if err := s.wsService.BroadcastProfileUpdate(channelIDs, user.UserProfile); err != nil {
+			log.Printf("ユーザー %s のプロフィール更新の送信エラー: %v", userID, err)
+		}
+	}
+	return user, nil
+}
+
+// visibleChannels lists the channels where others see the user: every
+// channel of the servers they are a member of, and their direct messages
+func (s *ProfileService) visibleChannels(userID string) ([]string, error) {
+	rows, err := s.db.Query(`
+		SELECT c.id FROM channels c
+		JOIN server_members sm ON sm.server_id = c.server_id
+		WHERE sm.user_id = $1
+		UNION
+		SELECT c.id FROM channels c
+		JOIN channel_members cm ON cm.channel_id = c.id
+		WHERE cm.user_id = $1 AND c.kind <> 'server'
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channelIDs []string
+	for rows.Next() {
+		var channelID string
+		if err := rows.Scan(&channelID); err != nil {
+			return nil, err
+		}
+		channelIDs = append(channelIDs, channelID)
+	}
+	return channelIDs, rows.Err()
+}
+
+// hasControlCharacters reports whether value contains control characters,
+// other than line breaks and tabs when multiline is set
+func hasControlCharacters(value string, multiline bool) bool {
+	return strings.IndexFunc(value, func(r rune) bool {
+		if multiline && (r == '\n' || r == '\t') {
+			return false
+		}
+		return unicode.IsControl(r)
+	}) >= 0
+}
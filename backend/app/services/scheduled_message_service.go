@@ -0,0 +1,388 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"app/models"
+)
+
+// Errors returned by ScheduledMessageService
+var (
+	ErrScheduledMessageNotFound = errors.New("scheduled message not found")
+	ErrScheduledMessageLocked   = errors.New("scheduled message has already been sent or cancelled")
+	ErrScheduleInPast           = errors.New("send time must be in the future")
+	ErrScheduleTooFar           = errors.New("messages can be scheduled at most one year ahead")
+)
+
+const (
+	// maxScheduleAhead bounds how far in the future a message can be scheduled
+	maxScheduleAhead = 365 * 24 * time.Hour
+	// scheduledClaimLease is how long a replica owns a claimed job. A job whose
+	// lease expires (the replica crashed or hung) is picked up again by another one.
+	scheduledClaimLease = 2 * time.Minute
+	// scheduledMaxAttempts is how many times delivery is tried before a job is marked failed
+	scheduledMaxAttempts = 5
+	// scheduledBatchSize is how many due jobs one tick claims at most
+	scheduledBatchSize = 50
+)
+
+// ScheduledMessageService stores messages and reminders to be posted later and
+// runs the background scheduler that delivers them.
+//
+// Jobs live in Postgres so they survive restarts. Each tick claims due jobs with
+// SELECT ... FOR UPDATE SKIP LOCKED, so concurrent replicas never pick up the same
+// job, and every job carries a pre-generated message ID so that a redelivery after
+// a crash hits channel_messages' primary key instead of posting a duplicate.
+type ScheduledMessageService struct {
+	db                    *sql.DB
+	channelMessageService *ChannelMessageService
+	serverService         *ServerService
+	directMessageService  *DirectMessageService
+	wsService             *WebSocketService
+}
+
+// NewScheduledMessageService creates a new ScheduledMessageService
+func NewScheduledMessageService(db *sql.DB, channelMessageService *ChannelMessageService, serverService *ServerService, directMessageService *DirectMessageService) *ScheduledMessageService {
+	return &ScheduledMessageService{
+		db:                    db,
+		channelMessageService: channelMessageService,
+		serverService:         serverService,
+		directMessageService:  directMessageService,
+	}
+}
+
+// SetWebSocketService はWebSocketServiceを設定する
+func (s *ScheduledMessageService) SetWebSocketService(wsService *WebSocketService) {
+	s.wsService = wsService
+}
+
+// ScheduleMessage schedules a message to be posted in a channel at sendAt
+func (s *ScheduledMessageService) ScheduleMessage(channelId, userId, content string, sendAt time.Time) (*models.ScheduledMessage, error) {
+	return s.schedule(channelId, userId, models.ScheduledKindMessage, content, sendAt)
+}
+
+// ScheduleReminder schedules a personal reminder. Reminders are delivered to the
+// user's own direct conversation so they reach the user wherever they are.
+func (s *ScheduledMessageService) ScheduleReminder(userId, text string, sendAt time.Time) (*models.ScheduledMessage, error) {
+	conversation, _, err := s.directMessageService.OpenConversation(userId, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return s.schedule(conversation.ID, userId, models.ScheduledKindReminder, text, sendAt)
+}
+
+func (s *ScheduledMessageService) schedule(channelId, userId, kind, content string, sendAt time.Time) (*models.ScheduledMessage, error) {
+	now := time.Now()
+	if err := validateSendAt(sendAt, now); err != nil {
+		return nil, err
+	}
+
+	scheduled := &models.ScheduledMessage{
+		ID:        uuid.New().String(),
+		ChannelId: channelId,
+		UserId:    userId,
+		Kind:      kind,
+		Content:   content,
+		SendAt:    sendAt,
+		Status:    models.ScheduledStatusPending,
+		MessageId: uuid.New().String(),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	_, err := s.db.Exec(`
+		INSERT INTO scheduled_messages (id, channel_id, user_id, kind, content, send_at, status, message_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $9)
+	`, scheduled.ID, channelId, userId, kind, content, sendAt, scheduled.Status, scheduled.MessageId, now)
+	if err != nil {
+		return nil, err
+	}
+	return scheduled, nil
+}
+
+// GetUserScheduledMessages lists a user's scheduled messages and reminders.
+// An empty status lists pending ones; an empty channelId lists all channels.
+func (s *ScheduledMessageService) GetUserScheduledMessages(userId, channelId, status string) ([]models.ScheduledMessage, error) {
+	if status == "" {
+		status = models.ScheduledStatusPending
+	}
+
+	query := `
+		SELECT id, channel_id, user_id, kind, content, send_at, status, message_id,
+		       attempts, last_error, sent_at, created_at, updated_at
+		FROM scheduled_messages
+		WHERE user_id = $1 AND status = $2`
+	args := []interface{}{userId, status}
+	if channelId != "" {
+		query += " AND channel_id = $3"
+		args = append(args, channelId)
+	}
+	query += " ORDER BY send_at ASC"
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scheduled := []models.ScheduledMessage{}
+	for rows.Next() {
+		message, err := scanScheduledMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		scheduled = append(scheduled, message)
+	}
+	return scheduled, rows.Err()
+}
+
+// GetScheduledMessage returns one of the user's scheduled messages
+func (s *ScheduledMessageService) GetScheduledMessage(id, userId string) (*models.ScheduledMessage, error) {
+	row := s.db.QueryRow(`
+		SELECT id, channel_id, user_id, kind, content, send_at, status, message_id,
+		       attempts, last_error, sent_at, created_at, updated_at
+		FROM scheduled_messages
+		WHERE id = $1 AND user_id = $2
+	`, id, userId)
+
+	message, err := scanScheduledMessage(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrScheduledMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// UpdateScheduledMessage edits the content or send time of a pending scheduled message
+func (s *ScheduledMessageService) UpdateScheduledMessage(id, userId string, req models.ScheduledMessageUpdateRequest) (*models.ScheduledMessage, error) {
+	now := time.Now()
+	if req.SendAt != nil {
+		if err := validateSendAt(*req.SendAt, now); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only pending jobs can change; once the scheduler has claimed a job it is too late
+	result, err := s.db.Exec(`
+		UPDATE scheduled_messages
+		SET content = COALESCE($1, content), send_at = COALESCE($2, send_at), updated_at = $3
+		WHERE id = $4 AND user_id = $5 AND status = 'pending'
+	`, req.Content, req.SendAt, now, id, userId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkPendingUpdate(result, id, userId); err != nil {
+		return nil, err
+	}
+
+	return s.GetScheduledMessage(id, userId)
+}
+
+// CancelScheduledMessage cancels a pending scheduled message
+func (s *ScheduledMessageService) CancelScheduledMessage(id, userId string) error {
+	result, err := s.db.Exec(`
+		UPDATE scheduled_messages SET status = 'cancelled', updated_at = $1
+		WHERE id = $2 AND user_id = $3 AND status = 'pending'
+	`, time.Now(), id, userId)
+	if err != nil {
+		return err
+	}
+	return s.checkPendingUpdate(result, id, userId)
+}
+
+// checkPendingUpdate tells apart a missing job from one that is no longer pending
+func (s *ScheduledMessageService) checkPendingUpdate(result sql.Result, id, userId string) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected > 0 {
+		return nil
+	}
+	if _, err := s.GetScheduledMessage(id, userId); err != nil {
+		return err
+	}
+	return ErrScheduledMessageLocked
+}
+
+// Start runs the scheduler, checking for due jobs at the given interval
+func (s *ScheduledMessageService) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.runDueJobs(); err != nil {
+				log.Printf("予約メッセージの処理エラー: %v", err)
+			}
+		}
+	}()
+}
+
+// runDueJobs claims due jobs and delivers them
+func (s *ScheduledMessageService) runDueJobs() error {
+	jobs, err := s.claimDueJobs()
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if err := s.deliver(job); err != nil {
+			log.Printf("予約メッセージ %s の配信エラー: %v", job.ID, err)
+			s.recordFailure(job, err)
+		}
+	}
+	return nil
+}
+
+// claimDueJobs marks due jobs as being sent by this replica. Jobs stuck in
+// 'sending' after their lease expired are claimed again.
+func (s *ScheduledMessageService) claimDueJobs() ([]models.ScheduledMessage, error) {
+	now := time.Now()
+	rows, err := s.db.Query(`
+		UPDATE scheduled_messages
+		SET status = 'sending', locked_until = $2, attempts = attempts + 1, updated_at = $1
+		WHERE id IN (
+			SELECT id FROM scheduled_messages
+			WHERE (status = 'pending' AND send_at <= $1)
+			   OR (status = 'sending' AND locked_until < $1)
+			ORDER BY send_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, channel_id, user_id, kind, content, send_at, status, message_id,
+		          attempts, last_error, sent_at, created_at, updated_at
+	`, now, now.Add(scheduledClaimLease), scheduledBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []models.ScheduledMessage
+	for rows.Next() {
+		job, err := scanScheduledMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// deliver posts a claimed job through ChannelMessageService and broadcasts it
+func (s *ScheduledMessageService) deliver(job models.ScheduledMessage) error {
+	message := models.ChannelMessage{
+		ID:        job.MessageId,
+		ChannelId: job.ChannelId,
+		UserId:    job.UserId,
+		Type:      models.MessageTypeUser,
+		Content:   job.Content,
+		Timestamp: time.Now(),
+	}
+	if job.Kind == models.ScheduledKindReminder {
+		message.Type = models.MessageTypeSystem
+		message.Content = "⏰ Reminder: " + job.Content
+	}
+
+	// The author may have left the channel since scheduling the message
+	if job.Kind == models.ScheduledKindMessage {
+		hasAccess, err := s.serverService.HasChannelAccess(job.ChannelId, job.UserId)
+		if err != nil {
+			return err
+		}
+		if !hasAccess {
+			return s.finish(job.ID, models.ScheduledStatusFailed, "author no longer has access to the channel")
+		}
+	}
+
+	alreadySent := false
+	if err := s.channelMessageService.SaveChannelMessage(message); err != nil {
+		// The message ID is fixed per job, so a duplicate key means an earlier
+		// attempt saved the message but did not get to mark the job as sent
+		pqErr, ok := err.(*pq.Error)
+		if !ok || pqErr.Code != "23505" {
+			return err
+		}
+		alreadySent = true
+	}
+
+	if err := s.finish(job.ID, models.ScheduledStatusSent, ""); err != nil {
+		return err
+	}
+
+	if !alreadySent && s.wsService != nil {
+		if err := s.wsService.BroadcastNewMessage(job.ChannelId, message); err != nil {
+			log.Printf("WebSocketブロードキャストエラー: %v", err)
+		}
+	}
+	return nil
+}
+
+// finish records the final status of a claimed job
+func (s *ScheduledMessageService) finish(id, status, lastError string) error {
+	now := time.Now()
+	var sentAt interface{}
+	if status == models.ScheduledStatusSent {
+		sentAt = now
+	}
+	_, err := s.db.Exec(`
+		UPDATE scheduled_messages
+		SET status = $1, sent_at = $2, last_error = NULLIF($3, ''), locked_until = NULL, updated_at = $4
+		WHERE id = $5 AND status = 'sending'
+	`, status, sentAt, lastError, now, id)
+	return err
+}
+
+// recordFailure keeps a failed job claimed with a growing backoff, so it is retried
+// once the backoff expires, and gives up after scheduledMaxAttempts.
+func (s *ScheduledMessageService) recordFailure(job models.ScheduledMessage, cause error) {
+	var err error
+	if job.Attempts >= scheduledMaxAttempts {
+		err = s.finish(job.ID, models.ScheduledStatusFailed, cause.Error())
+	} else {
+		backoff := time.Duration(job.Attempts) * time.Minute
+		_, err = s.db.Exec(`
+			UPDATE scheduled_messages SET last_error = $1, locked_until = $2, updated_at = $3
+			WHERE id = $4 AND status = 'sending'
+		`, cause.Error(), time.Now().Add(backoff), time.Now(), job.ID)
+	}
+	if err != nil {
+		log.Printf("予約メッセージ %s の状態更新エラー: %v", job.ID, err)
+	}
+}
+
+func validateSendAt(sendAt, now time.Time) error {
+	if !sendAt.After(now) {
+		return ErrScheduleInPast
+	}
+	if sendAt.Sub(now) > maxScheduleAhead {
+		return ErrScheduleTooFar
+	}
+	return nil
+}
+
+func scanScheduledMessage(row rowScanner) (models.ScheduledMessage, error) {
+	var message models.ScheduledMessage
+	var lastError sql.NullString
+	var sentAt sql.NullTime
+	err := row.Scan(
+		&message.ID, &message.ChannelId, &message.UserId, &message.Kind, &message.Content,
+		&message.SendAt, &message.Status, &message.MessageId, &message.Attempts,
+		&lastError, &sentAt, &message.CreatedAt, &message.UpdatedAt,
+	)
+	if err != nil {
+		return message, err
+	}
+	message.LastError = lastError.String
+	if sentAt.Valid {
+		message.SentAt = &sentAt.Time
+	}
+	return message, nil
+}
@@ -2,12 +2,20 @@ package services
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
 	"app/models"
 )
 
+var (
+	ErrNotServerOwner         = errors.New("only the server owner can do this")
+	ErrNewOwnerNotMember      = errors.New("the new owner must be a member of the server")
+	ErrNewOwnerNeedsTwoFactor = errors.New("this server requires its owner to have two-factor authentication enabled")
+	ErrCannotTransferToSelf   = errors.New("you already own this server")
+)
+
 // ServerService handles server-related business logic
 type ServerService struct {
 	db *sql.DB
@@ -72,7 +80,8 @@ func (s *ServerService) AddChannelMember(member models.ChannelMember) error {
 func (s *ServerService) GetUserServers(userId string) ([]models.ServerResponse, error) {
 	rows, err := s.db.Query(`
 		SELECT s.id, s.name, s.description, s.owner_id, s.created_at, 
-		       (SELECT COUNT(*) FROM server_members WHERE server_id = s.id) as member_count
+		       (SELECT COUNT(*) FROM server_members WHERE server_id = s.id) as member_count,
+		       s.require_two_factor
 		FROM servers s
 		JOIN server_members sm ON s.id = sm.server_id
 		WHERE sm.user_id = $1
@@ -88,7 +97,7 @@ func (s *ServerService) GetUserServers(userId string) ([]models.ServerResponse,
 		var server models.ServerResponse
 		if err := rows.Scan(
 			&server.ID, &server.Name, &server.Description, &server.OwnerId,
-			&server.CreatedAt, &server.MemberCount,
+			&server.CreatedAt, &server.MemberCount, &server.RequireTwoFactor,
 		); err != nil {
 			return nil, err
 		}
@@ -151,11 +160,7 @@ func (s *ServerService) IsServerMember(serverId, userId string) (bool, error) {
 
 // HasChannelManagementPermission checks if a user has permission to manage channels
 func (s *ServerService) HasChannelManagementPermission(serverId, userId string) (bool, error) {
-	var role string
-	err := s.db.QueryRow(
-		"SELECT role FROM server_members WHERE server_id = $1 AND user_id = $2",
-		serverId, userId,
-	).Scan(&role)
+	role, err := s.memberRole(serverId, userId)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
@@ -165,6 +170,105 @@ func (s *ServerService) HasChannelManagementPermission(serverId, userId string)
 	return role == "owner", nil
 }
 
+// IsServerModerator checks if a user moderates a server (owner or admin)
+func (s *ServerService) IsServerModerator(serverId, userId string) (bool, error) {
+	role, err := s.memberRole(serverId, userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	return role == "owner" || role == "admin", nil
+}
+
+// memberRole returns the role a member can act with. In a server that
+// requires two-factor authentication, owners and admins without it act as
+// plain members until they enable it.
+func (s *ServerService) memberRole(serverId, userId string) (string, error) {
+	var role string
+	err := s.db.QueryRow(`
+		SELECT CASE
+			WHEN sm.role <> 'member' AND s.require_two_factor AND NOT EXISTS (
+				SELECT 1 FROM user_totp t WHERE t.user_id = sm.user_id AND t.confirmed_at IS NOT NULL
+			) THEN 'member'
+			ELSE sm.role
+		END
+		FROM server_members sm
+		JOIN servers s ON s.id = sm.server_id
+		WHERE sm.server_id = $1 AND sm.user_id = $2
+	`, serverId, userId).Scan(&role)
+	return role, err
+}
+
+// CanPinMessages checks if a user may pin and unpin messages in a channel.
+// Server moderators can pin in server channels; every participant can pin in direct conversations.
+func (s *ServerService) CanPinMessages(channelId, userId string) (bool, error) {
+	serverId, err := s.GetServerIdByChannelId(channelId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if serverId == "" {
+		return s.IsChannelMember(channelId, userId)
+	}
+
+	hasAccess, err := s.HasChannelAccess(channelId, userId)
+	if err != nil || !hasAccess {
+		return false, err
+	}
+
+	return s.IsServerModerator(serverId, userId)
+}
+
+// SetChannelTopic updates a channel's topic
+func (s *ServerService) SetChannelTopic(channelId, topic, userId string) error {
+	now := time.Now()
+	_, err := s.db.Exec(
+		"UPDATE channels SET topic = $1, topic_updated_by = $2, topic_updated_at = $3, updated_at = $3 WHERE id = $4",
+		topic, userId, now, channelId,
+	)
+	return err
+}
+
+// SetRevisionRetention sets how many days message revisions are kept (0 keeps them forever)
+func (s *ServerService) SetRevisionRetention(serverId string, retentionDays int) error {
+	var days sql.NullInt64
+	if retentionDays > 0 {
+		days = sql.NullInt64{Int64: int64(retentionDays), Valid: true}
+	}
+	_, err := s.db.Exec(
+		"UPDATE servers SET revision_retention_days = $1, updated_at = $2 WHERE id = $3",
+		days, time.Now(), serverId,
+	)
+	return err
+}
+
+// SetTwoFactorRequirement sets whether owners and admins of a server need
+// two-factor authentication. Only an owner who has it enabled can turn the
+// requirement on, so they don't lock themselves out.
+func (s *ServerService) SetTwoFactorRequirement(serverId, userId string, required bool) error {
+	if required {
+		var hasTwoFactor bool
+		if err := s.db.QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL)", userId,
+		).Scan(&hasTwoFactor); err != nil {
+			return err
+		}
+		if !hasTwoFactor {
+			return ErrTwoFactorNotEnabled
+		}
+	}
+	_, err := s.db.Exec(
+		"UPDATE servers SET require_two_factor = $1, updated_at = $2 WHERE id = $3",
+		required, time.Now(), serverId,
+	)
+	return err
+}
+
 // IsChannelPrivate checks if a channel is private
 func (s *ServerService) IsChannelPrivate(channelId string) (bool, error) {
 	var isPrivate bool
@@ -175,28 +279,40 @@ func (s *ServerService) IsChannelPrivate(channelId string) (bool, error) {
 	return isPrivate, err
 }
 
-// GetServerIdByChannelId returns the server ID for a channel
+// GetServerIdByChannelId returns the server ID for a channel.
+// Direct conversations do not belong to a server and return an empty ID.
 func (s *ServerService) GetServerIdByChannelId(channelId string) (string, error) {
-	var serverId string
+	var serverId sql.NullString
 	err := s.db.QueryRow(
 		"SELECT server_id FROM channels WHERE id = $1",
 		channelId,
 	).Scan(&serverId)
-	return serverId, err
+	return serverId.String, err
+}
+
+// IsChannelMember checks if a user is listed in channel_members for a channel
+func (s *ServerService) IsChannelMember(channelId, userId string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM channel_members WHERE channel_id = $1 AND user_id = $2)",
+		channelId, userId,
+	).Scan(&exists)
+	return exists, err
 }
 
 // HasChannelAccess checks if a user has access to a channel
 func (s *ServerService) HasChannelAccess(channelId, userId string) (bool, error) {
 	// Get the server ID for the channel
-	var serverId string
-	err := s.db.QueryRow(
-		"SELECT server_id FROM channels WHERE id = $1",
-		channelId,
-	).Scan(&serverId)
+	serverId, err := s.GetServerIdByChannelId(channelId)
 	if err != nil {
 		return false, err
 	}
 
+	// Direct conversations are only readable by their participants
+	if serverId == "" {
+		return s.IsChannelMember(channelId, userId)
+	}
+
 	// Check if user is a member of the server
 	isMember, err := s.IsServerMember(serverId, userId)
 	if err != nil || !isMember {
@@ -219,12 +335,7 @@ func (s *ServerService) HasChannelAccess(channelId, userId string) (bool, error)
 	}
 
 	// If the channel is private, check if the user is a member of the channel
-	var exists bool
-	err = s.db.QueryRow(
-		"SELECT EXISTS(SELECT 1 FROM channel_members WHERE channel_id = $1 AND user_id = $2)",
-		channelId, userId,
-	).Scan(&exists)
-	return exists, err
+	return s.IsChannelMember(channelId, userId)
 }
 
 // CreateCategory creates a new category in a server
@@ -326,12 +437,13 @@ func (s *ServerService) GetServerIdByCategoryId(categoryId string) (string, erro
 // IsUserServerOwnerByChannelId checks if the user is the owner of the server that contains the channel
 func (s *ServerService) IsUserServerOwnerByChannelId(channelId, userId string) (bool, error) {
 	var ownerId string
+	var requireTwoFactor bool
 	err := s.db.QueryRow(`
-		SELECT s.owner_id 
+		SELECT s.owner_id, s.require_two_factor
 		FROM servers s
 		JOIN channels c ON s.id = c.server_id
 		WHERE c.id = $1
-	`, channelId).Scan(&ownerId)
+	`, channelId).Scan(&ownerId, &requireTwoFactor)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -340,7 +452,19 @@ func (s *ServerService) IsUserServerOwnerByChannelId(channelId, userId string) (
 		return false, err
 	}
 
-	return ownerId == userId, nil
+	if ownerId != userId {
+		return false, nil
+	}
+	if !requireTwoFactor {
+		return true, nil
+	}
+
+	// The server requires two-factor authentication of its owner
+	var hasTwoFactor bool
+	err = s.db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL)", userId,
+	).Scan(&hasTwoFactor)
+	return hasTwoFactor, err
 }
 
 // DeleteChannel deletes a channel
@@ -358,6 +482,36 @@ func (s *ServerService) DeleteChannel(channelId string) error {
 		return err
 	}
 
+	// Delete the channel's attachments, including unposted uploads to it.
+	// Their files are removed from storage by AttachmentCleanupService.
+	var attachmentIds []string
+	rows, err := tx.Query(`
+		SELECT ca.id
+		FROM channel_attachments ca
+		LEFT JOIN channel_messages cm ON ca.message_id = cm.id
+		WHERE cm.channel_id = $1 OR ca.channel_id = $1
+	`, channelId)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		attachmentIds = append(attachmentIds, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(attachmentIds) > 0 {
+		if err := deleteAttachmentsTx(tx, attachmentIds); err != nil {
+			return err
+		}
+	}
+
 	// Delete channel messages
 	_, err = tx.Exec("DELETE FROM channel_messages WHERE channel_id = $1", channelId)
 	if err != nil {
@@ -374,16 +528,131 @@ func (s *ServerService) DeleteChannel(channelId string) error {
 	return tx.Commit()
 }
 
+// TransferOwnership makes another member the owner of a server. The
+// previous owner stays on as an admin.
+func (s *ServerService) TransferOwnership(serverId, userId, newOwnerId string) error {
+	if newOwnerId == userId {
+		return ErrCannotTransferToSelf
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var ownerId string
+	var requireTwoFactor bool
+	err = tx.QueryRow(
+		"SELECT owner_id, require_two_factor FROM servers WHERE id = $1 FOR UPDATE", serverId,
+	).Scan(&ownerId, &requireTwoFactor)
+	if err == sql.ErrNoRows || (err == nil && ownerId != userId) {
+		return ErrNotServerOwner
+	}
+	if err != nil {
+		return err
+	}
+
+	var isMember, hasTwoFactor bool
+	if err := tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM server_members WHERE server_id = $1 AND user_id = $2),
+		       EXISTS (SELECT 1 FROM user_totp WHERE user_id = $2 AND confirmed_at IS NOT NULL)
+	`, serverId, newOwnerId).Scan(&isMember, &hasTwoFactor); err != nil {
+		return err
+	}
+	if !isMember {
+		return ErrNewOwnerNotMember
+	}
+	// The new owner would act as a plain member until they enabled it
+	if requireTwoFactor && !hasTwoFactor {
+		return ErrNewOwnerNeedsTwoFactor
+	}
+
+	now := time.Now()
+	for _, update := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{"UPDATE servers SET owner_id = $1, updated_at = $2 WHERE id = $3", []interface{}{newOwnerId, now, serverId}},
+		{"UPDATE server_members SET role = 'owner', updated_at = $1 WHERE server_id = $2 AND user_id = $3", []interface{}{now, serverId, newOwnerId}},
+		{"UPDATE server_members SET role = 'admin', updated_at = $1 WHERE server_id = $2 AND user_id = $3", []interface{}{now, serverId, userId}},
+	} {
+		if _, err := tx.Exec(update.query, update.args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteServer deletes a server owned by the user, with its channels,
+// messages and members
+func (s *ServerService) DeleteServer(serverId, userId string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var ownerId string
+	err = tx.QueryRow("SELECT owner_id FROM servers WHERE id = $1 FOR UPDATE", serverId).Scan(&ownerId)
+	if err == sql.ErrNoRows || (err == nil && ownerId != userId) {
+		return ErrNotServerOwner
+	}
+	if err != nil {
+		return err
+	}
+
+	// Their files are removed from storage by AttachmentCleanupService
+	var attachmentIds []string
+	rows, err := tx.Query(`
+		SELECT ca.id
+		FROM channel_attachments ca
+		LEFT JOIN channel_messages cm ON ca.message_id = cm.id
+		JOIN channels c ON c.id = COALESCE(cm.channel_id, ca.channel_id)
+		WHERE c.server_id = $1
+	`, serverId)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		attachmentIds = append(attachmentIds, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(attachmentIds) > 0 {
+		if err := deleteAttachmentsTx(tx, attachmentIds); err != nil {
+			return err
+		}
+	}
+
+	// Channels, messages, members and categories go with the server
+	if _, err := tx.Exec("DELETE FROM servers WHERE id = $1", serverId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 // チャンネルを取得
 func (s *ServerService) GetChannelByID(channelID string) (models.Channel, error) {
 	var channel models.Channel
+	var serverId, categoryId, description sql.NullString
 	err := s.db.QueryRow(
-		"SELECT id, server_id, category_id, name, description, is_private, created_at, updated_at FROM channels WHERE id = $1",
+		"SELECT id, server_id, category_id, name, description, is_private, kind, topic, created_at, updated_at FROM channels WHERE id = $1",
 		channelID,
 	).Scan(
-		&channel.ID, &channel.ServerId, &channel.CategoryId, &channel.Name,
-		&channel.Description, &channel.IsPrivate, &channel.CreatedAt, &channel.UpdatedAt,
+		&channel.ID, &serverId, &categoryId, &channel.Name,
+		&description, &channel.IsPrivate, &channel.Kind, &channel.Topic, &channel.CreatedAt, &channel.UpdatedAt,
 	)
+	channel.ServerId = serverId.String
+	channel.CategoryId = categoryId.String
+	channel.Description = description.String
 	return channel, err
 }
 
@@ -404,16 +673,8 @@ func (s *ServerService) UserHasAccessToChannel(userID, channelID string) (bool,
 		return s.IsServerMember(serverID, userID)
 	}
 
-	// If the channel is private, check if the user is a member of the channel
-	var count int
-	err = s.db.QueryRow(
-		"SELECT COUNT(*) FROM channel_members WHERE channel_id = $1 AND user_id = $2",
-		channelID, userID,
-	).Scan(&count)
-	if err != nil {
-		return false, err
-	}
-	return count > 0, nil
+	// If the channel is private (or a direct conversation), check if the user is a member of the channel
+	return s.IsChannelMember(channelID, userID)
 }
 
 // UserHasChannelAccess はユーザーが指定されたチャンネルにアクセスできるかどうかを確認する
@@ -424,12 +685,21 @@ func (s *ServerService) UserHasChannelAccess(userID string, channelID string) (b
 		FROM channels c
 		WHERE c.id = $1
 	`
-	var serverID string
+	var serverID sql.NullString
 	err := s.db.QueryRow(query, channelID).Scan(&channelID, &serverID)
 	if err != nil {
 		return false, fmt.Errorf("チャンネル情報の取得に失敗しました: %w", err)
 	}
 
+	// ダイレクトメッセージは参加者のみアクセスできる
+	if !serverID.Valid {
+		isMember, err := s.IsChannelMember(channelID, userID)
+		if err != nil {
+			return false, fmt.Errorf("チャンネルメンバーシップの確認に失敗しました: %w", err)
+		}
+		return isMember, nil
+	}
+
 	// ユーザーがサーバーのメンバーかどうかを確認
 	query = `
 		SELECT COUNT(*)
@@ -437,7 +707,7 @@ func (s *ServerService) UserHasChannelAccess(userID string, channelID string) (b
 		WHERE server_id = $1 AND user_id = $2
 	`
 	var count int
-	err = s.db.QueryRow(query, serverID, userID).Scan(&count)
+	err = s.db.QueryRow(query, serverID.String, userID).Scan(&count)
 	if err != nil {
 		return false, fmt.Errorf("サーバーメンバーシップの確認に失敗しました: %w", err)
 	}
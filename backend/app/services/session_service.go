@@ -0,0 +1,400 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+
+	"app/models"
+)
+
+const (
+	// DefaultAccessTokenTTL is how long an access token is valid
+	DefaultAccessTokenTTL = 15 * time.Minute
+	// DefaultRefreshTokenTTL is how long a session survives without being refreshed
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+	// revokedSessionRetention is how long revoked and expired sessions are kept
+	revokedSessionRetention = 7 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used; the session has been revoked")
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrSessionRevoked      = errors.New("session has been revoked or has expired")
+)
+
+// AccessClaims are the claims of an access token
+type AccessClaims struct {
+	UserID    string `json:"userID"`
+	SessionID string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// SessionService issues access and refresh tokens and keeps track of login
+// sessions, so a session can be revoked before its tokens expire.
+//
+// Access tokens are JWTs signed by KeyManager carrying the session id; they are only accepted
+// while their session is active. Refresh tokens are random strings stored
+// as hashes, and each can be used once: refreshing rotates it. Presenting a
+// rotated token again means it was copied, so the whole session is revoked.
+type SessionService struct {
+	db         *sql.DB
+	keys       *KeyManager
+	wsService  *WebSocketService
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+// NewSessionService creates a new SessionService
+func NewSessionService(db *sql.DB, keys *KeyManager, accessTTL, refreshTTL time.Duration) *SessionService {
+	return &SessionService{
+		db:         db,
+		keys:       keys,
+		accessTTL:  accessTTL,
+		refreshTTL: refreshTTL,
+	}
+}
+
+// SetWebSocketService sets the WebSocket service used to disconnect revoked sessions
+func (s *SessionService) SetWebSocketService(wsService *WebSocketService) {
+	s.wsService = wsService
+}
+
+// CreateSession starts a session for a user who has just authenticated
+func (s *SessionService) CreateSession(userID string, client models.SessionClient) (*models.AuthTokens, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	sessionID := uuid.New().String()
+	now := time.Now()
+	if _, err := tx.Exec(`
+		INSERT INTO user_sessions (id, user_id, user_agent, ip_address, created_at, last_used_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $5, $6)
+	`, sessionID, userID, truncateRunes(client.UserAgent, 512), client.IPAddress, now, now.Add(s.refreshTTL)); err != nil {
+		return nil, fmt.Errorf("error creating session: %w", err)
+	}
+
+	tokens, err := s.issueTokens(tx, userID, sessionID, now)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, tx.Commit()
+}
+
+// Refresh exchanges a refresh token for a new access token and refresh token
+func (s *SessionService) Refresh(refreshToken string, client models.SessionClient) (*models.AuthTokens, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var sessionID, userID string
+	var expiresAt time.Time
+	var usedAt, revokedAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT rt.session_id, s.user_id, rt.expires_at, rt.used_at, s.revoked_at
+		FROM refresh_tokens rt
+		JOIN user_sessions s ON s.id = rt.session_id
+		WHERE rt.token_hash = $1
+		FOR UPDATE OF rt, s
+	`, hashToken(refreshToken)).Scan(&sessionID, &userID, &expiresAt, &usedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if revokedAt.Valid || !expiresAt.After(now) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if usedAt.Valid {
+		// Either the legitimate client or whoever copied the token already
+		// rotated it; we can't tell which, so neither keeps the session
+		if _, err := tx.Exec(
+			"UPDATE user_sessions SET revoked_at = $1, revoked_reason = $2 WHERE id = $3",
+			now, models.SessionRevokedReuse, sessionID,
+		); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		log.Printf("リフレッシュトークンの再利用を検出したため、セッション %s を失効させました", sessionID)
+		s.disconnect(sessionID)
+		return nil, ErrRefreshTokenReused
+	}
+
+	if _, err := tx.Exec("UPDATE refresh_tokens SET used_at = $1 WHERE token_hash = $2", now, hashToken(refreshToken)); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`
+		UPDATE user_sessions SET last_used_at = $1, expires_at = $2, user_agent = $3, ip_address = $4
+		WHERE id = $5
+	`, now, now.Add(s.refreshTTL), truncateRunes(client.UserAgent, 512), client.IPAddress, sessionID); err != nil {
+		return nil, err
+	}
+
+	tokens, err := s.issueTokens(tx, userID, sessionID, now)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, tx.Commit()
+}
+
+// issueTokens signs an access token and stores a new refresh token for a session
+func (s *SessionService) issueTokens(tx *sql.Tx, userID, sessionID string, now time.Time) (*models.AuthTokens, error) {
+	expiresAt := now.Add(s.accessTTL)
+	accessToken, err := s.keys.Sign(AccessClaims{
+		UserID:    userID,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error generating token: %w", err)
+	}
+
+	refreshToken, err := generateRandomToken()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO refresh_tokens (token_hash, session_id, created_at, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, hashToken(refreshToken), sessionID, now, now.Add(s.refreshTTL)); err != nil {
+		return nil, fmt.Errorf("error storing refresh token: %w", err)
+	}
+
+	return &models.AuthTokens{
+		Token:        accessToken,
+		ExpiresAt:    expiresAt,
+		RefreshToken: refreshToken,
+		SessionId:    sessionID,
+	}, nil
+}
+
+// ValidateAccessToken checks an access token's signature and expiry and that
+// its session is still active
+func (s *SessionService) ValidateAccessToken(tokenString string) (*AccessClaims, error) {
+	claims, err := s.parseAccessToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	var active bool
+	err = s.db.QueryRow(
+		"SELECT revoked_at IS NULL AND expires_at > $1 FROM user_sessions WHERE id = $2 AND user_id = $3",
+		time.Now(), claims.SessionID, claims.UserID,
+	).Scan(&active)
+	if err == sql.ErrNoRows || (err == nil && !active) {
+		return nil, ErrSessionRevoked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// GetSessions lists a user's active sessions, most recently used first
+func (s *SessionService) GetSessions(userID, currentSessionID string) ([]models.Session, error) {
+	rows, err := s.db.Query(`
+		SELECT id, user_agent, ip_address, created_at, last_used_at, expires_at
+		FROM user_sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2
+		ORDER BY last_used_at DESC
+	`, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var session models.Session
+		if err := rows.Scan(&session.ID, &session.UserAgent, &session.IPAddress,
+			&session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt); err != nil {
+			return nil, err
+		}
+		session.Device = describeUserAgent(session.UserAgent)
+		session.Current = session.ID == currentSessionID
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession revokes one of a user's sessions and closes its WebSockets
+func (s *SessionService) RevokeSession(userID, sessionID, reason string) error {
+	if _, err := uuid.Parse(sessionID); err != nil {
+		return ErrSessionNotFound
+	}
+
+	result, err := s.db.Exec(`
+		UPDATE user_sessions SET revoked_at = $1, revoked_reason = $2
+		WHERE id = $3 AND user_id = $4 AND revoked_at IS NULL
+	`, time.Now(), reason, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrSessionNotFound
+	}
+
+	s.disconnect(sessionID)
+	return nil
+}
+
+// RevokeAllSessions revokes every active session of a user except
+// exceptSessionID (pass "" to revoke them all) and returns how many it revoked
+func (s *SessionService) RevokeAllSessions(userID, exceptSessionID, reason string) (int, error) {
+	rows, err := s.db.Query(`
+		UPDATE user_sessions SET revoked_at = $1, revoked_reason = $2
+		WHERE user_id = $3 AND revoked_at IS NULL AND id::text <> $4
+		RETURNING id
+	`, time.Now(), reason, userID, exceptSessionID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var sessionIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+		sessionIDs = append(sessionIDs, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	s.disconnect(sessionIDs...)
+	return len(sessionIDs), nil
+}
+
+func (s *SessionService) disconnect(sessionIDs ...string) {
+	if s.wsService != nil && len(sessionIDs) > 0 {
+		s.wsService.DisconnectSessions(sessionIDs...)
+	}
+}
+
+// StartCleanup runs CleanupExpired every interval
+func (s *SessionService) StartCleanup(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.CleanupExpired(); err != nil {
+				log.Printf("セッションのクリーンアップエラー: %v", err)
+			}
+		}
+	}()
+}
+
+// CleanupExpired deletes expired refresh tokens, and sessions that expired
+// or were revoked more than revokedSessionRetention ago
+func (s *SessionService) CleanupExpired() error {
+	now := time.Now()
+	if _, err := s.db.Exec("DELETE FROM refresh_tokens WHERE expires_at <= $1", now); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(
+		"DELETE FROM user_sessions WHERE expires_at <= $1 OR revoked_at <= $1",
+		now.Add(-revokedSessionRetention),
+	)
+	return err
+}
+
+// parseAccessToken verifies an access token's signature and expiry. Tokens
+// issued before sessions existed have no sid and are rejected.
+func (s *SessionService) parseAccessToken(tokenString string) (*AccessClaims, error) {
+	claims := &AccessClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, s.keys.Keyfunc,
+		jwt.WithValidMethods([]string{models.SigningAlgorithmEdDSA, models.SigningAlgorithmRS256}),
+		jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	if claims.UserID == "" || claims.SessionID == "" {
+		return nil, errors.New("invalid token claims")
+	}
+	return claims, nil
+}
+
+func generateRandomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is how refresh tokens are stored, so a database leak doesn't leak usable tokens
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// describeUserAgent turns a User-Agent header into a short label such as
+// "Firefox on Linux". It only recognises common browsers and systems.
+func describeUserAgent(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+
+	browser := "Unknown browser"
+	for _, candidate := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"CriOS/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(userAgent, candidate.token) {
+			browser = candidate.name
+			break
+		}
+	}
+
+	system := ""
+	for _, candidate := range []struct{ token, name string }{
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, candidate.token) {
+			system = candidate.name
+			break
+		}
+	}
+
+	if system == "" {
+		return browser
+	}
+	return browser + " on " + system
+}
@@ -0,0 +1,217 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"app/storage"
+)
+
+// StorageMigrationReport summarizes a storage migration run
+type StorageMigrationReport struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	DryRun   bool     `json:"dryRun"`
+	Migrated int      `json:"migrated"`
+	Missing  int      `json:"missing"` // rows whose file no longer exists in the source
+	Failed   int      `json:"failed"`
+	Errors   []string `json:"errors"`
+}
+
+// maxStorageMigrationErrors keeps reports readable when a backend is down
+const maxStorageMigrationErrors = 100
+
+// StorageMigrationService moves attachment files and their thumbnails between
+// storage backends and rewrites channel_attachments.file_path and
+// attachment_thumbnails.file_path to point at the new copies.
+//
+// Each file is copied before its row is updated, and the update only applies
+// if file_path is unchanged, so the migration can be interrupted and re-run.
+type StorageMigrationService struct {
+	db    *sql.DB
+	files *storage.Manager
+}
+
+// NewStorageMigrationService creates a new StorageMigrationService
+func NewStorageMigrationService(db *sql.DB, files *storage.Manager) *StorageMigrationService {
+	return &StorageMigrationService{
+		db:    db,
+		files: files,
+	}
+}
+
+// Run copies every attachment and thumbnail held by the from backend to the to backend.
+// With deleteSource the original is removed once its row points at the copy.
+func (s *StorageMigrationService) Run(from, to string, batchSize int, deleteSource, dryRun bool) (*StorageMigrationReport, error) {
+	source, ok := s.files.Backend(from)
+	if !ok {
+		return nil, fmt.Errorf("storage backend %q is not configured", from)
+	}
+	target, ok := s.files.Backend(to)
+	if !ok {
+		return nil, fmt.Errorf("storage backend %q is not configured", to)
+	}
+	if from == to {
+		return nil, errors.New("source and target backends must differ")
+	}
+
+	report := &StorageMigrationReport{From: from, To: to, DryRun: dryRun, Errors: []string{}}
+	ctx := context.Background()
+	lastID := ""
+	for {
+		rows, err := s.db.Query(`
+			SELECT id, file_path
+			FROM channel_attachments
+			WHERE $1 = '' OR id > $1::uuid
+			ORDER BY id
+			LIMIT $2
+		`, lastID, batchSize)
+		if err != nil {
+			return report, err
+		}
+
+		type attachmentFile struct{ id, filePath string }
+		var batch []attachmentFile
+		for rows.Next() {
+			var file attachmentFile
+			if err := rows.Scan(&file.id, &file.filePath); err != nil {
+				rows.Close()
+				return report, err
+			}
+			batch = append(batch, file)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return report, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		firstID := lastID
+		lastID = batch[len(batch)-1].id
+
+		for _, file := range batch {
+			key, ok := source.Key(file.filePath)
+			if !ok {
+				continue
+			}
+			err := s.migrateFile(ctx, source, target, file.filePath, key, deleteSource, dryRun, func(locator string) (sql.Result, error) {
+				return s.db.Exec(
+					"UPDATE channel_attachments SET file_path = $1 WHERE id = $2 AND file_path = $3",
+					locator, file.id, file.filePath,
+				)
+			})
+			report.record(file.id, err)
+		}
+
+		if err := s.migrateThumbnails(ctx, source, target, firstID, lastID, deleteSource, dryRun, report); err != nil {
+			return report, err
+		}
+	}
+
+	if report.Failed > 0 {
+		return report, fmt.Errorf("%d files could not be migrated", report.Failed)
+	}
+	return report, nil
+}
+
+// migrateThumbnails migrates the thumbnails of the attachments whose IDs are
+// after afterID and up to lastID, the batch just migrated
+func (s *StorageMigrationService) migrateThumbnails(ctx context.Context, source, target storage.Storage, afterID, lastID string, deleteSource, dryRun bool, report *StorageMigrationReport) error {
+	rows, err := s.db.Query(`
+		SELECT attachment_id, size, file_path
+		FROM attachment_thumbnails
+		WHERE ($1 = '' OR attachment_id > $1::uuid) AND attachment_id <= $2::uuid
+		ORDER BY attachment_id, size
+	`, afterID, lastID)
+	if err != nil {
+		return err
+	}
+
+	type thumbnailFile struct {
+		attachmentID string
+		size         int
+		filePath     string
+	}
+	var thumbnails []thumbnailFile
+	for rows.Next() {
+		var file thumbnailFile
+		if err := rows.Scan(&file.attachmentID, &file.size, &file.filePath); err != nil {
+			rows.Close()
+			return err
+		}
+		thumbnails = append(thumbnails, file)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, file := range thumbnails {
+		key, ok := source.Key(file.filePath)
+		if !ok {
+			continue
+		}
+		err := s.migrateFile(ctx, source, target, file.filePath, key, deleteSource, dryRun, func(locator string) (sql.Result, error) {
+			return s.db.Exec(
+				"UPDATE attachment_thumbnails SET file_path = $1 WHERE attachment_id = $2 AND size = $3 AND file_path = $4",
+				locator, file.attachmentID, file.size, file.filePath,
+			)
+		})
+		report.record(fmt.Sprintf("%s (thumbnail %d)", file.attachmentID, file.size), err)
+	}
+	return nil
+}
+
+// record counts the outcome of migrating one file
+func (r *StorageMigrationReport) record(id string, err error) {
+	switch {
+	case err == nil:
+		r.Migrated++
+	case errors.Is(err, storage.ErrNotFound):
+		r.Missing++
+	default:
+		r.Failed++
+		if len(r.Errors) < maxStorageMigrationErrors {
+			r.Errors = append(r.Errors, fmt.Sprintf("%s: %v", id, err))
+		}
+	}
+}
+
+// migrateFile copies one file and points its row at the copy with update,
+// which must only change the row if its file_path is still filePath
+func (s *StorageMigrationService) migrateFile(ctx context.Context, source, target storage.Storage, filePath, key string, deleteSource, dryRun bool, update func(locator string) (sql.Result, error)) error {
+	info, err := source.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+
+	reader, err := source.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	err = target.Put(ctx, key, reader, info.Size, info.ContentType)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+
+	result, err := update(target.Locator(key))
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		// The row changed or was deleted meanwhile; leave the source untouched
+		return err
+	}
+
+	if deleteSource {
+		return source.Delete(ctx, key)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	// The RFC lists 8-digit codes; these are their last six digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		step := totpStep(time.Unix(tt.unix, 0))
+		if got := totpCode(rfc6238Secret, step); got != tt.code {
+			t.Errorf("totpCode at %d = %q, want %q", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := totpStep(now)
+	tests := []struct {
+		name         string
+		code         string
+		lastUsedStep int64
+		wantStep     int64
+		wantOK       bool
+	}{
+		{"current step", totpCode(rfc6238Secret, current), 0, current, true},
+		{"spaces are ignored", "050 471", 0, current, true},
+		{"previous step within skew", totpCode(rfc6238Secret, current-1), 0, current - 1, true},
+		{"next step within skew", totpCode(rfc6238Secret, current+1), 0, current + 1, true},
+		{"outside skew", totpCode(rfc6238Secret, current-2), 0, 0, false},
+		{"wrong code", "000000", 0, 0, false},
+		{"wrong length", "05047", 0, 0, false},
+		{"replayed step", totpCode(rfc6238Secret, current), current, 0, false},
+		{"step before a used one", totpCode(rfc6238Secret, current-1), current, 0, false},
+		{"step after a used one", totpCode(rfc6238Secret, current+1), current, current + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := matchTOTP(rfc6238Secret, tt.code, now, tt.lastUsedStep)
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("matchTOTP(%q) = %d, %v; want %d, %v", tt.code, step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestIsTOTPCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"123456", true},
+		{"123 456", true},
+		{"12345", false},
+		{"1234567", false},
+		{"12a456", false},
+		{"k7m2p-x9qra", false},
+	}
+	for _, tt := range tests {
+		if got := isTOTPCode(tt.code); got != tt.want {
+			t.Errorf("isTOTPCode(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestRecoveryCodeHashing(t *testing.T) {
+	stored := hashToken(normalizeRecoveryCode("k7m2p-x9qra"))
+	tests := []struct {
+		typed string
+		want  bool
+	}{
+		{"k7m2p-x9qra", true},
+		{"K7M2P-X9QRA", true},
+		{"k7m2px9qra", true},
+		{" k7m2p x9qra ", true},
+		{"k7m2p-x9qrb", false},
+		{"k7m2p", false},
+	}
+	for _, tt := range tests {
+		if got := hashToken(normalizeRecoveryCode(tt.typed)) == stored; got != tt.want {
+			t.Errorf("recovery code %q matches = %v, want %v", tt.typed, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateRecoveryCode(t *testing.T) {
+	code, err := generateRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != 11 || code[5] != '-' {
+		t.Errorf("generateRecoveryCode() = %q, want the form xxxxx-xxxxx", code)
+	}
+	if normalizeRecoveryCode(code) != code[:5]+code[6:] {
+		t.Errorf("normalizeRecoveryCode(%q) = %q", code, normalizeRecoveryCode(code))
+	}
+}
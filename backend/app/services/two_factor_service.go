@@ -0,0 +1,494 @@
+package services
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"app/models"
+)
+
+const (
+	// LoginChallengeTTL is how long the second step of a login can take
+	LoginChallengeTTL = 5 * time.Minute
+	// maxLoginChallengeAttempts is how many codes can be tried per challenge
+	maxLoginChallengeAttempts = 5
+	// recoveryCodeCount is how many recovery codes are generated at a time
+	recoveryCodeCount = 10
+	// totpSecretSize is the size of a TOTP secret in bytes (160 bits, as RFC 4226 recommends)
+	totpSecretSize = 20
+	// unconfirmedTOTPTTL is how long an enrollment can stay unconfirmed before cleanup removes it
+	unconfirmedTOTPTTL = 24 * time.Hour
+)
+
+var (
+	ErrTwoFactorAlreadyEnabled   = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled       = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorNotEnrolled      = errors.New("start two-factor enrollment first")
+	ErrInvalidTwoFactorCode      = errors.New("invalid two-factor authentication code")
+	ErrInvalidLoginChallenge     = errors.New("login challenge is invalid or has expired; sign in again")
+	ErrTwoFactorRequiredByServer = errors.New("a server you own requires two-factor authentication")
+)
+
+// recoveryCodeAlphabet leaves out characters that are easily confused
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// TwoFactorService handles TOTP two-factor authentication: enrollment,
+// recovery codes, and the challenge that completes a login after the
+// password step.
+//
+// TOTP secrets are encrypted with a key derived from the secret passed to
+// NewTwoFactorService. Recovery codes and challenge tokens are stored hashed.
+type TwoFactorService struct {
+	db     *sql.DB
+	aead   cipher.AEAD
+	issuer string
+}
+
+// NewTwoFactorService creates a TwoFactorService. issuer is the name
+// authenticator apps show next to the account.
+func NewTwoFactorService(db *sql.DB, secret, issuer string) (*TwoFactorService, error) {
+	aead, err := newAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &TwoFactorService{
+		db:     db,
+		aead:   aead,
+		issuer: issuer,
+	}, nil
+}
+
+// TwoFactorServiceFromEnv creates a TwoFactorService configured by
+// TOTP_SECRET_KEY, which encrypts the TOTP secrets and is derived from
+// JWT_SECRET when unset, and TOTP_ISSUER ("ChatBot" by default)
+func TwoFactorServiceFromEnv(db *sql.DB) (*TwoFactorService, error) {
+	secret := os.Getenv("TOTP_SECRET_KEY")
+	if secret == "" {
+		jwtSecret := os.Getenv("JWT_SECRET")
+		if jwtSecret == "" {
+			return nil, errors.New("TOTP_SECRET_KEY or JWT_SECRET must be set")
+		}
+		secret = "totp:" + jwtSecret
+	}
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "ChatBot"
+	}
+	return NewTwoFactorService(db, secret, issuer)
+}
+
+// IsEnabled reports whether a user has confirmed two-factor authentication
+func (s *TwoFactorService) IsEnabled(userID string) (bool, error) {
+	var enabled bool
+	err := s.db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL)", userID,
+	).Scan(&enabled)
+	return enabled, err
+}
+
+// GetStatus returns whether two-factor authentication is enabled and how
+// many unused recovery codes are left
+func (s *TwoFactorService) GetStatus(userID string) (*models.TwoFactorStatus, error) {
+	status := &models.TwoFactorStatus{}
+	var confirmedAt sql.NullTime
+	err := s.db.QueryRow("SELECT confirmed_at FROM user_totp WHERE user_id = $1", userID).Scan(&confirmedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if !confirmedAt.Valid {
+		return status, nil
+	}
+
+	status.Enabled = true
+	status.EnabledAt = &confirmedAt.Time
+	if err := s.db.QueryRow(
+		"SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = $1 AND used_at IS NULL", userID,
+	).Scan(&status.RecoveryCodesRemaining); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Enroll generates a new TOTP secret for a user. Two-factor authentication
+// is enabled once ConfirmEnrollment receives a code for it; enrolling again
+// before that replaces the secret.
+func (s *TwoFactorService) Enroll(userID string) (*models.TwoFactorEnrollment, error) {
+	var email string
+	if err := s.db.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&email); err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	sealed, err := s.seal(userID, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.db.Exec(`
+		INSERT INTO user_totp (user_id, secret, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, created_at = EXCLUDED.created_at, last_used_step = 0
+		WHERE user_totp.confirmed_at IS NULL
+	`, userID, sealed, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return nil, ErrTwoFactorAlreadyEnabled
+	}
+
+	return &models.TwoFactorEnrollment{
+		Secret: totpEncoding.EncodeToString(secret),
+		URI:    totpURI(s.issuer, email, secret),
+	}, nil
+}
+
+// ConfirmEnrollment enables two-factor authentication when code is valid
+// for the enrolled secret, and returns a fresh set of recovery codes
+func (s *TwoFactorService) ConfirmEnrollment(userID, code string) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	confirmed, err := s.verifyTOTP(tx, userID, code)
+	if err != nil {
+		return nil, err
+	}
+	if confirmed {
+		return nil, ErrTwoFactorAlreadyEnabled
+	}
+	if _, err := tx.Exec("UPDATE user_totp SET confirmed_at = $1 WHERE user_id = $2", time.Now(), userID); err != nil {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes after checking a TOTP code
+func (s *TwoFactorService) RegenerateRecoveryCodes(userID, code string) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	confirmed, err := s.verifyTOTP(tx, userID, code)
+	if err == ErrTwoFactorNotEnrolled || (err == nil && !confirmed) {
+		return nil, ErrTwoFactorNotEnabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// Disable turns two-factor authentication off after checking the password
+// and a TOTP or recovery code. Users who sign in through an identity
+// provider and have no password only need the code. It is refused while the
+// user owns a server that requires two-factor authentication.
+func (s *TwoFactorService) Disable(userID, password, code string) error {
+	var hashedPassword string
+	if err := s.db.QueryRow("SELECT password FROM users WHERE id = $1", userID).Scan(&hashedPassword); err != nil {
+		return err
+	}
+	if hashedPassword != "" && bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)) != nil {
+		return ErrIncorrectPassword
+	}
+
+	var ownsRequiringServer bool
+	if err := s.db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM servers WHERE owner_id = $1 AND require_two_factor)", userID,
+	).Scan(&ownsRequiringServer); err != nil {
+		return err
+	}
+	if ownsRequiringServer {
+		return ErrTwoFactorRequiredByServer
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.verifySecondFactor(tx, userID, code); err != nil {
+		return err
+	}
+	for _, query := range []string{
+		"DELETE FROM user_totp WHERE user_id = $1",
+		"DELETE FROM user_recovery_codes WHERE user_id = $1",
+		"DELETE FROM login_challenges WHERE user_id = $1",
+	} {
+		if _, err := tx.Exec(query, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// CreateLoginChallenge starts the second step of a login for a user whose
+// password was checked
+func (s *TwoFactorService) CreateLoginChallenge(userID string) (string, time.Time, error) {
+	token, err := generateRandomToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	expiresAt := now.Add(LoginChallengeTTL)
+	if _, err := s.db.Exec(
+		"INSERT INTO login_challenges (token_hash, user_id, created_at, expires_at) VALUES ($1, $2, $3, $4)",
+		hashToken(token), userID, now, expiresAt,
+	); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// LoginChallengeUser returns the user a challenge was issued for, if it can
+// still be completed
+func (s *TwoFactorService) LoginChallengeUser(challengeToken string) (string, error) {
+	var userID string
+	err := s.db.QueryRow(`
+		SELECT user_id FROM login_challenges
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2 AND attempts < $3
+	`, hashToken(challengeToken), time.Now(), maxLoginChallengeAttempts).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidLoginChallenge
+	}
+	return userID, err
+}
+
+// CompleteLoginChallenge checks a TOTP code or a recovery code against a
+// challenge and returns the user it was issued for. A challenge can be
+// completed once and allows maxLoginChallengeAttempts tries.
+func (s *TwoFactorService) CompleteLoginChallenge(challengeToken, code string) (string, error) {
+	now := time.Now()
+	tokenHash := hashToken(challengeToken)
+
+	// Counted outside the transaction below so failed attempts stick
+	var userID string
+	err := s.db.QueryRow(`
+		UPDATE login_challenges SET attempts = attempts + 1
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2 AND attempts < $3
+		RETURNING user_id
+	`, tokenHash, now, maxLoginChallengeAttempts).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidLoginChallenge
+	}
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if err := s.verifySecondFactor(tx, userID, code); err != nil {
+		if err == ErrTwoFactorNotEnrolled {
+			// 2FA was disabled after the password step
+			return "", ErrInvalidLoginChallenge
+		}
+		return "", err
+	}
+	result, err := tx.Exec(
+		"UPDATE login_challenges SET used_at = $1 WHERE token_hash = $2 AND used_at IS NULL", now, tokenHash,
+	)
+	if err != nil {
+		return "", err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return "", ErrInvalidLoginChallenge
+	}
+	return userID, tx.Commit()
+}
+
+// verifySecondFactor accepts a TOTP code or an unused recovery code for a
+// user with two-factor authentication enabled
+func (s *TwoFactorService) verifySecondFactor(tx *sql.Tx, userID, code string) error {
+	if isTOTPCode(code) {
+		confirmed, err := s.verifyTOTP(tx, userID, code)
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			return ErrTwoFactorNotEnrolled
+		}
+		return nil
+	}
+
+	var enabled bool
+	if err := tx.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL)", userID,
+	).Scan(&enabled); err != nil {
+		return err
+	}
+	if !enabled {
+		return ErrTwoFactorNotEnrolled
+	}
+	result, err := tx.Exec(
+		"UPDATE user_recovery_codes SET used_at = $1 WHERE code_hash = $2 AND user_id = $3 AND used_at IS NULL",
+		time.Now(), hashToken(normalizeRecoveryCode(code)), userID,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// verifyTOTP checks a code against the user's secret and records its time
+// step so the code can't be used again. It reports whether enrollment was
+// already confirmed.
+func (s *TwoFactorService) verifyTOTP(tx *sql.Tx, userID, code string) (bool, error) {
+	var sealed []byte
+	var lastUsedStep int64
+	var confirmedAt sql.NullTime
+	err := tx.QueryRow(
+		"SELECT secret, last_used_step, confirmed_at FROM user_totp WHERE user_id = $1 FOR UPDATE", userID,
+	).Scan(&sealed, &lastUsedStep, &confirmedAt)
+	if err == sql.ErrNoRows {
+		return false, ErrTwoFactorNotEnrolled
+	}
+	if err != nil {
+		return false, err
+	}
+	secret, err := s.open(userID, sealed)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := matchTOTP(secret, code, time.Now(), lastUsedStep)
+	if !ok {
+		return false, ErrInvalidTwoFactorCode
+	}
+	if _, err := tx.Exec("UPDATE user_totp SET last_used_step = $1 WHERE user_id = $2", step, userID); err != nil {
+		return false, err
+	}
+	return confirmedAt.Valid, nil
+}
+
+// replaceRecoveryCodes deletes a user's recovery codes and generates new ones
+func replaceRecoveryCodes(tx *sql.Tx, userID string) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	codes := make([]string, 0, recoveryCodeCount)
+	for len(codes) < recoveryCodeCount {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(
+			"INSERT INTO user_recovery_codes (code_hash, user_id, created_at) VALUES ($1, $2, $3)",
+			hashToken(normalizeRecoveryCode(code)), userID, now,
+		); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// generateRecoveryCode returns a random code like "k7m2p-x9qra"
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := make([]byte, 0, 11)
+	for i, v := range b {
+		if i == 5 {
+			code = append(code, '-')
+		}
+		// 256 is not a multiple of the alphabet size; the bias doesn't matter for single-use codes
+		code = append(code, recoveryCodeAlphabet[int(v)%len(recoveryCodeAlphabet)])
+	}
+	return string(code), nil
+}
+
+// normalizeRecoveryCode accepts codes typed with other case, spaces or without the dash
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// isTOTPCode reports whether code looks like a TOTP code rather than a recovery code
+func isTOTPCode(code string) bool {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return false
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// seal encrypts a TOTP secret; the user id is authenticated so a secret
+// can't be moved to another user's row
+func (s *TwoFactorService) seal(userID string, secret []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, secret, []byte(userID)), nil
+}
+
+func (s *TwoFactorService) open(userID string, sealed []byte) ([]byte, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, errors.New("sealed TOTP secret is too short")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	secret, err := s.aead.Open(nil, nonce, ciphertext, []byte(userID))
+	if err != nil {
+		return nil, errors.New("cannot decrypt TOTP secret; was TOTP_SECRET_KEY changed?")
+	}
+	return secret, nil
+}
+
+// StartCleanup deletes expired login challenges and abandoned enrollments every interval
+func (s *TwoFactorService) StartCleanup(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			now := time.Now()
+			if _, err := s.db.Exec("DELETE FROM login_challenges WHERE expires_at <= $1", now); err != nil {
+				log.Printf("ログインチャレンジのクリーンアップエラー: %v", err)
+			}
+			if _, err := s.db.Exec(
+				"DELETE FROM user_totp WHERE confirmed_at IS NULL AND created_at <= $1", now.Add(-unconfirmedTOTPTTL),
+			); err != nil {
+				log.Printf("未完了の2段階認証登録のクリーンアップエラー: %v", err)
+			}
+		}
+	}()
+}
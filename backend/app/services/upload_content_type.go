@@ -0,0 +1,127 @@
+package services
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// sniffLength is how much of a file http.DetectContentType looks at
+const sniffLength = 512
+
+// extensionContentTypes maps file extensions to the MIME type their content
+// should have. It is kept here rather than using mime.TypeByExtension so the
+// result does not depend on the host's /etc/mime.types.
+var extensionContentTypes = map[string]string{
+	".jpg": "image/jpeg", ".jpeg": "image/jpeg", ".png": "image/png", ".gif": "image/gif",
+	".webp": "image/webp", ".bmp": "image/bmp", ".ico": "image/x-icon", ".svg": "image/svg+xml",
+	".heic": "image/heic", ".heif": "image/heif", ".avif": "image/avif", ".tif": "image/tiff", ".tiff": "image/tiff",
+	".mp4": "video/mp4", ".m4v": "video/mp4", ".webm": "video/webm", ".mov": "video/quicktime", ".avi": "video/avi",
+	".mp3": "audio/mpeg", ".wav": "audio/wave", ".ogg": "application/ogg", ".oga": "application/ogg",
+	".m4a": "audio/mp4", ".flac": "audio/flac", ".aiff": "audio/aiff", ".mid": "audio/midi", ".midi": "audio/midi",
+	".pdf": "application/pdf", ".zip": "application/zip", ".gz": "application/x-gzip", ".rar": "application/x-rar-compressed",
+	".7z": "application/x-7z-compressed", ".tar": "application/x-tar",
+	".doc": "application/msword", ".xls": "application/vnd.ms-excel", ".ppt": "application/vnd.ms-powerpoint",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text", ".ods": "application/vnd.oasis.opendocument.spreadsheet",
+	".odp": "application/vnd.oasis.opendocument.presentation", ".epub": "application/epub+zip",
+	".txt": "text/plain", ".log": "text/plain", ".md": "text/markdown", ".csv": "text/csv", ".tsv": "text/tab-separated-values",
+	".json": "application/json", ".xml": "text/xml", ".yaml": "text/yaml", ".yml": "text/yaml",
+	".html": "text/html", ".htm": "text/html", ".css": "text/css", ".js": "text/javascript",
+	".go": "text/plain", ".py": "text/plain", ".ts": "text/plain", ".tsx": "text/plain", ".sql": "text/plain", ".sh": "text/plain",
+}
+
+// sniffableContentTypes are the types http.DetectContentType can recognize.
+// Files claiming one of these types must actually be recognized as it.
+var sniffableContentTypes = map[string]bool{
+	"image/jpeg": true, "image/png": true, "image/gif": true, "image/webp": true, "image/bmp": true, "image/x-icon": true,
+	"video/mp4": true, "video/webm": true, "video/avi": true, "audio/mpeg": true, "audio/wave": true,
+	"audio/aiff": true, "audio/midi": true, "application/ogg": true, "application/pdf": true,
+	"application/zip": true, "application/x-gzip": true, "application/x-rar-compressed": true,
+	"text/html": true,
+}
+
+// zipContainerTypes are formats stored as zip archives
+var zipContainerTypes = map[string]bool{
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   true,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         true,
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": true,
+	"application/vnd.oasis.opendocument.text":                                   true,
+	"application/vnd.oasis.opendocument.spreadsheet":                            true,
+	"application/vnd.oasis.opendocument.presentation":                           true,
+	"application/epub+zip": true,
+}
+
+// contentTypeAliases are sniffed types that other formats share a container with
+var contentTypeAliases = map[string]string{
+	"audio/mp4":       "video/mp4", // .m4a uses the MP4 container
+	"video/quicktime": "video/mp4", // many .mov files carry MP4 brands
+}
+
+// detectContentType determines a file's MIME type from its first bytes and
+// checks it against the type its extension claims. ok is false when the
+// content contradicts the extension, e.g. an HTML page named photo.png.
+func detectContentType(fileName string, head []byte) (contentType string, ok bool) {
+	sniffed := http.DetectContentType(head)
+	if i := strings.Index(sniffed, ";"); i >= 0 {
+		sniffed = sniffed[:i]
+	}
+
+	expected, known := extensionContentTypes[strings.ToLower(filepath.Ext(fileName))]
+	if !known {
+		// Unknown extensions are described by their content alone
+		return sniffed, true
+	}
+	if contentTypeMatches(expected, sniffed) {
+		return expected, true
+	}
+	return sniffed, false
+}
+
+// contentTypeMatches reports whether sniffed content is consistent with the expected type
+func contentTypeMatches(expected, sniffed string) bool {
+	switch {
+	case expected == sniffed, contentTypeAliases[expected] == sniffed:
+		return true
+	case sniffed == "application/octet-stream":
+		// Binary content the sniffer cannot identify is only fine for
+		// types it could not have identified anyway
+		return !sniffableContentTypes[expected] && !isTextContentType(expected)
+	case sniffed == "application/zip":
+		return zipContainerTypes[expected]
+	case sniffed == "text/plain":
+		return isTextContentType(expected) && expected != "text/html"
+	case sniffed == "text/xml":
+		return expected == "text/xml" || expected == "image/svg+xml"
+	}
+	return false
+}
+
+func isTextContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") ||
+		contentType == "application/json" || contentType == "image/svg+xml"
+}
+
+// getFileType returns the attachment category shown by clients for a MIME type
+func getFileType(contentType string) string {
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return "image"
+	case strings.HasPrefix(contentType, "video/"):
+		return "video"
+	case strings.HasPrefix(contentType, "audio/"), contentType == "application/ogg":
+		return "audio"
+	case contentType == "application/pdf":
+		return "pdf"
+	case contentType == "application/msword", strings.Contains(contentType, "wordprocessingml"), strings.Contains(contentType, "opendocument.text"):
+		return "document"
+	case contentType == "application/vnd.ms-excel", strings.Contains(contentType, "spreadsheet"):
+		return "spreadsheet"
+	case contentType == "application/vnd.ms-powerpoint", strings.Contains(contentType, "presentation"):
+		return "presentation"
+	default:
+		return "other"
+	}
+}
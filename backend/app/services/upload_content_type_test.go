@@ -0,0 +1,42 @@
+package services
+
+import "testing"
+
+func TestDetectContentType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	jpeg := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+	html := []byte("<html><body><script>alert(1)</script></body></html>")
+	zip := []byte("PK\x03\x04\x14\x00\x00\x00\x08\x00")
+	text := []byte("just some notes\n")
+	binary := make([]byte, 16)
+
+	tests := []struct {
+		fileName string
+		head     []byte
+		wantType string
+		wantOK   bool
+	}{
+		{"photo.png", png, "image/png", true},
+		{"PHOTO.PNG", png, "image/png", true},
+		{"photo.jpg", jpeg, "image/jpeg", true},
+		{"photo.png", html, "text/html", false},
+		{"photo.jpg", png, "image/png", false},
+		{"archive.zip", binary, "application/octet-stream", false},
+		{"report.docx", zip, "application/vnd.openxmlformats-officedocument.wordprocessingml.document", true},
+		{"report.docx", text, "text/plain", false},
+		{"notes.txt", text, "text/plain", true},
+		{"notes.txt", html, "text/html", false},
+		{"page.html", text, "text/plain", false},
+		{"page.html", html, "text/html", true},
+		{"drawing.svg", []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`), "image/svg+xml", true},
+		{"song.flac", binary, "audio/flac", true},
+		{"data.bin", html, "text/html", true},
+		{"noextension", png, "image/png", true},
+	}
+	for _, tt := range tests {
+		contentType, ok := detectContentType(tt.fileName, tt.head)
+		if contentType != tt.wantType || ok != tt.wantOK {
+			t.Errorf("detectContentType(%q) = %q, %v; want %q, %v", tt.fileName, contentType, ok, tt.wantType, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"app/models"
+)
+
+// Site-wide upload defaults, overridable with UPLOAD_MAX_FILE_SIZE,
+// UPLOAD_SERVER_QUOTA and UPLOAD_USER_QUOTA
+const (
+	DefaultMaxFileSize  int64 = 25 << 20
+	DefaultServerQuota  int64 = 10 << 30
+	DefaultUserQuota    int64 = 2 << 30
+	topUploadersInUsage       = 20
+)
+
+// ErrInvalidUploadPolicy is returned when a policy update is malformed
+var ErrInvalidUploadPolicy = errors.New("invalid upload policy")
+
+// UploadLimits are the site-wide upload limits in bytes. A quota of 0 means unlimited.
+type UploadLimits struct {
+	MaxFileSize int64
+	ServerQuota int64
+	UserQuota   int64
+}
+
+// UploadLimitsFromEnv reads the site-wide limits. Sizes accept a K, M or G suffix.
+func UploadLimitsFromEnv() (UploadLimits, error) {
+	limits := UploadLimits{
+		MaxFileSize: DefaultMaxFileSize,
+		ServerQuota: DefaultServerQuota,
+		UserQuota:   DefaultUserQuota,
+	}
+	for name, target := range map[string]*int64{
+		"UPLOAD_MAX_FILE_SIZE": &limits.MaxFileSize,
+		"UPLOAD_SERVER_QUOTA":  &limits.ServerQuota,
+		"UPLOAD_USER_QUOTA":    &limits.UserQuota,
+	} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		size, err := parseByteSize(value)
+		if err != nil {
+			return limits, fmt.Errorf("%s: %w", name, err)
+		}
+		*target = size
+	}
+	if limits.MaxFileSize <= 0 {
+		return limits, errors.New("UPLOAD_MAX_FILE_SIZE must be positive")
+	}
+	return limits, nil
+}
+
+// parseByteSize parses sizes such as "1048576", "512K", "25M" or "2G"
+func parseByteSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(value), "B"))
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return size * multiplier, nil
+}
+
+// UploadError is an upload rejection. Code is one of the models.UploadError*
+// constants so clients can react to it; Details carries the relevant limits.
+type UploadError struct {
+	Code    string
+	Message string
+	Details map[string]interface{}
+}
+
+func (e *UploadError) Error() string {
+	return e.Message
+}
+
+// StatusCode is the HTTP status an upload rejection is reported with
+func (e *UploadError) StatusCode() int {
+	switch e.Code {
+	case models.UploadErrorTypeNotAllowed, models.UploadErrorContentMismatch:
+		return http.StatusUnsupportedMediaType
+	case models.UploadErrorServerQuotaExceeded, models.UploadErrorUserQuotaExceeded:
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusRequestEntityTooLarge
+	}
+}
+
+// FileTooLargeError reports a file over the size limit
+func FileTooLargeError(maxBytes int64) *UploadError {
+	return &UploadError{
+		Code:    models.UploadErrorFileTooLarge,
+		Message: fmt.Sprintf("ファイルサイズが上限（%s）を超えています", formatByteSize(maxBytes)),
+		Details: map[string]interface{}{"maxBytes": maxBytes},
+	}
+}
+
+// UploadPolicyService enforces size limits, allowed file types and storage
+// quotas on uploads, and reports storage usage
+type UploadPolicyService struct {
+	db     *sql.DB
+	limits UploadLimits
+}
+
+// NewUploadPolicyService creates a new UploadPolicyService
+func NewUploadPolicyService(db *sql.DB, limits UploadLimits) *UploadPolicyService {
+	return &UploadPolicyService{
+		db:     db,
+		limits: limits,
+	}
+}
+
+// Limits returns the site-wide limits
+func (s *UploadPolicyService) Limits() UploadLimits {
+	return s.limits
+}
+
+// GetPolicy returns the effective upload policy of a server. An empty
+// serverId (direct messages) yields the site defaults.
+func (s *UploadPolicyService) GetPolicy(serverId string) (*models.UploadPolicy, error) {
+	policy := &models.UploadPolicy{
+		ServerId:     serverId,
+		MaxFileSize:  s.limits.MaxFileSize,
+		StorageQuota: s.limits.ServerQuota,
+		AllowedTypes: []string{},
+		DeniedTypes:  []string{},
+	}
+	if serverId == "" {
+		return policy, nil
+	}
+
+	var maxFileSize, storageQuota sql.NullInt64
+	var updatedAt time.Time
+	err := s.db.QueryRow(`
+		SELECT max_file_size, storage_quota, allowed_types, denied_types, updated_at
+		FROM server_upload_policies
+		WHERE server_id = $1
+	`, serverId).Scan(&maxFileSize, &storageQuota, pq.Array(&policy.AllowedTypes), pq.Array(&policy.DeniedTypes), &updatedAt)
+	if err == sql.ErrNoRows {
+		return policy, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	policy.IsCustom = true
+	policy.UpdatedAt = &updatedAt
+	if maxFileSize.Valid && maxFileSize.Int64 < policy.MaxFileSize {
+		policy.MaxFileSize = maxFileSize.Int64
+	}
+	if storageQuota.Valid {
+		policy.StorageQuota = storageQuota.Int64
+	}
+	return policy, nil
+}
+
+// UpdatePolicy replaces a server's upload policy
+func (s *UploadPolicyService) UpdatePolicy(serverId, userId string, req models.UploadPolicyRequest) (*models.UploadPolicy, error) {
+	if req.MaxFileSize != nil && *req.MaxFileSize > s.limits.MaxFileSize {
+		return nil, fmt.Errorf("%w: maxFileSize cannot exceed the site limit of %d bytes", ErrInvalidUploadPolicy, s.limits.MaxFileSize)
+	}
+	allowed, err := normalizeTypePatterns(req.AllowedTypes)
+	if err != nil {
+		return nil, err
+	}
+	denied, err := normalizeTypePatterns(req.DeniedTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO server_upload_policies (server_id, max_file_size, storage_quota, allowed_types, denied_types, updated_by, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (server_id) DO UPDATE
+		SET max_file_size = EXCLUDED.max_file_size, storage_quota = EXCLUDED.storage_quota,
+		    allowed_types = EXCLUDED.allowed_types, denied_types = EXCLUDED.denied_types,
+		    updated_by = EXCLUDED.updated_by, updated_at = EXCLUDED.updated_at
+	`, serverId, req.MaxFileSize, req.StorageQuota, pq.Array(allowed), pq.Array(denied), userId, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return s.GetPolicy(serverId)
+}
+
+// normalizeTypePatterns validates MIME patterns such as "image/png" or "image/*"
+func normalizeTypePatterns(patterns []string) ([]string, error) {
+	normalized := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		parts := strings.Split(pattern, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[0] == "*" || parts[1] == "" {
+			return nil, fmt.Errorf("%w: %q is not a MIME type pattern like \"image/*\"", ErrInvalidUploadPolicy, pattern)
+		}
+		normalized = append(normalized, pattern)
+	}
+	return normalized, nil
+}
+
+// matchesTypePattern reports whether a MIME type matches any of the patterns
+func matchesTypePattern(contentType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, contentType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckFile validates a file before it is stored: its size, that its content
+// matches its extension, and the server's allowed and denied types. head is
+// the start of the file. It returns the detected MIME type.
+func (s *UploadPolicyService) CheckFile(serverId, fileName string, size int64, head []byte) (string, error) {
+	policy, err := s.GetPolicy(serverId)
+	if err != nil {
+		return "", err
+	}
+	if size > policy.MaxFileSize {
+		return "", FileTooLargeError(policy.MaxFileSize)
+	}
+
+	contentType, ok := detectContentType(fileName, head)
+	if !ok {
+		return "", &UploadError{
+			Code:    models.UploadErrorContentMismatch,
+			Message: "ファイルの内容が拡張子と一致しません",
+			Details: map[string]interface{}{"fileName": fileName, "detectedType": contentType},
+		}
+	}
+	if unstrippableImageTypes[contentType] {
+		return "", &UploadError{
+			Code:    models.UploadErrorImageMetadata,
+			Message: "この形式の画像は位置情報などのメタデータを削除できないため、アップロードできません。JPEG、PNG、GIFに変換してください",
+			Details: map[string]interface{}{"fileName": fileName, "contentType": contentType},
+		}
+	}
+
+	if matchesTypePattern(contentType, policy.DeniedTypes) ||
+		(len(policy.AllowedTypes) > 0 && !matchesTypePattern(contentType, policy.AllowedTypes)) {
+		return "", &UploadError{
+			Code:    models.UploadErrorTypeNotAllowed,
+			Message: "このサーバーではこの種類のファイルはアップロードできません",
+			Details: map[string]interface{}{
+				"contentType":  contentType,
+				"allowedTypes": policy.AllowedTypes,
+				"deniedTypes":  policy.DeniedTypes,
+			},
+		}
+	}
+	return contentType, nil
+}
+
+// CheckQuota reports whether size more bytes currently fit in the quotas.
+// It is an early check for long uploads; the quotas are enforced again when
+// the attachment is recorded.
+func (s *UploadPolicyService) CheckQuota(serverId, userId string, size int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return s.checkQuotaTx(tx, serverId, userId, size)
+}
+
+// checkQuotaTx checks that size more bytes fit in the server's and the
+// user's quotas. It takes transaction-scoped locks so concurrent uploads
+// cannot both squeeze into the last free space; the attachment row must be
+// inserted in the same transaction.
+func (s *UploadPolicyService) checkQuotaTx(tx *sql.Tx, serverId, userId string, size int64) error {
+	if serverId != "" {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('upload-quota:server:' || $1))", serverId); err != nil {
+			return err
+		}
+		policy, err := s.GetPolicy(serverId)
+		if err != nil {
+			return err
+		}
+		if policy.StorageQuota > 0 {
+			used, err := serverStorageUsed(tx, serverId)
+			if err != nil {
+				return err
+			}
+			if used+size > policy.StorageQuota {
+				return &UploadError{
+					Code:    models.UploadErrorServerQuotaExceeded,
+					Message: fmt.Sprintf("サーバーのストレージ容量（%s）を超えています", formatByteSize(policy.StorageQuota)),
+					Details: map[string]interface{}{"usedBytes": used, "quotaBytes": policy.StorageQuota},
+				}
+			}
+		}
+	}
+
+	if s.limits.UserQuota > 0 {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('upload-quota:user:' || $1))", userId); err != nil {
+			return err
+		}
+		var used int64
+		if err := tx.QueryRow(
+			"SELECT COALESCE(SUM(file_size), 0) FROM channel_attachments WHERE uploaded_by = $1", userId,
+		).Scan(&used); err != nil {
+			return err
+		}
+		if used+size > s.limits.UserQuota {
+			return &UploadError{
+				Code:    models.UploadErrorUserQuotaExceeded,
+				Message: fmt.Sprintf("アップロードできる容量（%s）を超えています", formatByteSize(s.limits.UserQuota)),
+				Details: map[string]interface{}{"usedBytes": used, "quotaBytes": s.limits.UserQuota},
+			}
+		}
+	}
+	return nil
+}
+
+// queryRower is satisfied by *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func serverStorageUsed(db queryRower, serverId string) (int64, error) {
+	var used int64
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(ca.file_size), 0)
+		FROM channel_attachments ca
+		JOIN channels ch ON ca.channel_id = ch.id
+		WHERE ch.server_id = $1
+	`, serverId).Scan(&used)
+	return used, err
+}
+
+// GetServerUsage reports a server's storage usage and its largest uploaders
+func (s *UploadPolicyService) GetServerUsage(serverId string) (*models.ServerStorageUsage, error) {
+	policy, err := s.GetPolicy(serverId)
+	if err != nil {
+		return nil, err
+	}
+	usage := &models.ServerStorageUsage{
+		StorageUsage: models.StorageUsage{QuotaBytes: policy.StorageQuota},
+		TopUploaders: []models.UserStorageUsage{},
+	}
+
+	rows, err := s.db.Query(`
+		SELECT COALESCE(u.id::text, ''), COALESCE(u.username, ''), SUM(ca.file_size), COUNT(*)
+		FROM channel_attachments ca
+		JOIN channels ch ON ca.channel_id = ch.id
+		LEFT JOIN users u ON ca.uploaded_by = u.id
+		WHERE ch.server_id = $1
+		GROUP BY u.id, u.username
+		ORDER BY SUM(ca.file_size) DESC
+	`, serverId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var uploader models.UserStorageUsage
+		if err := rows.Scan(&uploader.UserId, &uploader.Username, &uploader.UsedBytes, &uploader.AttachmentCount); err != nil {
+			return nil, err
+		}
+		usage.UsedBytes += uploader.UsedBytes
+		usage.AttachmentCount += uploader.AttachmentCount
+		if uploader.UserId != "" && len(usage.TopUploaders) < topUploadersInUsage {
+			usage.TopUploaders = append(usage.TopUploaders, uploader)
+		}
+	}
+	return usage, rows.Err()
+}
+
+// GetUserUsage reports how much storage a user's uploads take across all servers and DMs
+func (s *UploadPolicyService) GetUserUsage(userId string) (*models.StorageUsage, error) {
+	usage := &models.StorageUsage{QuotaBytes: s.limits.UserQuota}
+	err := s.db.QueryRow(
+		"SELECT COALESCE(SUM(file_size), 0), COUNT(*) FROM channel_attachments WHERE uploaded_by = $1", userId,
+	).Scan(&usage.UsedBytes, &usage.AttachmentCount)
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// formatByteSize renders a size for error messages, e.g. "25.0 MB"
+func formatByteSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
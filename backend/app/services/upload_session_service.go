@@ -0,0 +1,520 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+
+	"app/models"
+	"app/storage"
+)
+
+// Errors returned by UploadSessionService
+var (
+	ErrUploadSessionNotFound  = errors.New("upload session not found")
+	ErrUploadOffsetMismatch   = errors.New("upload offset does not match the bytes received so far")
+	ErrUploadChunkTooLarge    = errors.New("chunk extends past the declared file size")
+	ErrUploadIncomplete       = errors.New("upload has not received all of its bytes yet")
+	ErrUploadSessionBusy      = errors.New("upload is already being completed")
+	ErrUploadSessionClosed    = errors.New("upload has already been completed")
+	ErrUploadTargetGone       = errors.New("the channel this upload was for no longer exists")
+	ErrTooManyUploadSessions  = fmt.Errorf("at most %d uploads can be in progress at once", maxActiveUploadSessions)
+	ErrNotUploadMessageAuthor = errors.New("you are not the author of this message")
+)
+
+const (
+	// MaxUploadChunkSize is the largest chunk a single PATCH may carry
+	MaxUploadChunkSize = 16 << 20
+	// uploadSessionTTL is how long a session is kept after its last chunk
+	uploadSessionTTL = 24 * time.Hour
+	// completedUploadRetention keeps completed sessions around so a client
+	// that lost the completion response can still read the attachment ID
+	completedUploadRetention = time.Hour
+	// uploadCompletionLease is how long a replica owns a session it is
+	// completing. A session left 'completing' by a crash can be completed
+	// again afterwards.
+	uploadCompletionLease = 10 * time.Minute
+	// maxActiveUploadSessions bounds the sessions a user can have open
+	maxActiveUploadSessions = 20
+	// uploadSessionGCBatchSize is how many expired sessions one pass removes at most
+	uploadSessionGCBatchSize = 100
+)
+
+// UploadSessionService implements resumable uploads.
+//
+// A client creates a session declaring the file's name, size and channel (or
+// an existing message of theirs to attach it to), sends the
+// bytes in order with PATCH requests, and completes the session, which runs
+// the same checks as a single-request upload and creates the attachment.
+// Each chunk is stored as its own object, so chunks can land on any replica
+// and any storage backend; a chunk only counts once its row is committed.
+// Sessions that are not finished before they expire are garbage-collected.
+type UploadSessionService struct {
+	db                    *sql.DB
+	files                 *storage.Manager
+	channelMessageService *ChannelMessageService
+}
+
+// NewUploadSessionService creates a new UploadSessionService
+func NewUploadSessionService(db *sql.DB, channelMessageService *ChannelMessageService) *UploadSessionService {
+	return &UploadSessionService{
+		db:                    db,
+		files:                 channelMessageService.Files(),
+		channelMessageService: channelMessageService,
+	}
+}
+
+// CreateSession starts a resumable upload. The size and quotas are checked
+// up front so a client does not send gigabytes that are then rejected; the
+// file type is checked on completion, once its content is known.
+func (s *UploadSessionService) CreateSession(userId string, req models.UploadSessionRequest) (*models.UploadSession, error) {
+	if req.MessageId != "" {
+		isAuthor, err := s.channelMessageService.IsMessageAuthor(req.MessageId, userId)
+		if err != nil {
+			return nil, err
+		}
+		if !isAuthor {
+			return nil, ErrNotUploadMessageAuthor
+		}
+	}
+
+	target, err := s.channelMessageService.attachmentTarget(req.ChannelId, req.MessageId)
+	if err != nil {
+		return nil, err
+	}
+	uploads := s.channelMessageService.Uploads()
+	policy, err := uploads.GetPolicy(target.serverId)
+	if err != nil {
+		return nil, err
+	}
+	if req.FileSize > policy.MaxFileSize {
+		return nil, FileTooLargeError(policy.MaxFileSize)
+	}
+	if err := uploads.CheckQuota(target.serverId, userId, req.FileSize); err != nil {
+		return nil, err
+	}
+
+	var active int
+	if err := s.db.QueryRow(
+		"SELECT COUNT(*) FROM upload_sessions WHERE user_id = $1 AND status <> 'completed' AND expires_at > $2",
+		userId, time.Now(),
+	).Scan(&active); err != nil {
+		return nil, err
+	}
+	if active >= maxActiveUploadSessions {
+		return nil, ErrTooManyUploadSessions
+	}
+
+	now := time.Now()
+	session := &models.UploadSession{
+		ID:           uuid.New().String(),
+		UserId:       userId,
+		ChannelId:    target.channelId,
+		MessageId:    target.messageId,
+		FileName:     req.FileName,
+		FileSize:     req.FileSize,
+		Status:       models.UploadSessionActive,
+		MaxChunkSize: MaxUploadChunkSize,
+		ExpiresAt:    now.Add(uploadSessionTTL),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO upload_sessions (id, user_id, channel_id, message_id, file_name, file_size, status, expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, NULLIF($4, '')::uuid, $5, $6, $7, $8, $9, $10)
+	`, session.ID, session.UserId, session.ChannelId, session.MessageId, session.FileName, session.FileSize,
+		session.Status, session.ExpiresAt, session.CreatedAt, session.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// GetSession returns one of the user's upload sessions
+func (s *UploadSessionService) GetSession(id, userId string) (*models.UploadSession, error) {
+	var session models.UploadSession
+	var channelId, messageId, attachmentId sql.NullString
+	err := s.db.QueryRow(`
+		SELECT id, user_id, channel_id, message_id, file_name, file_size, received_bytes, status, attachment_id,
+		       expires_at, created_at, updated_at
+		FROM upload_sessions
+		WHERE id = $1 AND user_id = $2 AND expires_at > $3
+	`, id, userId, time.Now()).Scan(
+		&session.ID, &session.UserId, &channelId, &messageId, &session.FileName, &session.FileSize, &session.ReceivedBytes,
+		&session.Status, &attachmentId, &session.ExpiresAt, &session.CreatedAt, &session.UpdatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUploadSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	session.ChannelId = channelId.String
+	session.MessageId = messageId.String
+	session.AttachmentId = attachmentId.String
+	session.MaxChunkSize = MaxUploadChunkSize
+	return &session, nil
+}
+
+// WriteChunk appends the bytes read from r at offset, which must equal the
+// bytes received so far. A chunk that fails midway is discarded as a whole,
+// so the client resumes from the offset GetSession reports.
+func (s *UploadSessionService) WriteChunk(id, userId string, offset int64, r io.Reader) (*models.UploadSession, error) {
+	session, err := s.GetSession(id, userId)
+	if err != nil {
+		return nil, err
+	}
+	if session.Status != models.UploadSessionActive {
+		return session, ErrUploadSessionClosed
+	}
+	if offset != session.ReceivedBytes {
+		return session, ErrUploadOffsetMismatch
+	}
+
+	// Read at most one byte past the end to detect oversized chunks.
+	// Concurrent writes for the same offset use distinct keys; only one of
+	// them can commit below.
+	remaining := session.FileSize - offset
+	counter := &countingReader{reader: io.LimitReader(r, remaining+1)}
+	ctx := context.Background()
+	key := "upload_sessions/" + id + "/" + strconv.FormatInt(offset, 10) + "-" + uuid.New().String()
+	filePath, err := s.files.Put(ctx, key, counter, -1, "application/octet-stream")
+	if err != nil {
+		return session, fmt.Errorf("failed to store chunk: %v", err)
+	}
+	discard := func() {
+		if err := s.files.Delete(ctx, filePath); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("アップロードチャンク %s の削除エラー: %v", filePath, err)
+		}
+	}
+	if counter.n > remaining {
+		discard()
+		return session, ErrUploadChunkTooLarge
+	}
+	if counter.n == 0 {
+		discard()
+		return session, nil
+	}
+
+	if err := s.commitChunk(session, offset, counter.n, filePath); err != nil {
+		discard()
+		if errors.Is(err, ErrUploadOffsetMismatch) {
+			if current, getErr := s.GetSession(id, userId); getErr == nil {
+				return current, err
+			}
+		}
+		return session, err
+	}
+
+	session.ReceivedBytes += counter.n
+	session.UpdatedAt = time.Now()
+	session.ExpiresAt = session.UpdatedAt.Add(uploadSessionTTL)
+	return session, nil
+}
+
+// commitChunk records a stored chunk if no other chunk was committed at its offset meanwhile
+func (s *UploadSessionService) commitChunk(session *models.UploadSession, offset, size int64, filePath string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	result, err := tx.Exec(`
+		UPDATE upload_sessions
+		SET received_bytes = received_bytes + $1, expires_at = $2, updated_at = $3
+		WHERE id = $4 AND status = 'active' AND received_bytes = $5
+	`, size, now.Add(uploadSessionTTL), now, session.ID, offset)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return ErrUploadOffsetMismatch
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO upload_session_chunks (session_id, chunk_offset, chunk_size, file_path) VALUES ($1, $2, $3, $4)",
+		session.ID, offset, size, filePath,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Complete joins the chunks of a fully received session into an attachment.
+// Completing an already completed session returns it again, so clients can
+// safely retry.
+func (s *UploadSessionService) Complete(id, userId string) (*models.UploadSession, error) {
+	now := time.Now()
+	result, err := s.db.Exec(`
+		UPDATE upload_sessions
+		SET status = 'completing', updated_at = $1
+		WHERE id = $2 AND user_id = $3 AND expires_at > $1 AND received_bytes = file_size
+		  AND (status = 'active' OR (status = 'completing' AND updated_at < $4))
+	`, now, id, userId, now.Add(-uploadCompletionLease))
+	if err != nil {
+		return nil, err
+	}
+	if claimed, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if claimed == 0 {
+		session, err := s.GetSession(id, userId)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case session.Status == models.UploadSessionCompleted:
+			return session, nil
+		case session.Status == models.UploadSessionCompleting:
+			return session, ErrUploadSessionBusy
+		default:
+			return session, ErrUploadIncomplete
+		}
+	}
+
+	session, err := s.GetSession(id, userId)
+	if err != nil {
+		return nil, err
+	}
+	attachmentId, err := s.saveAttachment(session)
+	if err != nil {
+		// Let the client retry or abort
+		if _, resetErr := s.db.Exec(
+			"UPDATE upload_sessions SET status = 'active', updated_at = $1 WHERE id = $2 AND status = 'completing'",
+			time.Now(), id,
+		); resetErr != nil {
+			log.Printf("アップロード %s の状態更新エラー: %v", id, resetErr)
+		}
+		return session, err
+	}
+
+	now = time.Now()
+	if _, err := s.db.Exec(`
+		UPDATE upload_sessions
+		SET status = 'completed', attachment_id = $1, expires_at = $2, updated_at = $3
+		WHERE id = $4
+	`, attachmentId, now.Add(completedUploadRetention), now, id); err != nil {
+		return session, err
+	}
+	s.deleteChunks(id)
+
+	session.Status = models.UploadSessionCompleted
+	session.AttachmentId = attachmentId
+	session.ExpiresAt = now.Add(completedUploadRetention)
+	session.UpdatedAt = now
+	return session, nil
+}
+
+// saveAttachment streams the session's chunks into a new attachment
+func (s *UploadSessionService) saveAttachment(session *models.UploadSession) (string, error) {
+	// A session for a message that was deleted meanwhile becomes an
+	// unposted upload to the message's channel
+	if session.ChannelId == "" && session.MessageId == "" {
+		return "", ErrUploadTargetGone
+	}
+	target, err := s.channelMessageService.attachmentTarget(session.ChannelId, session.MessageId)
+	if err != nil {
+		return "", err
+	}
+
+	chunks, err := s.chunkPaths(session.ID)
+	if err != nil {
+		return "", err
+	}
+	content := &chunkReader{ctx: context.Background(), files: s.files, paths: chunks}
+	defer content.Close()
+
+	buffered := bufio.NewReaderSize(content, sniffLength)
+	head, err := buffered.Peek(sniffLength)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read upload: %w", err)
+	}
+	return s.channelMessageService.saveAttachment(target, session.UserId, session.FileName, session.FileSize, head, buffered)
+}
+
+// Abort cancels an upload and removes its chunks
+func (s *UploadSessionService) Abort(id, userId string) error {
+	result, err := s.db.Exec(
+		"UPDATE upload_sessions SET expires_at = $1 WHERE id = $2 AND user_id = $3 AND status = 'active' AND expires_at > $1",
+		time.Now(), id, userId,
+	)
+	if err != nil {
+		return err
+	}
+	if aborted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if aborted == 0 {
+		session, err := s.GetSession(id, userId)
+		if err != nil {
+			return err
+		}
+		if session.Status == models.UploadSessionCompleting {
+			return ErrUploadSessionBusy
+		}
+		return ErrUploadSessionClosed
+	}
+	return s.removeSession(id)
+}
+
+// StartCleanup periodically removes expired sessions and their chunks
+func (s *UploadSessionService) StartCleanup(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.CleanupExpired(); err != nil {
+				log.Printf("期限切れアップロードの削除エラー: %v", err)
+			}
+		}
+	}()
+}
+
+// CleanupExpired removes expired sessions, leaving ones that are being
+// completed until their completion lease runs out
+func (s *UploadSessionService) CleanupExpired() error {
+	for {
+		now := time.Now()
+		rows, err := s.db.Query(`
+			SELECT id FROM upload_sessions
+			WHERE expires_at <= $1 AND (status <> 'completing' OR updated_at < $2)
+			ORDER BY expires_at
+			LIMIT $3
+		`, now, now.Add(-uploadCompletionLease), uploadSessionGCBatchSize)
+		if err != nil {
+			return err
+		}
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if err := s.removeSession(id); err != nil {
+				return err
+			}
+		}
+		if len(ids) < uploadSessionGCBatchSize {
+			return nil
+		}
+	}
+}
+
+// removeSession deletes a session's chunk files, then its rows. A file whose
+// deletion fails keeps its row so the next pass tries again.
+func (s *UploadSessionService) removeSession(id string) error {
+	if !s.deleteChunks(id) {
+		return nil
+	}
+	_, err := s.db.Exec("DELETE FROM upload_sessions WHERE id = $1", id)
+	return err
+}
+
+// deleteChunks removes a session's chunk files and rows. It reports whether all of them were removed.
+func (s *UploadSessionService) deleteChunks(id string) bool {
+	paths, err := s.chunkPaths(id)
+	if err != nil {
+		log.Printf("アップロード %s のチャンク取得エラー: %v", id, err)
+		return false
+	}
+	ctx := context.Background()
+	for _, filePath := range paths {
+		if err := s.files.Delete(ctx, filePath); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("アップロードチャンク %s の削除エラー: %v", filePath, err)
+			return false
+		}
+		if _, err := s.db.Exec(
+			"DELETE FROM upload_session_chunks WHERE session_id = $1 AND file_path = $2", id, filePath,
+		); err != nil {
+			log.Printf("アップロードチャンク %s の削除エラー: %v", filePath, err)
+			return false
+		}
+	}
+	return true
+}
+
+// chunkPaths lists a session's chunk files in upload order
+func (s *UploadSessionService) chunkPaths(id string) ([]string, error) {
+	rows, err := s.db.Query(
+		"SELECT file_path FROM upload_session_chunks WHERE session_id = $1 ORDER BY chunk_offset",
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var filePath string
+		if err := rows.Scan(&filePath); err != nil {
+			return nil, err
+		}
+		paths = append(paths, filePath)
+	}
+	return paths, rows.Err()
+}
+
+// chunkReader reads stored chunks one after another, opening each only when
+// the previous one is exhausted
+type chunkReader struct {
+	ctx     context.Context
+	files   *storage.Manager
+	paths   []string
+	current io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.paths) == 0 {
+				return 0, io.EOF
+			}
+			reader, err := r.files.Open(r.ctx, r.paths[0])
+			if err != nil {
+				return 0, err
+			}
+			r.current = reader
+			r.paths = r.paths[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Close closes the chunk being read, if any
+func (r *chunkReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
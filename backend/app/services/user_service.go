@@ -5,24 +5,51 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"os"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// ErrUserNotFound is returned when no user has the given ID
+var ErrUserNotFound = errors.New("user not found")
+
 type UserService struct {
-	db *sql.DB
+	db        *sql.DB
+	sessions  *SessionService
+	twoFactor *TwoFactorService
+	tokens    *PersonalAccessTokenService
+	throttle  *LoginThrottleService
+}
+
+func NewUserService(db *sql.DB, sessions *SessionService) *UserService {
+	return &UserService{db: db, sessions: sessions}
 }
 
-func NewUserService(db *sql.DB) *UserService {
-	return &UserService{db: db}
+// SetPersonalAccessTokenService enables authentication with personal access tokens
+func (s *UserService) SetPersonalAccessTokenService(tokens *PersonalAccessTokenService) {
+	s.tokens = tokens
 }
 
-// Register creates a new user in the database
-func (s *UserService) Register(req models.RegisterRequest) (*models.UserResponse, error) {
+// SetLoginThrottleService limits failed logins and registrations
+func (s *UserService) SetLoginThrottleService(throttle *LoginThrottleService) {
+	s.throttle = throttle
+}
+
+// SetTwoFactorService enables the second login step for users with two-factor authentication
+func (s *UserService) SetTwoFactorService(twoFactor *TwoFactorService) {
+	s.twoFactor = twoFactor
+}
+
+// Register creates a new user in the database. The user can log in once
+// their email address has been verified.
+func (s *UserService) Register(req models.RegisterRequest, client models.SessionClient) (*models.RegisterResponse, error) {
+	if s.throttle != nil {
+		if err := s.throttle.CheckRegistration(client.IPAddress); err != nil {
+			return nil, err
+		}
+	}
+
 	// Check if user with email already exists
 	var count int
 	err := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE email = $1", req.Email).Scan(&count)
@@ -61,36 +88,38 @@ func (s *UserService) Register(req models.RegisterRequest) (*models.UserResponse
 		return nil, fmt.Errorf("error creating user: %w", err)
 	}
 
-	// Generate JWT token
-	token, err := s.generateToken(userID)
-	if err != nil {
-		return nil, fmt.Errorf("error generating token: %w", err)
-	}
-
 	// Return user response
-	return &models.UserResponse{
-		ID:        userID,
-		Username:  req.Username,
-		Email:     req.Email,
-		CreatedAt: now,
-		Token:     token,
+	return &models.RegisterResponse{
+		ID:                   userID,
+		Username:             req.Username,
+		Email:                req.Email,
+		CreatedAt:            now,
+		VerificationRequired: true,
 	}, nil
 }
 
-// Login authenticates a user and returns a JWT token
-func (s *UserService) Login(req models.LoginRequest) (*models.UserResponse, error) {
+// Login authenticates a user and starts a session. For users with
+// two-factor authentication it returns a challenge instead, to be completed
+// with CompleteTwoFactorLogin.
+func (s *UserService) Login(req models.LoginRequest, client models.SessionClient) (*models.LoginResponse, error) {
+	if s.throttle != nil {
+		if err := s.throttle.CheckLogin(req.Email, client.IPAddress); err != nil {
+			return nil, err
+		}
+	}
+
 	var user models.User
 	var hashedPassword string
 
 	// Find user by email
 	err := s.db.QueryRow(
-		"SELECT id, username, email, password, created_at, updated_at FROM users WHERE email = $1",
+		"SELECT id, username, email, password, created_at, updated_at, email_verified_at IS NOT NULL FROM users WHERE email = $1",
 		req.Email,
-	).Scan(&user.ID, &user.Username, &user.Email, &hashedPassword, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.Username, &user.Email, &hashedPassword, &user.CreatedAt, &user.UpdatedAt, &user.EmailVerified)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, errors.New("invalid email or password")
+			return nil, s.loginFailed(req.Email, client, nil)
 		}
 		return nil, fmt.Errorf("error finding user: %w", err)
 	}
@@ -98,22 +127,138 @@ func (s *UserService) Login(req models.LoginRequest) (*models.UserResponse, erro
 	// Verify password
 	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(req.Password))
 	if err != nil {
-		return nil, errors.New("invalid email or password")
+		return nil, s.loginFailed(req.Email, client, &user)
+	}
+	// With two-factor authentication the account's failures are only
+	// forgotten once the second factor is checked, so a challenge doesn't
+	// give a fresh set of guesses at the code
+	if s.throttle != nil {
+		twoFactorEnabled, err := s.twoFactorEnabled(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !twoFactorEnabled {
+			if err := s.throttle.LoginSucceeded(req.Email); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	// Generate JWT token
-	token, err := s.generateToken(user.ID)
+	// Only after the password matched, so this doesn't reveal which addresses are registered
+	if !user.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+
+	return s.beginLogin(&user, client)
+}
+
+// loginFailed records a failed password login and returns its error
+func (s *UserService) loginFailed(email string, client models.SessionClient, user *models.User) error {
+	if s.throttle != nil {
+		if err := s.throttle.LoginFailed(email, client.IPAddress, user); err != nil {
+			return err
+		}
+	}
+	return errors.New("invalid email or password")
+}
+
+// LoginUser starts a login for a user who authenticated some other way,
+// such as through an identity provider. Two-factor authentication still
+// applies.
+func (s *UserService) LoginUser(userID string, client models.SessionClient) (*models.LoginResponse, error) {
+	user, err := s.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.beginLogin(user, client)
+}
+
+// beginLogin starts a session for an authenticated user, or returns a
+// two-factor challenge if they have two-factor authentication enabled
+func (s *UserService) beginLogin(user *models.User, client models.SessionClient) (*models.LoginResponse, error) {
+	enabled, err := s.twoFactorEnabled(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		token, expiresAt, err := s.twoFactor.CreateLoginChallenge(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		return &models.LoginResponse{
+			TwoFactorRequired:  true,
+			ChallengeToken:     token,
+			ChallengeExpiresAt: &expiresAt,
+		}, nil
+	}
+
+	response, err := s.startSession(user, client)
 	if err != nil {
-		return nil, fmt.Errorf("error generating token: %w", err)
+		return nil, err
+	}
+	return &models.LoginResponse{UserResponse: response}, nil
+}
+
+// CompleteTwoFactorLogin finishes a login with the challenge token from
+// Login and a TOTP code or a recovery code
+func (s *UserService) CompleteTwoFactorLogin(challengeToken, code string, client models.SessionClient) (*models.UserResponse, error) {
+	if s.twoFactor == nil {
+		return nil, ErrInvalidLoginChallenge
+	}
+	userID, err := s.twoFactor.LoginChallengeUser(challengeToken)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wrong codes count against the account like wrong passwords
+	if s.throttle != nil {
+		if err := s.throttle.CheckLogin(user.Email, client.IPAddress); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := s.twoFactor.CompleteLoginChallenge(challengeToken, code); err != nil {
+		if s.throttle != nil && err == ErrInvalidTwoFactorCode {
+			if err := s.throttle.LoginFailed(user.Email, client.IPAddress, user); err != nil {
+				return nil, err
+			}
+		}
+		return nil, err
+	}
+	if s.throttle != nil {
+		if err := s.throttle.LoginSucceeded(user.Email); err != nil {
+			return nil, err
+		}
+	}
+	return s.startSession(user, client)
+}
+
+// twoFactorEnabled reports whether logging in as the user needs a second factor
+func (s *UserService) twoFactorEnabled(userID string) (bool, error) {
+	if s.twoFactor == nil {
+		return false, nil
+	}
+	return s.twoFactor.IsEnabled(userID)
+}
+
+// startSession starts a session for an authenticated user
+func (s *UserService) startSession(user *models.User, client models.SessionClient) (*models.UserResponse, error) {
+	tokens, err := s.sessions.CreateSession(user.ID, client)
+	if err != nil {
+		return nil, err
 	}
 
 	// Return user response
 	return &models.UserResponse{
-		ID:        user.ID,
-		Username:  user.Username,
-		Email:     user.Email,
-		CreatedAt: user.CreatedAt,
-		Token:     token,
+		ID:         user.ID,
+		Username:   user.Username,
+		Email:      user.Email,
+		CreatedAt:  user.CreatedAt,
+		AuthTokens: *tokens,
 	}, nil
 }
 
@@ -122,13 +267,13 @@ func (s *UserService) GetUserByID(userID string) (*models.User, error) {
 	var user models.User
 
 	err := s.db.QueryRow(
-		"SELECT id, username, email, created_at, updated_at FROM users WHERE id = $1",
+		"SELECT id, username, email, created_at, updated_at, email_verified_at IS NOT NULL FROM users WHERE id = $1",
 		userID,
-	).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.EmailVerified)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, errors.New("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, fmt.Errorf("error finding user: %w", err)
 	}
@@ -136,96 +281,56 @@ func (s *UserService) GetUserByID(userID string) (*models.User, error) {
 	return &user, nil
 }
 
-// ValidateToken validates a JWT token and returns the user ID
+// ValidateToken validates an access token and returns the user ID
 func (s *UserService) ValidateToken(tokenString string) (string, error) {
-	// Parse the token
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Validate the signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-
-		// Return the secret key
-		jwtSecret := os.Getenv("JWT_SECRET")
-		if jwtSecret == "" {
-			return nil, errors.New("JWT_SECRET is not set")
-		}
-		return []byte(jwtSecret), nil
-	})
-
+	claims, err := s.sessions.ValidateAccessToken(tokenString)
 	if err != nil {
 		return "", err
 	}
+	return claims.UserID, nil
+}
 
-	// Validate the token
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		userID, ok := claims["userID"].(string)
-		if !ok {
-			return "", errors.New("invalid token claims")
-		}
-		return userID, nil
-	}
-
-	return "", errors.New("invalid token")
+// ValidateAccessToken validates an access token and returns its user and session
+func (s *UserService) ValidateAccessToken(tokenString string) (*AccessClaims, error) {
+	return s.sessions.ValidateAccessToken(tokenString)
 }
 
-// generateToken generates a new JWT token for the given user ID
-func (s *UserService) generateToken(userID string) (string, error) {
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		return "", errors.New("JWT_SECRET is not set")
+// ValidatePersonalAccessToken validates a personal access token and returns its user and scopes
+func (s *UserService) ValidatePersonalAccessToken(token, ipAddress string) (*TokenAuth, error) {
+	if s.tokens == nil {
+		return nil, ErrInvalidPersonalAccessToken
 	}
+	return s.tokens.ValidateToken(token, ipAddress)
+}
 
-	// Create token claims
-	claims := jwt.MapClaims{
-		"userID": userID,
-		"exp":    time.Now().Add(time.Hour * 24 * 7).Unix(), // Token valid for 7 days
+// IsAdmin reports whether the user is a site administrator
+func (s *UserService) IsAdmin(userID string) (bool, error) {
+	var isAdmin bool
+	err := s.db.QueryRow("SELECT is_admin FROM users WHERE id = $1", userID).Scan(&isAdmin)
+	if err == sql.ErrNoRows {
+		return false, nil
 	}
-
-	// Create token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// Sign token with secret key
-	tokenString, err := token.SignedString([]byte(jwtSecret))
 	if err != nil {
-		return "", err
+		return false, fmt.Errorf("error checking admin flag: %w", err)
 	}
-
-	return tokenString, nil
+	return isAdmin, nil
 }
 
-// SearchUsers searches for users by username or email
-func (s *UserService) SearchUsers(query string, currentUserID string) ([]models.User, error) {
-	// Use LIKE query to search for users by username or email
-	rows, err := s.db.Query(`
-		SELECT id, username, email, created_at, updated_at 
-		FROM users 
-		WHERE (username ILIKE $1 OR email ILIKE $1) AND id != $2
-		LIMIT 10
-	`, "%"+query+"%", currentUserID)
-
+// GetUserIDByEmail looks up a user's ID by email address
+func (s *UserService) GetUserIDByEmail(email string) (string, error) {
+	var userID string
+	err := s.db.QueryRow("SELECT id FROM users WHERE LOWER(email) = LOWER($1)", email).Scan(&userID)
 	if err != nil {
-		return nil, fmt.Errorf("error searching users: %w", err)
-	}
-	defer rows.Close()
-
-	var users []models.User
-	for rows.Next() {
-		var user models.User
-		var createdAt, updatedAt time.Time
-
-		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &createdAt, &updatedAt); err != nil {
-			return nil, fmt.Errorf("error scanning user row: %w", err)
+		if err == sql.ErrNoRows {
+			return "", errors.New("user not found")
 		}
-
-		user.CreatedAt = createdAt
-		user.UpdatedAt = updatedAt
-		users = append(users, user)
-	}
-
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating user rows: %w", err)
+		return "", fmt.Errorf("error finding user: %w", err)
 	}
+	return userID, nil
+}
 
-	return users, nil
+// SetAdmin grants or revokes site administrator rights
+func (s *UserService) SetAdmin(userID string, isAdmin bool) error {
+	_, err := s.db.Exec("UPDATE users SET is_admin = $1, updated_at = $2 WHERE id = $3", isAdmin, time.Now(), userID)
+	return err
 }
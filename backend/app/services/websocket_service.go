@@ -135,6 +135,133 @@ func (s *WebSocketService) BroadcastMessageDelete(channelID string, messageID st
 	return s.broadcastMessage(channelID, wsMessage)
 }
 
+// BroadcastChannelUpdate はチャンネル情報（トピックなど）の更新をブロードキャストする
+func (s *WebSocketService) BroadcastChannelUpdate(channelID string, channel interface{}) error {
+	wsMessage := models.WebSocketMessage{
+		Type:      "channel_update",
+		Message:   channel,
+		Timestamp: time.Now(),
+	}
+
+	return s.broadcastMessage(channelID, wsMessage)
+}
+
+// BroadcastMessagePin はメッセージのピン留めをブロードキャストする
+func (s *WebSocketService) BroadcastMessagePin(channelID string, messageID string, pinned bool) error {
+	messageType := "message_pin"
+	if !pinned {
+		messageType = "message_unpin"
+	}
+
+	wsMessage := models.WebSocketMessage{
+		Type:      messageType,
+		MessageID: messageID,
+		Timestamp: time.Now(),
+	}
+
+	return s.broadcastMessage(channelID, wsMessage)
+}
+
+// BroadcastProfileUpdate はユーザーのプロフィール変更を、そのユーザーが参加している
+// チャンネルに接続中のクライアントへ送信する
+func (s *WebSocketService) BroadcastProfileUpdate(channelIDs []string, profile interface{}) error {
+	messageBytes, err := json.Marshal(models.WebSocketMessage{
+		Type:      "profile_update",
+		Message:   profile,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("メッセージのJSONへの変換に失敗しました: %w", err)
+	}
+
+	s.Hub.Mutex.RLock()
+	defer s.Hub.Mutex.RUnlock()
+
+	for _, channelID := range channelIDs {
+		for _, client := range s.Hub.Channels[channelID] {
+			select {
+			case client.Send <- messageBytes:
+			default:
+				log.Printf("クライアント %s へのプロフィール更新の送信に失敗しました", client.ID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// SendEphemeral はチャンネルに接続している特定ユーザーのクライアントにのみメッセージを送信する
+func (s *WebSocketService) SendEphemeral(channelID string, userID string, message interface{}) error {
+	wsMessage := models.WebSocketMessage{
+		Type:      "ephemeral",
+		Message:   message,
+		Timestamp: time.Now(),
+	}
+
+	messageBytes, err := json.Marshal(wsMessage)
+	if err != nil {
+		return fmt.Errorf("メッセージのJSONへの変換に失敗しました: %w", err)
+	}
+
+	s.Hub.Mutex.RLock()
+	defer s.Hub.Mutex.RUnlock()
+
+	for _, client := range s.Hub.Channels[channelID] {
+		if client.UserID != userID {
+			continue
+		}
+		select {
+		case client.Send <- messageBytes:
+		default:
+			log.Printf("クライアント %s への一時メッセージの送信に失敗しました", client.ID)
+		}
+	}
+
+	return nil
+}
+
+// DisconnectSessions は指定したログインセッションのクライアントに
+// session_revoked を送ってから切断する
+func (s *WebSocketService) DisconnectSessions(sessionIDs ...string) {
+	revoked := make(map[string]bool, len(sessionIDs))
+	for _, id := range sessionIDs {
+		revoked[id] = true
+	}
+
+	messageBytes, err := json.Marshal(models.WebSocketMessage{
+		Type:      "session_revoked",
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		log.Printf("セッション失効メッセージのJSONへの変換に失敗しました: %v", err)
+		return
+	}
+
+	var clients []*models.WebSocketClient
+	s.Hub.Mutex.RLock()
+	for _, channelClients := range s.Hub.Channels {
+		for _, client := range channelClients {
+			if !revoked[client.SessionID] {
+				continue
+			}
+			select {
+			case client.Send <- messageBytes:
+			default:
+			}
+			clients = append(clients, client)
+		}
+	}
+	s.Hub.Mutex.RUnlock()
+
+	// 登録解除でSendが閉じられ、writePumpがクローズフレームを送って接続を閉じる
+	for _, client := range clients {
+		s.Hub.Unregister <- client
+	}
+	if len(clients) > 0 {
+		log.Printf("失効したセッションのWebSocket接続を %d 件切断しました", len(clients))
+	}
+}
+
 // broadcastMessage はメッセージをブロードキャストする
 func (s *WebSocketService) broadcastMessage(channelID string, message models.WebSocketMessage) error {
 	// メッセージをJSONに変換
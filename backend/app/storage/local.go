@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Local stores files in a directory on the local filesystem
+type Local struct {
+	root string
+}
+
+// NewLocal creates a local backend rooted at dir
+func NewLocal(dir string) *Local {
+	return &Local{root: filepath.Clean(dir)}
+}
+
+// Name implements Storage
+func (l *Local) Name() string {
+	return "local"
+}
+
+// path maps a key to a file below the root, rejecting keys that escape it
+func (l *Local) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || clean != "/"+key {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	return filepath.Join(l.root, filepath.FromSlash(clean[1:])), nil
+}
+
+// Put implements Storage. The file is written under a temporary name and
+// renamed so readers never see a partial file.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	filePath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("failed to create uploads directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+// Get implements Storage. The returned reader is an *os.File, so callers can seek it.
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	filePath, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+// Delete implements Storage
+func (l *Local) Delete(ctx context.Context, key string) error {
+	filePath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Stat implements Storage
+func (l *Local) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	filePath, err := l.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:         key,
+		Size:        info.Size(),
+		ContentType: mime.TypeByExtension(filepath.Ext(key)),
+		ModTime:     info.ModTime(),
+	}, nil
+}
+
+// Presign implements Storage. Local files are always served by the API.
+func (l *Local) Presign(ctx context.Context, key string, expires time.Duration, opts PresignOptions) (string, error) {
+	return "", ErrPresignUnsupported
+}
+
+// Locator implements Storage. Locators are slash-separated paths including
+// the root, e.g. "uploads/channel_attachments/<id>.png".
+func (l *Local) Locator(key string) string {
+	return filepath.ToSlash(filepath.Join(l.root, filepath.FromSlash(key)))
+}
+
+// Key implements Storage
+func (l *Local) Key(locator string) (string, bool) {
+	if strings.Contains(locator, "://") {
+		return "", false
+	}
+	root := filepath.ToSlash(l.root) + "/"
+	clean := path.Clean(filepath.ToSlash(locator))
+	if !strings.HasPrefix(clean, root) {
+		return "", false
+	}
+	return strings.TrimPrefix(clean, root), true
+}
@@ -0,0 +1,222 @@
+// Package storage stores uploaded files on local disk or in an S3-compatible
+// object store.
+//
+// Files are addressed by a key such as "channel_attachments/<id>.png". What
+// the database keeps in file_path is a locator: the key qualified by the
+// backend that holds it. Local locators are plain relative paths
+// ("uploads/channel_attachments/<id>.png", the format used before this
+// package existed) and S3 locators are "s3://<bucket>/<key>", so rows written
+// by either backend can always be read back.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Errors returned by storage backends
+var (
+	ErrNotFound           = errors.New("storage: object not found")
+	ErrPresignUnsupported = errors.New("storage: backend does not support presigned URLs")
+	ErrUnknownLocator     = errors.New("storage: no configured backend holds this file")
+)
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// PresignOptions customise a presigned download URL
+type PresignOptions struct {
+	// ContentDisposition overrides the Content-Disposition header of the response
+	ContentDisposition string
+}
+
+// Storage is a backend that holds uploaded files
+type Storage interface {
+	// Name identifies the backend: "local" or "s3"
+	Name() string
+	// Put stores the content of r under key. size may be -1 when unknown.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the object stored under key
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+	// Stat returns information about the object
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// Presign returns a URL that downloads the object without further
+	// authentication until it expires, or ErrPresignUnsupported
+	Presign(ctx context.Context, key string, expires time.Duration, opts PresignOptions) (string, error)
+	// Locator returns the value stored in file_path for key
+	Locator(key string) string
+	// Key returns the key a locator refers to and whether this backend holds it
+	Key(locator string) (string, bool)
+}
+
+// Manager writes new files to the primary backend and reads existing files
+// from whichever configured backend holds them
+type Manager struct {
+	primary  Storage
+	backends []Storage
+}
+
+// NewManager creates a manager. Files are written to primary; others are
+// only read, e.g. the local disk while its files are migrated to S3.
+func NewManager(primary Storage, others ...Storage) *Manager {
+	return &Manager{
+		primary:  primary,
+		backends: append([]Storage{primary}, others...),
+	}
+}
+
+// Primary returns the backend new files are written to
+func (m *Manager) Primary() Storage {
+	return m.primary
+}
+
+// Backend returns the configured backend with the given name
+func (m *Manager) Backend(name string) (Storage, bool) {
+	for _, backend := range m.backends {
+		if backend.Name() == name {
+			return backend, true
+		}
+	}
+	return nil, false
+}
+
+// Resolve finds the backend holding a locator and the key within it
+func (m *Manager) Resolve(locator string) (Storage, string, error) {
+	for _, backend := range m.backends {
+		if key, ok := backend.Key(locator); ok {
+			return backend, key, nil
+		}
+	}
+	return nil, "", fmt.Errorf("%w: %s", ErrUnknownLocator, locator)
+}
+
+// Put stores a new file in the primary backend and returns its locator
+func (m *Manager) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error) {
+	if err := m.primary.Put(ctx, key, r, size, contentType); err != nil {
+		return "", err
+	}
+	return m.primary.Locator(key), nil
+}
+
+// Open opens the file a locator refers to
+func (m *Manager) Open(ctx context.Context, locator string) (io.ReadCloser, error) {
+	backend, key, err := m.Resolve(locator)
+	if err != nil {
+		return nil, err
+	}
+	return backend.Get(ctx, key)
+}
+
+// Stat returns information about the file a locator refers to
+func (m *Manager) Stat(ctx context.Context, locator string) (ObjectInfo, error) {
+	backend, key, err := m.Resolve(locator)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return backend.Stat(ctx, key)
+}
+
+// Delete removes the file a locator refers to
+func (m *Manager) Delete(ctx context.Context, locator string) error {
+	backend, key, err := m.Resolve(locator)
+	if err != nil {
+		return err
+	}
+	return backend.Delete(ctx, key)
+}
+
+// Presign returns a presigned download URL for the file a locator refers to
+func (m *Manager) Presign(ctx context.Context, locator string, expires time.Duration, opts PresignOptions) (string, error) {
+	backend, key, err := m.Resolve(locator)
+	if err != nil {
+		return "", err
+	}
+	return backend.Presign(ctx, key, expires, opts)
+}
+
+// DefaultLocalRoot is where the local backend keeps files unless STORAGE_LOCAL_ROOT is set
+const DefaultLocalRoot = "./uploads"
+
+// FromEnv builds a manager from the environment:
+//
+//	STORAGE_BACKEND       local (default) or s3
+//	STORAGE_LOCAL_ROOT    directory of the local backend (default ./uploads)
+//	S3_ENDPOINT           e.g. http://minio:9000; defaults to AWS
+//	S3_REGION             default us-east-1
+//	S3_BUCKET             required for s3
+//	S3_ACCESS_KEY_ID      required for s3
+//	S3_SECRET_ACCESS_KEY  required for s3
+//	S3_PREFIX             optional key prefix inside the bucket
+//	S3_FORCE_PATH_STYLE   true for MinIO; defaults to true when S3_ENDPOINT is set
+//
+// The local backend is always configured so files written before a switch
+// to S3 stay readable until they are migrated.
+func FromEnv() (*Manager, error) {
+	root := os.Getenv("STORAGE_LOCAL_ROOT")
+	if root == "" {
+		root = DefaultLocalRoot
+	}
+	local := NewLocal(root)
+
+	backend := strings.ToLower(os.Getenv("STORAGE_BACKEND"))
+	switch backend {
+	case "", "local":
+		s3, err := s3FromEnv(false)
+		if err != nil {
+			return nil, err
+		}
+		if s3 != nil {
+			return NewManager(local, s3), nil
+		}
+		return NewManager(local), nil
+	case "s3":
+		s3, err := s3FromEnv(true)
+		if err != nil {
+			return nil, err
+		}
+		return NewManager(s3, local), nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+}
+
+// s3FromEnv builds the S3 backend if it is configured. When required is
+// false an unconfigured backend is not an error, so `local` deployments can
+// still read files migrated back from S3.
+func s3FromEnv(required bool) (*S3, error) {
+	config := S3Config{
+		Endpoint:        os.Getenv("S3_ENDPOINT"),
+		Region:          os.Getenv("S3_REGION"),
+		Bucket:          os.Getenv("S3_BUCKET"),
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		Prefix:          os.Getenv("S3_PREFIX"),
+		ForcePathStyle:  envBool(os.Getenv("S3_FORCE_PATH_STYLE"), os.Getenv("S3_ENDPOINT") != ""),
+	}
+	if config.Bucket == "" && !required {
+		return nil, nil
+	}
+	return NewS3(config)
+}
+
+func envBool(value string, fallback bool) bool {
+	switch strings.ToLower(value) {
+	case "1", "true", "yes":
+		return true
+	case "0", "false", "no":
+		return false
+	}
+	return fallback
+}
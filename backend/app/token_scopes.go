@@ -0,0 +1,79 @@
+package main
+
+import "app/models"
+
+// tokenRouteScopes maps "METHOD /route" to the scope a personal access token
+// needs to call it. Routes that aren't listed can only be used with a
+// session, so new endpoints stay closed to tokens until they're added here.
+var tokenRouteScopes = map[string]string{
+	// メッセージの閲覧
+	"GET /api/channel-messages/:id":             models.ScopeMessagesRead,
+	"GET /api/channel-messages/:id/revisions":   models.ScopeMessagesRead,
+	"GET /api/channel-messages/attachments/:id": models.ScopeMessagesRead,
+	"GET /api/channels/:id/messages":            models.ScopeMessagesRead,
+	"GET /api/channels/attachments/:id":         models.ScopeMessagesRead,
+	"GET /api/channels/:id/pins":                models.ScopeMessagesRead,
+	"GET /api/dms/:id/messages":                 models.ScopeMessagesRead,
+	"GET /api/polls/:id":                        models.ScopeMessagesRead,
+	"GET /api/scheduled-messages":               models.ScopeMessagesRead,
+	"POST /api/attachments/:id/url":             models.ScopeMessagesRead,
+
+	// メッセージの送信・編集・削除
+	"POST /api/channel-messages/:id":            models.ScopeMessagesWrite,
+	"PUT /api/channel-messages/:id":             models.ScopeMessagesWrite,
+	"DELETE /api/channel-messages/:id":          models.ScopeMessagesWrite,
+	"POST /api/channel-messages/attachments":    models.ScopeMessagesWrite,
+	"POST /api/channels/:id/messages":           models.ScopeMessagesWrite,
+	"PUT /api/channels/messages/:id":            models.ScopeMessagesWrite,
+	"DELETE /api/channels/messages/:id":         models.ScopeMessagesWrite,
+	"POST /api/channels/:id/upload":             models.ScopeMessagesWrite,
+	"POST /api/channels/:id/attachments":        models.ScopeMessagesWrite,
+	"POST /api/channels/:id/polls":              models.ScopeMessagesWrite,
+	"POST /api/channels/:id/scheduled-messages": models.ScopeMessagesWrite,
+	"POST /api/channels/:id/pins/:messageId":    models.ScopeMessagesWrite,
+	"DELETE /api/channels/:id/pins/:messageId":  models.ScopeMessagesWrite,
+	"POST /api/dms/:id/messages":                models.ScopeMessagesWrite,
+	"POST /api/dms/:id/attachments":             models.ScopeMessagesWrite,
+	"POST /api/dms/:id/scheduled-messages":      models.ScopeMessagesWrite,
+	"POST /api/polls/:id/votes":                 models.ScopeMessagesWrite,
+	"DELETE /api/polls/:id/votes":               models.ScopeMessagesWrite,
+	"PUT /api/scheduled-messages/:id":           models.ScopeMessagesWrite,
+	"DELETE /api/scheduled-messages/:id":        models.ScopeMessagesWrite,
+	"POST /api/uploads":                         models.ScopeMessagesWrite,
+	"GET /api/uploads/:id":                      models.ScopeMessagesWrite,
+	"HEAD /api/uploads/:id":                     models.ScopeMessagesWrite,
+	"PATCH /api/uploads/:id":                    models.ScopeMessagesWrite,
+	"POST /api/uploads/:id/complete":            models.ScopeMessagesWrite,
+	"DELETE /api/uploads/:id":                   models.ScopeMessagesWrite,
+
+	// サーバー・チャンネル・DMの閲覧
+	"GET /api/servers":                models.ScopeChannelsRead,
+	"GET /api/servers/:id/channels":   models.ScopeChannelsRead,
+	"GET /api/servers/:id/categories": models.ScopeChannelsRead,
+	"GET /api/channels/:id":           models.ScopeChannelsRead,
+	"GET /api/channels/:id/commands":  models.ScopeChannelsRead,
+	"GET /api/dms":                    models.ScopeChannelsRead,
+	"GET /api/dms/:id":                models.ScopeChannelsRead,
+
+	// チャンネルの管理
+	"POST /api/servers/:id/channels":   models.ScopeChannelsWrite,
+	"POST /api/servers/:id/categories": models.ScopeChannelsWrite,
+	"PUT /api/channels/:id/topic":      models.ScopeChannelsWrite,
+	"POST /api/channels/:id/members":   models.ScopeChannelsWrite,
+	"POST /api/channels/:id/category":  models.ScopeChannelsWrite,
+	"DELETE /api/channels/:id":         models.ScopeChannelsWrite,
+
+	// AIチャット
+	"GET /api/chats":                  models.ScopeChatsRead,
+	"GET /api/chats/:id":              models.ScopeChatsRead,
+	"POST /api/chats":                 models.ScopeChatsWrite,
+	"POST /api/chats/:id/messages":    models.ScopeChatsWrite,
+	"PUT /api/messages/:messageId":    models.ScopeChatsWrite,
+	"DELETE /api/messages/:messageId": models.ScopeChatsWrite,
+
+	// ユーザー情報
+	"GET /api/auth/me":   models.ScopeUsersRead,
+	"GET /api/users/me":  models.ScopeUsersRead,
+	"GET /api/users/:id": models.ScopeUsersRead,
+	"GET /api/users":     models.ScopeUsersRead,
+}
@@ -1,6 +1,6 @@
 'use client';
 
-import { useState } from 'react';
+import { useEffect, useState } from 'react';
 import { useRouter } from 'next/navigation';
 import Link from 'next/link';
 import { useAuth } from '@/context/AuthContext';
@@ -10,8 +10,38 @@ export default function LoginPage() {
   const [password, setPassword] = useState('');
   const [error, setError] = useState('');
   const [isLoading, setIsLoading] = useState(false);
+  const [resendMessage, setResendMessage] = useState('');
+  const [code, setCode] = useState('');
+  const [useRecoveryCode, setUseRecoveryCode] = useState(false);
   const router = useRouter();
-  const { login } = useAuth();
+  const [providers, setProviders] = useState<{ id: string; name: string }[]>([]);
+  const [passwordLoginEnabled, setPasswordLoginEnabled] = useState(true);
+  const { login, twoFactorChallenge, completeTwoFactorLogin, cancelTwoFactorLogin, loginWithProvider } = useAuth();
+
+  // 利用できるログイン方法（パスワード、外部IDプロバイダー）を取得する
+  useEffect(() => {
+    const apiUrl = process.env.NEXT_PUBLIC_API_URL || 'http://localhost:3000';
+    fetch(`${apiUrl}/api/auth/methods`)
+      .then((response) => (response.ok ? response.json() : null))
+      .then((data) => {
+        if (data) {
+          setProviders(data.providers || []);
+          setPasswordLoginEnabled(data.passwordLoginEnabled);
+        }
+      })
+      .catch((err) => console.error('ログイン方法の取得エラー:', err));
+  }, []);
+
+  const handleProviderLogin = async (providerId: string) => {
+    setError('');
+    setIsLoading(true);
+    try {
+      await loginWithProvider(providerId);
+    } catch (err) {
+      setError(err instanceof Error ? err.message : 'ログインに失敗しました');
+      setIsLoading(false);
+    }
+  };
 
   const handleSubmit = async (e: React.FormEvent) => {
     e.preventDefault();
@@ -42,6 +72,117 @@ export default function LoginPage() {
     }
   };
 
+  // 2段階認証のコードでログインを完了する
+  const handleTwoFactorSubmit = async (e: React.FormEvent) => {
+    e.preventDefault();
+    setError('');
+    setIsLoading(true);
+
+    try {
+      await completeTwoFactorLogin(code.trim(), useRecoveryCode);
+    } catch (err) {
+      console.error('2段階認証エラー:', err);
+      setError(err instanceof Error ? err.message : 'ログインに失敗しました');
+      setCode('');
+    } finally {
+      setIsLoading(false);
+    }
+  };
+
+  // 確認メールを再送する
+  const handleResendVerification = async () => {
+    const apiUrl = process.env.NEXT_PUBLIC_API_URL || 'http://localhost:3000';
+    try {
+      await fetch(`${apiUrl}/api/auth/verify-email/resend`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ email }),
+      });
+      setResendMessage('確認メールを再送しました。');
+    } catch (err) {
+      console.error('確認メールの再送エラー:', err);
+      setResendMessage('確認メールの再送に失敗しました。');
+    }
+  };
+
+  if (twoFactorChallenge) {
+    return (
+      <div className="min-h-screen bg-gray-100 flex flex-col pt-20 sm:px-6 lg:px-8">
+        <div className="sm:mx-auto sm:w-full sm:max-w-md">
+          <h2 className="text-center text-3xl font-extrabold text-gray-900">
+            2段階認証
+          </h2>
+        </div>
+
+        <div className="mt-8 sm:mx-auto sm:w-full sm:max-w-md">
+          <div className="bg-white py-8 px-4 shadow sm:rounded-lg sm:px-10">
+            <form className="space-y-6" onSubmit={handleTwoFactorSubmit}>
+              <div>
+                <label htmlFor="code" className="block text-sm font-medium text-gray-700">
+                  {useRecoveryCode ? 'リカバリーコード' : '認証アプリに表示されている6桁のコード'}
+                </label>
+                <div className="mt-1">
+                  <input
+                    id="code"
+                    name="code"
+                    type="text"
+                    inputMode={useRecoveryCode ? 'text' : 'numeric'}
+                    autoComplete="one-time-code"
+                    autoFocus
+                    required
+                    value={code}
+                    onChange={(e) => setCode(e.target.value)}
+                    className="appearance-none block w-full px-3 py-2 border border-gray-300 rounded-md shadow-sm placeholder-gray-400 focus:outline-none focus:ring-indigo-500 focus:border-indigo-500 sm:text-sm"
+                  />
+                </div>
+              </div>
+
+              {error && (
+                <div className="text-red-600 text-sm">
+                  {error}
+                </div>
+              )}
+
+              <div className="flex justify-between text-sm">
+                <button
+                  type="button"
+                  onClick={() => {
+                    setUseRecoveryCode(!useRecoveryCode);
+                    setCode('');
+                  }}
+                  className="text-indigo-600 hover:text-indigo-500"
+                >
+                  {useRecoveryCode ? '認証アプリのコードを使う' : 'リカバリーコードを使う'}
+                </button>
+                <button
+                  type="button"
+                  onClick={() => {
+                    cancelTwoFactorLogin();
+                    setCode('');
+                    setError('');
+                  }}
+                  className="text-gray-600 hover:text-gray-500"
+                >
+                  キャンセル
+                </button>
+              </div>
+
+              <div>
+                <button
+                  type="submit"
+                  disabled={isLoading}
+                  className="w-full flex justify-center py-2 px-4 border border-transparent rounded-md shadow-sm text-sm font-medium text-white bg-indigo-600 hover:bg-indigo-700 focus:outline-none focus:ring-2 focus:ring-offset-2 focus:ring-indigo-500 disabled:bg-indigo-300"
+                >
+                  {isLoading ? '確認中...' : '確認'}
+                </button>
+              </div>
+            </form>
+          </div>
+        </div>
+      </div>
+    );
+  }
+
   return (
     <div className="min-h-screen bg-gray-100 flex flex-col pt-20 sm:px-6 lg:px-8">
       <div className="sm:mx-auto sm:w-full sm:max-w-md">
@@ -52,7 +193,33 @@ export default function LoginPage() {
 
       <div className="mt-8 sm:mx-auto sm:w-full sm:max-w-md">
         <div className="bg-white py-8 px-4 shadow sm:rounded-lg sm:px-10">
-          <form className="space-y-6" onSubmit={handleSubmit}>
+          {providers.length > 0 && (
+            <div className="space-y-3">
+              {providers.map((provider) => (
+                <button
+                  key={provider.id}
+                  type="button"
+                  disabled={isLoading}
+                  onClick={() => handleProviderLogin(provider.id)}
+                  className="w-full flex justify-center py-2 px-4 border border-gray-300 rounded-md shadow-sm text-sm font-medium text-gray-700 bg-white hover:bg-gray-50 focus:outline-none focus:ring-2 focus:ring-offset-2 focus:ring-indigo-500 disabled:opacity-50"
+                >
+                  {provider.name} でログイン
+                </button>
+              ))}
+              {passwordLoginEnabled && (
+                <div className="text-center text-sm text-gray-500">または</div>
+              )}
+            </div>
+          )}
+
+          {!passwordLoginEnabled && error && (
+            <div className="mt-4 text-red-600 text-sm">
+              {error}
+            </div>
+          )}
+
+          {passwordLoginEnabled && (
+          <form className={providers.length > 0 ? 'space-y-6 mt-3' : 'space-y-6'} onSubmit={handleSubmit}>
             <div>
               <label htmlFor="email" className="block text-sm font-medium text-gray-700">
                 メールアドレス
@@ -92,9 +259,30 @@ export default function LoginPage() {
             {error && (
               <div className="text-red-600 text-sm">
                 {error}
+                {error.includes('確認されていません') && (
+                  <button
+                    type="button"
+                    onClick={handleResendVerification}
+                    className="block mt-1 text-indigo-600 hover:text-indigo-500"
+                  >
+                    確認メールを再送する
+                  </button>
+                )}
               </div>
             )}
 
+            {resendMessage && (
+              <div className="text-gray-600 text-sm">
+                {resendMessage}
+              </div>
+            )}
+
+            <div className="text-sm text-right">
+              <Link href="/forgot-password" className="text-indigo-600 hover:text-indigo-500">
+                パスワードをお忘れですか？
+              </Link>
+            </div>
+
             <div>
               <button
                 type="submit"
@@ -105,6 +293,7 @@ export default function LoginPage() {
               </button>
             </div>
           </form>
+          )}
         </div>
       </div>
     </div>
@@ -0,0 +1,71 @@
+'use client';
+
+import { useEffect, useRef, useState } from 'react';
+import { useRouter } from 'next/navigation';
+import Link from 'next/link';
+import { useAuth } from '@/context/AuthContext';
+
+export default function OIDCCallbackPage() {
+  const [error, setError] = useState('');
+  const router = useRouter();
+  const { completeProviderLogin, twoFactorChallenge } = useAuth();
+  // 開発モードでeffectが2回実行されても、認可コードは一度だけ使う
+  const started = useRef(false);
+
+  useEffect(() => {
+    if (started.current) {
+      return;
+    }
+    started.current = true;
+
+    const params = new URLSearchParams(window.location.search);
+    const providerError = params.get('error');
+    if (providerError) {
+      setError(params.get('error_description') || `IDプロバイダーがサインインを拒否しました (${providerError})`);
+      return;
+    }
+    const state = params.get('state');
+    const code = params.get('code');
+    if (!state || !code) {
+      setError('IDプロバイダーからの応答が不正です');
+      return;
+    }
+
+    // 成功するとAuthContextがチャットページに移動する
+    completeProviderLogin(state, code).catch((err) => {
+      setError(err instanceof Error ? err.message : 'ログインに失敗しました');
+    });
+  }, []);
+
+  // 2段階認証が必要な場合はログイン画面でコードを入力する
+  useEffect(() => {
+    if (twoFactorChallenge) {
+      router.push('/login');
+    }
+  }, [twoFactorChallenge]);
+
+  return (
+    <div className="min-h-screen bg-gray-100 flex flex-col pt-20 sm:px-6 lg:px-8">
+      <div className="sm:mx-auto sm:w-full sm:max-w-md">
+        <h2 className="text-center text-3xl font-extrabold text-gray-900">
+          ログイン
+        </h2>
+      </div>
+
+      <div className="mt-8 sm:mx-auto sm:w-full sm:max-w-md">
+        <div className="bg-white py-8 px-4 shadow sm:rounded-lg sm:px-10 space-y-4 text-sm text-gray-700">
+          {error ? (
+            <>
+              <p className="text-red-600">{error}</p>
+              <Link href="/login" className="text-indigo-600 hover:text-indigo-500">
+                ログイン画面へ
+              </Link>
+            </>
+          ) : (
+            <p>サインインしています...</p>
+          )}
+        </div>
+      </div>
+    </div>
+  );
+}
@@ -1,7 +1,6 @@
 'use client'
 
 import React, { useState } from 'react'
-import { useRouter } from 'next/navigation'
 import Link from 'next/link'
 
 export default function RegisterPage() {
@@ -9,7 +8,7 @@ export default function RegisterPage() {
   const [email, setEmail] = useState('')
   const [password, setPassword] = useState('')
   const [error, setError] = useState('')
-  const router = useRouter()
+  const [registered, setRegistered] = useState(false)
 
   const handleSubmit = async (e: React.FormEvent) => {
     e.preventDefault()
@@ -34,9 +33,8 @@ export default function RegisterPage() {
         throw new Error(data.error || 'Registration failed')
       }
 
-      // 登録成功時の処理
-      localStorage.setItem('token', data.token)
-      router.push('/') // ホームページへリダイレクト
+      // 登録成功時の処理（メールアドレスの確認後にログインできる）
+      setRegistered(true)
     } catch (err) {
       setError(err instanceof Error ? err.message : '登録に失敗しました')
     }
@@ -52,6 +50,14 @@ export default function RegisterPage() {
 
       <div className="mt-8 sm:mx-auto sm:w-full sm:max-w-md">
         <div className="bg-white py-8 px-4 shadow sm:rounded-lg sm:px-10">
+          {registered ? (
+            <div className="space-y-4 text-sm text-gray-700">
+              <p>{email} に確認メールを送信しました。メール内のリンクを開いて登録を完了してください。</p>
+              <Link href="/login" className="text-indigo-600 hover:text-indigo-500">
+                ログイン画面へ
+              </Link>
+            </div>
+          ) : (
           <form className="space-y-6" onSubmit={handleSubmit}>
             <div>
               <label htmlFor="username" className="block text-sm font-medium text-gray-700">
@@ -121,6 +127,7 @@ export default function RegisterPage() {
               </button>
             </div>
           </form>
+          )}
         </div>
       </div>
     </div>
@@ -0,0 +1,64 @@
+'use client';
+
+import { useEffect, useState } from 'react';
+import Link from 'next/link';
+
+export default function VerifyEmailPage() {
+  const [status, setStatus] = useState<'verifying' | 'verified' | 'failed'>('verifying');
+  const [error, setError] = useState('');
+
+  // メール内のリンクのトークンでメールアドレスを確認する
+  useEffect(() => {
+    const token = new URLSearchParams(window.location.search).get('token');
+    if (!token) {
+      setStatus('failed');
+      setError('リンクにトークンが含まれていません');
+      return;
+    }
+
+    const apiUrl = process.env.NEXT_PUBLIC_API_URL || 'http://localhost:3000';
+    fetch(`${apiUrl}/api/auth/verify-email`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ token }),
+    })
+      .then(async (response) => {
+        if (!response.ok) {
+          const data = await response.json().catch(() => ({}));
+          throw new Error(data.error || 'メールアドレスの確認に失敗しました');
+        }
+        setStatus('verified');
+      })
+      .catch((err) => {
+        setStatus('failed');
+        setError(err instanceof Error ? err.message : 'メールアドレスの確認に失敗しました');
+      });
+  }, []);
+
+  return (
+    <div className="min-h-screen bg-gray-100 flex flex-col pt-20 sm:px-6 lg:px-8">
+      <div className="sm:mx-auto sm:w-full sm:max-w-md">
+        <h2 className="text-center text-3xl font-extrabold text-gray-900">
+          メールアドレスの確認
+        </h2>
+      </div>
+
+      <div className="mt-8 sm:mx-auto sm:w-full sm:max-w-md">
+        <div className="bg-white py-8 px-4 shadow sm:rounded-lg sm:px-10 space-y-4 text-sm text-gray-700">
+          {status === 'verifying' && <p>確認しています...</p>}
+          {status === 'verified' && <p>メールアドレスを確認しました。ログインできます。</p>}
+          {status === 'failed' && (
+            <p className="text-red-600">
+              {error}。ログイン画面から確認メールを再送できます。
+            </p>
+          )}
+          {status !== 'verifying' && (
+            <Link href="/login" className="text-indigo-600 hover:text-indigo-500">
+              ログイン画面へ
+            </Link>
+          )}
+        </div>
+      </div>
+    </div>
+  );
+}
@@ -416,118 +416,47 @@ export default function ChannelRoom() {
     try {
       const token = localStorage.getItem('token');
       
-      // ファイルがある場合はファイルアップロードとメッセージを一緒に送信
+      // ファイルがある場合は、先にファイルをアップロードして添付ファイルIDを受け取り、
+      // そのIDを指定してメッセージを投稿する（メッセージとファイルは同時に紐付けられる）
       if (selectedFiles.length > 0) {
-        // メッセージを先に送信して、メッセージIDを取得
-        let messageId = '';
-        if (newMessage.trim() !== '') {
-          const messageResponse = await fetch(`${API_URL}/api/channels/${params.id}/messages`, {
+        const attachmentIds: string[] = [];
+        for (const file of selectedFiles) {
+          const formData = new FormData();
+          formData.append('file', file);
+
+          const uploadResponse = await fetch(`${API_URL}/api/channels/${params.id}/attachments`, {
             method: 'POST',
             headers: {
-              'Content-Type': 'application/json',
               'Authorization': `Bearer ${token}`,
             },
-            body: JSON.stringify({
-              content: newMessage,
-            }),
+            body: formData,
           });
-          
-          if (!messageResponse.ok) {
-            const errorData = await messageResponse.json().catch(() => ({ error: 'メッセージの送信に失敗しました' }));
-            throw new Error(errorData.error || 'メッセージの送信に失敗しました');
+
+          if (!uploadResponse.ok) {
+            const errorData = await uploadResponse.json().catch(() => ({}));
+            console.error('アップロードエラー:', uploadResponse.status, errorData);
+            throw new Error(errorData.error || `ファイルのアップロードに失敗しました: ${uploadResponse.status} ${uploadResponse.statusText}`);
           }
-          
-          const messageData = await messageResponse.json();
-          messageId = messageData.id || messageData.message?.id;
+
+          const uploadData = await uploadResponse.json();
+          attachmentIds.push(uploadData.attachmentId);
         }
-        
-        // ファイルがある場合は、作成したメッセージIDを使ってファイルをアップロード
-        if (selectedFiles.length > 0 && params.id) {
-          for (const file of selectedFiles) {
-            const formData = new FormData();
-            formData.append('file', file);
-            
-            // メッセージIDがない場合（テキストなしでファイルのみの場合）は空のメッセージを作成
-            if (!messageId) {
-              const emptyMessageResponse = await fetch(`${API_URL}/api/channels/${params.id}/messages`, {
-                method: 'POST',
-                headers: {
-                  'Content-Type': 'application/json',
-                  'Authorization': `Bearer ${token}`,
-                },
-                body: JSON.stringify({
-                  content: '',
-                }),
-              });
-              
-              if (!emptyMessageResponse.ok) {
-                throw new Error('空のメッセージの作成に失敗しました');
-              }
-              
-              const emptyMessageData = await emptyMessageResponse.json();
-              messageId = emptyMessageData.id || emptyMessageData.message?.id;
-            } else {
-              console.log('既存のメッセージIDを使用:', messageId);
-            }
-            
-            // 元のエンドポイントに戻す
-            const uploadUrl = `${API_URL}/api/channels/${params.id}/upload`;
-            
-            // messageIdをフォームデータに含める
-            formData.append('messageId', messageId);
-            // channelIdもフォームデータに含める
-            formData.append('channelId', params.id);
-            
-            const uploadResponse = await fetch(uploadUrl, {
-              method: 'POST',
-              headers: {
-                'Authorization': `Bearer ${token}`,
-              },
-              body: formData,
-            });
-            
-            if (!uploadResponse.ok) {
-              const errorText = await uploadResponse.text();
-              console.error('アップロードエラー:', uploadResponse.status, uploadResponse.statusText);
-              console.error('エラーレスポンス:', errorText);
-              console.error('送信したデータ:', {
-                url: uploadUrl,
-                messageId: messageId,
-                channelId: params.id,
-                fileName: file.name,
-                fileSize: file.size,
-                fileType: file.type
-              });
-              
-              // エラーの詳細情報を取得
-              let errorMessage = `ファイルのアップロードに失敗しました: ${uploadResponse.status} ${uploadResponse.statusText}`;
-              
-              try {
-                // JSONとしてパースを試みる
-                const errorData = JSON.parse(errorText);
-                if (errorData.error) {
-                  errorMessage = errorData.error;
-                } else if (errorData.message) {
-                  errorMessage = `ファイルのアップロードに失敗しました: ${errorData.message}`;
-                } else if (errorData.detail) {
-                  errorMessage = `ファイルのアップロードに失敗しました: ${errorData.detail}`;
-                }
-                
-                // スタックトレースがあれば記録（デバッグ用）
-                if (errorData.stack) {
-                  console.error('エラースタックトレース:', errorData.stack);
-                }
-                
-                throw new Error(errorMessage);
-              } catch (parseError) {
-                // JSONパースに失敗した場合はテキストをそのまま使用
-                console.error('エラーレスポンスのパースに失敗:', parseError);
-                throw new Error(`ファイルのアップロードに失敗しました: ${uploadResponse.status} ${uploadResponse.statusText} - ${errorText}`);
-              }
-            }
-            
-            const responseData = await uploadResponse.json();
-          }
+
+        const messageResponse = await fetch(`${API_URL}/api/channel-messages/${params.id}`, {
+          method: 'POST',
+          headers: {
+            'Content-Type': 'application/json',
+            'Authorization': `Bearer ${token}`,
+          },
+          body: JSON.stringify({
+            content: newMessage,
+            attachments: attachmentIds,
+          }),
+        });
+
+        if (!messageResponse.ok) {
+          const errorData = await messageResponse.json().catch(() => ({ error: 'メッセージの送信に失敗しました' }));
+          throw new Error(errorData.error || 'メッセージの送信に失敗しました');
         }
       } 
       // ファイルがなく、テキストメッセージのみの場合
@@ -686,15 +615,19 @@ export default function ChannelRoom() {
   };
 
   const renderAttachment = (path: string) => {
-    // パスからファイル名を抽出
-    const fileName = path.split('/').pop() || '';
+    // パスからファイル名を抽出（署名付きURLのクエリは除く）
+    const fileName = decodeURIComponent(path.split('?')[0].split('/').pop() || '');
     const fileExt = fileName.split('.').pop()?.toLowerCase() || '';
     
     // ファイルのURLを構築（パスの重複を防ぐ）
     let normalizedPath = '';
     
+    // 署名付きURL（例: /api/attachments/<id>/photo.png?expires=...&signature=...）はそのまま使用
+    if (path.startsWith('/api/')) {
+      normalizedPath = path;
+    }
     // ファイル名だけの場合（例: 316dc40d-692a-48ea-8ee9-9607d1096589.png）
-    if (!path.includes('/')) {
+    else if (!path.includes('/')) {
       normalizedPath = `/uploads/${path}`;
     } 
     // すでにuploadsが含まれている場合（例: uploads/316dc40d-692a-48ea-8ee9-9607d1096589.png）
@@ -934,6 +867,13 @@ export default function ChannelRoom() {
               } else {
                 console.error('メッセージ削除イベントにMessageIDがありません:', data);
               }
+            } else if (data.type === 'session_revoked') {
+              // ログインセッションが失効した場合は再接続せずにログイン画面へ戻る
+              ws.onclose = null;
+              localStorage.removeItem('token');
+              localStorage.removeItem('refreshToken');
+              localStorage.removeItem('tokenExpiresAt');
+              window.location.href = '/login';
             } else {
               console.log('未知のメッセージタイプを受信:', data.type);
             }
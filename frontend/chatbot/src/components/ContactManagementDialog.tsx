@@ -10,8 +10,11 @@ const API_URL = process.env.NEXT_PUBLIC_API_URL || 'http://localhost:3000';
 type User = {
   id: string;
   username: string;
-  email: string;
-  createdAt: string;
+  displayName?: string;
+  avatarUrl?: string;
+  // メールアドレスでの検索を許可したユーザーのみ
+  email?: string;
+  createdAt?: string;
   chatworkId?: string;
   bio?: string;
   organization?: string;
@@ -136,7 +139,8 @@ export default function ContactManagementDialog({ isOpen, onClose, onSelectUser,
         
         let data;
         try {
-          data = responseText ? JSON.parse(responseText) : [];
+          // 検索結果はページ単位で { users, nextOffset } として返る
+          data = responseText ? JSON.parse(responseText).users : [];
         } catch (parseError) {
           console.error('JSONパースエラー:', parseError);
           setError('レスポンスの解析に失敗しました');
@@ -10,8 +10,11 @@ const API_URL = process.env.NEXT_PUBLIC_API_URL || 'http://localhost:3000';
 type User = {
   id: string;
   username: string;
-  email: string;
-  createdAt: string;
+  displayName?: string;
+  avatarUrl?: string;
+  // メールアドレスでの検索を許可したユーザーのみ
+  email?: string;
+  createdAt?: string;
 };
 
 // プロップス型定義
@@ -79,7 +82,8 @@ export default function FriendSearchDialog({ isOpen, onClose, onSelectUser, titl
         
         let data;
         try {
-          data = responseText ? JSON.parse(responseText) : [];
+          // 検索結果はページ単位で { users, nextOffset } として返る
+          data = responseText ? JSON.parse(responseText).users : [];
           console.log('パース後の検索結果:', data);
         } catch (parseError) {
           console.error('JSONパースエラー:', parseError);
@@ -193,8 +197,8 @@ export default function FriendSearchDialog({ isOpen, onClose, onSelectUser, titl
                       <UserIcon />
                     </div>
                     <div>
-                      <div className="font-medium text-white">{user.username}</div>
-                      <div className="text-sm text-gray-400">{user.email}</div>
+                      <div className="font-medium text-white">{user.displayName || user.username}</div>
+                      <div className="text-sm text-gray-400">@{user.username}</div>
                     </div>
                   </li>
                 ))}
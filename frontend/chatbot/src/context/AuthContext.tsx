@@ -2,6 +2,26 @@
 
 import React, { createContext, useContext, useState, useEffect, ReactNode } from 'react';
 
+// アクセストークンの有効期限のこの時間前にリフレッシュする
+const REFRESH_MARGIN_MS = 60 * 1000;
+
+// ログイン・リフレッシュ時に返されるトークンを保存する
+const storeTokens = (data: { token: string; refreshToken?: string; expiresAt?: string }) => {
+  localStorage.setItem('token', data.token);
+  if (data.refreshToken) {
+    localStorage.setItem('refreshToken', data.refreshToken);
+  }
+  if (data.expiresAt) {
+    localStorage.setItem('tokenExpiresAt', data.expiresAt);
+  }
+};
+
+const clearTokens = () => {
+  localStorage.removeItem('token');
+  localStorage.removeItem('refreshToken');
+  localStorage.removeItem('tokenExpiresAt');
+};
+
 // Auth user type
 type User = {
   id: string;
@@ -27,6 +47,12 @@ type AuthContextType = {
   isAuthenticated: boolean;
   isLoading: boolean;
   login: (email: string, password: string) => Promise<void>;
+  // パスワード認証後に2段階認証のコードが必要な場合に設定される
+  twoFactorChallenge: string | null;
+  completeTwoFactorLogin: (code: string, isRecoveryCode?: boolean) => Promise<void>;
+  cancelTwoFactorLogin: () => void;
+  loginWithProvider: (providerId: string) => Promise<void>;
+  completeProviderLogin: (state: string, code: string) => Promise<void>;
   register: (username: string, email: string, password: string) => Promise<void>;
   logout: () => void;
   error: string | null;
@@ -39,6 +65,11 @@ const AuthContext = createContext<AuthContextType>({
   isAuthenticated: false,
   isLoading: true,
   login: async () => {},
+  twoFactorChallenge: null,
+  completeTwoFactorLogin: async () => {},
+  cancelTwoFactorLogin: () => {},
+  loginWithProvider: async () => {},
+  completeProviderLogin: async () => {},
   register: async () => {},
   logout: () => {},
   error: null,
@@ -55,6 +86,7 @@ export const AuthProvider = ({ children }: AuthProviderProps) => {
   const [token, setToken] = useState<string | null>(null);
   const [isLoading, setIsLoading] = useState(true);
   const [error, setError] = useState<string | null>(null);
+  const [twoFactorChallenge, setTwoFactorChallenge] = useState<string | null>(null);
 
   // Check for token in localStorage on mount
   useEffect(() => {
@@ -81,10 +113,21 @@ export const AuthProvider = ({ children }: AuthProviderProps) => {
         setToken(storedToken);
         
         // 少し遅延してからユーザー情報を取得（ブラウザの初期化を待つ）
-        setTimeout(() => {
+        setTimeout(async () => {
+          // アクセストークンの有効期限が切れている場合は先にリフレッシュする
+          let currentToken: string | null = storedToken;
+          const expiresAt = Date.parse(localStorage.getItem('tokenExpiresAt') || '');
+          if (!isNaN(expiresAt) && expiresAt - Date.now() < REFRESH_MARGIN_MS) {
+            currentToken = await refreshSession();
+            if (!currentToken) {
+              setIsLoading(false);
+              return;
+            }
+          }
+
           // ユーザー情報を取得
           console.log('Fetching user with stored token after delay');
-          fetchUser(storedToken)
+          fetchUser(currentToken)
             .then(() => {
               console.log('User fetched successfully on init');
               // ユーザー情報の取得に成功したら、isAuthenticatedをtrueに設定
@@ -93,7 +136,7 @@ export const AuthProvider = ({ children }: AuthProviderProps) => {
             .catch(err => {
               console.error('Error fetching user with stored token:', err);
               // トークンが無効な場合はクリア
-              localStorage.removeItem('token');
+              clearTokens();
               setToken(null);
               setUser(null);
               setError('認証に失敗しました。再度ログインしてください。');
@@ -111,6 +154,57 @@ export const AuthProvider = ({ children }: AuthProviderProps) => {
     }
   }, []);
 
+  // リフレッシュトークンで新しいトークンを取得する。失敗した場合はログアウト状態にする
+  const refreshSession = async (): Promise<string | null> => {
+    const refreshToken = localStorage.getItem('refreshToken');
+    if (!refreshToken) {
+      return null;
+    }
+
+    const apiUrl = process.env.NEXT_PUBLIC_API_URL || 'http://localhost:3000';
+    try {
+      const response = await fetch(`${apiUrl}/api/auth/refresh`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ refreshToken }),
+      });
+      if (!response.ok) {
+        console.error('Token refresh failed:', response.status);
+        if (response.status === 401) {
+          clearTokens();
+          setToken(null);
+          setUser(null);
+          setError('セッションの有効期限が切れました。再度ログインしてください。');
+        }
+        return null;
+      }
+
+      const data = await response.json();
+      storeTokens(data);
+      setToken(data.token);
+      return data.token;
+    } catch (err) {
+      console.error('Token refresh error:', err);
+      return null;
+    }
+  };
+
+  // アクセストークンの有効期限が近づいたらリフレッシュする
+  useEffect(() => {
+    if (!token) {
+      return;
+    }
+    const expiresAt = Date.parse(localStorage.getItem('tokenExpiresAt') || '');
+    if (isNaN(expiresAt)) {
+      return;
+    }
+    const delay = Math.max(expiresAt - Date.now() - REFRESH_MARGIN_MS, 0);
+    const timer = setTimeout(() => {
+      refreshSession();
+    }, delay);
+    return () => clearTimeout(timer);
+  }, [token]);
+
   // Fetch user data with token
   const fetchUser = async (authToken: string) => {
     try {
@@ -217,7 +311,7 @@ export const AuthProvider = ({ children }: AuthProviderProps) => {
             console.error('Failed to decode token:', tokenError);
           }
           
-          localStorage.removeItem('token');
+          clearTokens();
           setToken(null);
           setUser(null);
           if (!error) {
@@ -279,56 +373,135 @@ export const AuthProvider = ({ children }: AuthProviderProps) => {
         if (response.status === 401) {
           throw new Error('メールアドレスまたはパスワードが正しくありません');
         }
+
+        if (errorData.code === 'email_not_verified') {
+          throw new Error('メールアドレスが確認されていません。確認メールのリンクを開いてください。');
+        }
         
         throw new Error(errorData.error || 'ログインに失敗しました');
       }
 
       const data = await response.json();
       console.log('Login response data keys:', Object.keys(data).join(', '));
-      
-      // トークンの検証
-      if (!data.token) {
-        throw new Error('サーバーからトークンが返されませんでした');
+
+      // 2段階認証が有効な場合は、コードの入力を待つ
+      if (data.twoFactorRequired) {
+        setTwoFactorChallenge(data.challengeToken);
+        return;
       }
-      
-      console.log('Login successful, token received:', data.token ? 'Yes (length: ' + data.token.length + ')' : 'No');
-      
-      // トークンをステートとローカルストレージに保存
-      // 先にローカルストレージに保存してから、ステートを更新
-      localStorage.setItem('token', data.token);
-      console.log('Token saved to localStorage');
-      
-      // ローカルストレージに保存されたことを確認
-      const storedToken = localStorage.getItem('token');
-      if (!storedToken) {
-        console.error('Failed to save token to localStorage');
-        throw new Error('ログイン情報の保存に失敗しました');
+
+      finishLogin(data, email);
+    } catch (err) {
+      console.error('Login error:', err);
+      setError(err instanceof Error ? err.message : 'ログインに失敗しました');
+      throw err;
+    } finally {
+      setIsLoading(false);
+    }
+  };
+
+  // 2段階認証のコード（またはリカバリーコード）でログインを完了する
+  const completeTwoFactorLogin = async (code: string, isRecoveryCode = false) => {
+    try {
+      setIsLoading(true);
+      setError(null);
+
+      const apiUrl = process.env.NEXT_PUBLIC_API_URL || 'http://localhost:3000';
+      const response = await fetch(`${apiUrl}/api/auth/login/2fa`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(
+          isRecoveryCode
+            ? { challengeToken: twoFactorChallenge, recoveryCode: code }
+            : { challengeToken: twoFactorChallenge, code }
+        ),
+      });
+
+      if (!response.ok) {
+        const errorData = await response.json().catch(() => ({}));
+        if (errorData.code === 'challenge_expired') {
+          // 有効期限切れか試行回数の上限。パスワードからやり直す
+          setTwoFactorChallenge(null);
+          throw new Error('認証の有効期限が切れました。もう一度ログインしてください。');
+        }
+        throw new Error('認証コードが正しくありません');
       }
-      
-      // ステートを更新
-      setToken(data.token);
-      console.log('Token state updated');
-      
-      // ユーザー情報を設定 (APIから返された場合)
-      if (data.id && data.email) {
-        setUser({
-          id: data.id,
-          username: data.username || email.split('@')[0], // ユーザー名がない場合はメールアドレスの@前を使用
-          email: data.email,
-          createdAt: data.createdAt || new Date().toISOString(),
-        });
-        console.log('User data set from login response');
+
+      const data = await response.json();
+      setTwoFactorChallenge(null);
+      finishLogin(data, data.email);
+    } catch (err) {
+      console.error('Two-factor login error:', err);
+      setError(err instanceof Error ? err.message : 'ログインに失敗しました');
+      throw err;
+    } finally {
+      setIsLoading(false);
+    }
+  };
+
+  const cancelTwoFactorLogin = () => {
+    setTwoFactorChallenge(null);
+    setError(null);
+  };
+
+  // IDプロバイダーのサインイン画面に移動する。stateはコールバックの検証用に保存する
+  const loginWithProvider = async (providerId: string) => {
+    try {
+      setIsLoading(true);
+      setError(null);
+
+      const apiUrl = process.env.NEXT_PUBLIC_API_URL || 'http://localhost:3000';
+      const response = await fetch(`${apiUrl}/api/auth/oidc/${encodeURIComponent(providerId)}/authorize`, {
+        method: 'POST',
+      });
+      if (!response.ok) {
+        const errorData = await response.json().catch(() => ({}));
+        throw new Error(errorData.error || 'IDプロバイダーに接続できませんでした');
       }
-      
-      // バックエンドの修正が完了するまでの一時的な対応策として、
-      // ログイン成功時には即座にチャットページにリダイレクトする
-      console.log('Redirecting to /chat immediately after successful login');
-      window.location.href = '/chat';
-      
+
+      const data = await response.json();
+      sessionStorage.setItem('oidcState', data.state);
+      window.location.href = data.authorizationUrl;
+    } catch (err) {
+      console.error('Provider login error:', err);
+      setError(err instanceof Error ? err.message : 'ログインに失敗しました');
+      setIsLoading(false);
+      throw err;
+    }
+  };
+
+  // IDプロバイダーから戻ったときに、認可コードでログインを完了する
+  const completeProviderLogin = async (state: string, code: string) => {
+    try {
+      setIsLoading(true);
       setError(null);
-      
+
+      // このブラウザで開始したサインインであることを確認する
+      const expectedState = sessionStorage.getItem('oidcState');
+      sessionStorage.removeItem('oidcState');
+      if (!expectedState || expectedState !== state) {
+        throw new Error('サインインの状態が一致しません。もう一度ログインしてください。');
+      }
+
+      const apiUrl = process.env.NEXT_PUBLIC_API_URL || 'http://localhost:3000';
+      const response = await fetch(`${apiUrl}/api/auth/oidc/callback`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ state, code }),
+      });
+      if (!response.ok) {
+        const errorData = await response.json().catch(() => ({}));
+        throw new Error(errorData.error || 'IDプロバイダーでのサインインに失敗しました');
+      }
+
+      const data = await response.json();
+      if (data.twoFactorRequired) {
+        setTwoFactorChallenge(data.challengeToken);
+        return;
+      }
+      finishLogin(data, data.email);
     } catch (err) {
-      console.error('Login error:', err);
+      console.error('Provider callback error:', err);
       setError(err instanceof Error ? err.message : 'ログインに失敗しました');
       throw err;
     } finally {
@@ -336,6 +509,50 @@ export const AuthProvider = ({ children }: AuthProviderProps) => {
     }
   };
 
+  // ログインで返されたトークンとユーザー情報を保存してチャットページに移動する
+  const finishLogin = (data: any, email: string) => {
+    // トークンの検証
+    if (!data.token) {
+      throw new Error('サーバーからトークンが返されませんでした');
+    }
+    
+    console.log('Login successful, token received:', data.token ? 'Yes (length: ' + data.token.length + ')' : 'No');
+    
+    // トークンをステートとローカルストレージに保存
+    // 先にローカルストレージに保存してから、ステートを更新
+    storeTokens(data);
+    console.log('Token saved to localStorage');
+    
+    // ローカルストレージに保存されたことを確認
+    const storedToken = localStorage.getItem('token');
+    if (!storedToken) {
+      console.error('Failed to save token to localStorage');
+      throw new Error('ログイン情報の保存に失敗しました');
+    }
+    
+    // ステートを更新
+    setToken(data.token);
+    console.log('Token state updated');
+    
+    // ユーザー情報を設定 (APIから返された場合)
+    if (data.id && data.email) {
+      setUser({
+        id: data.id,
+        username: data.username || email.split('@')[0], // ユーザー名がない場合はメールアドレスの@前を使用
+        email: data.email,
+        createdAt: data.createdAt || new Date().toISOString(),
+      });
+      console.log('User data set from login response');
+    }
+    
+    // バックエンドの修正が完了するまでの一時的な対応策として、
+    // ログイン成功時には即座にチャットページにリダイレクトする
+    console.log('Redirecting to /chat immediately after successful login');
+    window.location.href = '/chat';
+    
+    setError(null);
+  };
+
   // Register function
   const register = async (username: string, email: string, password: string) => {
     try {
@@ -355,16 +572,8 @@ export const AuthProvider = ({ children }: AuthProviderProps) => {
         throw new Error(errorData.error || 'アカウント登録に失敗しました');
       }
 
-      const data = await response.json();
-      setToken(data.token);
-      setUser({
-        id: data.id,
-        username: data.username,
-        email: data.email,
-        createdAt: data.createdAt,
-      });
-      
-      localStorage.setItem('token', data.token);
+      // メールアドレスの確認が済むまでログインできないため、トークンは返されない
+      await response.json();
     } catch (err) {
       console.error('Registration error:', err);
       setError(err instanceof Error ? err.message : 'アカウント登録に失敗しました');
@@ -377,14 +586,25 @@ export const AuthProvider = ({ children }: AuthProviderProps) => {
   // Logout function
   const logout = () => {
     console.log('Logging out user');
+
+    // サーバー側のセッションを失効させる（失敗してもローカルのログアウトは続行する）
+    const currentToken = localStorage.getItem('token');
+    if (currentToken) {
+      const apiUrl = process.env.NEXT_PUBLIC_API_URL || 'http://localhost:3000';
+      fetch(`${apiUrl}/api/auth/logout`, {
+        method: 'POST',
+        headers: { 'Authorization': `Bearer ${currentToken}` },
+        keepalive: true,
+      }).catch(err => console.error('Logout request failed:', err));
+    }
     
     // Clear user state
     setUser(null);
     setToken(null);
     setError(null);
     
-    // Clear token from localStorage
-    localStorage.removeItem('token');
+    // Clear tokens from localStorage
+    clearTokens();
     console.log('Token removed from localStorage');
     
     // Redirect to login page
@@ -400,6 +620,11 @@ export const AuthProvider = ({ children }: AuthProviderProps) => {
         isAuthenticated: !!token,
         isLoading, 
         login, 
+        twoFactorChallenge,
+        completeTwoFactorLogin,
+        cancelTwoFactorLogin,
+        loginWithProvider,
+        completeProviderLogin,
         register, 
         logout,
         error